@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tinycached/utils"
+)
+
+/*
+ * tinycached压测工具，与redis-benchmark类似
+ * 例：benchmark -addr 127.0.0.1:7000 -c 50 -n 100000 -P 16 -t set,get
+ * -P大于1时每个客户端一次发出多条命令，再依次读取回复，用于测试流水线的吞吐
+ */
+
+var (
+	addr     = flag.String("addr", "127.0.0.1:7000", "服务器地址")
+	clients  = flag.Int("c", 50, "并发客户端数")
+	requests = flag.Int("n", 100000, "每项测试的请求总数")
+	pipeline = flag.Int("P", 1, "每个客户端一次发出的命令数")
+	dataSize = flag.Int("d", 3, "SET的value字节数")
+	keyRange = flag.Int("r", 10000, "随机key的范围")
+	tests    = flag.String("t", "set,get", "测试的命令，以逗号分隔")
+)
+
+type result struct {
+	elapsed   time.Duration
+	latencies []time.Duration // 每批命令从发出到收到全部回复的耗时
+}
+
+// 生成一条测试命令
+func makeCmd(test string, rnd *rand.Rand, value string) string {
+	key := fmt.Sprintf("key%d", rnd.Intn(*keyRange))
+	switch test {
+	case "set":
+		return "SET " + key + ":" + value + "\n"
+	case "get":
+		return "GET " + key + "\n"
+	default:
+		return strings.ToUpper(test) + "\n"
+	}
+}
+
+func runClient(test string, total *int64, res *result, mutex *sync.Mutex) error {
+	conn, err := net.Dial("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	value := strings.Repeat("x", *dataSize)
+
+	var latencies []time.Duration
+	for {
+		// 领取一批请求
+		batch := int64(*pipeline)
+		if left := atomic.AddInt64(total, -batch); left < 0 {
+			if batch += left; batch <= 0 {
+				break
+			}
+		}
+		start := time.Now()
+		for i := int64(0); i < batch; i++ {
+			writer.WriteString(makeCmd(test, rnd, value))
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		for i := int64(0); i < batch; i++ {
+			if _, err := utils.ReadReply(reader.ReadByte); err != nil {
+				return err
+			}
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+
+	mutex.Lock()
+	res.latencies = append(res.latencies, latencies...)
+	mutex.Unlock()
+	return nil
+}
+
+func runTest(test string) (*result, error) {
+	res := &result{}
+	total := int64(*requests)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	errChan := make(chan error, *clients)
+	start := time.Now()
+	for i := 0; i < *clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := runClient(test, &total, res, &mutex); err != nil {
+				errChan <- err
+			}
+		}()
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	close(errChan)
+	if err := <-errChan; err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	return latencies[int(float64(len(latencies)-1)*p)]
+}
+
+func main() {
+	flag.Parse()
+	if *clients <= 0 || *requests <= 0 || *pipeline <= 0 || *keyRange <= 0 {
+		log.Fatal("-c, -n, -P and -r must be greater than 0")
+	}
+	for _, test := range strings.Split(*tests, ",") {
+		test = strings.ToLower(strings.TrimSpace(test))
+		res, err := runTest(test)
+		if err != nil {
+			log.Fatalf("%s: %v", test, err)
+		}
+		sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+		fmt.Printf("====== %s ======\n", strings.ToUpper(test))
+		fmt.Printf("  %d requests completed in %.2f seconds\n", *requests, res.elapsed.Seconds())
+		fmt.Printf("  %d parallel clients, pipeline %d, %d bytes payload\n", *clients, *pipeline, *dataSize)
+		fmt.Printf("  batch latency p50=%v p99=%v max=%v\n",
+			percentile(res.latencies, 0.5), percentile(res.latencies, 0.99), percentile(res.latencies, 1))
+		fmt.Printf("  %.2f requests per second\n\n", float64(*requests)/res.elapsed.Seconds())
+	}
+}
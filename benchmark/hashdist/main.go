@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"tinycached/proxy/consistenthash"
+)
+
+/*
+ * 比较代理可选的各个一致性哈希算法：key在节点间分布的均匀程度，以及增删一个节点时移动的key的比例
+ * 例：hashdist -nodes 10 -keys 1000000 -weights 1,1,2
+ * cv为各节点key数（除以权重后）的变异系数（标准差/均值），max为最多的节点与均值之比；
+ * 增删节点时理想的移动比例为该节点的权重占总权重的比例
+ */
+
+var (
+	nodes    = flag.Int("nodes", 10, "节点数")
+	keys     = flag.Int("keys", 1000000, "key的数量")
+	replicas = flag.Int("replicas", 160, "ring算法每单位权重的虚拟节点数")
+	weights  = flag.String("weights", "1", "各节点的权重，以逗号分隔，节点多于权重时循环使用")
+)
+
+type node struct {
+	name   string
+	weight int
+}
+
+func build(algorithm string, list []node) consistenthash.Hash {
+	h, err := consistenthash.New(algorithm, *replicas)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, n := range list {
+		h.AddNodeWeight(n.name, n.weight)
+	}
+	return h
+}
+
+func assign(h consistenthash.Hash) []string {
+	owners := make([]string, *keys)
+	for i := range owners {
+		owners[i] = h.FindNode("key:" + strconv.Itoa(i))
+	}
+	return owners
+}
+
+// 按权重归一化后各节点key数的变异系数，与最多的节点与均值之比
+func balance(list []node, owners []string) (cv, max float64) {
+	counts := make(map[string]int)
+	for _, o := range owners {
+		counts[o]++
+	}
+	total := 0
+	for _, n := range list {
+		total += n.weight
+	}
+	loads := make([]float64, len(list))
+	mean := 0.0
+	for i, n := range list {
+		// 以权重相同时应得的份额为单位
+		loads[i] = float64(counts[n.name]) / (float64(len(owners)) * float64(n.weight) / float64(total))
+		mean += loads[i]
+	}
+	mean /= float64(len(loads))
+	variance := 0.0
+	for _, l := range loads {
+		variance += (l - mean) * (l - mean)
+		max = math.Max(max, l/mean)
+	}
+	return math.Sqrt(variance/float64(len(loads))) / mean, max
+}
+
+func moved(before, after []string) float64 {
+	n := 0
+	for i := range before {
+		if before[i] != after[i] {
+			n++
+		}
+	}
+	return float64(n) / float64(len(before))
+}
+
+func parseWeights(s string) []int {
+	var ws []int
+	for _, f := range strings.Split(s, ",") {
+		w, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || w < 1 {
+			log.Fatalf("invalid weight %q", f)
+		}
+		ws = append(ws, w)
+	}
+	return ws
+}
+
+func main() {
+	flag.Parse()
+	if *nodes < 2 || *keys < 1 {
+		log.Fatal("nodes must be at least 2 and keys at least 1")
+	}
+	ws := parseWeights(*weights)
+	list := make([]node, *nodes)
+	total := 0
+	for i := range list {
+		list[i] = node{name: fmt.Sprintf("10.0.0.%d:7000", i+1), weight: ws[i%len(ws)]}
+		total += list[i].weight
+	}
+	added := node{name: fmt.Sprintf("10.0.0.%d:7000", *nodes+1), weight: 1}
+	removed := len(list) / 2
+	withoutOne := append(append([]node{}, list[:removed]...), list[removed+1:]...)
+
+	fmt.Printf("%d nodes, %d keys, weights %s\n", *nodes, *keys, *weights)
+	fmt.Printf("%-12s %8s %8s %12s %12s\n", "algorithm", "cv", "max", "moved(+1)", "moved(-1)")
+	fmt.Printf("%-12s %8s %8s %12.4f %12.4f\n", "ideal", "0", "1",
+		float64(added.weight)/float64(total+added.weight), float64(list[removed].weight)/float64(total))
+	for _, algorithm := range consistenthash.Algorithms {
+		h := build(algorithm, list)
+		before := assign(h)
+		cv, max := balance(list, before)
+
+		h.AddNodeWeight(added.name, added.weight)
+		afterAdd := assign(h)
+		h.RemoveNode(added.name)
+
+		h.RemoveNode(list[removed].name)
+		afterRemove := assign(h)
+		cvRemove, _ := balance(withoutOne, afterRemove)
+
+		fmt.Printf("%-12s %8.4f %8.4f %12.4f %12.4f   (cv after -1: %.4f)\n",
+			algorithm, cv, max, moved(before, afterAdd), moved(before, afterRemove), cvRemove)
+	}
+}
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ * 配置文件格式与redis一致：
+ * 每行为"配置名 值"，以#开头的行为注释，值中含空格时用双引号包裹
+ * 命令行参数与配置名同名（如-maxmemory 64mb），优先级高于配置文件
+ */
+
+// 配置项的值，与flag.Value一致
+type Value interface {
+	String() string
+	Set(string) error
+}
+
+type Param struct {
+	Name     string
+	Usage    string
+	value    Value
+	def      string       // 默认值
+	onChange func() error // 运行时修改后的回调，为nil表示不可在运行时修改
+}
+
+func (p *Param) Get() string {
+	return p.value.String()
+}
+
+func (p *Param) Set(s string) error {
+	if err := p.value.Set(s); err != nil {
+		return fmt.Errorf("%s: %v", p.Name, err)
+	}
+	return nil
+}
+
+// 一组配置项，按注册顺序保存
+type Params struct {
+	mutex sync.RWMutex // 保护运行时对配置项的读写
+	list  []*Param
+	index map[string]*Param
+}
+
+func (ps *Params) add(name string, usage string, v Value) {
+	if ps.index == nil {
+		ps.index = make(map[string]*Param)
+	}
+	p := &Param{Name: name, Usage: usage, value: v, def: v.String()}
+	ps.list = append(ps.list, p)
+	ps.index[name] = p
+}
+
+func (ps *Params) Lookup(name string) *Param {
+	return ps.index[strings.ToLower(name)]
+}
+
+func (ps *Params) List() []*Param {
+	return ps.list
+}
+
+type entry struct {
+	name   string
+	value  string
+	lineno int
+}
+
+// 解析配置文件中的一行；注释与空行返回ok=false
+func parseLine(line string) (name string, value string, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", "", false, nil
+	}
+	name, value = line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name, value = line[:i], line[i+1:]
+	}
+	name = strings.ToLower(name)
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "\"") {
+		if value, err = strconv.Unquote(value); err != nil {
+			return "", "", false, fmt.Errorf("bad quoted value for %s", name)
+		}
+	}
+	return name, value, true, nil
+}
+
+func readFile(path string) ([]entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []entry
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		name, value, ok, err := parseLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+		if ok {
+			entries = append(entries, entry{name, value, lineno})
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// 将配置文件中的配置项应用到ps上
+func (ps *Params) loadFile(path string) error {
+	entries, err := readFile(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := ps.Lookup(e.name)
+		if p == nil {
+			return fmt.Errorf("%s:%d: unknown option %q", path, e.lineno, e.name)
+		}
+		if err := p.Set(e.value); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, e.lineno, err)
+		}
+	}
+	return nil
+}
+
+// 依次应用默认值、配置文件与命令行参数，返回配置文件路径
+func (ps *Params) load(name string, args []string) (string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", "", "配置文件路径")
+	overrides := make(map[string]string)
+	for _, p := range ps.list {
+		p := p
+		fs.Func(p.Name, p.Usage+" (默认 "+strconv.Quote(p.Get())+")", func(s string) error {
+			overrides[p.Name] = s
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() > 0 {
+		return "", fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	if *path != "" {
+		if err := ps.loadFile(*path); err != nil {
+			return "", err
+		}
+	}
+
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := ps.Lookup(name).Set(overrides[name]); err != nil {
+			return "", fmt.Errorf("flag -%v", err)
+		}
+	}
+	return *path, nil
+}
+
+var errEmpty = errors.New("value must not be empty")
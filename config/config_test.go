@@ -0,0 +1,166 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		name  string
+		value string
+		ok    bool
+		err   bool
+	}{
+		{"", "", "", false, false},
+		{"   ", "", "", false, false},
+		{"# maxmemory 1mb", "", "", false, false},
+		{"  # indented comment", "", "", false, false},
+		{"maxmemory 64mb", "maxmemory", "64mb", true, false},
+		{"MaxMemory\t64mb", "maxmemory", "64mb", true, false},
+		{"  timeout   30  ", "timeout", "30", true, false},
+		{"requirepass", "requirepass", "", true, false},
+		{`replicaof "127.0.0.1 7000"`, "replicaof", "127.0.0.1 7000", true, false},
+		{`requirepass "a\"b # c"`, "requirepass", `a"b # c`, true, false},
+		{`requirepass ""`, "requirepass", "", true, false},
+		{`requirepass "unterminated`, "", "", false, true},
+		{"requirepass a b", "requirepass", "a b", true, false},
+	}
+	for _, tt := range tests {
+		name, value, ok, err := parseLine(tt.line)
+		if name != tt.name || value != tt.value || ok != tt.ok || (err != nil) != tt.err {
+			t.Errorf("parseLine(%q) = %q, %q, %v, %v; want %q, %q, %v, err=%v",
+				tt.line, name, value, ok, err, tt.name, tt.value, tt.ok, tt.err)
+		}
+	}
+}
+
+// 写入临时配置文件，返回路径
+func writeConf(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.conf")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// 默认值、配置文件与命令行参数依次覆盖
+func TestLoadServer(t *testing.T) {
+	path := writeConf(t, `# test config
+listen :7100
+maxmemory 128mb
+
+replicaof "127.0.0.1 7000"
+TIMEOUT 30
+slowlog-log-slower-than 500ms
+raft-peers a=127.0.0.1:7001, b=127.0.0.1:7002
+`)
+	cfg, err := LoadServer([]string{"-config", path, "-timeout", "1m", "-maxclients", "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Path != path {
+		t.Errorf("Path = %q, want %q", cfg.Path, path)
+	}
+	if cfg.Listen != ":7100" || cfg.MaxMemory != 128<<20 || cfg.ReplicaOf != "127.0.0.1 7000" {
+		t.Errorf("file values: listen=%q maxmemory=%d replicaof=%q", cfg.Listen, cfg.MaxMemory, cfg.ReplicaOf)
+	}
+	if cfg.SlowlogSlowerThan != 500*time.Millisecond {
+		t.Errorf("slowlog-log-slower-than = %v, want 500ms", cfg.SlowlogSlowerThan)
+	}
+	if got := strings.Join(cfg.RaftPeers, ","); got != "a=127.0.0.1:7001,b=127.0.0.1:7002" {
+		t.Errorf("raft-peers = %q", got)
+	}
+	// 命令行参数优先于配置文件
+	if cfg.Timeout != time.Minute || cfg.MaxClients != 10 {
+		t.Errorf("flag values: timeout=%v maxclients=%d", cfg.Timeout, cfg.MaxClients)
+	}
+	// 未出现的配置项为默认值
+	if def := DefaultServer(); cfg.AppendFsync != def.AppendFsync || cfg.ReplBacklogSize != def.ReplBacklogSize {
+		t.Errorf("defaults: appendfsync=%q repl-backlog-size=%d", cfg.AppendFsync, cfg.ReplBacklogSize)
+	}
+	if p := cfg.Params().Lookup("MAXMEMORY"); p == nil || p.Get() != "128mb" {
+		t.Errorf("Lookup(MAXMEMORY) = %v", p)
+	}
+}
+
+func TestLoadServerErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		args []string
+		want string
+	}{
+		{"unknown option", "listen :7100\nno-such-option 1\n", nil, `test.conf:2: unknown option "no-such-option"`},
+		{"bad value", "# comment\n\nmaxmemory lots\n", nil, `test.conf:3: maxmemory: invalid size "lots"`},
+		{"bad quote", "requirepass \"x\n", nil, "test.conf:1: bad quoted value for requirepass"},
+		{"bad enum", "appendfsync sometimes\n", nil, "appendfsync"},
+		{"bad flag", "", []string{"-maxmemory", "1x"}, `flag -maxmemory: invalid size "1x"`},
+		{"unknown flag", "", []string{"-no-such-option", "1"}, "no-such-option"},
+		{"extra argument", "", []string{"extra"}, `unexpected argument "extra"`},
+		{"zero maxmemory", "maxmemory 0\n", nil, "maxmemory: must be greater than 0"},
+		{"raft id not in peers", "", []string{"-raft-id", "c", "-raft-peers", "a=127.0.0.1:1,b=127.0.0.1:2"}, "raft-peers: c is not in the list"},
+		{"tls without cert", "", []string{"-tls-listen", ":7443"}, "tls-listen: tls-cert-file and tls-key-file are required"},
+		{"overflowing size", "", []string{"-repl-backlog-size", "17179869184gb"}, "too large"},
+		{"negative duration", "timeout -1\n", nil, "must not be negative"},
+	}
+	for _, tt := range tests {
+		args := tt.args
+		if tt.file != "" {
+			args = append([]string{"-config", writeConf(t, tt.file)}, args...)
+		}
+		_, err := LoadServer(args)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want error containing %q", tt.name, err, tt.want)
+		}
+	}
+	if _, err := LoadServer([]string{"-config", filepath.Join(t.TempDir(), "missing.conf")}); !os.IsNotExist(err) {
+		t.Errorf("missing config file: got %v", err)
+	}
+}
+
+// 校验失败时不修改原来的值
+func TestDurationValue(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+		str  string
+	}{
+		{"0", 0, true, "0"},
+		{"10", 10 * time.Second, true, "10"},
+		{"500ms", 500 * time.Millisecond, true, "500ms"},
+		{"1m30s", 90 * time.Second, true, "90"},
+		{"1.5s", 1500 * time.Millisecond, true, "1.5s"},
+		{"-1", 0, false, ""},
+		{"-5s", 0, false, ""},
+		{"10x", 0, false, ""},
+		{"", 0, false, ""},
+		{"9223372037", 0, false, ""},
+		{"-9223372037", 0, false, ""},
+		{"9223372036", 9223372036 * time.Second, true, "9223372036"},
+	}
+	for _, tt := range tests {
+		const old = 7 * time.Second
+		d := old
+		v := &durationValue{&d}
+		err := v.Set(tt.in)
+		if !tt.ok {
+			if err == nil || d != old {
+				t.Errorf("Set(%q): got %v, %v; want an error and the value unchanged", tt.in, d, err)
+			}
+			continue
+		}
+		if err != nil || d != tt.want {
+			t.Errorf("Set(%q) = %v, %v; want %v", tt.in, d, err, tt.want)
+		}
+		if got := v.String(); got != tt.str {
+			t.Errorf("String() after Set(%q) = %q, want %q", tt.in, got, tt.str)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"tinycached/utils/tlsutil"
+)
+
+// 代理服务器配置
+type Proxy struct {
+	Path            string        // 配置文件路径，未指定时为空
+	args            []string      // 启动时的命令行参数，重新加载时仍然覆盖配置文件
+	Listen          string        // 监听地址
+	MetricsListen   string        // Prometheus指标的HTTP监听地址，为空表示不开启
+	UnixSocket      string        // Unix socket路径，为空表示不监听
+	UnixSocketPerm  os.FileMode   // Unix socket文件的权限，0表示不修改
+	Backends        []string      // 缓存服务器列表，每项为"[名字=]地址[ 权重]"，地址可以是Unix socket路径
+	ConnectTimeout  time.Duration // 连接缓存服务器的超时
+	BackendTimeout  time.Duration // 等待缓存服务器回复的超时，0表示不超时
+	BackendPoolSize int           // 每个缓存服务器的多路复用连接数
+	Timeout         time.Duration // 客户端空闲超时，0表示不超时
+	ShutdownTimeout time.Duration // 关闭时等待客户端连接处理完的最长时间
+	BackendUser     string        // 代理登录缓存服务器的用户名，为空表示default
+	BackendPassword string        // 代理登录缓存服务器的密码，为空表示不登录
+	AdminPassword   string        // 执行PROXY命令前PROXY AUTH的密码，为空且未设置BackendPassword时只接受本机客户端的PROXY命令
+	TLSListen       string        // TLS监听地址，为空表示不开启
+	TLSCertFile     string        // 代理的证书，同时作为连接缓存服务器时的客户端证书
+	TLSKeyFile      string        // 代理的私钥
+	TLSCACertFile   string        // 校验客户端与缓存服务器证书的CA
+	TLSAuthClients  string        // 是否校验客户端证书：no、optional、yes
+	BackendTLS      bool          // 是否以TLS连接缓存服务器
+	HealthInterval  time.Duration // 健康检查的间隔
+	HealthTimeout   time.Duration // 等待健康检查回复的超时
+	HealthFall      int           // 连续失败该次数后将服务器移出一致性哈希
+	HealthRise      int           // 移出后连续通过该次数的检查才重新加入
+	ReconnectMax    time.Duration // 重连间隔从health-interval开始加倍，最大为该值
+	HashAlgorithm   string        // 选择服务器的算法：ring、jump、rendezvous、maglev
+	HashReplicas    int           // ring算法每单位权重的虚拟节点数
+	params          Params
+}
+
+func DefaultProxy() *Proxy {
+	cfg := &Proxy{
+		Listen:          ":8888",
+		Backends:        []string{"127.0.0.1:7000"},
+		ConnectTimeout:  3 * time.Second,
+		BackendPoolSize: 4,
+		ShutdownTimeout: 10 * time.Second,
+		TLSAuthClients:  "no",
+		HealthInterval:  time.Second,
+		HealthTimeout:   time.Second,
+		HealthFall:      3,
+		HealthRise:      2,
+		ReconnectMax:    30 * time.Second,
+		HashAlgorithm:   "ring",
+		HashReplicas:    160,
+	}
+	ps := &cfg.params
+	ps.add("listen", "监听地址", &stringValue{&cfg.Listen, validateAddr})
+	ps.add("metrics-listen", "Prometheus指标的HTTP监听地址，GET /metrics；为空表示不开启", &stringValue{&cfg.MetricsListen, nil})
+	ps.add("unixsocket", "Unix socket路径，与listen同时生效；为空表示不监听", &stringValue{&cfg.UnixSocket, nil})
+	ps.add("unixsocketperm", "Unix socket文件的八进制权限，如700；0表示不修改", &permValue{&cfg.UnixSocketPerm})
+	ps.add("backends", "缓存服务器列表，以逗号分隔，每项为\"[名字=]地址[ 权重]\"，名字默认为地址，权重默认为1；unix:或/开头的为Unix socket路径",
+		&listValue{&cfg.Backends, validateBackend})
+	ps.add("connect-timeout", "连接缓存服务器的超时", &durationValue{&cfg.ConnectTimeout})
+	ps.add("backend-timeout", "等待缓存服务器回复的超时，0表示不超时", &durationValue{&cfg.BackendTimeout})
+	ps.add("backend-pool-size", "每个缓存服务器的连接数，各客户端的命令在这些连接上多路复用", &intValue{&cfg.BackendPoolSize, 1})
+	ps.add("timeout", "客户端空闲超时，0表示不超时", &durationValue{&cfg.Timeout})
+	ps.add("shutdown-timeout", "关闭时等待客户端连接处理完的最长时间", &durationValue{&cfg.ShutdownTimeout})
+	ps.add("backend-user", "代理登录缓存服务器的用户名，为空表示default", &stringValue{&cfg.BackendUser, nil})
+	ps.add("backend-password", "代理登录缓存服务器的密码，为空表示不登录", &stringValue{&cfg.BackendPassword, nil})
+	ps.add("admin-password", "执行PROXY命令前须以PROXY AUTH提供的密码；为空且未设置backend-password时只接受本机（回环地址与Unix socket）客户端的PROXY命令",
+		&stringValue{&cfg.AdminPassword, nil})
+	ps.add("tls-listen", "TLS监听地址，为空表示不开启", &stringValue{&cfg.TLSListen, nil})
+	ps.add("tls-cert-file", "代理的证书，同时作为连接缓存服务器时的客户端证书", &stringValue{&cfg.TLSCertFile, nil})
+	ps.add("tls-key-file", "代理的私钥", &stringValue{&cfg.TLSKeyFile, nil})
+	ps.add("tls-ca-cert-file", "校验客户端与缓存服务器证书的CA，为空时使用系统CA", &stringValue{&cfg.TLSCACertFile, nil})
+	ps.add("tls-auth-clients", "是否校验客户端证书：no、optional、yes",
+		&enumValue{&cfg.TLSAuthClients, []string{"no", "optional", "yes"}})
+	ps.add("backend-tls", "是否以TLS连接缓存服务器：yes、no", &boolValue{&cfg.BackendTLS})
+	ps.add("health-interval", "向缓存服务器发送PING检查健康的间隔", &durationValue{&cfg.HealthInterval})
+	ps.add("health-timeout", "等待PING回复的超时", &durationValue{&cfg.HealthTimeout})
+	ps.add("health-fall", "连续失败该次数（PING或转发出错）后将服务器移出一致性哈希", &intValue{&cfg.HealthFall, 1})
+	ps.add("health-rise", "移出的服务器连续通过该次数的PING后重新加入一致性哈希", &intValue{&cfg.HealthRise, 1})
+	ps.add("reconnect-max-backoff", "重连失败后间隔从health-interval开始加倍，最大为该值", &durationValue{&cfg.ReconnectMax})
+	ps.add("hash-algorithm", "按key选择服务器的算法：ring、jump、rendezvous、maglev",
+		&enumValue{&cfg.HashAlgorithm, []string{"ring", "jump", "rendezvous", "maglev"}})
+	ps.add("hash-replicas", "ring算法每单位权重的虚拟节点数", &intValue{&cfg.HashReplicas, 1})
+	return cfg
+}
+
+// 按默认值、配置文件（-config指定）、命令行参数的顺序加载代理配置
+func LoadProxy(args []string) (*Proxy, error) {
+	cfg := DefaultProxy()
+	path, err := cfg.params.load("tinycached-proxy", args)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Path = path
+	cfg.args = args
+	return cfg, cfg.validate()
+}
+
+func (cfg *Proxy) Params() *Params {
+	return &cfg.params
+}
+
+// 重新读取配置文件并应用到当前配置，返回发生变化的配置项
+func (cfg *Proxy) Reload() ([]Change, error) {
+	fresh, err := LoadProxy(cfg.args)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.params.apply(&fresh.params), nil
+}
+
+// 一个缓存服务器
+type BackendSpec struct {
+	Name   string // 在一致性哈希上的名字，地址改变时key的分布不变
+	Addr   string
+	Weight int // 分到的key与权重成正比
+}
+
+// 权重的上限；ring算法中每单位权重占hash-replicas个虚拟节点
+const MaxBackendWeight = 100
+
+// 解析"[名字=]地址[ 权重]"
+func ParseBackend(s string) (BackendSpec, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return BackendSpec{}, fmt.Errorf("invalid backend %q: expected [name=]addr [weight]", s)
+	}
+	spec := BackendSpec{Name: fields[0], Addr: fields[0], Weight: 1}
+	if name, addr, ok := strings.Cut(fields[0], "="); ok {
+		spec.Name, spec.Addr = name, addr
+	}
+	if spec.Name == "" {
+		return BackendSpec{}, fmt.Errorf("invalid backend %q: empty name", s)
+	}
+	if len(fields) == 2 {
+		weight, err := strconv.Atoi(fields[1])
+		if err != nil || weight < 1 || weight > MaxBackendWeight {
+			return BackendSpec{}, fmt.Errorf("invalid weight %q: expected 1-%d", fields[1], MaxBackendWeight)
+		}
+		spec.Weight = weight
+	}
+	if err := validateBackendAddr(spec.Addr); err != nil {
+		return BackendSpec{}, err
+	}
+	return spec, nil
+}
+
+// 解析后的缓存服务器列表
+func (cfg *Proxy) BackendSpecs() []BackendSpec {
+	specs := make([]BackendSpec, 0, len(cfg.Backends))
+	for _, s := range cfg.Backends {
+		if spec, err := ParseBackend(s); err == nil {
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
+
+// 是否以自己的身份登录缓存服务器，并以ASUSER转发客户端的身份
+func (cfg *Proxy) BackendAuth() bool {
+	return cfg.BackendPassword != ""
+}
+
+// 是否需要加载证书
+func (cfg *Proxy) UseTLS() bool {
+	return cfg.TLSListen != "" || cfg.BackendTLS
+}
+
+func (cfg *Proxy) TLSOptions() tlsutil.Options {
+	return tlsutil.Options{
+		CertFile:    cfg.TLSCertFile,
+		KeyFile:     cfg.TLSKeyFile,
+		CAFile:      cfg.TLSCACertFile,
+		AuthClients: cfg.TLSAuthClients,
+	}
+}
+
+func (cfg *Proxy) validate() error {
+	if len(cfg.Backends) == 0 {
+		return errors.New("backends: at least one backend is required")
+	}
+	names := make(map[string]bool)
+	for _, spec := range cfg.BackendSpecs() {
+		if names[spec.Name] {
+			return fmt.Errorf("backends: duplicate name %q", spec.Name)
+		}
+		names[spec.Name] = true
+	}
+	if cfg.ConnectTimeout == 0 {
+		return errors.New("connect-timeout: must be greater than 0")
+	}
+	if cfg.HealthInterval == 0 || cfg.HealthTimeout == 0 {
+		return errors.New("health-interval, health-timeout: must be greater than 0")
+	}
+	if cfg.ReconnectMax < cfg.HealthInterval {
+		return errors.New("reconnect-max-backoff: must not be less than health-interval")
+	}
+	if cfg.TLSListen != "" && (cfg.TLSCertFile == "" || cfg.TLSKeyFile == "") {
+		return errors.New("tls-listen: tls-cert-file and tls-key-file are required")
+	}
+	return nil
+}
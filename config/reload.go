@@ -0,0 +1,40 @@
+package config
+
+import "fmt"
+
+// 重新加载配置时某个配置项的变化
+type Change struct {
+	Name    string
+	Old     string
+	New     string
+	Applied bool  // 是否已在运行时生效；为false时需要重启才能生效
+	Err     error // 生效失败的原因
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("%s: %q -> %q", c.Name, c.Old, c.New)
+	if c.Err != nil {
+		return s + " (failed: " + c.Err.Error() + ")"
+	} else if !c.Applied {
+		return s + " (restart required)"
+	}
+	return s
+}
+
+// 将新加载的配置与当前配置比较，可在运行时修改的配置项立即生效
+func (ps *Params) apply(fresh *Params) []Change {
+	var changes []Change
+	for _, p := range fresh.list {
+		old, _ := ps.Get(p.Name)
+		if old == p.Get() {
+			continue
+		}
+		c := Change{Name: p.Name, Old: old, New: p.Get()}
+		if cur := ps.Lookup(p.Name); cur.Live() {
+			c.Err = ps.SetLive(p.Name, c.New)
+			c.Applied = c.Err == nil
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
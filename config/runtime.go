@@ -0,0 +1,136 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// 注册配置项在运行时被修改后的回调，只有注册了回调的配置项才允许在运行时修改
+func (ps *Params) OnChange(name string, fn func() error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.index[name].onChange = fn
+}
+
+// 判断配置项是否可以在运行时修改
+func (p *Param) Live() bool {
+	return p.onChange != nil
+}
+
+// 运行时读取配置项
+func (ps *Params) Get(name string) (string, bool) {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	p := ps.Lookup(name)
+	if p == nil {
+		return "", false
+	}
+	return p.Get(), true
+}
+
+// 按glob模式匹配配置名，返回"配置名 值"列表
+func (ps *Params) Match(pattern string) []string {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	var ret []string
+	for _, p := range ps.list {
+		if ok, _ := path.Match(strings.ToLower(pattern), p.Name); ok {
+			ret = append(ret, p.Name+" "+p.Get())
+		}
+	}
+	return ret
+}
+
+// 运行时修改配置项；值不合法或回调失败时恢复原值
+func (ps *Params) SetLive(name string, value string) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	p := ps.Lookup(name)
+	if p == nil {
+		return fmt.Errorf("unknown option %q", name)
+	}
+	if !p.Live() {
+		return fmt.Errorf("%s: cannot be changed at runtime", p.Name)
+	}
+	old := p.Get()
+	if err := p.Set(value); err != nil {
+		p.Set(old)
+		return err
+	}
+	if err := p.onChange(); err != nil {
+		p.Set(old)
+		p.onChange()
+		return fmt.Errorf("%s: %v", p.Name, err)
+	}
+	return nil
+}
+
+func formatValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\"#") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// 将当前配置写回配置文件：保留注释与配置项的原有顺序，
+// 文件中没有而当前值与默认值不同的配置项追加到文件末尾
+func (ps *Params) Rewrite(filePath string) error {
+	if filePath == "" {
+		return errors.New("no config file specified")
+	}
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	written := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		name, _, ok, err := parseLine(line)
+		if p := ps.Lookup(name); err == nil && ok && p != nil {
+			if written[p.Name] {
+				// 重复出现的配置项只保留第一处
+				continue
+			}
+			line = p.Name + " " + formatValue(p.Get())
+			written[p.Name] = true
+		}
+		lines = append(lines, line)
+	}
+	file.Close()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	appended := false
+	for _, p := range ps.list {
+		if written[p.Name] || p.Get() == p.def {
+			continue
+		}
+		if !appended {
+			lines = append(lines, "", "# Generated by CONFIG REWRITE")
+			appended = true
+		}
+		lines = append(lines, p.Name+" "+formatValue(p.Get()))
+	}
+
+	// 先写临时文件再重命名，避免写到一半时进程退出导致配置文件损坏
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
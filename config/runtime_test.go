@@ -0,0 +1,133 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 回调失败时恢复原值，并以原值再调用一次回调，使运行时状态与配置一致
+func TestSetLiveRollback(t *testing.T) {
+	var limit, fixed int
+	var name string
+	var applied []int
+	ps := &Params{}
+	ps.add("limit", "", &intValue{&limit, 0})
+	ps.add("fixed", "", &intValue{&fixed, 0})
+	ps.add("name", "", &stringValue{&name, validateNotEmpty})
+	ps.OnChange("limit", func() error {
+		applied = append(applied, limit)
+		if limit > 10 {
+			return errors.New("too big")
+		}
+		return nil
+	})
+	ps.OnChange("name", func() error { return nil })
+
+	if err := ps.SetLive("LIMIT", "5"); err != nil || limit != 5 {
+		t.Fatalf("SetLive(limit, 5): limit=%d, %v", limit, err)
+	}
+	err := ps.SetLive("limit", "20")
+	if err == nil || err.Error() != "limit: too big" {
+		t.Errorf("SetLive(limit, 20): got %v, want limit: too big", err)
+	}
+	if got, _ := ps.Get("limit"); limit != 5 || got != "5" {
+		t.Errorf("after a failed callback limit=%d (%q), want 5", limit, got)
+	}
+	if want := []int{5, 20, 5}; len(applied) != len(want) || applied[1] != 20 || applied[2] != 5 {
+		t.Errorf("callback saw %v, want %v", applied, want)
+	}
+
+	// 值不合法时不调用回调
+	applied = nil
+	if err := ps.SetLive("limit", "-1"); err == nil || limit != 5 || len(applied) != 0 {
+		t.Errorf("SetLive(limit, -1): limit=%d, callbacks=%v, %v", limit, applied, err)
+	}
+	if err := ps.SetLive("name", ""); err == nil || name != "" {
+		t.Errorf("SetLive(name, \"\"): name=%q, %v", name, err)
+	}
+	if err := ps.SetLive("fixed", "1"); err == nil || !strings.Contains(err.Error(), "cannot be changed at runtime") || fixed != 0 {
+		t.Errorf("SetLive(fixed, 1): fixed=%d, %v", fixed, err)
+	}
+	if err := ps.SetLive("nope", "1"); err == nil {
+		t.Error("SetLive of an unknown option succeeded")
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.conf")
+	orig := `# tinycached config
+# maxmemory 1gb
+
+maxmemory 64mb
+  timeout   30   
+module-option keep me
+maxmemory 32mb
+requirepass "old pass"
+`
+	if err := os.WriteFile(path, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultServer()
+	ps := cfg.Params()
+	for name, value := range map[string]string{"maxmemory": "128mb", "requirepass": "new pass", "slowlog-max-len": "16", "replicaof": "127.0.0.1 7000"} {
+		if err := ps.Lookup(name).Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg.Timeout = 0
+	if err := ps.Rewrite(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 注释、空行与未知配置项原样保留，已有的配置项原地更新，重复的只保留第一处，
+	// 其余与默认值不同的配置项按注册顺序追加
+	want := `# tinycached config
+# maxmemory 1gb
+
+maxmemory 128mb
+timeout 0
+module-option keep me
+requirepass "new pass"
+
+# Generated by CONFIG REWRITE
+slowlog-max-len 16
+replicaof "127.0.0.1 7000"
+`
+	if string(got) != want {
+		t.Errorf("rewritten file:\n%s\nwant:\n%s", got, want)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	// 再次写回时内容不变
+	if err := ps.Rewrite(path); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := os.ReadFile(path); string(again) != want {
+		t.Errorf("second rewrite changed the file:\n%s", again)
+	}
+
+	// 写临时文件失败时原文件不变
+	if err := os.Mkdir(path+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	ps.Lookup("maxmemory").Set("1gb")
+	if err := ps.Rewrite(path); err == nil {
+		t.Error("rewrite succeeded although the temporary file could not be written")
+	}
+	if after, _ := os.ReadFile(path); string(after) != want {
+		t.Errorf("failed rewrite changed the file:\n%s", after)
+	}
+
+	if err := ps.Rewrite(""); err == nil {
+		t.Error("rewrite without a config file succeeded")
+	}
+}
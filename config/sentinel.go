@@ -0,0 +1,118 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 哨兵配置
+type Sentinel struct {
+	Path            string        // 配置文件路径，未指定时为空
+	args            []string      // 启动时的命令行参数
+	Listen          string        // 监听地址，供其他哨兵询问与投票
+	Monitor         []string      // 监控的主服务器，每项为"名字 host port quorum"
+	DownAfter       time.Duration // 主服务器持续无响应超过该时间即主观下线
+	FailoverTimeout time.Duration // 故障转移的超时，也是两次故障转移尝试的最小间隔
+	Sentinels       []string      // 其他哨兵的地址
+	Proxies         []string      // 故障转移后通知的代理地址
+	AuthUser        string        // 连接缓存服务器与代理时登录的用户名，为空表示default用户
+	AuthPass        string        // 连接缓存服务器与代理时登录的密码，为空表示不登录
+	ProxyAuthPass   string        // 通知代理前PROXY AUTH的密码，为空表示不发送
+	ConnectTimeout  time.Duration // 连接缓存服务器、代理与其他哨兵的超时
+	params          Params
+}
+
+// 一个被监控的主服务器
+type MonitorSpec struct {
+	Name   string // 名字，各哨兵须使用相同的名字
+	Addr   string // 启动时的地址，故障转移后以哨兵之间传播的地址为准
+	Quorum int    // 认为主服务器下线所需的哨兵数（含自己）
+}
+
+func DefaultSentinel() *Sentinel {
+	cfg := &Sentinel{
+		Listen:          ":26000",
+		DownAfter:       5 * time.Second,
+		FailoverTimeout: 30 * time.Second,
+		ConnectTimeout:  time.Second,
+	}
+	ps := &cfg.params
+	ps.add("listen", "监听地址", &stringValue{&cfg.Listen, validateAddr})
+	ps.add("monitor", "监控的主服务器，每项为\"名字 host port quorum\"，以逗号分隔", &listValue{&cfg.Monitor, validateMonitor})
+	ps.add("down-after", "主服务器持续无响应超过该时间即主观下线", &durationValue{&cfg.DownAfter})
+	ps.add("failover-timeout", "故障转移的超时，也是两次故障转移尝试的最小间隔", &durationValue{&cfg.FailoverTimeout})
+	ps.add("sentinels", "其他哨兵的地址列表，以逗号分隔", &listValue{&cfg.Sentinels, validateAddr})
+	ps.add("proxies", "故障转移后通知的代理地址列表，以逗号分隔", &listValue{&cfg.Proxies, validateAddr})
+	ps.add("auth-user", "连接缓存服务器与代理时登录的用户名，为空表示default用户；该用户须有admin权限", &stringValue{&cfg.AuthUser, nil})
+	ps.add("auth-pass", "连接缓存服务器与代理时登录的密码，为空表示不登录", &stringValue{&cfg.AuthPass, nil})
+	ps.add("proxy-auth-pass", "通知代理前以PROXY AUTH提供的密码，与代理的admin-password相同；为空表示不发送", &stringValue{&cfg.ProxyAuthPass, nil})
+	ps.add("connect-timeout", "连接缓存服务器、代理与其他哨兵的超时，也是等待回复的超时", &durationValue{&cfg.ConnectTimeout})
+	return cfg
+}
+
+// 按默认值、配置文件（-config指定）、命令行参数的顺序加载哨兵配置
+func LoadSentinel(args []string) (*Sentinel, error) {
+	cfg := DefaultSentinel()
+	path, err := cfg.params.load("tinycached-sentinel", args)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Path = path
+	cfg.args = args
+	return cfg, cfg.validate()
+}
+
+func (cfg *Sentinel) Params() *Params {
+	return &cfg.params
+}
+
+// 解析monitor配置项
+func (cfg *Sentinel) Masters() []MonitorSpec {
+	specs := make([]MonitorSpec, 0, len(cfg.Monitor))
+	for _, item := range cfg.Monitor {
+		spec, _ := parseMonitor(item)
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+func (cfg *Sentinel) validate() error {
+	if len(cfg.Monitor) == 0 {
+		return errors.New("monitor: at least one master is required")
+	}
+	names := make(map[string]bool)
+	for _, spec := range cfg.Masters() {
+		if names[spec.Name] {
+			return fmt.Errorf("monitor: duplicate master name %q", spec.Name)
+		}
+		names[spec.Name] = true
+	}
+	if cfg.DownAfter == 0 || cfg.FailoverTimeout == 0 || cfg.ConnectTimeout == 0 {
+		return errors.New("down-after, failover-timeout and connect-timeout must be greater than 0")
+	}
+	return nil
+}
+
+func parseMonitor(s string) (spec MonitorSpec, err error) {
+	elem := strings.Fields(s)
+	if len(elem) != 4 {
+		return spec, fmt.Errorf("invalid master %q: expected name host port quorum", s)
+	}
+	spec.Name, spec.Addr = elem[0], net.JoinHostPort(elem[1], elem[2])
+	if err := validateAddr(spec.Addr); err != nil {
+		return spec, err
+	}
+	if spec.Quorum, err = strconv.Atoi(elem[3]); err != nil || spec.Quorum < 1 {
+		return spec, fmt.Errorf("invalid quorum in %q", s)
+	}
+	return spec, nil
+}
+
+func validateMonitor(s string) error {
+	_, err := parseMonitor(s)
+	return err
+}
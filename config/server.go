@@ -0,0 +1,206 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+	"tinycached/utils/tlsutil"
+)
+
+// 缓存服务器配置
+type Server struct {
+	Path                 string        // 配置文件路径，未指定时为空
+	args                 []string      // 启动时的命令行参数，重新加载时仍然覆盖配置文件
+	Listen               string        // 监听地址
+	MetricsListen        string        // Prometheus指标的HTTP监听地址，为空表示不开启
+	UnixSocket           string        // Unix socket路径，为空表示不监听
+	UnixSocketPerm       os.FileMode   // Unix socket文件的权限，0表示不修改
+	IOMode               string        // 网络模型：goroutine为每个连接一个协程，netpoll为epoll事件循环
+	IOThreads            int           // netpoll模式下的事件循环数，0表示与CPU核数相同
+	MaxMemory            uint64        // 缓存最大字节数
+	MaxMemoryPolicy      string        // 内存耗尽时的淘汰策略
+	AppendOnly           bool          // 是否开启AOF持久化
+	AppendFilename       string        // AOF文件路径
+	AppendFsync          string        // AOF刷盘策略
+	MaxClients           int           // 最大客户端连接数
+	Timeout              time.Duration // 客户端空闲超时，0表示不超时
+	WriteTimeout         time.Duration // 向客户端写出回复的超时，0表示不超时
+	OutputBufferLimits   OutputLimits  // 各类客户端的输出缓冲区限制
+	NotifyKeyspaceEvents string        // 键空间事件类别
+	SlowlogSlowerThan    time.Duration // 执行时间超过该值的命令记入慢日志，0表示不记录
+	SlowlogMaxLen        int           // 慢日志保留的最大条数
+	ShutdownTimeout      time.Duration // 关闭时等待连接处理完的最长时间
+	ShutdownSnapshot     bool          // 关闭时是否写快照
+	DbFilename           string        // 快照文件路径
+	ReplicaOf            string        // 主服务器的"host port"，为空表示自己是主服务器
+	MasterUser           string        // 连接主服务器时登录的用户名，为空表示default用户
+	MasterAuth           string        // 连接主服务器时登录的密码，为空表示不登录
+	ReplicaReadOnly      bool          // 作为副本时是否拒绝客户端的写命令
+	ReplBacklogSize      uint64        // 复制积压缓冲区的字节数
+	RaftID               string        // 本节点在Raft组中的ID，为空表示不开启Raft模式
+	RaftPeers            []string      // Raft组的全部节点，每项为"ID=host:port"，包括自己
+	RaftDir              string        // Raft日志与快照的目录
+	RaftSnapshotEntries  int           // 快照之后执行的命令达到该数量时写新的快照，0表示不压缩日志
+	RequirePass          string        // default用户的密码，为空表示不需要密码
+	ACLFile              string        // ACL用户文件路径，为空表示不使用
+	TLSListen            string        // TLS监听地址，为空表示不开启
+	TLSCertFile          string        // 服务器证书
+	TLSKeyFile           string        // 服务器私钥
+	TLSCACertFile        string        // 校验客户端证书的CA
+	TLSAuthClients       string        // 是否校验客户端证书：no、optional、yes
+	params               Params
+}
+
+func DefaultServer() *Server {
+	cfg := &Server{
+		Listen:            ":7000",
+		IOMode:            "goroutine",
+		MaxMemory:         64 << 20,
+		MaxMemoryPolicy:   "allkeys-lru",
+		AppendOnly:        true,
+		AppendFilename:    "cache.aof",
+		AppendFsync:       "everysec",
+		MaxClients:        10000,
+		ShutdownTimeout:   10 * time.Second,
+		DbFilename:        "dump.tcs",
+		SlowlogSlowerThan: 10 * time.Millisecond,
+		SlowlogMaxLen:     128,
+		TLSAuthClients:    "no",
+		ReplicaReadOnly:   true,
+		ReplBacklogSize:   1 << 20,
+		OutputBufferLimits: OutputLimits{
+			ClassNormal:  {0, 0, 0},
+			ClassReplica: {256 << 20, 64 << 20, 60},
+			ClassPubSub:  {32 << 20, 8 << 20, 60},
+		},
+		RaftDir:             "raft",
+		RaftSnapshotEntries: 10000,
+	}
+	ps := &cfg.params
+	ps.add("listen", "监听地址", &stringValue{&cfg.Listen, validateAddr})
+	ps.add("metrics-listen", "Prometheus指标的HTTP监听地址，GET /metrics；为空表示不开启", &stringValue{&cfg.MetricsListen, nil})
+	ps.add("unixsocket", "Unix socket路径，与listen同时生效；为空表示不监听", &stringValue{&cfg.UnixSocket, nil})
+	ps.add("unixsocketperm", "Unix socket文件的八进制权限，如700；0表示不修改", &permValue{&cfg.UnixSocketPerm})
+	ps.add("io-mode", "网络模型：goroutine、netpoll（仅linux）",
+		&enumValue{&cfg.IOMode, []string{"goroutine", "netpoll"}})
+	ps.add("io-threads", "netpoll模式下的事件循环数，0表示与CPU核数相同", &intValue{&cfg.IOThreads, 0})
+	ps.add("maxmemory", "缓存最大字节数，如64mb", &sizeValue{&cfg.MaxMemory})
+	ps.add("maxmemory-policy", "淘汰策略：allkeys-lru、volatile-lru、noeviction",
+		&enumValue{&cfg.MaxMemoryPolicy, []string{"allkeys-lru", "volatile-lru", "noeviction"}})
+	ps.add("appendonly", "是否开启AOF持久化：yes、no", &boolValue{&cfg.AppendOnly})
+	ps.add("appendfilename", "AOF文件路径", &stringValue{&cfg.AppendFilename, validateNotEmpty})
+	ps.add("appendfsync", "AOF刷盘策略：always、everysec、no",
+		&enumValue{&cfg.AppendFsync, []string{"always", "everysec", "no"}})
+	ps.add("maxclients", "最大客户端连接数，超出时拒绝新连接", &intValue{&cfg.MaxClients, 1})
+	ps.add("timeout", "客户端空闲超时，0表示不超时", &durationValue{&cfg.Timeout})
+	ps.add("write-timeout", "向客户端写出回复的超时，客户端长时间不读取回复时断开；0表示不超时", &durationValue{&cfg.WriteTimeout})
+	ps.add("client-output-buffer-limit", "各类客户端（normal、replica、pubsub）的输出缓冲区限制：类别 hard soft soft秒数",
+		&outputLimitsValue{&cfg.OutputBufferLimits})
+	ps.add("notify-keyspace-events", "键空间事件类别，如KEA；为空则关闭", &stringValue{&cfg.NotifyKeyspaceEvents, nil})
+	ps.add("slowlog-log-slower-than", "执行时间超过该值的命令记入慢日志，如10ms；0表示不记录", &durationValue{&cfg.SlowlogSlowerThan})
+	ps.add("slowlog-max-len", "慢日志保留的最大条数，超出时丢弃最旧的一条", &intValue{&cfg.SlowlogMaxLen, 0})
+	ps.add("shutdown-timeout", "关闭时等待连接处理完的最长时间", &durationValue{&cfg.ShutdownTimeout})
+	ps.add("shutdown-snapshot", "关闭时是否写快照：yes、no", &boolValue{&cfg.ShutdownSnapshot})
+	ps.add("dbfilename", "快照文件路径，启动时若存在则先加载", &stringValue{&cfg.DbFilename, validateNotEmpty})
+	ps.add("replicaof", "主服务器的地址，格式为host port；为空表示自己是主服务器", &stringValue{&cfg.ReplicaOf, validateReplicaOf})
+	ps.add("masteruser", "连接主服务器时登录的用户名，为空表示default用户", &stringValue{&cfg.MasterUser, nil})
+	ps.add("masterauth", "连接主服务器时登录的密码，为空表示不登录", &stringValue{&cfg.MasterAuth, nil})
+	ps.add("replica-read-only", "作为副本时是否拒绝客户端的写命令：yes、no", &boolValue{&cfg.ReplicaReadOnly})
+	ps.add("repl-backlog-size", "复制积压缓冲区的大小，如1mb；断线的副本缺失的复制流仍在其中时只需部分重同步", &sizeValue{&cfg.ReplBacklogSize})
+	ps.add("raft-id", "本节点在Raft组中的ID；不为空时开启Raft模式，写命令经多数节点提交后才回复，不再使用AOF与快照文件", &stringValue{&cfg.RaftID, nil})
+	ps.add("raft-peers", "Raft组的全部节点，每项为\"ID=host:port\"（节点之间通信的地址），包括自己，以逗号分隔", &listValue{&cfg.RaftPeers, validateRaftPeer})
+	ps.add("raft-dir", "Raft日志与快照的目录", &stringValue{&cfg.RaftDir, validateNotEmpty})
+	ps.add("raft-snapshot-entries", "快照之后执行的命令达到该数量时写新的快照并压缩日志，0表示不压缩", &intValue{&cfg.RaftSnapshotEntries, 0})
+	ps.add("requirepass", "default用户的密码，为空表示不需要密码", &stringValue{&cfg.RequirePass, nil})
+	ps.add("aclfile", "ACL用户文件路径，启动时加载，ACL SAVE写回", &stringValue{&cfg.ACLFile, nil})
+	ps.add("tls-listen", "TLS监听地址，为空表示不开启", &stringValue{&cfg.TLSListen, nil})
+	ps.add("tls-cert-file", "服务器证书，收到SIGHUP时重新读取", &stringValue{&cfg.TLSCertFile, nil})
+	ps.add("tls-key-file", "服务器私钥，收到SIGHUP时重新读取", &stringValue{&cfg.TLSKeyFile, nil})
+	ps.add("tls-ca-cert-file", "校验客户端证书的CA", &stringValue{&cfg.TLSCACertFile, nil})
+	ps.add("tls-auth-clients", "是否校验客户端证书：no、optional、yes",
+		&enumValue{&cfg.TLSAuthClients, []string{"no", "optional", "yes"}})
+	return cfg
+}
+
+// 按默认值、配置文件（-config指定）、命令行参数的顺序加载服务器配置
+func LoadServer(args []string) (*Server, error) {
+	cfg := DefaultServer()
+	path, err := cfg.params.load("tinycached", args)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Path = path
+	cfg.args = args
+	return cfg, cfg.validate()
+}
+
+func (cfg *Server) Params() *Params {
+	return &cfg.params
+}
+
+// 将运行时修改过的配置写回配置文件
+func (cfg *Server) Rewrite() error {
+	return cfg.params.Rewrite(cfg.Path)
+}
+
+// 重新读取配置文件并应用到当前配置，返回发生变化的配置项
+func (cfg *Server) Reload() ([]Change, error) {
+	fresh, err := LoadServer(cfg.args)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.params.apply(&fresh.params), nil
+}
+
+func (cfg *Server) TLSOptions() tlsutil.Options {
+	return tlsutil.Options{
+		CertFile:    cfg.TLSCertFile,
+		KeyFile:     cfg.TLSKeyFile,
+		CAFile:      cfg.TLSCACertFile,
+		AuthClients: cfg.TLSAuthClients,
+	}
+}
+
+// 主服务器的host:port，自己是主服务器时返回空串
+func (cfg *Server) MasterAddr() string {
+	elem := strings.Fields(cfg.ReplicaOf)
+	if len(elem) != 2 {
+		return ""
+	}
+	return net.JoinHostPort(elem[0], elem[1])
+}
+
+// Raft组中各节点的地址，key为节点ID
+func (cfg *Server) RaftAddrs() map[string]string {
+	addrs := make(map[string]string)
+	for _, peer := range cfg.RaftPeers {
+		id, addr, _ := strings.Cut(peer, "=")
+		addrs[id] = addr
+	}
+	return addrs
+}
+
+func (cfg *Server) validate() error {
+	if cfg.MaxMemory == 0 {
+		return errors.New("maxmemory: must be greater than 0")
+	}
+	if cfg.RaftID != "" {
+		addrs := cfg.RaftAddrs()
+		if len(addrs) != len(cfg.RaftPeers) {
+			return errors.New("raft-peers: duplicate id")
+		}
+		if _, ok := addrs[cfg.RaftID]; !ok {
+			return fmt.Errorf("raft-peers: %s is not in the list", cfg.RaftID)
+		}
+		if cfg.ReplicaOf != "" {
+			return errors.New("replicaof: cannot be used with raft-id")
+		}
+	}
+	if cfg.TLSListen != "" && (cfg.TLSCertFile == "" || cfg.TLSKeyFile == "") {
+		return errors.New("tls-listen: tls-cert-file and tls-key-file are required")
+	}
+	return nil
+}
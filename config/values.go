@@ -0,0 +1,359 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"tinycached/utils"
+)
+
+type stringValue struct {
+	p        *string
+	validate func(string) error
+}
+
+func (v *stringValue) String() string {
+	return *v.p
+}
+
+func (v *stringValue) Set(s string) error {
+	if v.validate != nil {
+		if err := v.validate(s); err != nil {
+			return err
+		}
+	}
+	*v.p = s
+	return nil
+}
+
+// 取值只能是allowed之一
+type enumValue struct {
+	p       *string
+	allowed []string
+}
+
+func (v *enumValue) String() string {
+	return *v.p
+}
+
+func (v *enumValue) Set(s string) error {
+	s = strings.ToLower(s)
+	for _, a := range v.allowed {
+		if s == a {
+			*v.p = s
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid value %q, must be one of %s", s, strings.Join(v.allowed, ", "))
+}
+
+// yes/no
+type boolValue struct {
+	p *bool
+}
+
+func (v *boolValue) String() string {
+	if *v.p {
+		return "yes"
+	}
+	return "no"
+}
+
+func (v *boolValue) Set(s string) error {
+	switch strings.ToLower(s) {
+	case "yes":
+		*v.p = true
+	case "no":
+		*v.p = false
+	default:
+		return fmt.Errorf("invalid value %q, must be yes or no", s)
+	}
+	return nil
+}
+
+type intValue struct {
+	p   *int
+	min int
+}
+
+func (v *intValue) String() string {
+	return strconv.Itoa(*v.p)
+}
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid integer %q", s)
+	}
+	if n < v.min {
+		return fmt.Errorf("value %d is less than %d", n, v.min)
+	}
+	*v.p = n
+	return nil
+}
+
+// 字节数，支持kb/mb/gb后缀（1024进制），如64mb
+type sizeValue struct {
+	p *uint64
+}
+
+var sizeUnits = []struct {
+	suffix string
+	mul    uint64
+}{
+	{"gb", 1 << 30},
+	{"mb", 1 << 20},
+	{"kb", 1 << 10},
+	{"g", 1 << 30},
+	{"m", 1 << 20},
+	{"k", 1 << 10},
+	{"b", 1},
+}
+
+func (v *sizeValue) String() string {
+	return FormatSize(*v.p)
+}
+
+func (v *sizeValue) Set(s string) error {
+	n, err := ParseSize(s)
+	if err != nil {
+		return err
+	}
+	*v.p = n
+	return nil
+}
+
+func ParseSize(s string) (uint64, error) {
+	num, mul := strings.ToLower(strings.TrimSpace(s)), uint64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(num, u.suffix) {
+			num, mul = strings.TrimSuffix(num, u.suffix), u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxUint64/mul {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * mul, nil
+}
+
+func FormatSize(n uint64) string {
+	for _, u := range sizeUnits[:3] {
+		if n != 0 && n%u.mul == 0 {
+			return strconv.FormatUint(n/u.mul, 10) + u.suffix
+		}
+	}
+	return strconv.FormatUint(n, 10)
+}
+
+// 时长，支持Go的时长格式（如500ms、10s），纯数字按秒计算
+type durationValue struct {
+	p *time.Duration
+}
+
+func (v *durationValue) String() string {
+	if *v.p%time.Second == 0 {
+		return strconv.FormatInt(int64(*v.p/time.Second), 10)
+	}
+	return v.p.String()
+}
+
+func (v *durationValue) Set(s string) error {
+	var d time.Duration
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n > math.MaxInt64/int64(time.Second) || n < math.MinInt64/int64(time.Second) {
+			return fmt.Errorf("duration %q is too large", s)
+		}
+		d = time.Duration(n) * time.Second
+	} else if d, err = time.ParseDuration(s); err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	if d < 0 {
+		return fmt.Errorf("duration %q must not be negative", s)
+	}
+	*v.p = d
+	return nil
+}
+
+// 八进制的文件权限，如700；0表示不修改
+type permValue struct {
+	p *os.FileMode
+}
+
+func (v *permValue) String() string {
+	return strconv.FormatUint(uint64(*v.p), 8)
+}
+
+func (v *permValue) Set(s string) error {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0777 {
+		return fmt.Errorf("invalid permission %q", s)
+	}
+	*v.p = os.FileMode(n)
+	return nil
+}
+
+// 客户端类别，各类别的输出缓冲区限制不同
+type ClientClass int
+
+const (
+	ClassNormal  ClientClass = iota // 普通客户端
+	ClassReplica                    // 从服务器
+	ClassPubSub                     // 订阅了频道或执行了MONITOR的客户端
+	numClientClasses
+)
+
+var clientClassNames = [numClientClasses]string{"normal", "replica", "pubsub"}
+
+func (c ClientClass) String() string {
+	return clientClassNames[c]
+}
+
+// 输出缓冲区限制：超过Hard，或持续SoftSeconds超过Soft时断开连接；0表示不限制
+type OutputLimit struct {
+	Hard        uint64
+	Soft        uint64
+	SoftSeconds int
+}
+
+type OutputLimits [numClientClasses]OutputLimit
+
+// 按"类别 hard soft soft秒数"的格式，可以只给出部分类别，如pubsub 32mb 8mb 60
+type outputLimitsValue struct {
+	p *OutputLimits
+}
+
+func (v *outputLimitsValue) String() string {
+	var parts []string
+	for class, l := range v.p {
+		parts = append(parts, ClientClass(class).String(), FormatSize(l.Hard), FormatSize(l.Soft), strconv.Itoa(l.SoftSeconds))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (v *outputLimitsValue) Set(s string) error {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields)%4 != 0 {
+		return fmt.Errorf("invalid output buffer limits %q", s)
+	}
+	limits := *v.p
+	for i := 0; i < len(fields); i += 4 {
+		class := -1
+		for c, name := range clientClassNames {
+			if strings.EqualFold(fields[i], name) {
+				class = c
+			}
+		}
+		if class < 0 {
+			return fmt.Errorf("invalid client class %q", fields[i])
+		}
+		hard, err := ParseSize(fields[i+1])
+		if err != nil {
+			return err
+		}
+		soft, err := ParseSize(fields[i+2])
+		if err != nil {
+			return err
+		}
+		seconds, err := strconv.Atoi(fields[i+3])
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("invalid soft seconds %q", fields[i+3])
+		}
+		limits[class] = OutputLimit{Hard: hard, Soft: soft, SoftSeconds: seconds}
+	}
+	*v.p = limits
+	return nil
+}
+
+// 逗号分隔的列表
+type listValue struct {
+	p        *[]string
+	validate func(string) error
+}
+
+func (v *listValue) String() string {
+	return strings.Join(*v.p, ",")
+}
+
+func (v *listValue) Set(s string) error {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if v.validate != nil {
+			if err := v.validate(item); err != nil {
+				return err
+			}
+		}
+		list = append(list, item)
+	}
+	*v.p = list
+	return nil
+}
+
+func validateNotEmpty(s string) error {
+	if s == "" {
+		return errEmpty
+	}
+	return nil
+}
+
+// 校验host:port格式的地址
+func validateAddr(s string) error {
+	if s == "" {
+		return errEmpty
+	}
+	if _, port, err := net.SplitHostPort(s); err != nil {
+		return fmt.Errorf("invalid address %q: %v", s, err)
+	} else if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("invalid port in address %q", s)
+	}
+	return nil
+}
+
+// 校验replicaof：为空，或host port
+func validateReplicaOf(s string) error {
+	if s == "" {
+		return nil
+	}
+	elem := strings.Fields(s)
+	if len(elem) != 2 {
+		return fmt.Errorf("invalid master %q: expected host port", s)
+	}
+	return validateAddr(net.JoinHostPort(elem[0], elem[1]))
+}
+
+// 校验Raft节点：ID=host:port
+func validateRaftPeer(s string) error {
+	id, addr, ok := strings.Cut(s, "=")
+	if !ok || id == "" || strings.ContainsAny(id, " \t") {
+		return fmt.Errorf("invalid raft peer %q: expected id=host:port", s)
+	}
+	return validateAddr(addr)
+}
+
+// 校验代理的一个缓存服务器，见ParseBackend
+func validateBackend(s string) error {
+	_, err := ParseBackend(s)
+	return err
+}
+
+// 校验缓存服务器地址：host:port，或以unix:、/开头的Unix socket路径
+func validateBackendAddr(s string) error {
+	if network, path := utils.SplitNetAddr(s); network == "unix" {
+		if path == "" {
+			return errEmpty
+		}
+		return nil
+	}
+	return validateAddr(s)
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"1024", 1024, true},
+		{" 512 ", 512, true},
+		{"100b", 100, true},
+		{"1k", 1 << 10, true},
+		{"1kb", 1 << 10, true},
+		{"64MB", 64 << 20, true},
+		{"3m", 3 << 20, true},
+		{"2G", 2 << 30, true},
+		{"2gb", 2 << 30, true},
+		{"18446744073709551615", math.MaxUint64, true},
+		{"18446744073709551615b", math.MaxUint64, true},
+		{"17179869183gb", 17179869183 << 30, true},
+		{"", 0, false},
+		{"k", 0, false},
+		{"-1", 0, false},
+		{"1.5m", 0, false},
+		{"10tb", 0, false},
+		{"1 m", 0, false},
+		{"abc", 0, false},
+		{"18446744073709551616", 0, false},
+		// 乘以单位后溢出
+		{"17179869184gb", 0, false},
+		{"17592186044416m", 0, false},
+		{"18014398509481984k", 0, false},
+		{"18446744073709551615k", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if ok := err == nil; ok != tt.ok || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		in   uint64
+		want string
+	}{
+		{0, "0"},
+		{1, "1"},
+		{1000, "1000"},
+		{1 << 10, "1kb"},
+		{1536, "1536"},
+		{3 << 20, "3mb"},
+		{(1 << 20) + (1 << 10), "1025kb"},
+		{2 << 30, "2gb"},
+		{math.MaxUint64, "18446744073709551615"},
+	}
+	for _, tt := range tests {
+		got := FormatSize(tt.in)
+		if got != tt.want {
+			t.Errorf("FormatSize(%d) = %q, want %q", tt.in, got, tt.want)
+		}
+		// 输出可以重新解析为原值
+		if n, err := ParseSize(got); err != nil || n != tt.in {
+			t.Errorf("ParseSize(FormatSize(%d)) = %d, %v", tt.in, n, err)
+		}
+	}
+}
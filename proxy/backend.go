@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"time"
+	"tinycached/config"
+	"tinycached/proxy/consistenthash"
+)
+
+/*
+ * 代理转发到的一个缓存服务器。一致性哈希上使用名字而不是地址，
+ * 地址改变（故障转移后PROXY SWITCH）时key的分布不变。
+ * 健康的服务器在一致性哈希上；连续失败health-fall次后移出（摘除），
+ * 之后按退避间隔重连，连续通过health-rise次检查后重新加入，避免服务器时好时坏时key来回迁移
+ */
+type backend struct {
+	name    string
+	addr    string
+	weight  int
+	up      bool          // 是否在一致性哈希上；为true时pool不为nil
+	pool    *connPool     // 转发命令的连接池，加入一致性哈希时建立，移出时关闭
+	check   net.Conn      // 健康检查的连接，与转发分开
+	fails   int           // 在一致性哈希上时连续失败的次数
+	passes  int           // 摘除后连续通过检查的次数
+	backoff time.Duration // 摘除后当前的重连间隔
+	retryAt time.Time     // 摘除后下一次检查的时间
+	failed  bool          // 最近一次重连失败，重连仍失败时不再重复记日志
+}
+
+var (
+	errNodeExists  = errors.New("node already exists")
+	errUnknownNode = errors.New("unknown node")
+)
+
+// 健康检查的参数，由mutex保护，重新加载配置时更新
+type healthOptions struct {
+	interval   time.Duration
+	timeout    time.Duration
+	fall       int
+	rise       int
+	maxBackoff time.Duration
+}
+
+func healthOptionsOf(cfg *config.Proxy) healthOptions {
+	return healthOptions{
+		interval:   cfg.HealthInterval,
+		timeout:    cfg.HealthTimeout,
+		fall:       cfg.HealthFall,
+		rise:       cfg.HealthRise,
+		maxBackoff: cfg.ReconnectMax,
+	}
+}
+
+// 建立连接池并加入一致性哈希；调用方持有mutex
+func (proxy *cacheProxy) join(b *backend, reason string) {
+	b.pool = proxy.newPool(b.addr)
+	b.up = true
+	b.fails, b.passes, b.backoff = 0, 0, 0
+	proxy.hashmap.AddNodeWeight(b.name, b.weight)
+	proxy.ringChanges++
+	log.Printf("svr %s(%s) up: %s", b.name, b.addr, reason)
+}
+
+// 将服务器移出一致性哈希并关闭连接池，之后按退避间隔重连；调用方持有mutex
+func (proxy *cacheProxy) eject(b *backend, reason string) {
+	b.closeConns()
+	b.passes = 0
+	if !b.up {
+		return
+	}
+	b.up = false
+	b.fails = 0
+	b.backoff = proxy.health.interval
+	b.retryAt = time.Now().Add(b.backoff)
+	proxy.hashmap.RemoveNode(b.name)
+	proxy.ringChanges++
+	proxy.stats(b.name).ejections++
+	log.Printf("svr %s(%s) down: %s", b.name, b.addr, reason)
+}
+
+func (b *backend) closeConns() {
+	if b.pool != nil {
+		b.pool.close()
+		b.pool = nil
+	}
+	if b.check != nil {
+		b.check.Close()
+		b.check = nil
+	}
+}
+
+// 在一致性哈希上的服务器失败一次，连续失败health-fall次时摘除；调用方持有mutex
+func (proxy *cacheProxy) fail(b *backend, err error) {
+	if !b.up {
+		return
+	}
+	b.fails++
+	if b.fails >= proxy.health.fall {
+		proxy.eject(b, err.Error())
+	}
+}
+
+// 转发命令出错时调用：pool仍是服务器当前的连接池时计一次失败，出错的连接在下一次使用时重连
+func (proxy *cacheProxy) forwardFailed(name string, pool *connPool, err error) {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+
+	if b, ok := proxy.servers[name]; ok && b.pool == pool {
+		proxy.fail(b, err)
+	}
+}
+
+// 重新加载配置后按新的算法重建一致性哈希，大部分key会换到其他服务器
+func (proxy *cacheProxy) applyHashOptions() error {
+	hashmap, err := consistenthash.New(proxy.cfg.HashAlgorithm, proxy.cfg.HashReplicas)
+	if err != nil {
+		return err
+	}
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+
+	for _, b := range proxy.servers {
+		if b.up {
+			hashmap.AddNodeWeight(b.name, b.weight)
+		}
+	}
+	proxy.hashmap = hashmap
+	proxy.ringChanges++
+	log.Printf("hash rebuilt: %s", proxy.cfg.HashAlgorithm)
+	return nil
+}
+
+// 添加服务器并尝试连接；连接失败时仍然添加，之后重连
+func (proxy *cacheProxy) addNode(spec config.BackendSpec) error {
+	proxy.mutex.Lock()
+	if _, ok := proxy.servers[spec.Name]; ok {
+		proxy.mutex.Unlock()
+		return errNodeExists
+	}
+	b := &backend{name: spec.Name, addr: spec.Addr, weight: spec.Weight}
+	proxy.servers[spec.Name] = b
+	proxy.mutex.Unlock()
+	log.Printf("svr %s(%s) added, weight %d", b.name, b.addr, b.weight)
+
+	proxy.connect(b)
+	return nil
+}
+
+// 移除服务器，原来分配给它的key由其他服务器接管
+func (proxy *cacheProxy) delNode(name string) error {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+
+	b, ok := proxy.servers[name]
+	if !ok {
+		return errUnknownNode
+	}
+	if b.up {
+		proxy.hashmap.RemoveNode(b.name)
+		proxy.ringChanges++
+	}
+	b.up = false
+	b.closeConns()
+	delete(proxy.servers, name)
+	delete(proxy.backendStats, name)
+	log.Printf("svr %s(%s) removed", b.name, b.addr)
+	return nil
+}
+
+// 修改服务器的地址或权重：只有权重改变时重新加入一致性哈希，地址改变时断开原连接后重连
+func (proxy *cacheProxy) updateNode(spec config.BackendSpec) {
+	proxy.mutex.Lock()
+	b, ok := proxy.servers[spec.Name]
+	if !ok {
+		proxy.mutex.Unlock()
+		proxy.addNode(spec)
+		return
+	}
+	if b.addr == spec.Addr && b.weight == spec.Weight {
+		proxy.mutex.Unlock()
+		return
+	}
+	if b.addr == spec.Addr {
+		b.weight = spec.Weight
+		if b.up {
+			proxy.hashmap.RemoveNode(b.name)
+			proxy.hashmap.AddNodeWeight(b.name, b.weight)
+			proxy.ringChanges++
+		}
+		proxy.mutex.Unlock()
+		log.Printf("svr %s(%s) weight changed to %d", b.name, b.addr, b.weight)
+		return
+	}
+	proxy.eject(b, "address changed")
+	b.addr, b.weight = spec.Addr, spec.Weight
+	proxy.mutex.Unlock()
+	log.Printf("svr %s changed to %s, weight %d", b.name, b.addr, b.weight)
+
+	proxy.connect(b)
+}
+
+// 检查新添加或地址改变的服务器，通过后直接加入一致性哈希；失败时由健康检查重连
+func (proxy *cacheProxy) connect(b *backend) {
+	proxy.mutex.Lock()
+	addr, timeout := b.addr, proxy.health.timeout
+	proxy.mutex.Unlock()
+
+	conn, err := proxy.dialServer(addr)
+	if err == nil {
+		if err = ping(conn, timeout); err != nil {
+			conn.Close()
+		}
+	}
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	if err != nil {
+		if !b.failed {
+			log.Printf("svr %s(%s) connect failed: %v", b.name, addr, err)
+		}
+		b.failed = true
+		return
+	}
+	b.failed = false
+	// 连接期间服务器被移除、地址被修改或已由其他协程连上
+	if proxy.servers[b.name] != b || b.addr != addr || b.up {
+		conn.Close()
+		return
+	}
+	if b.check != nil {
+		b.check.Close()
+	}
+	b.check = conn
+	proxy.join(b, "connected")
+}
+
+/*
+ * 按配置中的服务器列表更新：只应用与上一次配置的差异，
+ * 通过PROXY命令在运行时添加、移除或切换的服务器，在配置中对应的项没有变化时保持不变
+ */
+func (proxy *cacheProxy) applyBackends(specs []config.BackendSpec) {
+	wanted := make(map[string]config.BackendSpec)
+	for _, spec := range specs {
+		wanted[spec.Name] = spec
+	}
+	for name := range proxy.configured {
+		if _, ok := wanted[name]; !ok {
+			proxy.delNode(name)
+		}
+	}
+	for _, spec := range specs {
+		if old, ok := proxy.configured[spec.Name]; !ok || old != spec {
+			proxy.updateNode(spec)
+		}
+	}
+	proxy.configured = wanted
+}
+
+// 服务器的状态，用于PROXY NODES、INFO与指标
+type nodeInfo struct {
+	name      string
+	addr      string
+	weight    int
+	up        bool
+	ejections uint64
+	checkErrs uint64
+}
+
+// 全部服务器，按名字排序；调用方持有mutex
+func (proxy *cacheProxy) nodes() []nodeInfo {
+	list := make([]nodeInfo, 0, len(proxy.servers))
+	for _, b := range proxy.servers {
+		n := nodeInfo{name: b.name, addr: b.addr, weight: b.weight, up: b.up}
+		if stats, ok := proxy.backendStats[b.name]; ok {
+			n.ejections, n.checkErrs = stats.ejections, stats.checkErrs
+		}
+		list = append(list, n)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// 名字对应的服务器地址，不存在时返回空串；调用方持有mutex
+func (proxy *cacheProxy) addrOf(name string) string {
+	if b, ok := proxy.servers[name]; ok {
+		return b.addr
+	}
+	return ""
+}
+
+func (n nodeInfo) status() string {
+	if n.up {
+		return "up"
+	}
+	return "down"
+}
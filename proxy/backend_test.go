@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 配置中带名字与权重的服务器
+func TestLoadBackends(t *testing.T) {
+	a, b, c := newFakeBackend(t, kvHandler), newFakeBackend(t, kvHandler), newFakeBackend(t, kvHandler)
+	proxy := newTestProxy(t, "-backends", fmt.Sprintf("a=%s 2, %s ,c=%s", a.addr, b.addr, c.addr))
+	proxy.testClient(t).expect("PROXY NODES", fmt.Sprintf("*3\n%[2]s\nname=a,addr=%[1]s,weight=2,status=up\nname=c,addr=%[3]s,weight=1,status=up",
+		a.addr, fmt.Sprintf("name=%s,addr=%s,weight=1,status=up", b.addr, b.addr), c.addr))
+
+	// 分到的key与权重成正比
+	counts := make(map[string]int)
+	const n = 4000
+	for i := 0; i < n; i++ {
+		counts[proxy.routeName(fmt.Sprintf("key%d", i))]++
+	}
+	if frac := float64(counts["a"]) / n; frac < 0.4 || frac > 0.6 {
+		t.Errorf("node with weight 2 got %.2f of keys, want about 0.5", frac)
+	}
+	for _, name := range []string{b.addr, "c"} {
+		if frac := float64(counts[name]) / n; frac < 0.15 || frac > 0.35 {
+			t.Errorf("%s got %.2f of keys, want about 0.25", name, frac)
+		}
+	}
+	// 没有名字的服务器以地址为名字
+	c0 := proxy.testClient(t)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%d", i)
+		c0.expect("SET "+key+":"+key, "DONE")
+	}
+	for _, fb := range []struct {
+		name string
+		b    *fakeBackend
+	}{{"a", a}, {b.addr, b}, {"c", c}} {
+		for key := range sets(fb.b) {
+			if got := proxy.routeName(key); got != fb.name {
+				t.Errorf("%s sent to %s, routed to %s", key, fb.name, got)
+			}
+		}
+	}
+}
+
+// 由一致性哈希选出的服务器
+func (proxy *cacheProxy) routeName(key string) string {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	name, _, _ := proxy.route(key)
+	return name
+}
+
+// 收到的某种命令中的key
+func keysOf(b *fakeBackend, cmd string) map[string]bool {
+	keys := make(map[string]bool)
+	for _, c := range b.connections() {
+		for _, line := range c.received() {
+			if arg, ok := strings.CutPrefix(line, cmd+" "); ok {
+				key, _, _ := strings.Cut(arg, ":")
+				keys[key] = true
+			}
+		}
+	}
+	return keys
+}
+
+func gets(b *fakeBackend) map[string]bool { return keysOf(b, "GET") }
+func sets(b *fakeBackend) map[string]bool { return keysOf(b, "SET") }
+
+// ADDNODE之后一部分key改由新服务器处理，DELNODE之后回到原来的服务器；加权的服务器分到更多key
+func TestAddDelNode(t *testing.T) {
+	const n = 400
+	a, b := newFakeBackend(t, kvHandler), newFakeBackend(t, kvHandler)
+	proxy := newTestProxy(t, "-backends", "a="+a.addr)
+	c := proxy.testClient(t)
+	for i := 0; i < n; i++ {
+		c.expect(fmt.Sprintf("SET key%d:%d", i, i), "DONE")
+	}
+
+	c.expect("PROXY ADDNODE b "+b.addr+" 3", "DONE")
+	c.expect("PROXY ADDNODE b "+b.addr, "node already exists")
+	c.expect("PROXY NODES", fmt.Sprintf("*2\nname=a,addr=%s,weight=1,status=up\nname=b,addr=%s,weight=3,status=up", a.addr, b.addr))
+
+	moved := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%d", i)
+		switch proxy.routeName(key) {
+		case "b":
+			moved[key] = true
+			// 新服务器上没有迁移过来的数据
+			c.expect("GET "+key, "key is not exits")
+		case "a":
+			c.expect("GET "+key, fmt.Sprint(i))
+		default:
+			t.Fatalf("%s routed to %q", key, proxy.routeName(key))
+		}
+	}
+	// 权重为3的服务器约分到3/4的key
+	if frac := float64(len(moved)) / n; frac < 0.6 || frac > 0.9 {
+		t.Errorf("%.2f of keys moved to the node with weight 3, want about 0.75", frac)
+	}
+	got := gets(b)
+	if len(got) != len(moved) {
+		t.Errorf("new node received %d GETs, want %d", len(got), len(moved))
+	}
+	for key := range got {
+		if !moved[key] {
+			t.Errorf("new node received GET %s routed to a", key)
+		}
+	}
+
+	c.expect("PROXY DELNODE b", "DONE")
+	c.expect("PROXY DELNODE b", "unknown node")
+	c.expect("PROXY NODES", fmt.Sprintf("*1\nname=a,addr=%s,weight=1,status=up", a.addr))
+	for i := 0; i < n; i++ {
+		c.expect(fmt.Sprintf("GET key%d", i), fmt.Sprint(i))
+	}
+	if len(gets(b)) != len(moved) {
+		t.Error("removed node still received commands")
+	}
+	waitFor(t, "connections to the removed node to close", func() bool {
+		for _, conn := range b.connections() {
+			if !conn.isClosed() {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// down为true时PING回复错误
+func healthHandler(down *atomic.Bool) func(c *fakeConn, line string) {
+	return func(c *fakeConn, line string) {
+		if line == "PING" && down.Load() {
+			c.reply("LOADING")
+			return
+		}
+		kvHandler(c, line)
+	}
+}
+
+// 服务器状态的快照
+func (proxy *cacheProxy) backendState(name string) backend {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	return *proxy.servers[name]
+}
+
+// 收到的PING数
+func pings(b *fakeBackend) int {
+	n := 0
+	for _, c := range b.connections() {
+		for _, line := range c.received() {
+			if line == "PING" {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+/*
+ * 连续失败health-fall次后摘除，key改由其他服务器处理；摘除后按加倍的间隔重连，
+ * 未到时间不检查，间隔不超过reconnect-max-backoff；恢复后连续通过health-rise次才重新加入
+ */
+func TestHealthCheck(t *testing.T) {
+	const interval, maxBackoff = 50 * time.Millisecond, 200 * time.Millisecond
+	var down atomic.Bool
+	a, b := newFakeBackend(t, healthHandler(&down)), newFakeBackend(t, kvHandler)
+	proxy := newTestProxy(t, "-backends", "a="+a.addr+",b="+b.addr,
+		"-health-interval", "50ms", "-health-fall", "2", "-health-rise", "2", "-reconnect-max-backoff", "200ms")
+	var keyA string
+	for i := 0; keyA == ""; i++ {
+		if key := fmt.Sprintf("key%d", i); proxy.routeName(key) == "a" {
+			keyA = key
+		}
+	}
+	proxy.checkAll()
+	if s := proxy.backendState("a"); !s.up || s.fails != 0 {
+		t.Fatalf("healthy node: up=%v fails=%d", s.up, s.fails)
+	}
+
+	down.Store(true)
+	proxy.checkAll()
+	if s := proxy.backendState("a"); !s.up || s.fails != 1 {
+		t.Fatalf("after 1 failure: up=%v fails=%d, want up with 1 failure", s.up, s.fails)
+	}
+	proxy.checkAll()
+	s := proxy.backendState("a")
+	if s.up || s.backoff != interval {
+		t.Fatalf("after 2 failures: up=%v backoff=%v, want down with backoff %v", s.up, s.backoff, interval)
+	}
+	if got := proxy.routeName(keyA); got != "b" {
+		t.Errorf("%s routed to %q after ejection, want b", keyA, got)
+	}
+	proxy.testClient(t).expect("PROXY NODES", fmt.Sprintf("*2\nname=a,addr=%s,weight=1,status=down\nname=b,addr=%s,weight=1,status=up", a.addr, b.addr))
+
+	// 未到重连时间的服务器不检查
+	before := pings(a)
+	proxy.checkAll()
+	if pings(a) != before {
+		t.Error("ejected node checked before its backoff expired")
+	}
+
+	for _, want := range []time.Duration{2 * interval, 4 * interval, maxBackoff} {
+		time.Sleep(time.Until(proxy.backendState("a").retryAt))
+		proxy.checkAll()
+		s := proxy.backendState("a")
+		if s.up || s.backoff != want {
+			t.Errorf("reconnect failed: up=%v backoff=%v, want down with backoff %v", s.up, s.backoff, want)
+		}
+	}
+
+	down.Store(false)
+	time.Sleep(time.Until(proxy.backendState("a").retryAt))
+	proxy.checkAll()
+	if s := proxy.backendState("a"); s.up || s.passes != 1 {
+		t.Fatalf("after 1 pass: up=%v passes=%d, want down with 1 pass", s.up, s.passes)
+	}
+	// 通过检查后不再等待退避间隔
+	proxy.checkAll()
+	if s := proxy.backendState("a"); !s.up || s.backoff != 0 {
+		t.Fatalf("after 2 passes: up=%v backoff=%v, want up", s.up, s.backoff)
+	}
+	if got := proxy.routeName(keyA); got != "a" {
+		t.Errorf("%s routed to %q after rejoining, want a", keyA, got)
+	}
+	c := proxy.testClient(t)
+	c.expect("SET "+keyA+":1", "DONE")
+	if !sets(a)[keyA] {
+		t.Errorf("%s not forwarded to the rejoined node", keyA)
+	}
+	proxy.mutex.Lock()
+	ejections := proxy.stats("a").ejections
+	proxy.mutex.Unlock()
+	if ejections != 1 {
+		t.Errorf("ejections=%d, want 1", ejections)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+	"tinycached/config"
+	"tinycached/server/acl"
+	"tinycached/utils"
+)
+
+/*
+ * 由代理自己执行的PROXY命令：
+ * PROXY AUTH 密码	以admin-password获得执行其他PROXY命令的权限
+ * PROXY SWITCH 旧地址 新地址	将服务器换成新地址，服务器在一致性哈希上的位置不变，由哨兵在故障转移后发送
+ * PROXY ADDNODE 名字 地址 [权重]	添加服务器，权重默认为1
+ * PROXY DELNODE 名字	移除服务器
+ * PROXY NODES	列出全部服务器
+ * 运行时添加、移除的服务器不写回配置文件，重新加载配置时只应用配置文件中改变的项
+ */
+func (proxy *cacheProxy) execProxyCmd(clt *clientConn, body string) []byte {
+	elem := strings.Fields(body)
+	if len(elem) == 0 {
+		return []byte("wrong command")
+	}
+	if strings.EqualFold(elem[0], "AUTH") && len(elem) == 2 {
+		if err := proxy.adminAuth(clt, elem[1]); err != nil {
+			return []byte(err.Error())
+		}
+		return []byte("DONE")
+	}
+	if err := proxy.checkAdmin(clt); err != nil {
+		return []byte(err.Error())
+	}
+	switch {
+	case strings.EqualFold(elem[0], "SWITCH") && len(elem) == 3:
+		if err := proxy.switchServer(elem[1], elem[2]); err != nil {
+			return []byte(err.Error())
+		}
+		return []byte("DONE")
+
+	case strings.EqualFold(elem[0], "ADDNODE") && (len(elem) == 3 || len(elem) == 4):
+		item := elem[1] + "=" + strings.Join(elem[2:], " ")
+		spec, err := config.ParseBackend(item)
+		if err != nil {
+			return []byte(err.Error())
+		}
+		if err := proxy.addNode(spec); err != nil {
+			return []byte(err.Error())
+		}
+		return []byte("DONE")
+
+	case strings.EqualFold(elem[0], "DELNODE") && len(elem) == 2:
+		if err := proxy.delNode(elem[1]); err != nil {
+			return []byte(err.Error())
+		}
+		return []byte("DONE")
+
+	case strings.EqualFold(elem[0], "NODES") && len(elem) == 1:
+		return proxy.nodesReply()
+	}
+	return []byte("wrong command")
+}
+
+// PROXY AUTH：密码与admin-password相同时，该客户端之后可以执行PROXY命令
+func (proxy *cacheProxy) adminAuth(clt *clientConn, pass string) error {
+	if proxy.cfg.AdminPassword == "" {
+		return errors.New("admin-password is not set")
+	}
+	if subtle.ConstantTimeCompare([]byte(pass), []byte(proxy.cfg.AdminPassword)) != 1 {
+		clt.admin = false
+		return errors.New("WRONGPASS invalid admin password")
+	}
+	clt.admin = true
+	return nil
+}
+
+/*
+ * PROXY命令修改集群成员，须经过认证：
+ * 1. 设置了admin-password时，客户端须先执行PROXY AUTH
+ * 2. 代理以自己的身份登录服务器时，还须由有admin权限的用户执行：
+ *    新建一条到服务器的连接，以客户端的身份执行INFO server，由服务器检查权限
+ * 两者都未设置时只接受本机客户端（回环地址与Unix socket）的PROXY命令
+ */
+func (proxy *cacheProxy) checkAdmin(clt *clientConn) error {
+	if proxy.cfg.AdminPassword != "" && !clt.admin {
+		return errors.New("NOAUTH PROXY AUTH required")
+	}
+	if !proxy.cfg.BackendAuth() {
+		if proxy.cfg.AdminPassword == "" && !isLocal(clt.RemoteAddr()) {
+			return errors.New("NOPERM PROXY commands from remote clients require admin-password or backend-password")
+		}
+		return nil
+	}
+	if clt.user == acl.Unauthenticated {
+		return errors.New("NOAUTH Authentication required.")
+	}
+	proxy.mutex.Lock()
+	addr := proxy.addrOf(proxy.hashmap.FindNode(clt.user))
+	proxy.mutex.Unlock()
+	if addr == "" {
+		return errors.New("EMPTY KEY: Cannot find server")
+	}
+
+	conn, err := proxy.dialServer(addr)
+	if err != nil {
+		return errors.New("Server cannot reach")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(proxy.cfg.ConnectTimeout))
+	line := utils.ASUSER.String() + " " + clt.user + " " + utils.INFO.String() + " server\n"
+	if err := utils.WriteAll(conn, []byte(line)); err != nil {
+		return errors.New("Server cannot reach")
+	}
+	reply, err := utils.ReadReply(bufio.NewReader(conn).ReadByte)
+	if err != nil {
+		return errors.New("Server cannot reach")
+	}
+	if reply := strings.TrimSuffix(string(reply), "\n"); strings.HasPrefix(reply, "NOPERM") {
+		return errors.New(reply)
+	}
+	return nil
+}
+
+// 是否是本机客户端：回环地址或Unix socket
+func isLocal(addr net.Addr) bool {
+	switch addr := addr.(type) {
+	case *net.UnixAddr:
+		return true
+	case *net.TCPAddr:
+		return addr.IP.IsLoopback()
+	}
+	return false
+}
+
+/*
+ * 将地址为oldAddr的服务器换成newAddr：连接新地址，服务器的名字不变，仍在一致性哈希上原来的位置，
+ * 原来落在旧地址上的key都转发给新地址，再断开与旧地址的连接。
+ * 旧地址因掉线未连接时同样生效；已经换成新地址时直接返回，哨兵重复通知不影响
+ */
+func (proxy *cacheProxy) switchServer(oldAddr string, newAddr string) error {
+	proxy.mutex.Lock()
+	b, done := proxy.findAddr(newAddr), false
+	if b != nil {
+		done = true
+	} else {
+		b = proxy.findAddr(oldAddr)
+	}
+	proxy.mutex.Unlock()
+	if done {
+		return nil
+	}
+	if b == nil {
+		return errors.New("unknown server " + oldAddr)
+	}
+
+	conn, err := proxy.dialServer(newAddr)
+	if err != nil {
+		log.Printf("svr %s connect failed", newAddr)
+		return errors.New("Server cannot reach")
+	}
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	if proxy.servers[b.name] != b || b.addr != oldAddr {
+		conn.Close()
+		return errors.New("unknown server " + oldAddr)
+	}
+	// 名字不变，已在一致性哈希上时只替换连接池
+	b.closeConns()
+	b.addr, b.check = newAddr, conn
+	if b.up {
+		b.pool, b.fails = proxy.newPool(newAddr), 0
+	} else {
+		proxy.join(b, "switched")
+	}
+	log.Printf("svr %s switched from %s to %s", b.name, oldAddr, newAddr)
+	return nil
+}
+
+// 地址为addr的服务器，不存在时返回nil；调用方持有mutex
+func (proxy *cacheProxy) findAddr(addr string) *backend {
+	for _, b := range proxy.servers {
+		if b.addr == addr {
+			return b
+		}
+	}
+	return nil
+}
+
+// PROXY NODES的回复：每个服务器一行
+func (proxy *cacheProxy) nodesReply() []byte {
+	proxy.mutex.Lock()
+	nodes := proxy.nodes()
+	proxy.mutex.Unlock()
+
+	lines := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		lines = append(lines, fmt.Sprintf("name=%s,addr=%s,weight=%d,status=%s", n.name, n.addr, n.weight, n.status()))
+	}
+	return utils.MultiLine(lines)
+}
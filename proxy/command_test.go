@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+var remoteAddr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+
+// 未设置admin-password与backend-password时只接受本机客户端的PROXY命令
+func TestProxyAdminLocalOnly(t *testing.T) {
+	b := newFakeBackend(t, kvHandler)
+	proxy := newTestProxy(t, "-backends", "a="+b.addr)
+
+	nodes := fmt.Sprintf("*1\nname=a,addr=%s,weight=1,status=up", b.addr)
+	proxy.testClient(t).expect("PROXY NODES", nodes)
+	unix := proxy.testClientFrom(t, &net.UnixAddr{Name: "/tmp/proxy.sock", Net: "unix"})
+	unix.expect("PROXY NODES", nodes)
+
+	remote := proxy.testClientFrom(t, remoteAddr)
+	for _, cmd := range []string{"PROXY NODES", "PROXY ADDNODE b 127.0.0.1:1", "PROXY DELNODE a", "PROXY SWITCH " + b.addr + " 127.0.0.1:1"} {
+		if got := remote.do(cmd); !strings.HasPrefix(got, "NOPERM") {
+			t.Errorf("%s from a remote client: got %q, want NOPERM", cmd, got)
+		}
+	}
+	if got := remote.do("PROXY AUTH secret"); got != "admin-password is not set" {
+		t.Errorf("PROXY AUTH without admin-password: got %q", got)
+	}
+	proxy.testClient(t).expect("PROXY NODES", nodes)
+}
+
+// 设置了admin-password时，本机与远程客户端都须先执行PROXY AUTH
+func TestProxyAdminPassword(t *testing.T) {
+	b := newFakeBackend(t, kvHandler)
+	proxy := newTestProxy(t, "-backends", "a="+b.addr, "-admin-password", "secret")
+	nodes := fmt.Sprintf("*1\nname=a,addr=%s,weight=1,status=up", b.addr)
+
+	for name, c := range map[string]*testClient{"local": proxy.testClient(t), "remote": proxy.testClientFrom(t, remoteAddr)} {
+		c.expect("PROXY NODES", "NOAUTH PROXY AUTH required")
+		c.expect("PROXY AUTH wrong", "WRONGPASS invalid admin password")
+		c.expect("PROXY DELNODE a", "NOAUTH PROXY AUTH required")
+		c.expect("PROXY AUTH secret", "DONE")
+		if got := c.do("PROXY NODES"); got != nodes {
+			t.Errorf("%s: PROXY NODES after AUTH: got %q, want %q", name, got, nodes)
+		}
+		// 认证只对该连接有效，密码错误时撤销
+		c.expect("PROXY AUTH wrong", "WRONGPASS invalid admin password")
+		c.expect("PROXY NODES", "NOAUTH PROXY AUTH required")
+	}
+	// 普通命令不受admin-password影响
+	proxy.testClientFrom(t, remoteAddr).expect("SET k:v", "DONE")
+}
@@ -1,18 +1,20 @@
 package consistenthash
 
 import (
-	"hash/crc32"
 	"sort"
 	"strconv"
 )
 
 type HashFunc func([]byte) uint32
 
+// 哈希环：每个节点在环上有replicas*权重个虚拟节点，key落到顺时针方向的第一个虚拟节点
 type Map struct {
 	hash     HashFunc
-	replicas int            //虚拟节点倍数
-	keys     []int          // 哈希环
-	hashmap  map[int]string //虚拟节点与真实节点的映射表：key为虚拟节点哈希值，value为对应的真实节点名称
+	replicas int               //虚拟节点倍数
+	keys     []int             // 哈希环
+	hashmap  map[int]string    //虚拟节点与真实节点的映射表：key为虚拟节点哈希值，value为对应的真实节点名称
+	labels   map[string]string // 真实节点计算虚拟节点哈希值时使用的名称，节点被替换后仍沿用原名称
+	weights  map[string]int    // 各名称的权重，虚拟节点数为replicas*权重
 }
 
 func NewConsistentHash(replicas int, hash HashFunc) (c *Map) {
@@ -20,33 +22,42 @@ func NewConsistentHash(replicas int, hash HashFunc) (c *Map) {
 		hash:     hash,
 		replicas: replicas,
 		hashmap:  make(map[int]string),
+		labels:   make(map[string]string),
+		weights:  make(map[string]int),
 	}
 	if hash == nil {
-		c.hash = crc32.ChecksumIEEE
+		c.hash = hash32
 	}
 	return c
 }
 
 // 添加节点到一致性哈希上
 func (c *Map) AddNode(key string) {
-	if key == "" {
+	c.AddNodeWeight(key, 1)
+}
+
+// 按权重添加节点，权重为n的节点有n倍的虚拟节点，分到约n倍的key；节点已在环上时不做任何事
+func (c *Map) AddNodeWeight(key string, weight int) {
+	if key == "" || weight < 1 || c.onRing(key) {
 		return
 	}
 
-	for i := 0; i < c.replicas; i++ {
-		// 对每一个真实节点 key，对应创建 replicas个虚拟节点
+	for i := 0; i < c.replicas*weight; i++ {
+		// 对每一个真实节点 key，对应创建 replicas*weight个虚拟节点
 		// 虚拟节点的名称是：strconv.Itoa(i) + key，通过添加编号的方式区分不同虚拟节点
 		hashVal := int(c.hash([]byte(strconv.Itoa(i) + key)))
 		c.keys = append(c.keys, hashVal)
 		c.hashmap[hashVal] = key
 	}
+	c.labels[key] = key
+	c.weights[key] = weight
 	// 环上哈希值排序
 	sort.Ints(c.keys)
 }
 
 // 获取节点
 func (c *Map) FindNode(key string) string {
-	if key == "" {
+	if key == "" || len(c.keys) == 0 {
 		return ""
 	}
 
@@ -57,16 +68,49 @@ func (c *Map) FindNode(key string) string {
 	return c.hashmap[c.keys[idx%len(c.keys)]]
 }
 
-// 移除一致性哈希上的节点
+// 移除一致性哈希上的节点；之后仍记住其虚拟节点的位置，供ReplaceNode使用
 func (c *Map) RemoveNode(key string) {
-	if key == "" {
+	if !c.onRing(key) {
 		return
 	}
 
-	for i := 0; i < c.replicas; i++ {
-		hashVal := int(c.hash([]byte(strconv.Itoa(i) + key)))
+	label := c.labels[key]
+	for i := 0; i < c.replicas*c.weights[label]; i++ {
+		hashVal := int(c.hash([]byte(strconv.Itoa(i) + label)))
 		idx := sort.SearchInts(c.keys, hashVal)
 		c.keys = append(c.keys[:idx], c.keys[idx+1:]...)
 		delete(c.hashmap, hashVal)
 	}
 }
+
+// 用新节点替换旧节点：新节点沿用旧节点的虚拟节点位置，原来落在旧节点上的key都落在新节点上；
+// 旧节点已被移除时重新加入这些位置。用于主服务器故障转移后更换地址
+func (c *Map) ReplaceNode(oldKey string, newKey string) bool {
+	label, ok := c.labels[oldKey]
+	if !ok || newKey == "" || newKey == oldKey || c.onRing(newKey) {
+		return false
+	}
+	removed := !c.onRing(oldKey)
+	for i := 0; i < c.replicas*c.weights[label]; i++ {
+		hashVal := int(c.hash([]byte(strconv.Itoa(i) + label)))
+		c.hashmap[hashVal] = newKey
+		if removed {
+			c.keys = append(c.keys, hashVal)
+		}
+	}
+	if removed {
+		sort.Ints(c.keys)
+	}
+	delete(c.labels, oldKey)
+	c.labels[newKey] = label
+	return true
+}
+
+// 节点是否在环上
+func (c *Map) onRing(key string) bool {
+	label, ok := c.labels[key]
+	if !ok || c.replicas == 0 {
+		return false
+	}
+	return c.hashmap[int(c.hash([]byte("0"+label)))] == key
+}
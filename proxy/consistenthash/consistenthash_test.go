@@ -0,0 +1,261 @@
+package consistenthash
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"testing"
+)
+
+const (
+	testNodes    = 10
+	testKeys     = 100000
+	testReplicas = 160
+)
+
+type testNode struct {
+	name   string
+	weight int
+}
+
+func testCluster(weights ...int) []testNode {
+	list := make([]testNode, testNodes)
+	for i := range list {
+		w := 1
+		if len(weights) > 0 {
+			w = weights[i%len(weights)]
+		}
+		list[i] = testNode{name: fmt.Sprintf("10.0.0.%d:7000", i+1), weight: w}
+	}
+	return list
+}
+
+func build(t *testing.T, algorithm string, list []testNode) Hash {
+	t.Helper()
+	h, err := New(algorithm, testReplicas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range list {
+		h.AddNodeWeight(n.name, n.weight)
+	}
+	return h
+}
+
+func assign(h Hash) []string {
+	owners := make([]string, testKeys)
+	for i := range owners {
+		owners[i] = h.FindNode("key:" + strconv.Itoa(i))
+	}
+	return owners
+}
+
+// 各节点key数除以按权重应得的份额后的变异系数，与最多的节点与应得份额之比
+func spread(list []testNode, owners []string) (cv, max float64) {
+	counts := make(map[string]int)
+	for _, o := range owners {
+		counts[o]++
+	}
+	total := 0
+	for _, n := range list {
+		total += n.weight
+	}
+	variance := 0.0
+	for _, n := range list {
+		load := float64(counts[n.name]) / (float64(len(owners)) * float64(n.weight) / float64(total))
+		variance += (load - 1) * (load - 1)
+		max = math.Max(max, load)
+	}
+	return math.Sqrt(variance / float64(len(list))), max
+}
+
+// 各算法分布的上限：ring的均匀程度取决于虚拟节点数，其余算法接近理想
+func spreadLimit(algorithm string) (cv, max float64) {
+	if algorithm == Ring {
+		return 0.15, 1.35
+	}
+	return 0.05, 1.1
+}
+
+func TestNew(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		if _, err := New(algorithm, testReplicas); err != nil {
+			t.Errorf("New(%q): %v", algorithm, err)
+		}
+	}
+	if _, err := New("modulo", testReplicas); err == nil {
+		t.Error("New with unknown algorithm should fail")
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		h := build(t, algorithm, nil)
+		if got := h.FindNode("a"); got != "" {
+			t.Errorf("%s: FindNode without nodes = %q, want empty", algorithm, got)
+		}
+		h.AddNodeWeight("n1", 1)
+		if got := h.FindNode(""); got != "" {
+			t.Errorf("%s: FindNode(\"\") = %q, want empty", algorithm, got)
+		}
+		if got := h.FindNode("a"); got != "n1" {
+			t.Errorf("%s: FindNode with one node = %q, want n1", algorithm, got)
+		}
+		h.RemoveNode("n1")
+		if got := h.FindNode("a"); got != "" {
+			t.Errorf("%s: FindNode after removing the last node = %q, want empty", algorithm, got)
+		}
+	}
+}
+
+func TestAddExisting(t *testing.T) {
+	list := testCluster()
+	for _, algorithm := range Algorithms {
+		h := build(t, algorithm, list)
+		before := assign(h)
+		// 重复添加，即使权重不同也不做任何事
+		h.AddNodeWeight(list[0].name, 5)
+		if n := countMoved(before, assign(h)); n != 0 {
+			t.Errorf("%s: adding an existing node moved %d keys", algorithm, n)
+		}
+	}
+}
+
+func TestSpread(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		cvLimit, maxLimit := spreadLimit(algorithm)
+		list := testCluster()
+		cv, max := spread(list, assign(build(t, algorithm, list)))
+		if cv > cvLimit || max > maxLimit {
+			t.Errorf("%s: cv %.4f max %.4f, want at most %.2f and %.2f", algorithm, cv, max, cvLimit, maxLimit)
+		}
+	}
+}
+
+func TestWeights(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		cvLimit, maxLimit := spreadLimit(algorithm)
+		list := testCluster(1, 2, 3)
+		cv, max := spread(list, assign(build(t, algorithm, list)))
+		if cv > cvLimit || max > maxLimit {
+			t.Errorf("%s: weighted cv %.4f max %.4f, want at most %.2f and %.2f", algorithm, cv, max, cvLimit, maxLimit)
+		}
+	}
+}
+
+func countMoved(before, after []string) int {
+	n := 0
+	for i := range before {
+		if before[i] != after[i] {
+			n++
+		}
+	}
+	return n
+}
+
+// 添加节点时移动的比例接近新节点的权重占总权重的比例；除maglev外移动的key都移到新节点上，
+// maglev重建查找表时少量槽位在原有节点间变化
+func TestAddNode(t *testing.T) {
+	for _, weight := range []int{1, 3} {
+		for _, algorithm := range Algorithms {
+			list := testCluster()
+			h := build(t, algorithm, list)
+			before := assign(h)
+			added := testNode{name: "10.0.0.100:7000", weight: weight}
+			h.AddNodeWeight(added.name, added.weight)
+			after := assign(h)
+
+			for i := range before {
+				if algorithm != Maglev && before[i] != after[i] && after[i] != added.name {
+					t.Fatalf("%s: key:%d moved from %s to %s instead of the new node", algorithm, i, before[i], after[i])
+				}
+			}
+			ideal := float64(weight) / float64(len(list)+weight)
+			moved := float64(countMoved(before, after)) / testKeys
+			if moved < ideal*0.7 || moved > ideal*1.3 {
+				t.Errorf("%s: adding a node of weight %d moved %.4f of keys, ideal %.4f", algorithm, weight, moved, ideal)
+			}
+		}
+	}
+}
+
+// 移除节点时该节点的key全部移走；ring与rendezvous只移动这些key，
+// maglev重建查找表时少量其他槽位也会变化，jump用末尾的桶填补空位，移动约为两倍
+func TestRemoveNode(t *testing.T) {
+	limits := map[string]float64{Ring: 1.0, Rendezvous: 1.0, Maglev: 1.2, Jump: 2.2}
+	for _, weight := range []int{1, 3} {
+		for _, algorithm := range Algorithms {
+			list := testCluster()
+			removed := &list[len(list)/2]
+			removed.weight = weight
+			h := build(t, algorithm, list)
+			before := assign(h)
+			h.RemoveNode(removed.name)
+			after := assign(h)
+
+			owned := 0
+			for i := range before {
+				if after[i] == removed.name {
+					t.Fatalf("%s: key:%d still on the removed node", algorithm, i)
+				}
+				if before[i] == removed.name {
+					owned++
+				}
+			}
+			moved := countMoved(before, after)
+			if limit := int(float64(owned) * limits[algorithm]); moved > limit {
+				t.Errorf("%s: removing a node of weight %d owning %d keys moved %d, want at most %d",
+					algorithm, weight, owned, moved, limit)
+			}
+		}
+	}
+}
+
+// 移除后再添加同一节点，ring、rendezvous与maglev恢复原来的分配
+func TestRemoveAndReadd(t *testing.T) {
+	for _, algorithm := range []string{Ring, Rendezvous, Maglev} {
+		list := testCluster(1, 2)
+		h := build(t, algorithm, list)
+		before := assign(h)
+		h.RemoveNode(list[3].name)
+		h.AddNodeWeight(list[3].name, list[3].weight)
+		if n := countMoved(before, assign(h)); n != 0 {
+			t.Errorf("%s: %d keys changed after removing and re-adding a node", algorithm, n)
+		}
+	}
+}
+
+func TestReplaceNode(t *testing.T) {
+	c := NewConsistentHash(testReplicas, nil)
+	list := testCluster()
+	for _, n := range list {
+		c.AddNode(n.name)
+	}
+	before := assign(c)
+	old, repl := list[2].name, "10.0.1.3:7000"
+	if !c.ReplaceNode(old, repl) {
+		t.Fatal("ReplaceNode failed")
+	}
+	after := assign(c)
+	for i := range before {
+		want := before[i]
+		if want == old {
+			want = repl
+		}
+		if after[i] != want {
+			t.Fatalf("key:%d on %s after replace, want %s", i, after[i], want)
+		}
+	}
+	if c.ReplaceNode(old, "10.0.1.4:7000") {
+		t.Error("ReplaceNode of a node no longer on the ring should fail")
+	}
+
+	// 被移除的节点替换后，新节点重新占用原来的位置
+	c.RemoveNode(repl)
+	if !c.ReplaceNode(repl, old) {
+		t.Fatal("ReplaceNode of a removed node failed")
+	}
+	if n := countMoved(before, assign(c)); n != 0 {
+		t.Errorf("%d keys changed after replacing back a removed node", n)
+	}
+}
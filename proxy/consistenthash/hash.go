@@ -0,0 +1,60 @@
+package consistenthash
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// 按key选择节点的算法，节点用名字表示；权重为n的节点分到约n倍的key
+type Hash interface {
+	AddNodeWeight(node string, weight int) // 节点已存在时不做任何事
+	RemoveNode(node string)
+	FindNode(key string) string // key为空或没有节点时返回空串
+}
+
+// 可选的算法
+const (
+	Ring       = "ring"       // 哈希环，每单位权重replicas个虚拟节点
+	Jump       = "jump"       // jump consistent hash，每单位权重一个桶
+	Rendezvous = "rendezvous" // 最高随机权重（HRW）
+	Maglev     = "maglev"     // Maglev查找表
+)
+
+var Algorithms = []string{Ring, Jump, Rendezvous, Maglev}
+
+// 按名字创建算法，replicas只用于ring
+func New(algorithm string, replicas int) (Hash, error) {
+	switch algorithm {
+	case Ring:
+		return NewConsistentHash(replicas, nil), nil
+	case Jump:
+		return NewJump(), nil
+	case Rendezvous:
+		return NewRendezvous(), nil
+	case Maglev:
+		return NewMaglev(MaglevTableSize), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q: expected %s", algorithm, strings.Join(Algorithms, ", "))
+}
+
+// 默认的环上哈希；crc32是线性的，名称相近的虚拟节点在环上分布不均
+func hash32(b []byte) uint32 {
+	return uint32(hash64(string(b)) >> 32)
+}
+
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return mix64(h.Sum64())
+}
+
+// splitmix64的终结步骤，使相近的输入得到分散的输出
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,62 @@
+package consistenthash
+
+/*
+ * jump consistent hash：key映射到0~n-1号桶，桶数从n变为n+1时只有约1/(n+1)的key移到新桶。
+ * 权重为w的节点占w个桶，新节点的桶追加在末尾；移除节点时用末尾的桶填补空位，
+ * 因此除了被移除节点的key，末尾几个桶的key也会移动。桶的顺序与添加节点的顺序有关
+ */
+type JumpHash struct {
+	buckets []string // 桶号对应的节点名称
+	weights map[string]int
+}
+
+func NewJump() *JumpHash {
+	return &JumpHash{weights: make(map[string]int)}
+}
+
+func (j *JumpHash) AddNodeWeight(node string, weight int) {
+	if node == "" || weight < 1 {
+		return
+	}
+	if _, ok := j.weights[node]; ok {
+		return
+	}
+	for i := 0; i < weight; i++ {
+		j.buckets = append(j.buckets, node)
+	}
+	j.weights[node] = weight
+}
+
+func (j *JumpHash) RemoveNode(node string) {
+	if _, ok := j.weights[node]; !ok {
+		return
+	}
+	for i := 0; i < len(j.buckets); {
+		if j.buckets[i] != node {
+			i++
+			continue
+		}
+		last := len(j.buckets) - 1
+		j.buckets[i] = j.buckets[last]
+		j.buckets = j.buckets[:last]
+	}
+	delete(j.weights, node)
+}
+
+func (j *JumpHash) FindNode(key string) string {
+	if key == "" || len(j.buckets) == 0 {
+		return ""
+	}
+	return j.buckets[jump(hash64(key), len(j.buckets))]
+}
+
+// Lamping与Veach的jump consistent hash
+func jump(key uint64, n int) int {
+	var b, i int64 = -1, 0
+	for i < int64(n) {
+		b = i
+		key = key*2862933555777941757 + 1
+		i = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,90 @@
+package consistenthash
+
+import "sort"
+
+// Maglev查找表的默认大小，须为质数且远大于节点数
+const MaglevTableSize = 65537
+
+/*
+ * Maglev：每个节点按自己的偏移与步长生成一个槽位的排列，各节点轮流占用排列中下一个空槽，
+ * 直到填满查找表；权重为w的节点每轮占w个槽。查找只需一次取模，
+ * 增删节点后重建整张表，大部分槽位保持原来的节点
+ */
+type MaglevHash struct {
+	size    int
+	weights map[string]int
+	names   []string // 按名字排序，表中保存下标
+	table   []int32
+}
+
+func NewMaglev(size int) *MaglevHash {
+	return &MaglevHash{size: size, weights: make(map[string]int)}
+}
+
+func (m *MaglevHash) AddNodeWeight(node string, weight int) {
+	if node == "" || weight < 1 {
+		return
+	}
+	if _, ok := m.weights[node]; ok {
+		return
+	}
+	m.weights[node] = weight
+	m.populate()
+}
+
+func (m *MaglevHash) RemoveNode(node string) {
+	if _, ok := m.weights[node]; !ok {
+		return
+	}
+	delete(m.weights, node)
+	m.populate()
+}
+
+func (m *MaglevHash) FindNode(key string) string {
+	if key == "" || len(m.names) == 0 {
+		return ""
+	}
+	return m.names[m.table[hash64(key)%uint64(m.size)]]
+}
+
+// 重建查找表；节点按名字排序，结果与添加的顺序无关
+func (m *MaglevHash) populate() {
+	m.names = m.names[:0]
+	for name := range m.weights {
+		m.names = append(m.names, name)
+	}
+	sort.Strings(m.names)
+	if len(m.names) == 0 {
+		m.table = nil
+		return
+	}
+
+	size := uint64(m.size)
+	offsets := make([]uint64, len(m.names))
+	skips := make([]uint64, len(m.names))
+	next := make([]uint64, len(m.names))
+	for i, name := range m.names {
+		h := hash64(name)
+		offsets[i] = h % size
+		skips[i] = mix64(h)%(size-1) + 1
+	}
+	table := make([]int32, m.size)
+	for i := range table {
+		table[i] = -1
+	}
+	for filled := 0; filled < m.size; {
+		for i, name := range m.names {
+			for w := 0; w < m.weights[name] && filled < m.size; w++ {
+				slot := (offsets[i] + next[i]*skips[i]) % size
+				for table[slot] >= 0 {
+					next[i]++
+					slot = (offsets[i] + next[i]*skips[i]) % size
+				}
+				table[slot] = int32(i)
+				next[i]++
+				filled++
+			}
+		}
+	}
+	m.table = table
+}
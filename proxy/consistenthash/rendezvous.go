@@ -0,0 +1,61 @@
+package consistenthash
+
+import "math"
+
+/*
+ * 最高随机权重（HRW）：每个节点对key计算一个分数，分数最高的节点得到该key。
+ * 分数为-权重/ln(u)，u为节点与key的哈希在(0,1)上的值，节点分到的key与权重成正比；
+ * 增删节点时只有该节点的key移动。查找需要计算每个节点的分数，节点多时较慢
+ */
+type RendezvousHash struct {
+	nodes []hrwNode
+}
+
+type hrwNode struct {
+	name   string
+	seed   uint64 // 节点名称的哈希，与key的哈希组合出分数
+	weight float64
+}
+
+func NewRendezvous() *RendezvousHash {
+	return &RendezvousHash{}
+}
+
+func (r *RendezvousHash) AddNodeWeight(node string, weight int) {
+	if node == "" || weight < 1 || r.index(node) >= 0 {
+		return
+	}
+	r.nodes = append(r.nodes, hrwNode{name: node, seed: hash64(node), weight: float64(weight)})
+}
+
+func (r *RendezvousHash) RemoveNode(node string) {
+	if i := r.index(node); i >= 0 {
+		r.nodes = append(r.nodes[:i], r.nodes[i+1:]...)
+	}
+}
+
+func (r *RendezvousHash) FindNode(key string) string {
+	if key == "" || len(r.nodes) == 0 {
+		return ""
+	}
+	h := hash64(key)
+	best, bestScore := "", math.Inf(-1)
+	for _, n := range r.nodes {
+		// 取53位映射到(0,1)，ln(u)<0
+		u := (float64(mix64(h^n.seed)>>11) + 0.5) / (1 << 53)
+		score := -n.weight / math.Log(u)
+		if score > bestScore || (score == bestScore && n.name < best) {
+			best, bestScore = n.name, score
+		}
+	}
+	return best
+}
+
+func (r *RendezvousHash) index(node string) int {
+	for i, n := range r.nodes {
+		if n.name == node {
+			return i
+		}
+	}
+	return -1
+}
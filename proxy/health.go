@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"tinycached/utils"
+)
+
+/*
+ * 健康检查：每隔health-interval向每个服务器发送PING，health-timeout内没有收到PONG为失败。
+ * 在一致性哈希上的服务器连续失败health-fall次（包括转发命令出错）后摘除；
+ * 摘除的服务器按退避间隔重连，间隔从health-interval开始每次失败加倍，最大为reconnect-max-backoff，
+ * 重连后连续通过health-rise次检查才重新加入一致性哈希
+ */
+func (proxy *cacheProxy) healthLoop() {
+	for {
+		proxy.mutex.Lock()
+		interval := proxy.health.interval
+		proxy.mutex.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		proxy.checkAll()
+	}
+}
+
+// 并发检查全部到期的服务器，全部完成后返回
+func (proxy *cacheProxy) checkAll() {
+	now := time.Now()
+	proxy.mutex.Lock()
+	var due []*backend
+	for _, b := range proxy.servers {
+		if b.up || !now.Before(b.retryAt) {
+			due = append(due, b)
+		}
+	}
+	proxy.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, b := range due {
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+			proxy.checkBackend(b)
+		}(b)
+	}
+	wg.Wait()
+}
+
+// 检查一个服务器
+func (proxy *cacheProxy) checkBackend(b *backend) {
+	proxy.mutex.Lock()
+	addr, check, timeout := b.addr, b.check, proxy.health.timeout
+	proxy.mutex.Unlock()
+
+	var err error
+	if check == nil {
+		check, err = proxy.dialServer(addr)
+	}
+	if err == nil {
+		if err = ping(check, timeout); err != nil {
+			check.Close()
+			check = nil
+		}
+	}
+
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	// 检查期间服务器被移除或地址被修改
+	if proxy.servers[b.name] != b || b.addr != addr {
+		if check != nil {
+			check.Close()
+		}
+		return
+	}
+	if b.check != check && b.check != nil {
+		b.check.Close()
+	}
+	b.check = check
+	if err != nil {
+		proxy.stats(b.name).checkErrs++
+		proxy.checkFailed(b, err)
+		return
+	}
+	proxy.checkPassed(b)
+}
+
+// 检查失败；调用方持有mutex
+func (proxy *cacheProxy) checkFailed(b *backend, err error) {
+	if b.up {
+		proxy.fail(b, err)
+		return
+	}
+	if b.passes > 0 {
+		log.Printf("svr %s(%s) check failed after %d passed: %v", b.name, b.addr, b.passes, err)
+	} else if !b.failed {
+		log.Printf("svr %s(%s) reconnect failed: %v", b.name, b.addr, err)
+	}
+	b.failed = true
+	b.passes = 0
+	b.backoff *= 2
+	if b.backoff < proxy.health.interval {
+		b.backoff = proxy.health.interval
+	}
+	if b.backoff > proxy.health.maxBackoff {
+		b.backoff = proxy.health.maxBackoff
+	}
+	b.retryAt = time.Now().Add(b.backoff)
+}
+
+// 检查通过；调用方持有mutex
+func (proxy *cacheProxy) checkPassed(b *backend) {
+	if b.up {
+		b.fails = 0
+		return
+	}
+	b.failed = false
+	b.passes++
+	b.retryAt = time.Time{}
+	if b.passes >= proxy.health.rise {
+		proxy.join(b, fmt.Sprintf("passed %d checks", b.passes))
+	}
+}
+
+// 在conn上发送PING，timeout内收到PONG时返回nil
+func ping(conn net.Conn, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := utils.WriteAll(conn, []byte(utils.PING.String()+"\n")); err != nil {
+		return err
+	}
+	char := make([]byte, 1)
+	reply, err := utils.ReadReply(func() (byte, error) {
+		_, err := conn.Read(char)
+		return char[0], err
+	})
+	if err != nil {
+		return err
+	}
+	if reply := strings.TrimSuffix(string(reply), "\n"); reply != "PONG" {
+		return errors.New("unexpected reply to PING: " + reply)
+	}
+	return nil
+}
+
+// 重新加载配置后更新健康检查的参数
+func (proxy *cacheProxy) applyHealthOptions() error {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+
+	proxy.health = healthOptionsOf(proxy.cfg)
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"tinycached/utils/metrics"
+)
+
+// 单个缓存服务器的转发统计
+type backendStats struct {
+	requests  uint64             // 转发的命令数
+	errors    uint64             // 等待回复出错的次数
+	latency   *metrics.Histogram // 从转发命令到收到回复的耗时
+	ejections uint64             // 被移出一致性哈希的次数，由mutex保护
+	checkErrs uint64             // 健康检查失败的次数，由mutex保护
+}
+
+// 取得服务器的转发统计，不存在时创建
+func (proxy *cacheProxy) backend(svrName string) *backendStats {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+
+	return proxy.stats(svrName)
+}
+
+// 同backend，调用方持有mutex
+func (proxy *cacheProxy) stats(svrName string) *backendStats {
+	stats, ok := proxy.backendStats[svrName]
+	if !ok {
+		stats = &backendStats{latency: metrics.NewHistogram(metrics.DefBuckets)}
+		proxy.backendStats[svrName] = stats
+	}
+	return stats
+}
+
+// INFO的各段，按输出顺序排列
+var infoSections = []struct {
+	name  string
+	title string
+	fn    func(proxy *cacheProxy) []string
+}{
+	{"server", "Server", (*cacheProxy).infoServer},
+	{"clients", "Clients", (*cacheProxy).infoClients},
+	{"stats", "Stats", (*cacheProxy).infoStats},
+	{"backends", "Backends", (*cacheProxy).infoBackends},
+}
+
+// 按段名生成INFO的内容，未指定段名或为all、default时返回全部段
+func (proxy *cacheProxy) info(sections []string) []string {
+	wanted := make(map[string]bool)
+	for _, name := range sections {
+		wanted[name] = true
+	}
+	all := len(sections) == 0 || wanted["all"] || wanted["default"]
+
+	var lines []string
+	for _, section := range infoSections {
+		if all || wanted[section.name] {
+			lines = append(lines, "# "+section.title)
+			lines = append(lines, section.fn(proxy)...)
+		}
+	}
+	return lines
+}
+
+func (proxy *cacheProxy) infoServer() []string {
+	uptime := time.Since(proxy.startTime)
+	return []string{
+		"process_id:" + fmt.Sprint(os.Getpid()),
+		"go_version:" + runtime.Version(),
+		"listen:" + proxy.cfg.Listen,
+		"uptime_in_seconds:" + fmt.Sprint(int64(uptime.Seconds())),
+		"uptime_in_days:" + fmt.Sprint(int64(uptime.Hours()/24)),
+		"config_file:" + proxy.cfg.Path,
+	}
+}
+
+func (proxy *cacheProxy) infoClients() []string {
+	return []string{
+		"connected_clients:" + fmt.Sprint(atomic.LoadInt64(&proxy.connected)),
+	}
+}
+
+func (proxy *cacheProxy) infoStats() []string {
+	proxy.mutex.Lock()
+	var requests, errors uint64
+	for _, stats := range proxy.backendStats {
+		requests += atomic.LoadUint64(&stats.requests)
+		errors += atomic.LoadUint64(&stats.errors)
+	}
+	ringChanges := proxy.ringChanges
+	proxy.mutex.Unlock()
+	return []string{
+		"total_connections_received:" + fmt.Sprint(atomic.LoadUint64(&proxy.totalConns)),
+		"total_commands_forwarded:" + fmt.Sprint(requests),
+		"total_forward_errors:" + fmt.Sprint(errors),
+		"ring_changes:" + fmt.Sprint(ringChanges),
+	}
+}
+
+// 每个服务器一行，按名字排序：已连接的为up，否则为down
+func (proxy *cacheProxy) infoBackends() []string {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+
+	nodes := proxy.nodes()
+	lines := []string{"backends:" + fmt.Sprint(len(nodes))}
+	for i, n := range nodes {
+		var requests, errors uint64
+		if stats, ok := proxy.backendStats[n.name]; ok {
+			requests = atomic.LoadUint64(&stats.requests)
+			errors = atomic.LoadUint64(&stats.errors)
+		}
+		lines = append(lines, fmt.Sprintf("backend%d:name=%s,addr=%s,weight=%d,status=%s,requests=%d,errors=%d,ejections=%d,check_errors=%d",
+			i, n.name, n.addr, n.weight, n.status(), requests, errors, n.ejections, n.checkErrs))
+	}
+	return lines
+}
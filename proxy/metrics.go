@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+	"tinycached/utils/metrics"
+)
+
+func (proxy *cacheProxy) collectMetrics(w *metrics.Writer) {
+	w.Gauge("tinycached_proxy_uptime_seconds", "Seconds since the proxy started.", time.Since(proxy.startTime).Seconds())
+	w.Gauge("tinycached_proxy_connected_clients", "Number of client connections.",
+		float64(atomic.LoadInt64(&proxy.connected)))
+	w.Counter("tinycached_proxy_connections_received_total", "Total number of accepted connections.",
+		atomic.LoadUint64(&proxy.totalConns))
+
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+
+	// 各服务器是否在一致性哈希环上
+	backends := proxy.nodes()
+	var ringNodes int
+	for _, n := range backends {
+		if n.up {
+			ringNodes++
+		}
+	}
+	w.Gauge("tinycached_proxy_ring_nodes", "Number of backends on the hash ring.", float64(ringNodes))
+	w.Counter("tinycached_proxy_ring_changes_total", "Times a backend joined or left the hash ring.", proxy.ringChanges)
+	for _, n := range backends {
+		var up float64
+		if n.up {
+			up = 1
+		}
+		w.Gauge("tinycached_proxy_backend_up", "Whether the backend is connected and on the hash ring.",
+			up, metrics.L("backend", n.name))
+	}
+	for _, n := range backends {
+		var requests uint64
+		if stats, ok := proxy.backendStats[n.name]; ok {
+			requests = atomic.LoadUint64(&stats.requests)
+		}
+		w.Counter("tinycached_proxy_backend_requests_total", "Commands forwarded to the backend.",
+			requests, metrics.L("backend", n.name))
+	}
+	for _, n := range backends {
+		var errors uint64
+		if stats, ok := proxy.backendStats[n.name]; ok {
+			errors = atomic.LoadUint64(&stats.errors)
+		}
+		w.Counter("tinycached_proxy_backend_errors_total", "Forwarded commands that got no reply.",
+			errors, metrics.L("backend", n.name))
+	}
+	for _, n := range backends {
+		w.Counter("tinycached_proxy_backend_ejections_total", "Times the backend was removed from the hash ring after failures.",
+			n.ejections, metrics.L("backend", n.name))
+	}
+	for _, n := range backends {
+		w.Counter("tinycached_proxy_backend_health_check_failures_total", "Failed health checks.",
+			n.checkErrs, metrics.L("backend", n.name))
+	}
+	for _, n := range backends {
+		if stats, ok := proxy.backendStats[n.name]; ok {
+			w.Histogram("tinycached_proxy_backend_request_duration_seconds", "Time from forwarding a command to receiving its reply.",
+				stats.latency, metrics.L("backend", n.name))
+		}
+	}
+}
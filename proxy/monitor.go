@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"tinycached/utils"
+)
+
+// 每个MONITOR客户端最多积压的行数；超出后丢弃，慢客户端不会拖住读取服务器推送的协程
+const maxMonitorBacklog = 1024
+
+/*
+ * 代理上的MONITOR：为客户端向每台在线服务器各建一条连接并执行MONITOR，
+ * 将各服务器推送的命令汇总写给客户端，每行前加上服务器地址。
+ * 之后客户端发来的命令都被忽略，直到客户端断开或代理关闭
+ */
+func (proxy *cacheProxy) monitor(clt *clientConn) {
+	proxy.mutex.Lock()
+	svrNames := make([]string, 0, len(proxy.servers))
+	for _, b := range proxy.servers {
+		if b.up {
+			svrNames = append(svrNames, b.addr)
+		}
+	}
+	proxy.mutex.Unlock()
+	if len(svrNames) == 0 {
+		utils.WriteReply(clt.writer, []byte("EMPTY KEY: Cannot find server"))
+		clt.writer.Flush()
+		return
+	}
+
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	lines := make(chan string, maxMonitorBacklog)
+	var wg sync.WaitGroup
+	for _, svrName := range svrNames {
+		conn, reader, err := proxy.startMonitor(svrName, clt.user)
+		if err != nil {
+			utils.WriteReply(clt.writer, []byte(svrName+": "+err.Error()))
+			clt.writer.Flush()
+			return
+		}
+		conns = append(conns, conn)
+		wg.Add(1)
+		go func(svrName string) {
+			defer wg.Done()
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				select {
+				case lines <- svrName + " " + line:
+				default:
+				}
+			}
+		}(svrName)
+	}
+	utils.WriteReply(clt.writer, []byte("DONE"))
+	if clt.writer.Flush() != nil {
+		return
+	}
+
+	// 客户端断开时结束
+	closed := make(chan struct{})
+	go func() {
+		clt.SetReadDeadline(time.Time{})
+		clt.reader.WriteTo(io.Discard)
+		close(closed)
+	}()
+	// 全部服务器断开时结束
+	backendsGone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(backendsGone)
+	}()
+	for {
+		select {
+		case line := <-lines:
+			clt.writer.WriteString(line)
+			if len(lines) == 0 && clt.writer.Flush() != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-backendsGone:
+			clt.writer.Flush()
+			return
+		case <-ctx.Done():
+			clt.writer.Flush()
+			return
+		}
+	}
+}
+
+// 新建一条到服务器的连接并执行MONITOR；代理以自己的身份登录时以客户端的身份执行，由服务器检查权限
+func (proxy *cacheProxy) startMonitor(svrName string, user string) (net.Conn, *bufio.Reader, error) {
+	conn, err := proxy.dialServer(svrName)
+	if err != nil {
+		log.Printf("svr %s monitor failed: %v", svrName, err)
+		return nil, nil, errors.New("Server cannot reach")
+	}
+	line := utils.MONITOR.String() + "\n"
+	if proxy.cfg.BackendAuth() {
+		line = utils.ASUSER.String() + " " + user + " " + line
+	}
+	conn.SetDeadline(time.Now().Add(proxy.cfg.ConnectTimeout))
+	reader := bufio.NewReader(conn)
+	if err := utils.WriteAll(conn, []byte(line)); err != nil {
+		conn.Close()
+		return nil, nil, errors.New("Server cannot reach")
+	}
+	for {
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, nil, errors.New("Server cannot reach")
+		}
+		reply = strings.TrimSuffix(reply, "\n")
+		if reply == "DONE" {
+			break
+		}
+		// 服务器可能在回复DONE之前就推送了命令，这些命令直接丢弃
+		if reply == "" || reply[0] < '0' || reply[0] > '9' {
+			conn.Close()
+			return nil, nil, errors.New(reply)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, reader, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+	"tinycached/utils"
+)
+
+/*
+ * 独占连接：事务与WAIT依赖服务器上按连接保存的状态，不能与其他客户端共用连接。
+ * WATCH或MULTI之后的命令发到该客户端独占的一条连接，EXEC、DISCARD（或不在事务中时的UNWATCH）之后关闭；
+ * 事务中的命令须在同一台服务器上，MULTI在第一条带key的命令到来时才发给该key所在的服务器。
+ * WAIT在一条新建的连接上执行，等待执行WAIT时服务器已有的全部写入
+ */
+type pinnedConn struct {
+	name    string
+	pool    *connPool
+	conn    net.Conn
+	reader  *bufio.Reader
+	oneShot bool // 只为一条WAIT建立，回复后关闭
+	private bool // 客户端的私有连接，事务结束后不关闭，见forwardPrivate
+}
+
+// 独占连接上发送一条命令并等待回复
+func (pc *pinnedConn) do(line []byte, timeout time.Duration) ([]byte, error) {
+	if timeout > 0 {
+		pc.conn.SetDeadline(time.Now().Add(timeout))
+		defer pc.conn.SetDeadline(time.Time{})
+	}
+	if err := utils.WriteAll(pc.conn, line); err != nil {
+		return nil, err
+	}
+	return utils.ReadReply(pc.reader.ReadByte)
+}
+
+// 需要独占连接的命令
+func needsPin(cmd utils.CmdType) bool {
+	switch cmd {
+	case utils.MULTI, utils.WATCH, utils.WAIT:
+		return true
+	}
+	return false
+}
+
+// 改变服务器上连接状态的命令：在共用的连接上执行会影响其他客户端。
+// 代理以自己的身份登录服务器时AUTH由代理处理，不会转发
+func changesConnState(cmd utils.CmdType, arg string) bool {
+	switch cmd {
+	case utils.AUTH:
+		return true
+	case utils.CLIENT:
+		sub, _, _ := strings.Cut(arg, " ")
+		return strings.EqualFold(sub, "SETNAME")
+	}
+	return false
+}
+
+// 复制命令把连接变成副本连接，不能经代理执行
+func isReplicationCmd(cmd utils.CmdType) bool {
+	return cmd == utils.SYNC || cmd == utils.PSYNC || cmd == utils.REPLCONF
+}
+
+// 一条改变了连接状态的命令，在客户端新建的私有连接上重放
+type stateCmd struct {
+	cmd utils.CmdType
+	arg string
+}
+
+// 转发到服务器的一行命令；代理以自己的身份登录时以ASUSER按客户端的身份执行
+func (proxy *cacheProxy) commandLine(clt *clientConn, cmd utils.CmdType, arg string) []byte {
+	line := cmd.String() + " " + arg + "\n"
+	if proxy.cfg.BackendAuth() {
+		line = utils.ASUSER.String() + " " + clt.user + " " + line
+	}
+	return []byte(line)
+}
+
+// 新建一条到服务器的连接并重放客户端改变过的连接状态，使用者负责关闭
+func (proxy *cacheProxy) openConn(clt *clientConn, name string, pool *connPool) (*pinnedConn, error) {
+	conn, err := pool.dedicated()
+	if err != nil {
+		return nil, err
+	}
+	pc := &pinnedConn{name: name, pool: pool, conn: conn, reader: bufio.NewReader(conn)}
+	for _, s := range clt.state {
+		reply, err := pc.do(proxy.commandLine(clt, s.cmd, s.arg), proxy.cfg.ConnectTimeout)
+		if err == nil && strings.TrimSuffix(string(reply), "\n") != "DONE" {
+			err = errors.New(strings.TrimSuffix(string(reply), "\n"))
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return pc, nil
+}
+
+/*
+ * 私有连接：客户端执行了AUTH或CLIENT SETNAME后，之后的命令不再经连接池转发，
+ * 改在该客户端到各个服务器的私有连接上执行。私有连接在第一次用到时建立并重放这些命令，
+ * 客户端断开时关闭
+ */
+func (proxy *cacheProxy) privateConn(clt *clientConn, name string, pool *connPool) (*pinnedConn, error) {
+	if pc, ok := clt.private[name]; ok {
+		if pc.pool == pool {
+			return pc, nil
+		}
+		// 服务器被摘除或地址改变后连接池已更换
+		proxy.dropPrivate(clt, pc)
+	}
+	pc, err := proxy.openConn(clt, name, pool)
+	if err != nil {
+		return nil, err
+	}
+	pc.private = true
+	clt.private[name] = pc
+	return pc, nil
+}
+
+func (proxy *cacheProxy) dropPrivate(clt *clientConn, pc *pinnedConn) {
+	pc.conn.Close()
+	if clt.private[pc.name] == pc {
+		delete(clt.private, pc.name)
+	}
+	if clt.pin == pc {
+		clt.pin = nil
+	}
+}
+
+// 在私有连接上转发命令；改变连接状态的命令成功后记下，之后新建的私有连接重放
+func (proxy *cacheProxy) forwardPrivate(clt *clientConn, cmd utils.CmdType, arg string) []byte {
+	if clt.private == nil {
+		clt.private = make(map[string]*pinnedConn)
+	}
+	svrName, pool, ok := proxy.chooseServer(clt.Conn, cmd, arg)
+	if !ok {
+		return []byte("EMPTY KEY: Cannot find server\n")
+	}
+	pc, err := proxy.privateConn(clt, svrName, pool)
+	if err != nil {
+		proxy.forwardFailed(svrName, pool, err)
+		return []byte("Server cannot reach\n")
+	}
+
+	stats := proxy.backend(svrName)
+	atomic.AddUint64(&stats.requests, 1)
+	start := time.Now()
+	reply, err := pc.do(proxy.commandLine(clt, cmd, arg), proxy.cfg.BackendTimeout)
+	if err != nil {
+		atomic.AddUint64(&stats.errors, 1)
+		proxy.forwardFailed(svrName, pool, err)
+		proxy.dropPrivate(clt, pc)
+		return []byte("Server cannot reach\n")
+	}
+	stats.latency.Observe(time.Since(start))
+
+	if changesConnState(cmd, arg) && strings.TrimSuffix(string(reply), "\n") == "DONE" {
+		clt.state = append(clt.state, stateCmd{cmd, arg})
+		// 其他服务器上的私有连接重新建立，使状态一致
+		for name, other := range clt.private {
+			if name != svrName {
+				proxy.dropPrivate(clt, other)
+			}
+		}
+	}
+	return reply
+}
+
+// 在独占连接上转发命令，需要时建立独占连接
+func (proxy *cacheProxy) forwardPinned(clt *clientConn, cmd utils.CmdType, arg string) []byte {
+	svrName, pool, ok := proxy.chooseServer(clt.Conn, cmd, arg)
+	if clt.pin == nil {
+		// 第一条带key的命令到来之前不发送MULTI；其他命令到来时发给按上一个key选择的服务器
+		if cmd == utils.MULTI || (clt.multi && cmd == utils.DISCARD) {
+			clt.multi = cmd == utils.MULTI
+			return []byte("DONE\n")
+		}
+		if !ok {
+			return []byte("EMPTY KEY: Cannot find server\n")
+		}
+		var pc *pinnedConn
+		var err error
+		if clt.private != nil {
+			pc, err = proxy.privateConn(clt, svrName, pool)
+		} else {
+			pc, err = proxy.openConn(clt, svrName, pool)
+		}
+		if err != nil {
+			proxy.forwardFailed(svrName, pool, err)
+			return []byte("Server cannot reach\n")
+		}
+		pc.oneShot = cmd == utils.WAIT && !clt.multi && !pc.private
+		clt.pin = pc
+		if clt.multi {
+			reply, err := clt.pin.do(proxy.commandLine(clt, utils.MULTI, ""), proxy.cfg.BackendTimeout)
+			if err != nil || strings.TrimSuffix(string(reply), "\n") != "DONE" {
+				proxy.unpin(clt, err != nil)
+				if err != nil {
+					return []byte("Server cannot reach\n")
+				}
+				return reply
+			}
+		}
+	} else if getKeyFromCmd(cmd, arg) != "" && svrName != clt.pin.name {
+		return []byte("CROSSSERVER keys in a transaction must be on the same server\n")
+	}
+
+	stats := proxy.backend(clt.pin.name)
+	atomic.AddUint64(&stats.requests, 1)
+	start := time.Now()
+	reply, err := clt.pin.do(proxy.commandLine(clt, cmd, arg), proxy.cfg.BackendTimeout)
+	if err != nil {
+		atomic.AddUint64(&stats.errors, 1)
+		proxy.forwardFailed(clt.pin.name, clt.pin.pool, err)
+		proxy.unpin(clt, true)
+		return []byte("Server cannot reach\n")
+	}
+	stats.latency.Observe(time.Since(start))
+
+	switch cmd {
+	case utils.MULTI:
+		clt.multi = true
+	case utils.EXEC, utils.DISCARD:
+		proxy.unpin(clt, false)
+	case utils.UNWATCH:
+		if !clt.multi {
+			proxy.unpin(clt, false)
+		}
+	default:
+		if clt.pin.oneShot {
+			proxy.unpin(clt, false)
+		}
+	}
+	return reply
+}
+
+// 结束独占连接，服务器上该连接的事务与监视随之结束；私有连接出错时才关闭，否则留给之后的命令
+func (proxy *cacheProxy) unpin(clt *clientConn, broken bool) {
+	if pc := clt.pin; pc != nil {
+		if !pc.private {
+			pc.conn.Close()
+		} else if broken {
+			proxy.dropPrivate(clt, pc)
+		}
+		clt.pin = nil
+	}
+	clt.multi = false
+}
+
+// 客户端断开时关闭它的独占连接与私有连接
+func (proxy *cacheProxy) releaseConns(clt *clientConn) {
+	proxy.unpin(clt, false)
+	for _, pc := range clt.private {
+		pc.conn.Close()
+	}
+	clt.private = nil
+}
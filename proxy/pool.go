@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+	"tinycached/utils"
+)
+
+// 每条多路复用连接上最多等待回复的命令数，超出时发送方在timeout内等待空位
+const maxPipeline = 1024
+
+var (
+	errPoolClosed     = errors.New("connection pool closed")
+	errBackendTimeout = errors.New("timed out waiting for reply")
+	errUnexpected     = errors.New("unexpected reply")
+)
+
+/*
+ * 到一个服务器的连接池：size条多路复用连接由全部客户端共用，按轮转分配命令，
+ * 连接断开后在下一次使用时重连。服务器移出一致性哈希或地址改变时关闭整个连接池
+ */
+type connPool struct {
+	addr   string
+	dial   func(addr string) (net.Conn, error)
+	mutex  sync.Mutex
+	conns  []*muxConn // 为nil或已断开的位置在使用时重连
+	next   int
+	closed bool
+}
+
+func (proxy *cacheProxy) newPool(addr string) *connPool {
+	return &connPool{
+		addr:  addr,
+		dial:  proxy.dialServer,
+		conns: make([]*muxConn, proxy.cfg.BackendPoolSize),
+	}
+}
+
+// 按轮转取一条可用的连接
+func (p *connPool) get() (*muxConn, error) {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil, errPoolClosed
+	}
+	i := p.next
+	p.next = (p.next + 1) % len(p.conns)
+	if mc := p.conns[i]; mc != nil && mc.alive() {
+		p.mutex.Unlock()
+		return mc, nil
+	}
+	p.mutex.Unlock()
+
+	conn, err := p.dial(p.addr)
+	if err != nil {
+		return nil, err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		conn.Close()
+		return nil, errPoolClosed
+	}
+	// 其他协程已在该位置重连
+	if mc := p.conns[i]; mc != nil && mc.alive() {
+		conn.Close()
+		return mc, nil
+	}
+	mc := newMuxConn(conn)
+	p.conns[i] = mc
+	return mc, nil
+}
+
+// 新建一条独占连接，用于事务、订阅与WAIT，使用者负责关闭
+func (p *connPool) dedicated() (net.Conn, error) {
+	p.mutex.Lock()
+	closed := p.closed
+	p.mutex.Unlock()
+	if closed {
+		return nil, errPoolClosed
+	}
+	return p.dial(p.addr)
+}
+
+// 关闭全部连接，等待回复的命令返回错误
+func (p *connPool) close() {
+	p.mutex.Lock()
+	conns := p.conns
+	p.conns, p.closed = nil, true
+	p.mutex.Unlock()
+
+	for _, mc := range conns {
+		if mc != nil {
+			mc.fail(errPoolClosed)
+		}
+	}
+}
+
+/*
+ * 多路复用连接：多个客户端的命令依次写入同一条连接，服务器按收到的顺序回复，
+ * 读协程按FIFO顺序把回复交给等待的命令。等待超时的命令仍留在队列中，
+ * 迟到的回复由读协程取走丢弃，之后的回复不会错位。
+ * 写出失败（可能只写出了一部分）、回复格式错误或多出回复时，之后的回复已无法对应，断开整条连接
+ */
+type muxConn struct {
+	conn     net.Conn
+	mutex    sync.Mutex    // 入队与写入在同一把锁内，队列顺序与写入顺序一致
+	slots    chan struct{} // 队列中的空位，在锁外占用，持有锁时入队不会阻塞
+	pending  chan *muxCall // 已写入、等待回复的命令
+	err      error         // 连接断开的原因，不为nil后不再接受命令
+	done     chan struct{}
+	failOnce sync.Once
+}
+
+type muxCall struct {
+	reply []byte
+	err   error
+	done  chan struct{}
+}
+
+func newMuxConn(conn net.Conn) *muxConn {
+	mc := &muxConn{
+		conn:    conn,
+		slots:   make(chan struct{}, maxPipeline),
+		pending: make(chan *muxCall, maxPipeline),
+		done:    make(chan struct{}),
+	}
+	go mc.readLoop()
+	return mc
+}
+
+func (mc *muxConn) alive() bool {
+	select {
+	case <-mc.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// 发送一条命令并等待回复；timeout为0表示一直等待，否则等待空位、写出与等待回复共用timeout
+func (mc *muxConn) do(line []byte, timeout time.Duration) ([]byte, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case mc.slots <- struct{}{}:
+	case <-mc.done:
+		return nil, errPoolClosed
+	case <-expired:
+		return nil, errBackendTimeout
+	}
+
+	call := &muxCall{done: make(chan struct{})}
+	mc.mutex.Lock()
+	if mc.err != nil {
+		mc.mutex.Unlock()
+		<-mc.slots
+		return nil, mc.err
+	}
+	mc.pending <- call
+	// 服务器不读取时写出阻塞，整条连接上的命令都在等待这把锁
+	if timeout > 0 {
+		mc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	} else {
+		mc.conn.SetWriteDeadline(time.Time{})
+	}
+	if err := utils.WriteAll(mc.conn, line); err != nil {
+		// 之后的命令不再写入这条连接，队列中的命令全部返回错误
+		mc.err = err
+		mc.mutex.Unlock()
+		mc.fail(err)
+		return nil, err
+	}
+	mc.mutex.Unlock()
+
+	select {
+	case <-call.done:
+		return call.reply, call.err
+	case <-expired:
+		return nil, errBackendTimeout
+	}
+}
+
+func (mc *muxConn) readLoop() {
+	reader := bufio.NewReader(mc.conn)
+	for {
+		reply, err := utils.ReadReply(reader.ReadByte)
+		if err != nil {
+			mc.fail(err)
+			return
+		}
+		select {
+		case call := <-mc.pending:
+			<-mc.slots
+			call.reply = reply
+			close(call.done)
+		default:
+			mc.fail(errUnexpected)
+			return
+		}
+	}
+}
+
+// 连接断开：不再接受命令，队列中的命令全部返回err
+func (mc *muxConn) fail(err error) {
+	mc.failOnce.Do(func() {
+		// 先唤醒等待空位的发送方，再在锁内设置err，之后不会再有命令入队
+		close(mc.done)
+		mc.mutex.Lock()
+		if mc.err == nil {
+			mc.err = err
+		}
+		mc.mutex.Unlock()
+		mc.conn.Close()
+		for {
+			select {
+			case call := <-mc.pending:
+				<-mc.slots
+				call.err = err
+				close(call.done)
+			default:
+				return
+			}
+		}
+	})
+}
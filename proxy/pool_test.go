@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"tinycached/utils"
+)
+
+// 直接连接假服务器的多路复用连接，测试结束时关闭
+func dialMux(t *testing.T, addr string) *muxConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := newMuxConn(conn)
+	t.Cleanup(func() { mc.fail(errPoolClosed) })
+	return mc
+}
+
+// GET k回复vk，LIST n回复n行的多行回复
+func echoHandler(c *fakeConn, line string) {
+	cmd, arg, _ := strings.Cut(line, " ")
+	switch cmd {
+	case "GET":
+		c.reply("v" + arg)
+	case "LIST":
+		n, _ := strconv.Atoi(arg)
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = fmt.Sprintf("item%d", i)
+		}
+		c.reply(string(utils.MultiLine(lines)))
+	case "SLOW":
+		time.Sleep(300 * time.Millisecond)
+		c.reply("slow")
+	case "BAD":
+		c.reply("*x")
+	case "TWICE":
+		c.reply("once")
+		c.reply("twice")
+	case "HANG":
+	default:
+		c.reply("wrong command")
+	}
+}
+
+// 等待call返回，超过5秒视为阻塞
+func within(t *testing.T, what string, call func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		call()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s blocked", what)
+	}
+}
+
+// 多个客户端并发使用同一条连接，每个都收到自己命令的回复
+func TestMuxConnFIFO(t *testing.T) {
+	b := newFakeBackend(t, echoHandler)
+	mc := dialMux(t, b.addr)
+
+	const clients, calls = 8, 500
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(i)))
+			for j := 0; j < calls; j++ {
+				line, want := fmt.Sprintf("GET c%d_%d", i, j), fmt.Sprintf("vc%d_%d\n", i, j)
+				if n := r.Intn(4); n > 0 && j%3 == 0 {
+					line, want = fmt.Sprintf("LIST %d", n), string(utils.MultiLine([]string{"item0", "item1", "item2"}[:n]))+"\n"
+				}
+				reply, err := mc.do([]byte(line+"\n"), 5*time.Second)
+				if err != nil {
+					t.Errorf("client %d: %s: %v", i, line, err)
+					return
+				}
+				if string(reply) != want {
+					t.Errorf("client %d: %s: got %q, want %q", i, line, reply, want)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(b.connections()) != 1 {
+		t.Errorf("%d backend connections, want 1", len(b.connections()))
+	}
+}
+
+// 回复格式错误时断开连接：另一个并发的客户端要么收到自己的回复，要么收到错误，不会收到错位的回复
+func TestMuxConnMalformedReply(t *testing.T) {
+	b := newFakeBackend(t, echoHandler)
+	mc := dialMux(t, b.addr)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; ; j++ {
+			line := fmt.Sprintf("GET k%d", j)
+			reply, err := mc.do([]byte(line+"\n"), 5*time.Second)
+			if err != nil {
+				return
+			}
+			if want := fmt.Sprintf("vk%d\n", j); string(reply) != want {
+				t.Errorf("%s: got %q, want %q", line, reply, want)
+				return
+			}
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := mc.do([]byte("BAD\n"), 5*time.Second); !errors.Is(err, utils.ErrMalformedReply) {
+		t.Errorf("BAD: got %v, want %v", err, utils.ErrMalformedReply)
+	}
+	within(t, "other client", wg.Wait)
+	if mc.alive() {
+		t.Error("connection still alive after a malformed reply")
+	}
+	if _, err := mc.do([]byte("GET a\n"), time.Second); err == nil {
+		t.Error("command accepted on a failed connection")
+	}
+}
+
+// 多出的回复没有命令等待时断开连接
+func TestMuxConnExtraReply(t *testing.T) {
+	b := newFakeBackend(t, echoHandler)
+	mc := dialMux(t, b.addr)
+	if reply, err := mc.do([]byte("TWICE\n"), time.Second); err != nil || string(reply) != "once\n" {
+		t.Fatalf("TWICE: got %q, %v", reply, err)
+	}
+	waitFor(t, "connection to fail", func() bool { return !mc.alive() })
+	if _, err := mc.do([]byte("GET a\n"), time.Second); err == nil {
+		t.Error("command accepted on a failed connection")
+	}
+}
+
+// 等待超时的命令返回错误，迟到的回复被丢弃，之后的命令收到自己的回复
+func TestMuxConnTimeout(t *testing.T) {
+	b := newFakeBackend(t, echoHandler)
+	mc := dialMux(t, b.addr)
+
+	start := time.Now()
+	if _, err := mc.do([]byte("SLOW\n"), 50*time.Millisecond); err != errBackendTimeout {
+		t.Fatalf("SLOW: got %v, want %v", err, errBackendTimeout)
+	}
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Errorf("timeout took %v", d)
+	}
+	reply, err := mc.do([]byte("GET a\n"), 5*time.Second)
+	if err != nil || string(reply) != "va\n" {
+		t.Errorf("GET a after timeout: got %q, %v", reply, err)
+	}
+	if !mc.alive() {
+		t.Error("connection closed after a timeout")
+	}
+}
+
+// 服务器断开时等待回复的命令全部返回错误；连接池在下一次使用时重连
+func TestMuxConnBackendFailure(t *testing.T) {
+	const n = 5
+	b := newFakeBackend(t, func(c *fakeConn, line string) {
+		if len(c.received()) == n {
+			c.Close()
+		}
+	})
+	pool := &connPool{addr: b.addr, dial: func(addr string) (net.Conn, error) { return net.Dial("tcp", addr) }, conns: make([]*muxConn, 1)}
+	t.Cleanup(pool.close)
+	mc, err := pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := mc.do([]byte("HANG\n"), 0)
+			errs <- err
+		}()
+	}
+	within(t, "pending commands", func() {
+		for i := 0; i < n; i++ {
+			if err := <-errs; err == nil {
+				t.Error("pending command succeeded on a closed connection")
+			}
+		}
+	})
+	if mc.alive() {
+		t.Error("connection still alive after the backend closed it")
+	}
+	if len(mc.pending) != 0 || len(mc.slots) != 0 {
+		t.Errorf("pending=%d slots=%d after failure, want 0", len(mc.pending), len(mc.slots))
+	}
+
+	again, err := pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == mc || !again.alive() {
+		t.Error("pool did not reconnect")
+	}
+}
+
+// 服务器不读取时写出在timeout内返回，排在后面的命令也不会一直等待
+func TestMuxConnWriteStall(t *testing.T) {
+	b := newFakeBackend(t, nil)
+	mc := dialMux(t, b.addr)
+
+	big := []byte(strings.Repeat("x", 64<<20) + "\n")
+	errs := make(chan error, 2)
+	go func() {
+		_, err := mc.do(big, 200*time.Millisecond)
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	go func() {
+		_, err := mc.do([]byte("GET a\n"), 200*time.Millisecond)
+		errs <- err
+	}()
+	within(t, "stalled writes", func() {
+		for i := 0; i < 2; i++ {
+			if err := <-errs; err == nil {
+				t.Error("write to a stalled backend succeeded")
+			}
+		}
+	})
+	if mc.alive() {
+		t.Error("connection still alive after a failed write")
+	}
+}
+
+// 队列已满时新命令在timeout内返回，不阻塞持有锁的写入
+func TestMuxConnFullQueue(t *testing.T) {
+	b := newFakeBackend(t, echoHandler)
+	mc := dialMux(t, b.addr)
+
+	var wg sync.WaitGroup
+	for i := 0; i < maxPipeline; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mc.do([]byte("HANG\n"), 0)
+		}()
+	}
+	waitFor(t, "queue to fill", func() bool { return len(mc.pending) == maxPipeline })
+
+	start := time.Now()
+	if _, err := mc.do([]byte("GET a\n"), 100*time.Millisecond); err != errBackendTimeout {
+		t.Errorf("GET on a full queue: got %v, want %v", err, errBackendTimeout)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("full queue blocked for %v", d)
+	}
+	mc.fail(errPoolClosed)
+	within(t, "queued commands", wg.Wait)
+}
+
+// 事务中的命令都在同一条独占连接上，其他客户端的命令不会混入；EXEC之后独占连接关闭
+func TestPinnedTransaction(t *testing.T) {
+	b := newFakeBackend(t, kvHandler)
+	proxy := newTestProxy(t, "-backends", b.addr, "-backend-pool-size", "1")
+
+	c, other := proxy.testClient(t), proxy.testClient(t)
+	other.expect("SET b:0", "DONE")
+	c.expect("MULTI", "DONE")
+	c.expect("SET a:1", "QUEUED")
+	other.expect("SET b:1", "DONE")
+	c.expect("GET a", "QUEUED")
+	other.expect("GET a", "key is not exits")
+	c.expect("EXEC", "*2\nDONE\n1")
+	other.expect("GET a", "1")
+
+	var pinned []*fakeConn
+	for _, fc := range b.connections() {
+		for _, line := range fc.received() {
+			if line == "MULTI" {
+				pinned = append(pinned, fc)
+				break
+			}
+		}
+	}
+	if len(pinned) != 1 {
+		t.Fatalf("MULTI sent on %d connections, want 1", len(pinned))
+	}
+	if got, want := strings.Join(pinned[0].received(), ","), "MULTI,SET a:1,GET a,EXEC"; got != want {
+		t.Errorf("pinned connection got %s, want %s", got, want)
+	}
+	waitFor(t, "pinned connection to close", pinned[0].isClosed)
+
+	// 事务结束后的命令回到连接池
+	c.expect("GET b", "1")
+	if got := strings.Join(pinned[0].received(), ","); strings.Contains(got, "GET b") {
+		t.Errorf("command after EXEC sent on the pinned connection: %s", got)
+	}
+}
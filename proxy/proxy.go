@@ -1,18 +1,26 @@
 package main
 
 import (
+	"bufio"
 	"context"
-	"io"
+	"errors"
+	"flag"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+	"tinycached/config"
 	"tinycached/proxy/consistenthash"
+	"tinycached/server/acl"
 	"tinycached/utils"
+	"tinycached/utils/metrics"
+	"tinycached/utils/tlsutil"
 )
 
 var (
@@ -25,160 +33,438 @@ func init() {
 }
 
 type cacheProxy struct {
-	mutex    sync.Mutex
-	servers  map[string]net.Conn // 已上线服务器map，key=服务器地址，value=与服务器的连接对象
-	clients  map[net.Conn]string // 已连接客户端map，key=与客户端的连接对象，value=上一次客户端发来的key，用于无key命令的服务器定位
-	hashmap  *consistenthash.Map // 一致性哈希
-	listener net.Listener
-	sigChan  chan os.Signal
-	wg       sync.WaitGroup
+	totalConns     uint64 // 累计接受的连接数，原子操作，放在首位保证64位对齐
+	connected      int64  // 当前的客户端连接数，原子操作
+	startTime      time.Time
+	backendStats   map[string]*backendStats // 各服务器的转发统计，由mutex保护
+	cfg            *config.Proxy
+	mutex          sync.Mutex
+	servers        map[string]*backend           // 全部服务器，key=服务器名字
+	configured     map[string]config.BackendSpec // 最近一次应用的backends配置，key=服务器名字
+	health         healthOptions                 // 健康检查的参数
+	ringChanges    uint64                        // 服务器加入或移出一致性哈希的次数
+	clients        map[net.Conn]string           // 已连接客户端map，key=与客户端的连接对象，value=上一次客户端发来的key，用于无key命令的服务器定位
+	connMutex      sync.Mutex
+	conns          map[*clientConn]struct{} // 当前的客户端连接，关闭代理时用于唤醒阻塞在读上的协程
+	hashmap        consistenthash.Hash      // 一致性哈希，算法由hash-algorithm选择
+	listener       net.Listener
+	extraListeners []net.Listener // TLS与Unix socket监听
+	certs          *tlsutil.Certs // 监听TLS与以TLS连接服务器共用的证书
+	metrics        *http.Server   // Prometheus指标的HTTP服务，未开启时为nil
+	sigChan        chan os.Signal
+	wg             sync.WaitGroup
 }
 
-func newCacheProxy(port uint16) *cacheProxy {
+func newCacheProxy(cfg *config.Proxy) (*cacheProxy, error) {
 	proxy := &cacheProxy{
-		servers: make(map[string]net.Conn),
-		hashmap: consistenthash.NewConsistentHash(3, nil),
-		sigChan: make(chan os.Signal, 1),
-	}
-	// 从json里load服务器地址
-	svrsTest := proxy.loadServerAddrs()
-	// 与各个服务器建立连接
-	for _, svrName := range svrsTest {
-		if err := proxy.connectToServer(svrName); err != nil {
-			log.Printf("svr %s connect failed", svrName)
-			break
+		startTime:    time.Now(),
+		backendStats: make(map[string]*backendStats),
+		cfg:          cfg,
+		health:       healthOptionsOf(cfg),
+		servers:      make(map[string]*backend),
+		clients:      make(map[net.Conn]string),
+		conns:        make(map[*clientConn]struct{}),
+		sigChan:      make(chan os.Signal, 1),
+	}
+	var err error
+	if proxy.hashmap, err = consistenthash.New(cfg.HashAlgorithm, cfg.HashReplicas); err != nil {
+		return nil, err
+	}
+	if cfg.UseTLS() {
+		if proxy.certs, err = tlsutil.New(cfg.TLSOptions()); err != nil {
+			return nil, err
 		}
 	}
+	// 与配置中的各个服务器建立连接，连接失败的服务器由健康检查重连
+	proxy.applyBackends(cfg.BackendSpecs())
+	go proxy.healthLoop()
+	// 重新加载配置时更新服务器列表与健康检查的参数
+	cfg.Params().OnChange("backends", func() error {
+		proxy.applyBackends(proxy.cfg.BackendSpecs())
+		return nil
+	})
+	for _, name := range []string{"health-interval", "health-timeout", "health-fall", "health-rise", "reconnect-max-backoff"} {
+		cfg.Params().OnChange(name, proxy.applyHealthOptions)
+	}
+	cfg.Params().OnChange("hash-algorithm", proxy.applyHashOptions)
+	cfg.Params().OnChange("hash-replicas", proxy.applyHashOptions)
 	// 捕获信号
 	proxy.capSignal()
 	// 监听端口
-	proxy.startListen(port)
-	return proxy
+	if err := proxy.startListen(); err != nil {
+		return nil, err
+	}
+	if cfg.MetricsListen != "" {
+		if proxy.metrics, err = metrics.Serve(cfg.MetricsListen, proxy.collectMetrics); err != nil {
+			proxy.stopListen()
+			return nil, err
+		}
+	}
+	return proxy, nil
 }
 
-// TODO
-func (proxy *cacheProxy) loadServerAddrs() []string {
-	return []string{"127.0.0.1:7000"}
+// 连接服务器，配置了backend-tls时使用TLS；服务器地址可以是Unix socket路径
+func (proxy *cacheProxy) dial(svrName string) (net.Conn, error) {
+	network, addr := utils.SplitNetAddr(svrName)
+	if proxy.cfg.BackendTLS {
+		return tlsutil.Dial(network, addr, proxy.cfg.ConnectTimeout, proxy.certs)
+	}
+	return net.DialTimeout(network, addr, proxy.cfg.ConnectTimeout)
 }
 
-func (proxy *cacheProxy) connectToServer(svrName string) error {
-	conn, err := net.Dial("tcp", svrName)
+// 连接服务器；配置了backend-password时以代理自己的身份登录
+func (proxy *cacheProxy) dialServer(svrName string) (net.Conn, error) {
+	conn, err := proxy.dial(svrName)
+	if err != nil {
+		return nil, err
+	}
+	if proxy.cfg.BackendAuth() {
+		user := proxy.cfg.BackendUser
+		if user == "" {
+			user = acl.DefaultUser
+		}
+		if err := authenticate(conn, user, proxy.cfg.BackendPassword, proxy.cfg.ConnectTimeout); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// 在conn上执行AUTH，回复不是DONE时返回服务器的错误信息
+func authenticate(conn net.Conn, user string, pass string, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := utils.WriteAll(conn, []byte(utils.AUTH.String()+" "+user+" "+pass+"\n")); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	reply, err := utils.ReadReply(reader.ReadByte)
 	if err != nil {
 		return err
 	}
-	proxy.servers[svrName] = conn
-	proxy.hashmap.AddNode(svrName)
+	if reply := strings.TrimSuffix(string(reply), "\n"); reply != "DONE" {
+		return errors.New(reply)
+	}
 	return nil
 }
 
+// SIGHUP重新加载配置，SIGINT与SIGTERM关闭代理
 func (proxy *cacheProxy) capSignal() {
 	signal.Notify(proxy.sigChan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		<-proxy.sigChan
-		proxy.listener.Close()
-		cancel()
+		for sig := range proxy.sigChan {
+			if sig == syscall.SIGHUP {
+				proxy.reloadConfig()
+				proxy.reloadCerts()
+				continue
+			}
+			proxy.stopListen()
+			cancel()
+			return
+		}
 	}()
 }
 
-func (proxy *cacheProxy) startListen(port uint16) {
-	var err error
-	proxy.listener, err = net.Listen("tcp", ":"+strconv.FormatUint(uint64(port), 10))
+// 重新读取证书文件；证书可能已被原地替换，即使配置没有变化也要读取
+func (proxy *cacheProxy) reloadCerts() {
+	if proxy.certs == nil {
+		return
+	}
+	if err := proxy.certs.Reload(proxy.cfg.TLSOptions()); err != nil {
+		log.Printf("reload: tls: %v", err)
+	} else {
+		log.Print("reload: tls certificates reloaded")
+	}
+}
+
+func (proxy *cacheProxy) reloadConfig() {
+	if proxy.cfg.Path == "" {
+		log.Print("reload: no config file specified")
+		return
+	}
+	changes, err := proxy.cfg.Reload()
 	if err != nil {
-		panic(err)
+		log.Printf("reload: %v", err)
+		return
+	}
+	log.Printf("reload: %d option(s) changed", len(changes))
+	for _, c := range changes {
+		log.Printf("reload: %v", c)
+	}
+}
+
+// 开始监听，tls-listen与unixsocket不为空时同时监听TLS连接与Unix socket
+func (proxy *cacheProxy) startListen() (err error) {
+	if proxy.listener, err = net.Listen("tcp", proxy.cfg.Listen); err != nil {
+		return err
+	}
+	if proxy.cfg.TLSListen != "" {
+		listener, err := tlsutil.Listen(proxy.cfg.TLSListen, proxy.certs)
+		if err != nil {
+			proxy.stopListen()
+			return err
+		}
+		proxy.extraListeners = append(proxy.extraListeners, listener)
+	}
+	if proxy.cfg.UnixSocket != "" {
+		listener, err := utils.ListenUnix(proxy.cfg.UnixSocket, proxy.cfg.UnixSocketPerm)
+		if err != nil {
+			proxy.stopListen()
+			return err
+		}
+		proxy.extraListeners = append(proxy.extraListeners, listener)
+	}
+	return nil
+}
+
+// 停止接受新连接
+func (proxy *cacheProxy) stopListen() {
+	proxy.listener.Close()
+	for _, listener := range proxy.extraListeners {
+		listener.Close()
+	}
+	if proxy.metrics != nil {
+		proxy.metrics.Close()
 	}
 }
 
-func (proxy *cacheProxy) chooseServer(cltConn net.Conn, cmd utils.CmdType, arg string) (string, net.Conn, bool) {
+func (proxy *cacheProxy) chooseServer(cltConn net.Conn, cmd utils.CmdType, arg string) (string, *connPool, bool) {
 	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+
 	if newKey := getKeyFromCmd(cmd, arg); newKey != "" {
 		proxy.clients[cltConn] = newKey
 	}
-	svrName := proxy.hashmap.FindNode(proxy.clients[cltConn])
-	svrConn, ok := proxy.servers[svrName]
-	proxy.mutex.Unlock()
-	return svrName, svrConn, ok
+	key := proxy.clients[cltConn]
+	if key == "" {
+		// 尚未发过带key的命令时按命令名选择服务器，如ACL WHOAMI
+		key = cmd.String()
+	}
+	return proxy.route(key)
+}
+
+// key所在的服务器及其连接池；调用方持有mutex
+func (proxy *cacheProxy) route(key string) (string, *connPool, bool) {
+	svrName := proxy.hashmap.FindNode(key)
+	b, ok := proxy.servers[svrName]
+	if !ok || !b.up {
+		return "", nil, false
+	}
+	return svrName, b.pool, true
+}
+
+// 与客户端的连接，读写都经过缓冲区
+type clientConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	user    string                 // 客户端在代理上登录的用户，转发命令时以该用户的身份执行
+	pin     *pinnedConn            // 事务或WAIT使用的独占连接，为nil时命令经连接池或私有连接转发
+	private map[string]*pinnedConn // 改变过连接状态后到各服务器的私有连接，key=服务器名字；为nil时经连接池转发
+	state   []stateCmd             // 改变过连接状态的命令，新建私有连接时重放
+	multi   bool                   // 客户端执行了MULTI，尚未EXEC或DISCARD
+	admin   bool                   // 执行过PROXY AUTH
+	mutex   sync.Mutex
+	closing bool // 代理正在关闭，不再读取新命令
 }
 
-func (proxy *cacheProxy) schedule(cltConn net.Conn) {
+// 每个客户端连接的读写缓冲区大小
+const ioBufSize = 4096
+
+func newClientConn(conn net.Conn) *clientConn {
+	return &clientConn{
+		Conn:   conn,
+		reader: bufio.NewReaderSize(conn, ioBufSize),
+		writer: bufio.NewWriterSize(conn, ioBufSize),
+		user:   acl.Unauthenticated,
+	}
+}
+
+// 处理客户端的一条命令，客户端断开或空闲超时时返回false
+func (proxy *cacheProxy) schedule(clt *clientConn) bool {
+	// 客户端空闲超时；代理正在关闭时不再读取命令
+	if !clt.waitCommand(proxy.cfg.Timeout) {
+		clt.writer.Flush()
+		return false
+	}
 	// 接受客户端命令
-	char := make([]byte, 1)
 	cmd, args, ok := utils.ParseFsm(func() (byte, bool) {
-		if _, err := cltConn.Read(char); err != nil {
-			return '-', false
-		}
-		return char[0], true
+		b, err := clt.reader.ReadByte()
+		return b, (err == nil)
 	})
 
 	if !ok {
-		return
+		clt.writer.Flush()
+		return false
 	}
 
 	if cmd == utils.ERROR {
-		utils.WriteAll(cltConn, []byte("Wrong fomat"))
-		return
-	}
-	// 转发客户端命令
-	for _, arg := range args {
-		// 根据客户端命令中的key选择对应的服务器
-		svrName, svrConn, ok := proxy.chooseServer(cltConn, cmd, arg)
-		if !ok {
-			utils.WriteAll(cltConn, []byte("EMPTY KEY: Cannot find server"))
-			return
+		utils.WriteReply(clt.writer, []byte("Wrong fomat"))
+	} else if cmd == utils.INFO {
+		// INFO由代理自己回复，查询缓存服务器的INFO须直接连接缓存服务器
+		utils.WriteReply(clt.writer, utils.MultiLine(proxy.info(strings.Fields(strings.ToLower(utils.Bodies(cmd, args)[0])))))
+	} else if cmd == utils.MONITOR {
+		// 客户端进入MONITOR后不再处理命令，结束时断开连接
+		proxy.monitor(clt)
+		return false
+	} else if cmd == utils.SUBSCRIBE || cmd == utils.PSUBSCRIBE {
+		// 订阅期间命令都发给频道所在的服务器，结束时断开连接
+		proxy.subscribe(clt, cmd, args)
+		return false
+	} else if cmd == utils.PING {
+		utils.WriteReply(clt.writer, []byte("PONG"))
+	} else if cmd == utils.PROXY {
+		utils.WriteReply(clt.writer, proxy.execProxyCmd(clt, utils.Bodies(cmd, args)[0]))
+	} else if cmd == utils.AUTH && proxy.cfg.BackendAuth() {
+		utils.WriteReply(clt.writer, proxy.authClient(clt, utils.Bodies(cmd, args)[0]))
+	} else if isReplicationCmd(cmd) {
+		utils.WriteReply(clt.writer, []byte(cmd.String()+" cannot be used through the proxy"))
+	} else if changesConnState(cmd, utils.Bodies(cmd, args)[0]) && (clt.pin != nil || clt.multi) {
+		utils.WriteReply(clt.writer, []byte(cmd.String()+" is not allowed in a transaction"))
+	} else {
+		// 转发客户端命令
+		for _, arg := range utils.Bodies(cmd, args) {
+			if clt.pin != nil || clt.multi || needsPin(cmd) {
+				clt.writer.Write(proxy.forwardPinned(clt, cmd, arg))
+			} else if clt.private != nil || changesConnState(cmd, arg) {
+				clt.writer.Write(proxy.forwardPrivate(clt, cmd, arg))
+			} else {
+				clt.writer.Write(proxy.forward(clt, cmd, arg))
+			}
 		}
-		// 将客户端命令发给服务器，并等待服务器回复
-		utils.WriteAll(svrConn, []byte(cmd.String()+" "+arg))
-		// 将服务器回复转发给客户端
-		proxy.waitAndForwardMsg(svrName, svrConn, cltConn)
 	}
+	// 客户端一次发来多条命令时，全部转发完再将回复一起发出
+	if clt.reader.Buffered() == 0 {
+		return clt.writer.Flush() == nil
+	}
+	return true
 }
 
-func (proxy *cacheProxy) waitAndForwardMsg(svrName string, svrConn net.Conn, cltConn net.Conn) {
-	for char := make([]byte, 1); char[0] != '\n'; {
-		if _, err := svrConn.Read(char); err != nil {
-			if err == io.EOF {
-				// 对端服务器掉线
-				proxy.hashmap.RemoveNode(svrName)
-				delete(proxy.servers, svrName)
-				utils.WriteAll(cltConn, []byte("Server cannot reach"))
-			}
-			break
-		}
+/*
+ * 代理以自己的身份登录服务器时，客户端的AUTH由代理处理：
+ * 用客户端的用户名与密码新建一条到服务器的连接登录，成功后记下该用户，
+ * 之后转发的命令都以ASUSER按该用户的权限执行
+ */
+func (proxy *cacheProxy) authClient(clt *clientConn, body string) []byte {
+	elem := strings.SplitN(body, " ", 2)
+	user, pass := acl.DefaultUser, elem[0]
+	if len(elem) == 2 {
+		user, pass = elem[0], elem[1]
+	}
+	// 尚未发过带key的命令时按用户名选择服务器
+	proxy.mutex.Lock()
+	key := proxy.clients[clt.Conn]
+	if key == "" {
+		key = user
+	}
+	addr := proxy.addrOf(proxy.hashmap.FindNode(key))
+	proxy.mutex.Unlock()
+	if addr == "" {
+		return []byte("EMPTY KEY: Cannot find server")
+	}
 
-		if err := utils.WriteAll(cltConn, char); err != nil {
-			break
+	conn, err := proxy.dial(addr)
+	if err != nil {
+		return []byte("Server cannot reach")
+	}
+	defer conn.Close()
+	if err := authenticate(conn, user, pass, proxy.cfg.ConnectTimeout); err != nil {
+		return []byte(err.Error())
+	}
+	clt.user = user
+	return []byte("DONE")
+}
+
+// 根据客户端命令中的key选择服务器，经连接池转发并等待回复
+func (proxy *cacheProxy) forward(clt *clientConn, cmd utils.CmdType, arg string) []byte {
+	svrName, pool, ok := proxy.chooseServer(clt.Conn, cmd, arg)
+	if !ok {
+		return []byte("EMPTY KEY: Cannot find server\n")
+	}
+	stats := proxy.backend(svrName)
+	atomic.AddUint64(&stats.requests, 1)
+	start := time.Now()
+	mc, err := pool.get()
+	if err == nil {
+		var reply []byte
+		if reply, err = mc.do(proxy.commandLine(clt, cmd, arg), proxy.cfg.BackendTimeout); err == nil {
+			stats.latency.Observe(time.Since(start))
+			return reply
 		}
 	}
+	// 失败次数达到health-fall时移出一致性哈希
+	atomic.AddUint64(&stats.errors, 1)
+	proxy.forwardFailed(svrName, pool, err)
+	return []byte("Server cannot reach\n")
 }
 
 func (proxy *cacheProxy) run() {
+	for _, listener := range proxy.extraListeners {
+		go proxy.acceptLoop(listener)
+	}
+	proxy.acceptLoop(proxy.listener)
+	proxy.shutdown()
+}
+
+// 接受客户端连接直到代理关闭
+func (proxy *cacheProxy) acceptLoop(listener net.Listener) {
 	for {
 		select {
 		case <-ctx.Done():
-			proxy.wg.Wait()
 			return
 		default:
-			cltConn, err := proxy.listener.Accept()
+			cltConn, err := listener.Accept()
 			if err != nil {
 				continue
 			}
 			proxy.wg.Add(1)
+			atomic.AddUint64(&proxy.totalConns, 1)
+			atomic.AddInt64(&proxy.connected, 1)
 			go func() {
-				for {
-					proxy.schedule(cltConn)
+				defer proxy.wg.Done()
+				defer atomic.AddInt64(&proxy.connected, -1)
+				defer cltConn.Close()
+				clt := proxy.addConn(cltConn)
+				defer proxy.removeConn(clt)
+				for proxy.schedule(clt) {
 				}
+				proxy.releaseConns(clt)
+				proxy.mutex.Lock()
+				delete(proxy.clients, cltConn)
+				proxy.mutex.Unlock()
 			}()
 		}
 	}
 }
 
 func getKeyFromCmd(cmd utils.CmdType, arg string) string {
-	if (cmd != utils.MULTI) && (cmd != utils.EXEC) && (cmd != utils.DISCARD) {
+	if (cmd != utils.MULTI) && (cmd != utils.EXEC) && (cmd != utils.DISCARD) && !cmd.JoinArgs() {
 		return strings.Split(arg, ":")[0]
 	}
 	return ""
 }
 
 func main() {
-	proxy := newCacheProxy(8888)
+	cfg, err := config.LoadProxy(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	proxy, err := newCacheProxy(cfg)
+	if err != nil {
+		log.Fatalf("start proxy: %v", err)
+	}
+	log.Printf("tinycached proxy listening on %s", cfg.Listen)
+	if cfg.TLSListen != "" {
+		log.Printf("tinycached proxy listening on %s (tls)", cfg.TLSListen)
+	}
+	if cfg.UnixSocket != "" {
+		log.Printf("tinycached proxy listening on %s (unix)", cfg.UnixSocket)
+	}
+	if cfg.MetricsListen != "" {
+		log.Printf("tinycached proxy metrics on http://%s/metrics", cfg.MetricsListen)
+	}
 	proxy.run()
 }
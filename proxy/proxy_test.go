@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"tinycached/config"
+	"tinycached/proxy/consistenthash"
+	"tinycached/utils"
+)
+
+/*
+ * 进程内的假缓存服务器：每条连接按行读取命令，交给handle回复。
+ * handle为nil时不读取连接，用于模拟写不进去的服务器
+ */
+type fakeBackend struct {
+	listener net.Listener
+	addr     string
+	handle   func(c *fakeConn, line string)
+	mutex    sync.Mutex
+	conns    []*fakeConn
+	data     map[string]string // kvHandler使用的数据
+}
+
+// 假服务器上的一条连接
+type fakeConn struct {
+	net.Conn
+	backend *fakeBackend
+	mutex   sync.Mutex
+	lines   []string // 收到的命令
+	multi   bool     // kvHandler：是否在事务中
+	queue   []string // kvHandler：事务中入队的命令
+	closed  bool
+}
+
+func newFakeBackend(t testing.TB, handle func(c *fakeConn, line string)) *fakeBackend {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBackend{listener: l, addr: l.Addr().String(), handle: handle, data: make(map[string]string)}
+	t.Cleanup(b.close)
+	go b.accept()
+	return b
+}
+
+func (b *fakeBackend) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &fakeConn{Conn: conn, backend: b}
+		b.mutex.Lock()
+		b.conns = append(b.conns, c)
+		b.mutex.Unlock()
+		if b.handle != nil {
+			go c.serve()
+		}
+	}
+}
+
+func (c *fakeConn) serve() {
+	defer c.markClosed()
+	reader := bufio.NewReader(c)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		c.mutex.Lock()
+		c.lines = append(c.lines, line)
+		c.mutex.Unlock()
+		c.backend.handle(c, line)
+	}
+}
+
+func (c *fakeConn) markClosed() {
+	c.Close()
+	c.mutex.Lock()
+	c.closed = true
+	c.mutex.Unlock()
+}
+
+// 写出一条回复，多行回复由调用方拼好
+func (c *fakeConn) reply(s string) {
+	utils.WriteAll(c, []byte(s+"\n"))
+}
+
+func (c *fakeConn) received() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.lines...)
+}
+
+func (c *fakeConn) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+// 全部连接的快照
+func (b *fakeBackend) connections() []*fakeConn {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]*fakeConn(nil), b.conns...)
+}
+
+// 停止接受连接并断开已有的连接，模拟服务器宕机
+func (b *fakeBackend) close() {
+	b.listener.Close()
+	for _, c := range b.connections() {
+		c.Close()
+	}
+}
+
+/*
+ * 最小的缓存服务器：PING、GET、SET、DEL与事务。事务中的命令只入队，EXEC时依次执行，
+ * 回复为各命令回复组成的多行回复
+ */
+func kvHandler(c *fakeConn, line string) {
+	cmd, arg, _ := strings.Cut(line, " ")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch cmd {
+	case "PING":
+		c.reply("PONG")
+	case "MULTI":
+		c.multi = true
+		c.reply("DONE")
+	case "DISCARD":
+		c.multi, c.queue = false, nil
+		c.reply("DONE")
+	case "EXEC":
+		var results []string
+		for _, queued := range c.queue {
+			cmd, arg, _ := strings.Cut(queued, " ")
+			results = append(results, c.backend.exec(cmd, arg))
+		}
+		c.multi, c.queue = false, nil
+		c.reply(string(utils.MultiLine(results)))
+	case "GET", "SET", "DEL":
+		if c.multi {
+			c.queue = append(c.queue, line)
+			c.reply("QUEUED")
+			return
+		}
+		c.reply(c.backend.exec(cmd, arg))
+	default:
+		c.reply("wrong command")
+	}
+}
+
+func (b *fakeBackend) exec(cmd string, arg string) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	key, value, _ := strings.Cut(arg, ":")
+	switch cmd {
+	case "SET":
+		b.data[key] = value
+		return "DONE"
+	case "DEL":
+		delete(b.data, key)
+		return "DONE"
+	}
+	if v, ok := b.data[key]; ok {
+		return v
+	}
+	return "key is not exits"
+}
+
+// 不经newCacheProxy建立代理：不监听、不启动健康检查协程，由测试直接调用checkAll
+func newTestProxy(t testing.TB, args ...string) *cacheProxy {
+	t.Helper()
+	cfg, err := config.LoadProxy(append([]string{"-connect-timeout", "1s", "-health-timeout", "200ms"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &cacheProxy{
+		startTime:    time.Now(),
+		backendStats: make(map[string]*backendStats),
+		cfg:          cfg,
+		health:       healthOptionsOf(cfg),
+		servers:      make(map[string]*backend),
+		clients:      make(map[net.Conn]string),
+		conns:        make(map[*clientConn]struct{}),
+	}
+	if proxy.hashmap, err = consistenthash.New(cfg.HashAlgorithm, cfg.HashReplicas); err != nil {
+		t.Fatal(err)
+	}
+	proxy.applyBackends(cfg.BackendSpecs())
+	t.Cleanup(func() {
+		proxy.mutex.Lock()
+		defer proxy.mutex.Unlock()
+		for _, b := range proxy.servers {
+			b.closeConns()
+		}
+	})
+	return proxy
+}
+
+// 经代理执行命令的客户端，连接的另一端由schedule处理
+type testClient struct {
+	t      testing.TB
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// 本机客户端
+func (proxy *cacheProxy) testClient(t testing.TB) *testClient {
+	return proxy.testClientFrom(t, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000})
+}
+
+// 以addr为客户端地址的连接
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (proxy *cacheProxy) testClientFrom(t testing.TB, addr net.Addr) *testClient {
+	local, pipe := net.Pipe()
+	remote := &addrConn{Conn: pipe, remote: addr}
+	clt := proxy.addConn(remote)
+	go func() {
+		defer remote.Close()
+		defer proxy.removeConn(clt)
+		for proxy.schedule(clt) {
+		}
+		proxy.releaseConns(clt)
+		proxy.mutex.Lock()
+		delete(proxy.clients, remote)
+		proxy.mutex.Unlock()
+	}()
+	t.Cleanup(func() { local.Close() })
+	return &testClient{t: t, conn: local, reader: bufio.NewReader(local)}
+}
+
+// 发送一条命令并读取回复，多行回复以\n连接，不含结尾的\n
+func (c *testClient) do(line string) string {
+	c.t.Helper()
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := utils.WriteAll(c.conn, []byte(line+"\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	reply, err := utils.ReadReply(c.reader.ReadByte)
+	if err != nil {
+		c.t.Fatalf("%s: read reply: %v (got %q)", line, err, reply)
+	}
+	return strings.TrimSuffix(string(reply), "\n")
+}
+
+func (c *testClient) expect(line string, want string) {
+	c.t.Helper()
+	if got := c.do(line); got != want {
+		c.t.Errorf("%s: got %q, want %q", line, got, want)
+	}
+}
+
+// 每隔一段时间检查一次，直到cond成立或超时
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"tinycached/utils"
+)
+
+// 键空间通知频道的前缀，频道名之后是KEY
+const keyspacePrefix = "__keyspace@0__:"
+
+// 频道所在的服务器按该key选择：键空间通知按KEY，其余按频道名
+func channelKey(channel string) string {
+	if strings.HasPrefix(channel, keyspacePrefix) {
+		return strings.TrimPrefix(channel, keyspacePrefix)
+	}
+	return channel
+}
+
+/*
+ * 订阅：服务器随时推送消息，不能与其他客户端共用连接。代理为客户端建立一条到频道所在服务器的独占连接，
+ * 之后客户端的命令都原样发给该服务器，服务器的回复与推送都转发给客户端，直到客户端或服务器断开。
+ * 同一个客户端订阅的频道须在同一台服务器上；模式订阅与__keyevent@0__频道只收到该服务器的消息
+ */
+func (proxy *cacheProxy) subscribe(clt *clientConn, cmd utils.CmdType, args []string) {
+	if clt.pin != nil || clt.multi {
+		utils.WriteReply(clt.writer, []byte("SUBSCRIBE is not allowed in a transaction"))
+		clt.writer.Flush()
+		return
+	}
+	key := ""
+	if len(args) > 0 {
+		key = channelKey(args[0])
+	}
+	proxy.mutex.Lock()
+	svrName, pool, ok := proxy.route(key)
+	proxy.mutex.Unlock()
+	if !ok {
+		utils.WriteReply(clt.writer, []byte("EMPTY KEY: Cannot find server"))
+		clt.writer.Flush()
+		return
+	}
+	// 重放客户端改变过的连接状态，如AUTH
+	pc, err := proxy.openConn(clt, svrName, pool)
+	if err != nil {
+		utils.WriteReply(clt.writer, []byte("Server cannot reach"))
+		clt.writer.Flush()
+		return
+	}
+	conn := pc.conn
+	defer conn.Close()
+	for _, body := range utils.Bodies(cmd, args) {
+		if err := utils.WriteAll(conn, proxy.commandLine(clt, cmd, body)); err != nil {
+			utils.WriteReply(clt.writer, []byte("Server cannot reach"))
+			clt.writer.Flush()
+			return
+		}
+	}
+
+	// 服务器的回复与推送原样转发给客户端，服务器断开时结束
+	serverGone := make(chan struct{})
+	go func() {
+		defer close(serverGone)
+		buf := make([]byte, ioBufSize)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				clt.writer.Write(buf[:n])
+				if clt.writer.Flush() != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	// 客户端的命令发给该服务器，客户端断开时结束
+	clientGone := make(chan struct{})
+	go func() {
+		defer close(clientGone)
+		clt.SetReadDeadline(time.Time{})
+		for {
+			cmd, args, ok := utils.ParseFsm(func() (byte, bool) {
+				b, err := clt.reader.ReadByte()
+				return b, err == nil
+			})
+			if !ok {
+				return
+			}
+			for _, body := range utils.Bodies(cmd, args) {
+				if utils.WriteAll(conn, proxy.commandLine(clt, cmd, body)) != nil {
+					return
+				}
+			}
+		}
+	}()
+	select {
+	case <-serverGone:
+	case <-clientGone:
+	case <-ctx.Done():
+	}
+	// 关闭两端的连接，使两个协程都退出
+	conn.Close()
+	clt.Close()
+	<-serverGone
+	<-clientGone
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// 读取下一条命令前调用，设置空闲超时；代理正在关闭时返回false
+func (c *clientConn) waitCommand(timeout time.Duration) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closing {
+		return false
+	}
+	if timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		c.SetReadDeadline(time.Time{})
+	}
+	return true
+}
+
+// 停止读取新命令：正在转发的命令不受影响，阻塞在读上的协程立即返回
+func (c *clientConn) stopReading() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closing = true
+	c.SetReadDeadline(time.Now())
+}
+
+func (proxy *cacheProxy) addConn(conn net.Conn) *clientConn {
+	c := newClientConn(conn)
+	proxy.connMutex.Lock()
+	defer proxy.connMutex.Unlock()
+
+	proxy.conns[c] = struct{}{}
+	if ctx.Err() != nil {
+		// 关闭过程中才接受的连接不再处理命令
+		c.closing = true
+	}
+	return c
+}
+
+func (proxy *cacheProxy) removeConn(c *clientConn) {
+	proxy.connMutex.Lock()
+	defer proxy.connMutex.Unlock()
+
+	delete(proxy.conns, c)
+}
+
+/*
+ * 关闭流程：
+ * 1. 监听已关闭，不再接受新连接
+ * 2. 唤醒空闲连接并使其退出，正在转发命令的连接回复后退出；订阅与MONITOR的连接随ctx结束
+ * 3. 等待全部连接退出，超过shutdown-timeout则强制关闭
+ * 4. 关闭到各个服务器的连接，仍在等待服务器回复的命令随之返回
+ */
+func (proxy *cacheProxy) shutdown() {
+	log.Print("shutting down")
+	proxy.connMutex.Lock()
+	for c := range proxy.conns {
+		c.stopReading()
+	}
+	proxy.connMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		proxy.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(proxy.cfg.ShutdownTimeout):
+		proxy.connMutex.Lock()
+		log.Printf("shutdown timeout, closing %d connection(s)", len(proxy.conns))
+		for c := range proxy.conns {
+			c.Close()
+		}
+		proxy.connMutex.Unlock()
+	}
+
+	// 只关闭不置空，强制关闭后仍在转发的协程从已关闭的连接池得到错误
+	proxy.mutex.Lock()
+	for _, b := range proxy.servers {
+		if b.pool != nil {
+			b.pool.close()
+		}
+	}
+	proxy.mutex.Unlock()
+	log.Print("proxy stopped")
+}
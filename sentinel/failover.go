@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+	"tinycached/utils"
+)
+
+// 提升副本后轮询其角色的间隔
+const promotePollInterval = 100 * time.Millisecond
+
+// 通知代理的一次地址变更
+type proxySwitch struct {
+	proxy string
+	name  string
+	from  string
+	to    string
+}
+
+// 主服务器主观下线时询问其他哨兵，达到quorum即客观下线，随后尝试成为领头哨兵并故障转移
+func (s *sentinel) checkMaster(m *master) {
+	s.mutex.Lock()
+	down := s.sdown(m.inst)
+	if !down {
+		if m.odown {
+			log.Printf("%s: master %s is back", m.name, m.addr)
+		}
+		m.odown = false
+	}
+	s.mutex.Unlock()
+	if !down {
+		return
+	}
+
+	agreed := 1
+	for _, reply := range s.broadcast(fmt.Sprintf("%s IS-MASTER-DOWN %s", utils.SENTINEL, m.name)) {
+		if reply == "1" {
+			agreed++
+		}
+	}
+
+	s.mutex.Lock()
+	if agreed < m.quorum || !s.sdown(m.inst) {
+		m.odown = false
+		s.mutex.Unlock()
+		return
+	}
+	if !m.odown {
+		log.Printf("%s: master %s is down, %d of quorum %d sentinels agree", m.name, m.addr, agreed, m.quorum)
+	}
+	m.odown = true
+	// 上一次故障转移或投票之后failover-timeout内不再发起，加上随机的延迟，避免多个哨兵同时拉票
+	if m.failingOver || time.Since(m.failoverStart) < s.cfg.FailoverTimeout {
+		s.mutex.Unlock()
+		return
+	}
+	s.mutex.Unlock()
+	time.Sleep(time.Duration(rand.Int63n(int64(checkInterval))))
+
+	if epoch, ok := s.elect(m); ok {
+		s.failover(m, epoch)
+	}
+}
+
+/*
+ * 增加纪元并向其他哨兵拉票，投给自己的哨兵数（含自己）不少于全部哨兵的多数且不少于quorum时当选，
+ * 返回当选的纪元
+ */
+func (s *sentinel) elect(m *master) (uint64, bool) {
+	s.mutex.Lock()
+	if m.failingOver || time.Since(m.failoverStart) < s.cfg.FailoverTimeout {
+		s.mutex.Unlock()
+		return 0, false
+	}
+	s.epoch++
+	epoch := s.epoch
+	m.leader, m.leaderEpoch, m.failoverStart = s.id, epoch, time.Now()
+	s.mutex.Unlock()
+
+	votes := 1
+	line := fmt.Sprintf("%s VOTE %s %d %s", utils.SENTINEL, m.name, epoch, s.id)
+	for _, reply := range s.broadcast(line) {
+		elem := strings.Fields(reply)
+		if len(elem) == 2 && elem[0] == s.id && elem[1] == strconv.FormatUint(epoch, 10) {
+			votes++
+		}
+	}
+	needed := (len(s.cfg.Sentinels)+1)/2 + 1
+	if m.quorum > needed {
+		needed = m.quorum
+	}
+	if votes < needed {
+		log.Printf("%s: election for epoch %d lost, %d of %d votes", m.name, epoch, votes, needed)
+		return 0, false
+	}
+	log.Printf("%s: elected leader for epoch %d with %d votes", m.name, epoch, votes)
+	return epoch, true
+}
+
+// 为拉票的哨兵投票：每个纪元只投给第一个拉票的哨兵，返回该纪元投给的哨兵
+func (s *sentinel) vote(m *master, epoch uint64, candidate string) (string, uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if epoch > s.epoch {
+		s.epoch = epoch
+	}
+	if epoch > m.leaderEpoch {
+		m.leader, m.leaderEpoch = candidate, epoch
+		// 投票后自己在failover-timeout内不再拉票，给当选的哨兵留出故障转移的时间
+		if candidate != s.id {
+			m.failoverStart = time.Now()
+		}
+	}
+	return m.leader, m.leaderEpoch
+}
+
+// SENTINEL FAILOVER：不询问其他哨兵，以新的纪元立即故障转移
+func (s *sentinel) forceFailover(m *master) error {
+	s.mutex.Lock()
+	if m.failingOver {
+		s.mutex.Unlock()
+		return errors.New("failover already in progress")
+	}
+	s.epoch++
+	epoch := s.epoch
+	m.leader, m.leaderEpoch, m.failoverStart = s.id, epoch, time.Now()
+	s.mutex.Unlock()
+
+	if _, ok := s.promotable(m); !ok {
+		return errors.New("no suitable replica")
+	}
+	go s.failover(m, epoch)
+	return nil
+}
+
+// 在持有锁时调用：选出在线、复制偏移量最大的副本，偏移量相同时选地址小的
+func (s *sentinel) bestReplica(m *master) (string, bool) {
+	best, found := "", false
+	var offset int64
+	for _, addr := range sortedAddrs(m.replicas) {
+		r := m.replicas[addr]
+		if s.sdown(r) || r.role != "slave" {
+			continue
+		}
+		if !found || r.offset > offset {
+			best, offset, found = addr, r.offset, true
+		}
+	}
+	return best, found
+}
+
+func (s *sentinel) promotable(m *master) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.bestReplica(m)
+}
+
+/*
+ * 领头哨兵的故障转移：
+ * 1. 选出复制偏移量最大的副本，执行REPLICAOF NO ONE，等待它的角色变为master
+ * 2. 采用新的地址与纪元，并告知其他哨兵
+ * 3. 让其他副本复制新的主服务器，失败的由之后的检查重试
+ * 4. 通知代理，失败的由notifyLoop重试
+ */
+func (s *sentinel) failover(m *master, epoch uint64) {
+	s.mutex.Lock()
+	if m.failingOver {
+		s.mutex.Unlock()
+		return
+	}
+	candidate, ok := s.bestReplica(m)
+	if !ok {
+		s.mutex.Unlock()
+		log.Printf("%s: failover aborted, no suitable replica", m.name)
+		return
+	}
+	m.failingOver = true
+	s.mutex.Unlock()
+
+	log.Printf("%s: promoting %s, epoch %d", m.name, candidate, epoch)
+	if err := s.promote(candidate); err != nil {
+		log.Printf("%s: failover aborted, promote %s: %v", m.name, candidate, err)
+		s.mutex.Lock()
+		m.failingOver = false
+		s.mutex.Unlock()
+		return
+	}
+
+	s.mutex.Lock()
+	old := m.addr
+	if epoch > m.configEpoch {
+		m.configEpoch = epoch
+		s.switchMaster(m, candidate)
+	}
+	m.failingOver = false
+	m.inst.role = "master"
+	var others []string
+	for _, addr := range sortedAddrs(m.replicas) {
+		if addr != old && !s.sdown(m.replicas[addr]) {
+			others = append(others, addr)
+		}
+	}
+	s.mutex.Unlock()
+	log.Printf("%s: failover done, master %s -> %s", m.name, old, candidate)
+
+	s.hello(m)
+	for _, addr := range others {
+		s.repoint(m, addr, candidate)
+	}
+	s.notifyProxies()
+}
+
+// 提升副本为主服务器，等待它在INFO中报告role:master，最多等待failover-timeout
+func (s *sentinel) promote(addr string) error {
+	if err := s.replicaOf(addr, ""); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(s.cfg.FailoverTimeout)
+	for time.Now().Before(deadline) {
+		if info, err := s.info(addr); err == nil && info.role == "master" {
+			return nil
+		}
+		time.Sleep(promotePollInterval)
+	}
+	return errors.New("timeout waiting for the replica to become a master")
+}
+
+// 每秒重试通知代理，直到哨兵关闭
+func (s *sentinel) notifyLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		s.notifyProxies()
+	}
+}
+
+/*
+ * 按发生的顺序用PROXY SWITCH把地址变更告知代理。无法连接的代理留到下次重试，
+ * 同一代理之后的变更也一起推迟；代理返回错误（如已由其他哨兵通知）时丢弃该变更
+ */
+func (s *sentinel) notifyProxies() {
+	s.mutex.Lock()
+	pending := s.notify
+	s.notify = nil
+	s.mutex.Unlock()
+
+	var retry []proxySwitch
+	failed := make(map[string]bool)
+	for _, sw := range pending {
+		if failed[sw.proxy] {
+			retry = append(retry, sw)
+			continue
+		}
+		lines := []string{fmt.Sprintf("%s SWITCH %s %s", utils.PROXY, sw.from, sw.to)}
+		if s.cfg.ProxyAuthPass != "" {
+			lines = append([]string{utils.PROXY.String() + " AUTH " + s.cfg.ProxyAuthPass}, lines...)
+		}
+		replies, err := s.call(sw.proxy, true, lines...)
+		if err != nil {
+			failed[sw.proxy] = true
+			retry = append(retry, sw)
+			continue
+		}
+		if reply := replies[len(replies)-1]; replies[0] != "DONE" || reply != "DONE" {
+			if replies[0] != "DONE" {
+				reply = "proxy auth: " + replies[0]
+			}
+			log.Printf("%s: proxy %s: switch %s -> %s: %s", sw.name, sw.proxy, sw.from, sw.to, reply)
+			continue
+		}
+		log.Printf("%s: proxy %s switched %s -> %s", sw.name, sw.proxy, sw.from, sw.to)
+	}
+
+	s.mutex.Lock()
+	s.notify = append(retry, s.notify...)
+	s.mutex.Unlock()
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tinycached/utils"
+)
+
+// 检查缓存服务器与向其他哨兵传播地址的间隔
+const checkInterval = time.Second
+
+// 每秒检查一次主服务器，直到哨兵关闭
+func (s *sentinel) monitorLoop(name string) {
+	defer s.wg.Done()
+	s.mutex.Lock()
+	m := s.masters[name]
+	s.mutex.Unlock()
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		s.checkInstances(m)
+		s.checkMaster(m)
+		s.reconfigure(m)
+		s.hello(m)
+	}
+}
+
+// INFO replication的结果
+type replInfo struct {
+	role       string
+	masterAddr string
+	linkUp     bool
+	offset     int64
+	replicas   []string // 主服务器的副本地址
+}
+
+// 向实例发送INFO replication并解析
+func (s *sentinel) info(addr string) (*replInfo, error) {
+	replies, err := s.call(addr, true, utils.INFO.String()+" replication")
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string)
+	for _, line := range strings.Split(replies[0], "\n") {
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			fields[k] = v
+		}
+	}
+	info := &replInfo{role: fields["role"]}
+	switch info.role {
+	case "master":
+		for i := 0; ; i++ {
+			v, ok := fields["slave"+strconv.Itoa(i)]
+			if !ok {
+				break
+			}
+			var ip, port string
+			for _, kv := range strings.Split(v, ",") {
+				if k, v, ok := strings.Cut(kv, "="); ok && k == "ip" {
+					ip = v
+				} else if ok && k == "port" {
+					port = v
+				}
+			}
+			if ip != "" && port != "" {
+				info.replicas = append(info.replicas, net.JoinHostPort(ip, port))
+			}
+		}
+	case "slave":
+		info.masterAddr = net.JoinHostPort(fields["master_host"], fields["master_port"])
+		info.linkUp = fields["master_link_status"] == "up"
+		info.offset, _ = strconv.ParseInt(fields["slave_repl_offset"], 10, 64)
+	default:
+		return nil, fmt.Errorf("unexpected INFO reply %q", replies[0])
+	}
+	return info, nil
+}
+
+// 并发检查主服务器与全部副本，记录结果；从主服务器的回复中发现新的副本
+func (s *sentinel) checkInstances(m *master) {
+	s.mutex.Lock()
+	insts := []*instance{m.inst}
+	for _, r := range m.replicas {
+		insts = append(insts, r)
+	}
+	s.mutex.Unlock()
+
+	infos := make([]*replInfo, len(insts))
+	var wg sync.WaitGroup
+	for i, inst := range insts {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			infos[i], _ = s.info(addr)
+		}(i, inst.addr)
+	}
+	wg.Wait()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for i, inst := range insts {
+		info := infos[i]
+		if info == nil {
+			continue
+		}
+		inst.lastOK, inst.role = now, info.role
+		inst.masterAddr, inst.linkUp, inst.offset = info.masterAddr, info.linkUp, info.offset
+		// 检查期间主服务器可能已经切换，只从当前主服务器的回复中发现副本
+		if inst != m.inst {
+			continue
+		}
+		for _, addr := range info.replicas {
+			if _, ok := m.replicas[addr]; !ok && addr != m.addr {
+				log.Printf("%s: discovered replica %s", m.name, addr)
+				m.replicas[addr] = &instance{addr: addr, lastOK: now}
+			}
+		}
+	}
+}
+
+/*
+ * 让实例复制当前的主服务器：主服务器在线且没有正在进行的故障转移时，
+ * 自认为是主服务器的副本（如恢复的原主服务器）或复制其他地址的副本都改为复制当前的主服务器
+ */
+func (s *sentinel) reconfigure(m *master) {
+	s.mutex.Lock()
+	if m.failingOver || s.sdown(m.inst) || m.inst.role != "master" {
+		s.mutex.Unlock()
+		return
+	}
+	addr := m.addr
+	var wrong []string
+	for _, r := range m.replicas {
+		if s.sdown(r) || r.role == "" {
+			continue
+		}
+		if r.role == "master" || r.masterAddr != addr {
+			wrong = append(wrong, r.addr)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, r := range wrong {
+		log.Printf("%s: reconfiguring %s as a replica of %s", m.name, r, addr)
+		s.repoint(m, r, addr)
+	}
+}
+
+// 让副本addr复制新的主服务器，成功后记下，下一次检查之前不再重复发送
+func (s *sentinel) repoint(m *master, addr string, master string) {
+	if err := s.replicaOf(addr, master); err != nil {
+		log.Printf("%s: reconfigure %s: %v", m.name, addr, err)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if r, ok := m.replicas[addr]; ok {
+		r.role, r.masterAddr = "slave", master
+	}
+}
+
+// 让实例addr复制master；master为空表示成为主服务器
+func (s *sentinel) replicaOf(addr string, master string) error {
+	line := utils.REPLICAOF.String() + " NO ONE"
+	if master != "" {
+		host, port, err := net.SplitHostPort(master)
+		if err != nil {
+			return err
+		}
+		line = utils.REPLICAOF.String() + " " + host + " " + port
+	}
+	replies, err := s.call(addr, true, line)
+	if err != nil {
+		return err
+	}
+	if replies[0] != "DONE" {
+		return fmt.Errorf("%s", replies[0])
+	}
+	return nil
+}
+
+// 向其他哨兵传播主服务器当前的地址与纪元，使重启或错过故障转移的哨兵跟上
+func (s *sentinel) hello(m *master) {
+	s.mutex.Lock()
+	line := fmt.Sprintf("%s HELLO %s %s %d", utils.SENTINEL, m.name, m.addr, m.configEpoch)
+	s.mutex.Unlock()
+	s.broadcast(line)
+}
+
+// 并发向全部其他哨兵发送一条命令，返回各哨兵的回复，无法连接的哨兵不在其中
+func (s *sentinel) broadcast(line string) []string {
+	replies := make([]string, len(s.cfg.Sentinels))
+	var wg sync.WaitGroup
+	for i, peer := range s.cfg.Sentinels {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			if ret, err := s.call(peer, false, line); err == nil {
+				replies[i] = ret[0]
+			}
+		}(i, peer)
+	}
+	wg.Wait()
+
+	ret := replies[:0]
+	for _, reply := range replies {
+		if reply != "" {
+			ret = append(ret, reply)
+		}
+	}
+	return ret
+}
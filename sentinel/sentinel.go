@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"tinycached/config"
+	"tinycached/server/acl"
+	"tinycached/utils"
+)
+
+/*
+ * 哨兵：监控主服务器与它的副本，主服务器下线时自动故障转移。
+ * 1. 每秒向主服务器与已知的副本发送INFO replication，从主服务器的回复中发现新的副本
+ * 2. 主服务器持续无响应超过down-after即主观下线（sdown），再询问其他哨兵，
+ *    认为下线的哨兵数（含自己）达到quorum即客观下线（odown）
+ * 3. 客观下线后增加纪元并向其他哨兵拉票，得到多数哨兵（且不少于quorum）的票即成为领头哨兵
+ * 4. 领头哨兵选出复制偏移量最大的副本，执行REPLICAOF NO ONE将其提升为主服务器，
+ *    让其他副本复制新的主服务器，再把新地址告知其他哨兵与代理
+ * 5. 原来的主服务器恢复后，哨兵让它成为新主服务器的副本
+ */
+type sentinel struct {
+	id       string // 哨兵ID，40个十六进制字符，每次启动随机生成
+	cfg      *config.Sentinel
+	mutex    sync.Mutex
+	epoch    uint64             // 当前纪元，每次拉票加1，收到更大的纪元时跟随
+	masters  map[string]*master // key=主服务器的名字
+	names    []string           // 主服务器的名字，按名字排序
+	notify   []proxySwitch      // 尚未成功通知代理的地址变更，按发生的顺序
+	listener net.Listener
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// 一个被监控的主服务器，由sentinel.mutex保护
+type master struct {
+	name          string
+	quorum        int
+	addr          string // 当前的地址，故障转移后为新主服务器的地址
+	configEpoch   uint64 // 当前地址生效时的纪元，哨兵之间以纪元大的地址为准
+	inst          *instance
+	replicas      map[string]*instance // key=副本地址
+	odown         bool
+	leader        string // 本纪元投票给的哨兵
+	leaderEpoch   uint64
+	failoverStart time.Time // 最近一次开始故障转移或投票的时间
+	failingOver   bool
+}
+
+// 一个缓存服务器实例最近一次INFO replication的结果，由sentinel.mutex保护
+type instance struct {
+	addr       string
+	lastOK     time.Time // 最近一次正常回复的时间
+	role       string    // master或slave
+	masterAddr string    // 副本正在复制的主服务器地址
+	linkUp     bool      // 副本与主服务器的连接是否正常
+	offset     int64     // 副本已执行的复制流偏移量
+}
+
+func newSentinel(cfg *config.Sentinel) (*sentinel, error) {
+	s := &sentinel{
+		id:      newSentinelID(),
+		cfg:     cfg,
+		masters: make(map[string]*master),
+		stop:    make(chan struct{}),
+	}
+	now := time.Now()
+	for _, spec := range cfg.Masters() {
+		// 启动时视为刚收到过回复，避免在第一次检查之前就判定下线
+		s.masters[spec.Name] = &master{
+			name:     spec.Name,
+			quorum:   spec.Quorum,
+			addr:     spec.Addr,
+			inst:     &instance{addr: spec.Addr, lastOK: now},
+			replicas: make(map[string]*instance),
+		}
+		s.names = append(s.names, spec.Name)
+	}
+	sort.Strings(s.names)
+
+	var err error
+	if s.listener, err = net.Listen("tcp", cfg.Listen); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newSentinelID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *sentinel) run() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		close(s.stop)
+		s.listener.Close()
+	}()
+
+	for _, name := range s.names {
+		s.wg.Add(1)
+		go s.monitorLoop(name)
+	}
+	s.wg.Add(1)
+	go s.notifyLoop()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.stop:
+				s.wg.Wait()
+				return
+			default:
+				continue
+			}
+		}
+		go s.serve(conn)
+	}
+}
+
+// 处理其他哨兵与管理员的命令，直到连接断开
+func (s *sentinel) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		cmd, args, ok := utils.ParseFsm(func() (byte, bool) {
+			b, err := reader.ReadByte()
+			return b, err == nil
+		})
+		if !ok {
+			return
+		}
+		var ret []byte
+		if cmd == utils.SENTINEL {
+			ret = s.execCmd(utils.Bodies(cmd, args)[0])
+		} else {
+			ret = []byte("wrong command")
+		}
+		utils.WriteReply(writer, ret)
+		if reader.Buffered() == 0 && writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+/*
+ * 哨兵的命令：
+ * SENTINEL MASTERS						全部主服务器的状态
+ * SENTINEL GET-MASTER-ADDR-BY-NAME 名字	主服务器当前的地址
+ * SENTINEL REPLICAS 名字					主服务器的副本
+ * SENTINEL FAILOVER 名字					不经其他哨兵同意，立即开始故障转移
+ * 以下由哨兵之间自动发送：
+ * SENTINEL IS-MASTER-DOWN 名字				自己是否认为主服务器主观下线，回复1或0
+ * SENTINEL VOTE 名字 纪元 哨兵ID			拉票，回复"投票给的哨兵ID 纪元"
+ * SENTINEL HELLO 名字 地址 纪元				传播主服务器的地址，纪元大于自己记录的时采用
+ */
+func (s *sentinel) execCmd(body string) []byte {
+	elem := strings.Fields(body)
+	if len(elem) == 0 {
+		return []byte("wrong command")
+	}
+	sub, elem := strings.ToUpper(elem[0]), elem[1:]
+	if sub == "MASTERS" {
+		return utils.MultiLine(s.mastersInfo())
+	}
+	if len(elem) == 0 {
+		return []byte("wrong command")
+	}
+	s.mutex.Lock()
+	m, ok := s.masters[elem[0]]
+	s.mutex.Unlock()
+	if !ok {
+		return []byte("no such master")
+	}
+
+	switch {
+	case sub == "GET-MASTER-ADDR-BY-NAME" && len(elem) == 1:
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return []byte(m.addr)
+
+	case sub == "REPLICAS" && len(elem) == 1:
+		return utils.MultiLine(s.replicasInfo(m))
+
+	case sub == "FAILOVER" && len(elem) == 1:
+		if err := s.forceFailover(m); err != nil {
+			return []byte(err.Error())
+		}
+		return []byte("DONE")
+
+	case sub == "IS-MASTER-DOWN" && len(elem) == 1:
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.sdown(m.inst) {
+			return []byte("1")
+		}
+		return []byte("0")
+
+	case sub == "VOTE" && len(elem) == 3:
+		epoch, err := strconv.ParseUint(elem[1], 10, 64)
+		if err != nil {
+			return []byte("invalid epoch")
+		}
+		leader, leaderEpoch := s.vote(m, epoch, elem[2])
+		return []byte(fmt.Sprintf("%s %d", leader, leaderEpoch))
+
+	case sub == "HELLO" && len(elem) == 3:
+		epoch, err := strconv.ParseUint(elem[2], 10, 64)
+		if err != nil {
+			return []byte("invalid epoch")
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.adopt(m, elem[1], epoch)
+		return []byte("DONE")
+	}
+	return []byte("wrong command")
+}
+
+// 每个主服务器一行：name=,addr=,status=ok|sdown|odown,replicas=,epoch=
+func (s *sentinel) mastersInfo() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	lines := make([]string, 0, len(s.names))
+	for _, name := range s.names {
+		m := s.masters[name]
+		status := "ok"
+		if m.odown {
+			status = "odown"
+		} else if s.sdown(m.inst) {
+			status = "sdown"
+		}
+		lines = append(lines, fmt.Sprintf("name=%s,addr=%s,status=%s,replicas=%d,epoch=%d",
+			m.name, m.addr, status, len(m.replicas), m.configEpoch))
+	}
+	return lines
+}
+
+// 每个副本一行：addr=,status=ok|sdown,role=,master=,offset=
+func (s *sentinel) replicasInfo(m *master) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	lines := make([]string, 0, len(m.replicas))
+	for _, addr := range sortedAddrs(m.replicas) {
+		r := m.replicas[addr]
+		status := "ok"
+		if s.sdown(r) {
+			status = "sdown"
+		}
+		lines = append(lines, fmt.Sprintf("addr=%s,status=%s,role=%s,master=%s,offset=%d",
+			r.addr, status, r.role, r.masterAddr, r.offset))
+	}
+	return lines
+}
+
+func sortedAddrs(insts map[string]*instance) []string {
+	addrs := make([]string, 0, len(insts))
+	for addr := range insts {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// 在持有锁时调用：实例是否主观下线
+func (s *sentinel) sdown(inst *instance) bool {
+	return time.Since(inst.lastOK) > s.cfg.DownAfter
+}
+
+/*
+ * 在持有锁时调用：采用其他哨兵传播的主服务器地址，纪元不大于自己记录的时忽略。
+ * 原来的主服务器变为副本，恢复后由哨兵让它复制新的主服务器
+ */
+func (s *sentinel) adopt(m *master, addr string, epoch uint64) {
+	if epoch > s.epoch {
+		s.epoch = epoch
+	}
+	if epoch <= m.configEpoch {
+		return
+	}
+	m.configEpoch = epoch
+	if addr == m.addr {
+		return
+	}
+	log.Printf("%s: switch master %s -> %s, epoch %d", m.name, m.addr, addr, epoch)
+	s.switchMaster(m, addr)
+}
+
+// 在持有锁时调用：将主服务器换成addr，原来的主服务器变为副本，并通知代理
+func (s *sentinel) switchMaster(m *master, addr string) {
+	old := m.inst
+	inst, ok := m.replicas[addr]
+	if !ok {
+		inst = &instance{addr: addr}
+	}
+	delete(m.replicas, addr)
+	// 新的主服务器视为刚收到过回复，下一次检查之前不判定下线
+	inst.lastOK = time.Now()
+	m.replicas[old.addr] = old
+	m.inst, m.addr = inst, addr
+	m.odown, m.failingOver = false, false
+	for _, proxy := range s.cfg.Proxies {
+		s.notify = append(s.notify, proxySwitch{proxy: proxy, name: m.name, from: old.addr, to: addr})
+	}
+}
+
+// 向addr发送一组命令，返回每条命令的回复（去掉结尾的\n）；login为true且配置了auth-pass时先登录
+func (s *sentinel) call(addr string, login bool, lines ...string) ([]string, error) {
+	timeout := s.cfg.ConnectTimeout
+	network, address := utils.SplitNetAddr(addr)
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * timeout))
+
+	if login && s.cfg.AuthPass != "" {
+		user := s.cfg.AuthUser
+		if user == "" {
+			user = acl.DefaultUser
+		}
+		lines = append([]string{utils.AUTH.String() + " " + user + " " + s.cfg.AuthPass}, lines...)
+	}
+	if err := utils.WriteAll(conn, []byte(strings.Join(lines, "\n")+"\n")); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	replies := make([]string, 0, len(lines))
+	for range lines {
+		reply, err := utils.ReadReply(reader.ReadByte)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, strings.TrimSuffix(string(reply), "\n"))
+	}
+	if login && s.cfg.AuthPass != "" {
+		if replies[0] != "DONE" {
+			return nil, fmt.Errorf("auth: %s", replies[0])
+		}
+		replies = replies[1:]
+	}
+	return replies, nil
+}
+
+func main() {
+	cfg, err := config.LoadSentinel(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	s, err := newSentinel(cfg)
+	if err != nil {
+		log.Fatalf("start sentinel: %v", err)
+	}
+	log.Printf("tinycached sentinel %s listening on %s", s.id, cfg.Listen)
+	s.run()
+}
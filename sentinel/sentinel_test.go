@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"tinycached/config"
+	"tinycached/utils"
+)
+
+/*
+ * 进程内的故障转移测试：缓存服务器与代理由测试实现，只处理哨兵发送的命令
+ * （INFO replication、REPLICAOF、PROXY SWITCH），哨兵是真实的sentinel，经回环地址互相通信
+ */
+
+// 一组模拟的缓存服务器，副本关系由各自的master字段决定
+type fakeCluster struct {
+	mutex   sync.Mutex
+	servers map[string]*fakeServer
+}
+
+type fakeServer struct {
+	cluster  *fakeCluster
+	addr     string
+	listener net.Listener
+	conns    map[net.Conn]bool
+	alive    bool
+	master   string // 正在复制的主服务器，为空表示自己是主服务器
+	offset   int64
+	received []string // 收到的REPLICAOF命令
+}
+
+func newFakeCluster() *fakeCluster {
+	return &fakeCluster{servers: make(map[string]*fakeServer)}
+}
+
+func listenLoopback(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// 启动一个服务器，master为空时是主服务器
+func (c *fakeCluster) start(t *testing.T, master string, offset int64) *fakeServer {
+	t.Helper()
+	l := listenLoopback(t)
+	s := &fakeServer{cluster: c, addr: l.Addr().String(), master: master, offset: offset}
+	c.mutex.Lock()
+	c.servers[s.addr] = s
+	c.mutex.Unlock()
+	s.serve(l)
+	t.Cleanup(s.kill)
+	return s
+}
+
+func (s *fakeServer) serve(l net.Listener) {
+	s.cluster.mutex.Lock()
+	s.listener, s.alive, s.conns = l, true, make(map[net.Conn]bool)
+	s.cluster.mutex.Unlock()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.cluster.mutex.Lock()
+			if !s.alive {
+				s.cluster.mutex.Unlock()
+				conn.Close()
+				return
+			}
+			s.conns[conn] = true
+			s.cluster.mutex.Unlock()
+			go s.handle(conn)
+		}
+	}()
+}
+
+// 进程崩溃：关闭监听与全部连接
+func (s *fakeServer) kill() {
+	s.cluster.mutex.Lock()
+	defer s.cluster.mutex.Unlock()
+
+	if !s.alive {
+		return
+	}
+	s.alive = false
+	s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// 在原来的地址上重新启动，复制关系保持崩溃前的状态
+func (s *fakeServer) restart(t *testing.T) {
+	t.Helper()
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.serve(l)
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		elem := strings.Fields(line)
+		var reply []byte
+		switch {
+		case len(elem) == 0:
+			reply = []byte("wrong command")
+		case elem[0] == utils.INFO.String():
+			reply = utils.MultiLine(s.info())
+		case elem[0] == utils.REPLICAOF.String() && len(elem) == 3:
+			s.cluster.mutex.Lock()
+			s.received = append(s.received, strings.Join(elem[1:], " "))
+			if strings.EqualFold(elem[1], "NO") {
+				s.master = ""
+			} else {
+				s.master = net.JoinHostPort(elem[1], elem[2])
+			}
+			s.cluster.mutex.Unlock()
+			reply = []byte("DONE")
+		default:
+			reply = []byte("wrong command")
+		}
+		utils.WriteReply(writer, reply)
+		if writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+// 与服务器的INFO replication相同的格式
+func (s *fakeServer) info() []string {
+	c := s.cluster
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if s.master != "" {
+		host, port, _ := net.SplitHostPort(s.master)
+		status := "down"
+		if m, ok := c.servers[s.master]; ok && m.alive && m.master == "" {
+			status = "up"
+		}
+		return []string{"# Replication", "role:slave", "master_host:" + host, "master_port:" + port,
+			"master_link_status:" + status, "slave_repl_offset:" + fmt.Sprint(s.offset)}
+	}
+	lines := []string{"# Replication", "role:master"}
+	n := 0
+	for _, r := range c.servers {
+		if r.alive && r.master == s.addr {
+			host, port, _ := net.SplitHostPort(r.addr)
+			lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%s,state=online,offset=%d,lag=0", n, host, port, r.offset))
+			n++
+		}
+	}
+	return append(lines, fmt.Sprintf("connected_slaves:%d", n))
+}
+
+func (s *fakeServer) state() (master string, received []string) {
+	s.cluster.mutex.Lock()
+	defer s.cluster.mutex.Unlock()
+
+	return s.master, append([]string(nil), s.received...)
+}
+
+// 模拟的代理，记录收到的PROXY SWITCH；同一地址只能切换一次，之后的重复通知返回错误
+type fakeProxy struct {
+	addr     string
+	mutex    sync.Mutex
+	backends map[string]bool
+	switches []string
+}
+
+func startFakeProxy(t *testing.T, backends ...string) *fakeProxy {
+	t.Helper()
+	l := listenLoopback(t)
+	t.Cleanup(func() { l.Close() })
+	p := &fakeProxy{addr: l.Addr().String(), backends: make(map[string]bool)}
+	for _, b := range backends {
+		p.backends[b] = true
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.handle(conn)
+		}
+	}()
+	return p
+}
+
+func (p *fakeProxy) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		reply := "wrong command"
+		if elem := strings.Fields(line); len(elem) == 4 && elem[0] == utils.PROXY.String() && elem[1] == "SWITCH" {
+			p.mutex.Lock()
+			if p.backends[elem[2]] && !p.backends[elem[3]] {
+				delete(p.backends, elem[2])
+				p.backends[elem[3]] = true
+				p.switches = append(p.switches, elem[2]+" -> "+elem[3])
+				reply = "DONE"
+			} else {
+				reply = "no such server " + elem[2]
+			}
+			p.mutex.Unlock()
+		}
+		conn.Write([]byte(reply + "\n"))
+	}
+}
+
+func (p *fakeProxy) switched() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return append([]string(nil), p.switches...)
+}
+
+// 启动一组互相认识的哨兵，监控master
+func startSentinels(t *testing.T, n int, quorum int, master string, proxies ...string) []*sentinel {
+	t.Helper()
+	listeners := make([]net.Listener, n)
+	addrs := make([]string, n)
+	for i := range listeners {
+		listeners[i] = listenLoopback(t)
+		addrs[i] = listeners[i].Addr().String()
+	}
+	host, port, _ := net.SplitHostPort(master)
+	sentinels := make([]*sentinel, n)
+	for i := range sentinels {
+		var others []string
+		for j, addr := range addrs {
+			if j != i {
+				others = append(others, addr)
+			}
+		}
+		args := []string{
+			"-listen", addrs[i],
+			"-monitor", fmt.Sprintf("mymaster %s %s %d", host, port, quorum),
+			// 副本的状态每秒检查一次，down-after须大于检查间隔，否则两次检查之间副本被视为下线
+			"-down-after", "1500ms",
+			"-failover-timeout", "5s",
+			"-connect-timeout", "200ms",
+		}
+		if len(others) > 0 {
+			args = append(args, "-sentinels", strings.Join(others, ","))
+		}
+		if len(proxies) > 0 {
+			args = append(args, "-proxies", strings.Join(proxies, ","))
+		}
+		cfg, err := config.LoadSentinel(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 监听地址已预先占用，好让每个哨兵启动前就知道其他哨兵的地址
+		listeners[i].Close()
+		s, err := newSentinel(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sentinels[i] = s
+		go s.run()
+		t.Cleanup(func() {
+			close(s.stop)
+			s.listener.Close()
+		})
+	}
+	return sentinels
+}
+
+// 向哨兵发送一条SENTINEL命令
+func ask(t *testing.T, s *sentinel, line string) string {
+	t.Helper()
+	replies, err := s.call(s.listener.Addr().String(), false, utils.SENTINEL.String()+" "+line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return replies[0]
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// 等待哨兵发现主服务器的n个副本，并从副本自己的INFO得知其角色
+func waitReplicas(t *testing.T, s *sentinel, n int) {
+	t.Helper()
+	waitFor(t, 5*time.Second, "sentinel to discover the replicas", func() bool {
+		return strings.Count(ask(t, s, "REPLICAS mymaster"), "status=ok,role=slave,") == n
+	})
+}
+
+// 主服务器崩溃后，哨兵提升偏移量最大的副本，其他副本改为复制它，代理收到PROXY SWITCH；
+// 原来的主服务器恢复后成为新主服务器的副本
+func TestFailover(t *testing.T) {
+	cluster := newFakeCluster()
+	master := cluster.start(t, "", 0)
+	best := cluster.start(t, master.addr, 200)
+	other := cluster.start(t, master.addr, 100)
+	proxy := startFakeProxy(t, master.addr)
+	sentinels := startSentinels(t, 3, 2, master.addr, proxy.addr)
+
+	for _, s := range sentinels {
+		waitReplicas(t, s, 2)
+	}
+
+	master.kill()
+	waitFor(t, 15*time.Second, "failover", func() bool {
+		m, _ := best.state()
+		return m == "" && len(proxy.switched()) > 0
+	})
+
+	want := master.addr + " -> " + best.addr
+	if got := proxy.switched(); len(got) != 1 || got[0] != want {
+		t.Errorf("proxy switches %q, want [%s]", got, want)
+	}
+	waitFor(t, 5*time.Second, "the other replica to follow the new master", func() bool {
+		m, _ := other.state()
+		return m == best.addr
+	})
+	for i, s := range sentinels {
+		waitFor(t, 5*time.Second, fmt.Sprintf("sentinel %d to adopt the new master", i), func() bool {
+			return ask(t, s, "GET-MASTER-ADDR-BY-NAME mymaster") == best.addr
+		})
+	}
+	if _, received := best.state(); len(received) != 1 || received[0] != "NO ONE" {
+		t.Errorf("promoted replica received %q, want a single REPLICAOF NO ONE", received)
+	}
+
+	// 原来的主服务器仍以为自己是主服务器，恢复后被改为新主服务器的副本
+	master.restart(t)
+	waitFor(t, 5*time.Second, "the old master to become a replica", func() bool {
+		m, _ := master.state()
+		return m == best.addr
+	})
+	if got := proxy.switched(); len(got) != 1 {
+		t.Errorf("proxy switched again after the old master came back: %q", got)
+	}
+	for _, s := range sentinels {
+		if info := ask(t, s, "MASTERS"); !strings.Contains(info, "addr="+best.addr+",status=ok") {
+			t.Errorf("sentinel reports %q", info)
+		}
+	}
+}
+
+// 认为主服务器下线的哨兵数达不到quorum时不故障转移
+func TestNoFailoverWithoutQuorum(t *testing.T) {
+	cluster := newFakeCluster()
+	master := cluster.start(t, "", 0)
+	replica := cluster.start(t, master.addr, 100)
+	proxy := startFakeProxy(t, master.addr)
+	// 只有一个哨兵，quorum为2
+	s := startSentinels(t, 1, 2, master.addr, proxy.addr)[0]
+	waitReplicas(t, s, 1)
+
+	master.kill()
+	waitFor(t, 5*time.Second, "master to be reported down", func() bool {
+		return strings.Contains(ask(t, s, "MASTERS"), "status=sdown")
+	})
+	time.Sleep(3 * checkInterval)
+	if m, received := replica.state(); m != master.addr || len(received) != 0 {
+		t.Errorf("replica reconfigured without quorum: master %q, received %q", m, received)
+	}
+	if got := proxy.switched(); len(got) != 0 {
+		t.Errorf("proxy switched without quorum: %q", got)
+	}
+	if got := ask(t, s, "GET-MASTER-ADDR-BY-NAME mymaster"); got != master.addr {
+		t.Errorf("master address %s, want %s", got, master.addr)
+	}
+}
+
+// SENTINEL FAILOVER不等待其他哨兵同意，主服务器在线时也立即故障转移
+func TestForcedFailover(t *testing.T) {
+	cluster := newFakeCluster()
+	master := cluster.start(t, "", 0)
+	replica := cluster.start(t, master.addr, 100)
+	proxy := startFakeProxy(t, master.addr)
+	s := startSentinels(t, 1, 1, master.addr, proxy.addr)[0]
+	if got := ask(t, s, "FAILOVER nosuch"); got != "no such master" {
+		t.Errorf("FAILOVER of an unknown master: %q", got)
+	}
+	waitReplicas(t, s, 1)
+
+	if got := ask(t, s, "FAILOVER mymaster"); got != "DONE" {
+		t.Fatalf("FAILOVER: %q", got)
+	}
+	waitFor(t, 5*time.Second, "forced failover", func() bool {
+		return len(proxy.switched()) == 1
+	})
+	if m, _ := replica.state(); m != "" {
+		t.Errorf("replica not promoted, still replicating %s", m)
+	}
+	waitFor(t, 5*time.Second, "the old master to become a replica", func() bool {
+		m, _ := master.state()
+		return m == replica.addr
+	})
+}
@@ -0,0 +1,383 @@
+package acl
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"tinycached/utils"
+)
+
+// 命令类别
+type Category uint8
+
+const (
+	CatRead        Category = 1 << iota // 读命令：GET
+	CatWrite                            // 写命令：SET、DEL、EXPR，以及WAIT
+	CatAdmin                            // 管理命令：CONFIG、ACL等
+	CatTransaction                      // 事务命令：MULTI、EXEC、DISCARD、WATCH、UNWATCH
+	CatPubSub                           // 订阅命令：SUBSCRIBE、PSUBSCRIBE、UNSUBSCRIBE
+)
+
+const CatAll = CatRead | CatWrite | CatAdmin | CatTransaction | CatPubSub
+
+var categoryNames = []struct {
+	name string
+	cat  Category
+}{
+	{"read", CatRead},
+	{"write", CatWrite},
+	{"admin", CatAdmin},
+	{"transaction", CatTransaction},
+	{"pubsub", CatPubSub},
+}
+
+// 命令所属的类别；返回0的命令（如AUTH）不受权限限制
+func CategoryOf(cmd utils.CmdType) Category {
+	switch cmd {
+	case utils.GET:
+		return CatRead
+	case utils.SET, utils.DEL, utils.EXPR, utils.WAIT:
+		// WAIT等待之前的写入到达副本，归入写命令
+		return CatWrite
+	case utils.MULTI, utils.EXEC, utils.DISCARD, utils.WATCH, utils.UNWATCH:
+		return CatTransaction
+	case utils.SUBSCRIBE, utils.PSUBSCRIBE, utils.UNSUBSCRIBE:
+		return CatPubSub
+	case utils.AUTH, utils.PING:
+		return 0
+	default:
+		return CatAdmin
+	}
+}
+
+var (
+	ErrNoAuth    = errors.New("NOAUTH Authentication required.")
+	ErrWrongPass = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+)
+
+const (
+	DefaultUser     = "default"
+	Unauthenticated = "-" // 保留的用户名，表示未认证的客户端
+)
+
+type User struct {
+	Name      string
+	enabled   bool
+	noPass    bool                // 不需要密码
+	passwords map[string]struct{} // 密码的sha256十六进制
+	commands  Category            // 允许的命令类别
+	keys      []string            // 允许访问的key的glob模式
+}
+
+func newUser(name string) *User {
+	return &User{Name: name, passwords: make(map[string]struct{})}
+}
+
+func (u *User) clone() *User {
+	c := *u
+	c.passwords = make(map[string]struct{}, len(u.passwords))
+	for p := range u.passwords {
+		c.passwords[p] = struct{}{}
+	}
+	c.keys = append([]string(nil), u.keys...)
+	return &c
+}
+
+func hashPassword(pass string) string {
+	sum := sha256.Sum256([]byte(pass))
+	return hex.EncodeToString(sum[:])
+}
+
+// 按redis的ACL规则修改用户
+func (u *User) applyRule(rule string) error {
+	switch {
+	case rule == "on":
+		u.enabled = true
+	case rule == "off":
+		u.enabled = false
+	case rule == "nopass":
+		u.noPass = true
+		u.passwords = make(map[string]struct{})
+	case rule == "resetpass":
+		u.noPass = false
+		u.passwords = make(map[string]struct{})
+	case strings.HasPrefix(rule, ">"):
+		u.noPass = false
+		u.passwords[hashPassword(rule[1:])] = struct{}{}
+	case strings.HasPrefix(rule, "<"):
+		delete(u.passwords, hashPassword(rule[1:]))
+	case strings.HasPrefix(rule, "#"):
+		if len(rule) != 65 {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': invalid password hash", rule)
+		}
+		u.noPass = false
+		u.passwords[strings.ToLower(rule[1:])] = struct{}{}
+	case rule == "allkeys":
+		u.keys = []string{"*"}
+	case rule == "resetkeys":
+		u.keys = nil
+	case strings.HasPrefix(rule, "~"):
+		if _, err := path.Match(rule[1:], ""); err != nil {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': bad pattern", rule)
+		}
+		u.keys = append(u.keys, rule[1:])
+	case rule == "allcommands" || rule == "+@all":
+		u.commands = CatAll
+	case rule == "nocommands" || rule == "-@all":
+		u.commands = 0
+	case strings.HasPrefix(rule, "+@") || strings.HasPrefix(rule, "-@"):
+		cat, ok := parseCategory(rule[2:])
+		if !ok {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': unknown category", rule)
+		}
+		if rule[0] == '+' {
+			u.commands |= cat
+		} else {
+			u.commands &^= cat
+		}
+	case rule == "reset":
+		*u = *newUser(u.Name)
+	default:
+		return fmt.Errorf("Error in ACL SETUSER modifier '%s': Syntax error", rule)
+	}
+	return nil
+}
+
+func parseCategory(name string) (Category, bool) {
+	for _, cn := range categoryNames {
+		if cn.name == strings.ToLower(name) {
+			return cn.cat, true
+		}
+	}
+	return 0, false
+}
+
+// 以ACL规则的形式描述用户，如"user alice on #... ~user* +@read"
+func (u *User) String() string {
+	rules := []string{"user", u.Name}
+	if u.enabled {
+		rules = append(rules, "on")
+	} else {
+		rules = append(rules, "off")
+	}
+	if u.noPass {
+		rules = append(rules, "nopass")
+	}
+	hashes := make([]string, 0, len(u.passwords))
+	for p := range u.passwords {
+		hashes = append(hashes, "#"+p)
+	}
+	sort.Strings(hashes)
+	rules = append(rules, hashes...)
+	for _, k := range u.keys {
+		rules = append(rules, "~"+k)
+	}
+	if u.commands == CatAll {
+		rules = append(rules, "+@all")
+	} else if u.commands == 0 {
+		rules = append(rules, "-@all")
+	} else {
+		for _, cn := range categoryNames {
+			if u.commands&cn.cat != 0 {
+				rules = append(rules, "+@"+cn.name)
+			}
+		}
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *User) checkPassword(pass string) bool {
+	if u.noPass {
+		return true
+	}
+	_, ok := u.passwords[hashPassword(pass)]
+	return ok
+}
+
+func (u *User) canAccessKey(key string) bool {
+	for _, pattern := range u.keys {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 用户表
+type ACL struct {
+	mutex sync.RWMutex
+	users map[string]*User
+}
+
+// 新建用户表，其中只有不需要密码、拥有全部权限的default用户
+func New() *ACL {
+	a := &ACL{users: make(map[string]*User)}
+	def := newUser(DefaultUser)
+	for _, rule := range []string{"on", "nopass", "allkeys", "+@all"} {
+		def.applyRule(rule)
+	}
+	a.users[DefaultUser] = def
+	return a
+}
+
+// 设置default用户的密码，为空表示不需要密码
+func (a *ACL) SetRequirePass(pass string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	def := a.users[DefaultUser].clone()
+	if pass == "" {
+		def.applyRule("nopass")
+	} else {
+		def.applyRule("resetpass")
+		def.applyRule(">" + pass)
+	}
+	a.users[DefaultUser] = def
+}
+
+// 新连接是否无需AUTH即以default用户登录
+func (a *ACL) DefaultNoAuth() bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	def := a.users[DefaultUser]
+	return def.enabled && def.noPass
+}
+
+func (a *ACL) Authenticate(name string, pass string) error {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	u, ok := a.users[name]
+	if !ok || !u.enabled || !u.checkPassword(pass) {
+		return ErrWrongPass
+	}
+	return nil
+}
+
+// 检查用户能否执行cat类别的命令并访问key；key为空表示命令不涉及key
+func (a *ACL) Check(name string, cat Category, key string) error {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	u, ok := a.users[name]
+	if !ok || !u.enabled {
+		return ErrNoAuth
+	}
+	if u.commands&cat != cat {
+		return fmt.Errorf("NOPERM User %s has no permissions to run this command", name)
+	}
+	if key != "" && !u.canAccessKey(key) {
+		return fmt.Errorf("NOPERM No permissions to access key '%s'", key)
+	}
+	return nil
+}
+
+// 创建或修改用户；规则全部合法时才生效
+func (a *ACL) SetUser(name string, rules []string) error {
+	if name == Unauthenticated {
+		return fmt.Errorf("'%s' is a reserved user name", name)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	u, ok := a.users[name]
+	if ok {
+		u = u.clone()
+	} else {
+		u = newUser(name)
+	}
+	for _, rule := range rules {
+		if err := u.applyRule(rule); err != nil {
+			return err
+		}
+	}
+	a.users[name] = u
+	return nil
+}
+
+// 删除用户，返回实际删除的用户数
+func (a *ACL) DelUser(names []string) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	n := 0
+	for _, name := range names {
+		if name == DefaultUser {
+			return n, errors.New("The 'default' user cannot be removed")
+		}
+		if _, ok := a.users[name]; ok {
+			delete(a.users, name)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// 全部用户的描述，按用户名排序
+func (a *ACL) List() []string {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]string, 0, len(names))
+	for _, name := range names {
+		list = append(list, a.users[name].String())
+	}
+	return list
+}
+
+/*
+ * ACL文件格式与redis一致，每行描述一个用户：
+ * user 用户名 规则...
+ * 以#开头的行为注释
+ */
+func (a *ACL) Load(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	loaded := New()
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			return fmt.Errorf("%s:%d: expected 'user <name> [rules...]'", filePath, lineno)
+		}
+		if err := loaded.SetUser(fields[1], fields[2:]); err != nil {
+			return fmt.Errorf("%s:%d: %v", filePath, lineno, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	a.users = loaded.users
+	a.mutex.Unlock()
+	return nil
+}
+
+func (a *ACL) Save(filePath string) error {
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(strings.Join(a.List(), "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// 以用户name登录的连接
+func login(t *testing.T, addr string, name string, pass string) *testConn {
+	t.Helper()
+	c := dial(t, addr)
+	c.expect("AUTH "+name+" "+pass, "DONE")
+	return c
+}
+
+// 回复以NOPERM开头
+func expectNoPerm(c *testConn, line string) {
+	c.t.Helper()
+	if got := c.do(line); !strings.HasPrefix(got, "NOPERM") {
+		c.t.Errorf("%s: got %q, want NOPERM", line, got)
+	}
+}
+
+// 按类别与key模式授权，修改用户后对已登录的连接立即生效
+func TestACLCategories(t *testing.T) {
+	s := startServer(t, "-requirepass", "secret")
+	anon := dial(t, s.addr)
+	anon.expect("PING", "PONG")
+	anon.expect("GET a", "NOAUTH Authentication required.")
+	anon.expect("ACL WHOAMI", "NOAUTH Authentication required.")
+	anon.expect("AUTH wrong", "WRONGPASS invalid username-password pair or user is disabled.")
+
+	admin := dial(t, s.addr)
+	admin.expect("AUTH secret", "DONE")
+	admin.expect("ACL WHOAMI", "default")
+	admin.expect("ACL SETUSER reader on >pw ~user* +@read", "DONE")
+	admin.expect("ACL SETUSER writer on >pw allkeys +@write", "DONE")
+	admin.expect("ACL SETUSER app on >pw allkeys +@all -@admin", "DONE")
+	admin.expect("ACL SETUSER reader bad", "Error in ACL SETUSER modifier 'bad': Syntax error")
+	admin.expect("SET user1:1", "DONE")
+	admin.expect("SET other:1", "DONE")
+
+	reader := login(t, s.addr, "reader", "pw")
+	reader.expect("ACL WHOAMI", "reader")
+	reader.expect("GET user1", "1")
+	reader.expect("GET other", "NOPERM No permissions to access key 'other'")
+	reader.expect("SET user1:2", "NOPERM User reader has no permissions to run this command")
+	expectNoPerm(reader, "DEL user1")
+	expectNoPerm(reader, "MULTI")
+	expectNoPerm(reader, "SUBSCRIBE ch")
+	expectNoPerm(reader, "CONFIG GET maxmemory")
+	expectNoPerm(reader, "ACL LIST")
+	expectNoPerm(reader, "CLIENT LIST")
+	// 只涉及当前连接的命令不需要权限
+	reader.expect("CLIENT SETNAME r", "DONE")
+	reader.expect("PING", "PONG")
+
+	writer := login(t, s.addr, "writer", "pw")
+	writer.expect("SET other:2", "DONE")
+	writer.expect("DEL user1", "DONE")
+	expectNoPerm(writer, "GET other")
+
+	app := login(t, s.addr, "app", "pw")
+	app.expect("SET user2:1", "DONE")
+	app.expect("GET other", "2")
+	app.expect("MULTI", "DONE")
+	app.expect("DISCARD", "DONE")
+	app.expect("SUBSCRIBE ch", "DONE")
+	app.expect("UNSUBSCRIBE", "DONE")
+	expectNoPerm(app, "CONFIG GET maxmemory")
+	expectNoPerm(app, "ACL SETUSER app +@admin")
+
+	// 修改与禁用用户立即影响已登录的连接
+	admin.expect("ACL SETUSER reader +@write", "DONE")
+	reader.expect("SET user1:3", "DONE")
+	expectNoPerm(reader, "SET other:3")
+	admin.expect("ACL SETUSER reader off", "DONE")
+	reader.expect("GET user1", "NOAUTH Authentication required.")
+	dial(t, s.addr).expect("AUTH reader pw", "WRONGPASS invalid username-password pair or user is disabled.")
+	admin.expect("ACL DELUSER writer", "1")
+	writer.expect("SET other:4", "NOAUTH Authentication required.")
+}
+
+// ASUSER须有admin权限；命令按指定用户检查权限，执行后恢复原来的身份
+func TestASUser(t *testing.T) {
+	s := startServer(t, "-requirepass", "secret")
+	admin := login(t, s.addr, "default", "secret")
+	admin.expect("ACL SETUSER reader on >pw ~user* +@read", "DONE")
+	admin.expect("ACL SETUSER app on >pw allkeys +@all -@admin", "DONE")
+	admin.expect("SET user1:1", "DONE")
+	admin.expect("SET other:1", "DONE")
+
+	// 没有admin权限的用户不能借ASUSER提升权限
+	app := login(t, s.addr, "app", "pw")
+	app.expect("ASUSER default CONFIG GET maxmemory", "NOPERM User app has no permissions to run this command")
+	app.expect("ASUSER default GET other", "NOPERM User app has no permissions to run this command")
+	app.expect("ASUSER app GET other", "NOPERM User app has no permissions to run this command")
+	app.expect("ACL WHOAMI", "app")
+	expectNoPerm(app, "CONFIG GET maxmemory")
+	dial(t, s.addr).expect("ASUSER default GET other", "NOAUTH Authentication required.")
+
+	admin.expect("ASUSER reader GET user1", "1")
+	admin.expect("ASUSER reader GET other", "NOPERM No permissions to access key 'other'")
+	admin.expect("ASUSER reader SET user1:2", "NOPERM User reader has no permissions to run this command")
+	admin.expect("ASUSER reader CONFIG GET maxmemory", "NOPERM User reader has no permissions to run this command")
+	admin.expect("ASUSER reader ACL WHOAMI", "reader")
+	admin.expect("ASUSER app SET other:2", "DONE")
+	admin.expect("ASUSER app ACL LIST", "NOPERM User app has no permissions to run this command")
+	// "-"为未认证的客户端，requirepass时须先登录
+	admin.expect("ASUSER - GET user1", "NOAUTH Authentication required.")
+	admin.expect("ASUSER nobody GET user1", "NOAUTH Authentication required.")
+	// 不能嵌套，也不能借ASUSER登录
+	admin.expect("ASUSER reader ASUSER default CONFIG GET maxmemory", "wrong command")
+	admin.expect("ASUSER reader AUTH app pw", "wrong command")
+	admin.expect("ASUSER reader", "wrong command")
+
+	// 执行后恢复原来的身份
+	admin.expect("ACL WHOAMI", "default")
+	admin.expect("GET other", "2")
+	admin.expect("CONFIG GET maxmemory", "*1\nmaxmemory 64mb")
+}
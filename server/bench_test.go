@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+/*
+ * 回环地址上流水线执行SET与GET：每批写出depth对命令，再按顺序读出全部回复。
+ * 每次操作为一对SET与GET，depth=1即为不使用流水线的一问一答
+ * 例：go test -run '^$' -bench Pipeline ./server
+ */
+func BenchmarkPipeline(b *testing.B) {
+	for _, mode := range []string{"goroutine", "netpoll"} {
+		if mode == "netpoll" && runtime.GOOS != "linux" {
+			continue
+		}
+		for _, depth := range []int{1, 16, 128} {
+			b.Run(fmt.Sprintf("%s/depth=%d", mode, depth), func(b *testing.B) {
+				benchPipeline(b, mode, depth)
+			})
+		}
+	}
+}
+
+func benchPipeline(b *testing.B, mode string, depth int) {
+	s := startServer(b, "-io-mode", mode)
+	c := dial(b, s.addr)
+
+	// 预先生成每对命令，key在1000个之间循环
+	const keys = 1000
+	pairs := make([][]byte, keys)
+	for i := range pairs {
+		pairs[i] = []byte(fmt.Sprintf("SET bench%d:value%d\nGET bench%d\n", i, i, i))
+	}
+
+	var batch []byte
+	b.ResetTimer()
+	for done := 0; done < b.N; {
+		n := depth
+		if b.N-done < n {
+			n = b.N - done
+		}
+		batch = batch[:0]
+		for j := 0; j < n; j++ {
+			batch = append(batch, pairs[(done+j)%keys]...)
+		}
+		if _, err := c.Write(batch); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 2*n; j++ {
+			if _, err := c.reader.ReadSlice('\n'); err != nil {
+				b.Fatal(err)
+			}
+		}
+		done += n
+	}
+}
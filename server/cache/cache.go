@@ -2,11 +2,15 @@ package cache
 
 import (
 	"sync"
+	"tinycached/server/persistence"
 )
 
 type Cache struct {
-	mutex sync.Mutex
-	cache *LRU
+	mutex       sync.Mutex
+	cache       *LRU
+	notifyMutex sync.RWMutex
+	notifyFlags NotifyFlags  // 开启的事件类别
+	hooks       []NotifyFunc // 键空间事件回调
 }
 
 func New(maxBytes uint64) (c *Cache) {
@@ -14,31 +18,145 @@ func New(maxBytes uint64) (c *Cache) {
 	return c
 }
 
-func (c *Cache) SetExpireTimeMs(key string, expireTimeMs int64) {
+// 设置开启的键空间事件类别
+func (c *Cache) SetNotifyFlags(flags NotifyFlags) {
+	c.notifyMutex.Lock()
+	defer c.notifyMutex.Unlock()
+
+	c.notifyFlags = flags
+}
+
+func (c *Cache) NotifyFlags() NotifyFlags {
+	c.notifyMutex.RLock()
+	defer c.notifyMutex.RUnlock()
+
+	return c.notifyFlags
+}
+
+// 注册键空间事件回调；只有类别已开启的事件才会触发回调
+func (c *Cache) AddNotifyHook(fn NotifyFunc) {
+	c.notifyMutex.Lock()
+	defer c.notifyMutex.Unlock()
+
+	c.hooks = append(c.hooks, fn)
+}
+
+func (c *Cache) SetPolicy(policy Policy) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	c.cache.SetPolicy(policy)
+}
+
+// 修改最大字节数，超出部分立即淘汰
+func (c *Cache) SetMaxBytes(maxBytes uint64) {
+	c.mutex.Lock()
+	c.cache.SetMaxBytes(maxBytes)
+	events := c.cache.popEvents()
+	c.mutex.Unlock()
+
+	c.dispatch(events)
+}
+
+func (c *Cache) SetExpireTimeMs(key string, expireTimeMs int64) {
+	c.mutex.Lock()
 	c.cache.SetExpireTimeMs(key, expireTimeMs)
+	events := c.cache.popEvents()
+	c.mutex.Unlock()
+
+	c.dispatch(events)
 }
 
-func (c *Cache) Add(key string, value []byte) {
+func (c *Cache) Add(key string, value []byte) error {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	err := c.cache.Add(key, value)
+	events := c.cache.popEvents()
+	c.mutex.Unlock()
 
-	c.cache.Add(key, value)
+	c.dispatch(events)
+	return err
 }
 
 func (c *Cache) Del(key string) {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
-
 	c.cache.Del(key)
+	events := c.cache.popEvents()
+	c.mutex.Unlock()
+
+	c.dispatch(events)
 }
 
 func (c *Cache) Get(key string) (value []byte, ok bool) {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
-
 	value, ok = c.cache.Get(key)
+	events := c.cache.popEvents()
+	c.mutex.Unlock()
+
+	c.dispatch(events)
 	return value, ok
 }
+
+// 主动删除一批已过期的key，见LRU.ExpireCycle
+func (c *Cache) ExpireCycle(rounds int) int {
+	c.mutex.Lock()
+	n := c.cache.ExpireCycle(rounds)
+	events := c.cache.popEvents()
+	c.mutex.Unlock()
+
+	c.dispatch(events)
+	return n
+}
+
+func (c *Cache) Stats() Stats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.cache.Stats()
+}
+
+// 导出全部未过期的缓存项
+func (c *Cache) Entries() []persistence.Entry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.cache.Entries()
+}
+
+// 加载快照中的缓存项
+func (c *Cache) Load(e persistence.Entry) error {
+	c.mutex.Lock()
+	err := c.cache.Load(e)
+	events := c.cache.popEvents()
+	c.mutex.Unlock()
+
+	c.dispatch(events)
+	return err
+}
+
+// 删除全部缓存项，不记录AOF，也不产生键空间事件；用于副本全量同步前清空数据
+func (c *Cache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.cache.Clear()
+}
+
+// 在缓存锁外分发事件，避免回调中再次访问缓存导致死锁
+func (c *Cache) dispatch(events []keyEvent) {
+	if len(events) == 0 {
+		return
+	}
+	c.notifyMutex.RLock()
+	flags := c.notifyFlags
+	hooks := c.hooks
+	c.notifyMutex.RUnlock()
+
+	for _, e := range events {
+		if !flags.Enabled(e.event) {
+			continue
+		}
+		for _, fn := range hooks {
+			fn(e.event, e.key)
+		}
+	}
+}
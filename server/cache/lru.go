@@ -2,12 +2,51 @@ package cache
 
 import (
 	"container/list"
+	"errors"
 	"time"
 	"tinycached/server/persistence"
 	"tinycached/utils"
 	"unsafe"
 )
 
+// 内存耗尽时的淘汰策略
+type Policy int
+
+const (
+	AllKeysLRU  Policy = iota // 在所有key中淘汰最久未使用的
+	VolatileLRU               // 只在设置了过期时间的key中淘汰最久未使用的
+	NoEviction                // 不淘汰，拒绝写入
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "allkeys-lru":
+		return AllKeysLRU, nil
+	case "volatile-lru":
+		return VolatileLRU, nil
+	case "noeviction":
+		return NoEviction, nil
+	default:
+		return AllKeysLRU, errors.New("invalid maxmemory policy " + s)
+	}
+}
+
+func (p Policy) String() string {
+	switch p {
+	case VolatileLRU:
+		return "volatile-lru"
+	case NoEviction:
+		return "noeviction"
+	default:
+		return "allkeys-lru"
+	}
+}
+
+var ErrOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'")
+
+// 每个缓存项除key与value外的固定开销
+const entryOverhead = uint64(unsafe.Sizeof(kvPair{}) + unsafe.Sizeof(list.Element{}))
+
 type cacheValue struct {
 	value        []byte
 	expireTimeMs int64
@@ -19,34 +58,67 @@ type kvPair struct {
 	cvalue cacheValue
 }
 
+func (kv *kvPair) bytes() uint64 {
+	return uint64(len(kv.key)+len(kv.cvalue.value)) + entryOverhead
+}
+
 type LRU struct {
 	usedBytes  uint64
 	maxBytes   uint64
+	policy     Policy
 	cacheQueue *list.List
 	cacheMap   map[string]*list.Element
+	volatile   map[string]*list.Element // 设置了过期时间的key，主动过期时从中抽样
 	aof        *persistence.Aof
+	events     []keyEvent // 尚未分发的键空间事件
+	stats      Stats      // 运行统计，其中Keys、UsedBytes等在Stats()中填写
+}
+
+// 缓存的运行统计，用于INFO
+type Stats struct {
+	Keys      int    // key总数
+	Volatile  int    // 设置了过期时间的key数
+	UsedBytes uint64 // 已使用字节数
+	MaxBytes  uint64 // 最大字节数
+	Policy    Policy // 淘汰策略
+	Hits      uint64 // GET命中次数
+	Misses    uint64 // GET未命中次数
+	Evicted   uint64 // 因内存不足淘汰的key数
+	Expired   uint64 // 因过期删除的key数
 }
 
 func NewLRUCache(maxBytes uint64) (lru *LRU) {
 	lru = &LRU{
 		maxBytes:   maxBytes,
+		policy:     AllKeysLRU,
 		cacheQueue: list.New(),
 		cacheMap:   make(map[string]*list.Element),
+		volatile:   make(map[string]*list.Element),
 		aof:        persistence.AofInstance(),
 	}
 	return lru
 }
 
+func (lru *LRU) SetPolicy(policy Policy) {
+	lru.policy = policy
+}
+
 func (lru *LRU) SetExpireTimeMs(key string, expireTimeMs int64) {
 	elem, ok := lru.cacheMap[key]
 	if !ok {
 		return
 	}
-	elem.Value.(*kvPair).cvalue.expireTimeMs = expireTimeMs
+	cvalue := &elem.Value.(*kvPair).cvalue
+	if expireTimeMs > 0 {
+		lru.volatile[key] = elem
+	} else {
+		delete(lru.volatile, key)
+	}
+	cvalue.expireTimeMs = expireTimeMs
+	lru.notify(EventExpire, key)
 }
 
-func (lru *LRU) Add(key string, value []byte) {
-	// 如果内存耗尽，则淘汰缓存项，直至有内存空间
+func (lru *LRU) Add(key string, value []byte) error {
 	newCache := &kvPair{
 		key: key,
 		cvalue: cacheValue{
@@ -55,51 +127,81 @@ func (lru *LRU) Add(key string, value []byte) {
 			bornTimeMs:   time.Now().UnixMilli(),
 		},
 	}
-	curBytes := uint64(unsafe.Sizeof(newCache))
-	for lru.usedBytes+curBytes > lru.maxBytes {
-		node := lru.cacheQueue.Back()
-		elem := node.Value.(*kvPair)
-		// 更新已使用字节数
-		elemBytes := uint64(unsafe.Sizeof(elem))
-		lru.usedBytes -= elemBytes
-		// 淘汰缓存
-		lru.aof.Append([]byte("DEL"), []byte(elem.key))
-		delete(lru.cacheMap, elem.key)
-		lru.cacheQueue.Remove(node)
+	// 若key已存在，其旧值占用的内存会被释放
+	var oldBytes uint64
+	if elem, ok := lru.cacheMap[key]; ok {
+		oldBytes = elem.Value.(*kvPair).bytes()
+	}
+	// 如果内存耗尽，则淘汰缓存项，直至有内存空间
+	for lru.usedBytes-oldBytes+newCache.bytes() > lru.maxBytes {
+		if !lru.evictOne(key) {
+			return ErrOOM
+		}
 	}
 	// 更新缓存
-	if _, ok := lru.Get(key); ok {
-		// 查看待插入的key是否已存在；若存在则提升到队头，并修改其值
-		oldElem := lru.cacheQueue.Front().Value.(*kvPair)
-		lru.cacheQueue.Front().Value = newCache
-		// 更新已使用字节数
-		lru.usedBytes += uint64(len(value) - len(oldElem.cvalue.value))
-		return
+	if elem, ok := lru.cacheMap[key]; ok {
+		// 待插入的key已存在，则提升到队头，并修改其值；新值没有过期时间
+		lru.usedBytes -= elem.Value.(*kvPair).bytes()
+		delete(lru.volatile, key)
+		elem.Value = newCache
+		lru.cacheQueue.MoveToFront(elem)
 	} else {
 		// 插入新的缓存项
-		lru.cacheQueue.PushFront(newCache)
-		lru.cacheMap[key] = lru.cacheQueue.Front()
-		// 更新已使用字节数
-		lru.usedBytes += curBytes
+		lru.cacheMap[key] = lru.cacheQueue.PushFront(newCache)
+	}
+	// 更新已使用字节数
+	lru.usedBytes += newCache.bytes()
+	lru.notify(EventSet, key)
+	return nil
+}
+
+// 修改最大字节数，超出部分立即按淘汰策略淘汰
+func (lru *LRU) SetMaxBytes(maxBytes uint64) {
+	lru.maxBytes = maxBytes
+	for lru.usedBytes > lru.maxBytes {
+		if !lru.evictOne("") {
+			return
+		}
 	}
 }
 
+// 按淘汰策略淘汰一个缓存项，skip为正在写入的key；没有可淘汰的缓存项时返回false
+func (lru *LRU) evictOne(skip string) bool {
+	if lru.policy == NoEviction {
+		return false
+	}
+	for node := lru.cacheQueue.Back(); node != nil; node = node.Prev() {
+		elem := node.Value.(*kvPair)
+		if elem.key == skip {
+			continue
+		}
+		if lru.policy == VolatileLRU && elem.cvalue.expireTimeMs <= 0 {
+			continue
+		}
+		// 淘汰缓存
+		lru.aof.Append([]byte("DEL"), []byte(elem.key))
+		lru.remove(node)
+		lru.stats.Evicted++
+		lru.notify(EventEvicted, elem.key)
+		return true
+	}
+	return false
+}
+
 func (lru *LRU) Del(key string) {
 	elem, ok := lru.cacheMap[key]
 	if !ok {
 		return
 	}
-	// 更新已使用字节数
-	elemBytes := uint64(unsafe.Sizeof(elem))
-	lru.usedBytes -= elemBytes
 	// 删除目标缓存
-	delete(lru.cacheMap, key)
-	lru.cacheQueue.Remove(elem)
+	lru.remove(elem)
+	lru.notify(EventDel, key)
 }
 
 func (lru *LRU) Get(key string) ([]byte, bool) {
 	elem, ok := lru.cacheMap[key]
 	if !ok {
+		lru.stats.Misses++
 		return nil, false
 	}
 	target := elem.Value.(*kvPair).cvalue.value
@@ -107,18 +209,130 @@ func (lru *LRU) Get(key string) ([]byte, bool) {
 	// 检查过期时间，若过期则销毁
 	bornTime := elem.Value.(*kvPair).cvalue.bornTimeMs
 	expireTime := elem.Value.(*kvPair).cvalue.expireTimeMs
-	if expireTime > 0 && bornTime+expireTime >= time.Now().UnixMilli() {
-		// 更新已使用字节数
-		elemBytes := uint64(unsafe.Sizeof(elem.Value.(*kvPair)))
-		lru.usedBytes -= elemBytes
-		// 淘汰缓存
-		lru.aof.Append([]byte("DEL"), []byte(key))
-		delete(lru.cacheMap, key)
-		lru.cacheQueue.Remove(elem)
+	if expireTime > 0 && bornTime+expireTime <= time.Now().UnixMilli() {
+		lru.expire(elem)
+		lru.stats.Misses++
+		return nil, false
 	} else {
 		// 更新目标缓存的位置
 		lru.cacheQueue.MoveToFront(elem)
-		lru.cacheMap[key] = lru.cacheQueue.Front()
+		lru.stats.Hits++
 	}
 	return targetCopy, true
 }
+
+// 删除已过期的缓存项，记录AOF并产生expired事件
+func (lru *LRU) expire(elem *list.Element) {
+	key := elem.Value.(*kvPair).key
+	lru.aof.Append([]byte("DEL"), []byte(key))
+	lru.remove(elem)
+	lru.stats.Expired++
+	lru.notify(EventExpired, key)
+}
+
+// 主动过期每轮抽查的key数
+const expireSample = 20
+
+/*
+ * 主动过期：只在读取时检查过期的key如果不再被读取，就一直占用内存，也不会产生expired事件。
+ * 每轮从设置了过期时间的key中抽查expireSample个，删除已过期的；
+ * 抽查的key中超过四分之一已过期时继续下一轮，最多rounds轮。返回删除的key数
+ */
+func (lru *LRU) ExpireCycle(rounds int) int {
+	now := time.Now().UnixMilli()
+	removed := 0
+	for i := 0; i < rounds && len(lru.volatile) > 0; i++ {
+		checked, expired := 0, 0
+		// map的遍历顺序是随机的，相当于随机抽样
+		for _, elem := range lru.volatile {
+			if checked == expireSample {
+				break
+			}
+			checked++
+			cvalue := elem.Value.(*kvPair).cvalue
+			if cvalue.bornTimeMs+cvalue.expireTimeMs <= now {
+				lru.expire(elem)
+				expired++
+			}
+		}
+		removed += expired
+		if expired*4 <= checked {
+			break
+		}
+	}
+	return removed
+}
+
+// 导出全部未过期的缓存项，用于生成快照
+func (lru *LRU) Entries() []persistence.Entry {
+	now := time.Now().UnixMilli()
+	entries := make([]persistence.Entry, 0, len(lru.cacheMap))
+	// 从队尾开始导出，加载快照时按相同顺序插入即可恢复LRU顺序
+	for node := lru.cacheQueue.Back(); node != nil; node = node.Prev() {
+		kv := node.Value.(*kvPair)
+		var expireAt int64
+		if kv.cvalue.expireTimeMs > 0 {
+			if expireAt = kv.cvalue.bornTimeMs + kv.cvalue.expireTimeMs; expireAt <= now {
+				continue
+			}
+		}
+		entries = append(entries, persistence.Entry{Key: kv.key, Value: kv.cvalue.value, ExpireAtMs: expireAt})
+	}
+	return entries
+}
+
+// 加载快照中的缓存项，已过期的缓存项直接丢弃
+func (lru *LRU) Load(e persistence.Entry) error {
+	now := time.Now().UnixMilli()
+	if e.ExpireAtMs > 0 && e.ExpireAtMs <= now {
+		return nil
+	}
+	if err := lru.Add(e.Key, e.Value); err != nil {
+		return err
+	}
+	if e.ExpireAtMs > 0 {
+		kv := lru.cacheMap[e.Key].Value.(*kvPair)
+		kv.cvalue.bornTimeMs = now
+		kv.cvalue.expireTimeMs = e.ExpireAtMs - now
+		lru.volatile[e.Key] = lru.cacheMap[e.Key]
+	}
+	return nil
+}
+
+// 删除全部缓存项，保留统计中的累计值
+func (lru *LRU) Clear() {
+	lru.cacheQueue.Init()
+	lru.cacheMap = make(map[string]*list.Element)
+	lru.volatile = make(map[string]*list.Element)
+	lru.usedBytes = 0
+}
+
+// 移除缓存项并更新已使用字节数
+func (lru *LRU) remove(elem *list.Element) {
+	kv := elem.Value.(*kvPair)
+	lru.usedBytes -= kv.bytes()
+	delete(lru.volatile, kv.key)
+	delete(lru.cacheMap, kv.key)
+	lru.cacheQueue.Remove(elem)
+}
+
+func (lru *LRU) Stats() Stats {
+	stats := lru.stats
+	stats.Keys = len(lru.cacheMap)
+	stats.Volatile = len(lru.volatile)
+	stats.UsedBytes = lru.usedBytes
+	stats.MaxBytes = lru.maxBytes
+	stats.Policy = lru.policy
+	return stats
+}
+
+func (lru *LRU) notify(event Event, key string) {
+	lru.events = append(lru.events, keyEvent{event, key})
+}
+
+// 取出并清空待分发的事件
+func (lru *LRU) popEvents() []keyEvent {
+	events := lru.events
+	lru.events = nil
+	return events
+}
@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"errors"
+	"strings"
+)
+
+// 键空间事件
+type Event int
+
+const (
+	EventSet     Event = iota // SET写入
+	EventDel                  // DEL删除
+	EventExpire               // EXPR修改过期时间
+	EventExpired              // 访问时发现已过期而被删除
+	EventEvicted              // 内存不足被淘汰
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventSet:
+		return "set"
+	case EventDel:
+		return "del"
+	case EventExpire:
+		return "expire"
+	case EventExpired:
+		return "expired"
+	case EventEvicted:
+		return "evicted"
+	default:
+		return ""
+	}
+}
+
+// 事件类别开关，与redis的notify-keyspace-events一致
+type NotifyFlags uint16
+
+const (
+	NotifyKeyspace NotifyFlags = 1 << iota // K：发布到__keyspace@0__:<key>频道
+	NotifyKeyevent                         // E：发布到__keyevent@0__:<event>频道
+	NotifyGeneric                          // g：del、expire
+	NotifyString                           // $：set
+	NotifyExpired                          // x：expired
+	NotifyEvicted                          // e：evicted
+)
+
+const NotifyAll = NotifyGeneric | NotifyString | NotifyExpired | NotifyEvicted
+
+var notifyFlagChars = []struct {
+	char byte
+	flag NotifyFlags
+}{
+	{'K', NotifyKeyspace},
+	{'E', NotifyKeyevent},
+	{'g', NotifyGeneric},
+	{'$', NotifyString},
+	{'x', NotifyExpired},
+	{'e', NotifyEvicted},
+}
+
+// 解析形如"KEA"、"Kx"的事件类别配置，"A"表示g$xe
+func ParseNotifyFlags(s string) (NotifyFlags, error) {
+	var flags NotifyFlags
+	for i := 0; i < len(s); i++ {
+		if s[i] == 'A' {
+			flags |= NotifyAll
+			continue
+		}
+		found := false
+		for _, fc := range notifyFlagChars {
+			if fc.char == s[i] {
+				flags |= fc.flag
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, errors.New("invalid notify flag '" + string(s[i]) + "'")
+		}
+	}
+	return flags, nil
+}
+
+func (flags NotifyFlags) String() string {
+	var sb strings.Builder
+	for _, fc := range notifyFlagChars {
+		if flags&NotifyAll == NotifyAll && fc.flag&NotifyAll != 0 {
+			continue
+		}
+		if flags&fc.flag != 0 {
+			sb.WriteByte(fc.char)
+		}
+	}
+	if flags&NotifyAll == NotifyAll {
+		sb.WriteByte('A')
+	}
+	return sb.String()
+}
+
+// 判断某类事件是否开启
+func (flags NotifyFlags) Enabled(e Event) bool {
+	switch e {
+	case EventSet:
+		return flags&NotifyString != 0
+	case EventDel, EventExpire:
+		return flags&NotifyGeneric != 0
+	case EventExpired:
+		return flags&NotifyExpired != 0
+	case EventEvicted:
+		return flags&NotifyEvicted != 0
+	default:
+		return false
+	}
+}
+
+// 事件回调；回调在缓存锁外执行，可以安全地再次访问缓存
+type NotifyFunc func(event Event, key string)
+
+type keyEvent struct {
+	event Event
+	key   string
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// CLIENT LIST的回复，按id索引，每个客户端为字段名到值的映射
+func clientList(c *testConn) map[string]map[string]string {
+	c.t.Helper()
+	reply := c.do("CLIENT LIST")
+	lines := strings.Split(reply, "\n")
+	if !strings.HasPrefix(lines[0], "*") {
+		c.t.Fatalf("CLIENT LIST: %q", reply)
+	}
+	ret := make(map[string]map[string]string)
+	for _, line := range lines[1:] {
+		fields := make(map[string]string)
+		for _, f := range strings.Fields(line) {
+			k, v, _ := strings.Cut(f, "=")
+			fields[k] = v
+		}
+		ret[fields["id"]] = fields
+	}
+	return ret
+}
+
+// 连接被服务器断开
+func expectClosed(c *testConn) {
+	c.t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err := c.reader.ReadByte(); err != nil {
+			if err != io.EOF && !strings.Contains(err.Error(), "reset") {
+				c.t.Errorf("expected the connection to be closed, got %v", err)
+			}
+			return
+		}
+	}
+}
+
+func TestClientList(t *testing.T) {
+	s := startServer(t)
+	a, b, admin := dial(t, s.addr), dial(t, s.addr), dial(t, s.addr)
+	idA, idB := a.do("CLIENT ID"), b.do("CLIENT ID")
+	if idA == idB {
+		t.Errorf("both clients have id %s", idA)
+	}
+
+	a.expect("CLIENT GETNAME", "NIL")
+	a.expect("CLIENT SETNAME web", "DONE")
+	a.expect("CLIENT GETNAME", "web")
+	a.expect("CLIENT SETNAME a b", "client names cannot contain spaces")
+	a.expect("SET cl_a:1", "DONE")
+	b.expect("SUBSCRIBE cl_ch", "DONE")
+	tx := dial(t, s.addr)
+	tx.expect("WATCH cl_a", "DONE")
+	tx.expect("MULTI", "DONE")
+	tx.expect("GET cl_a", "QUEUED")
+	// CLIENT不入队
+	idTx := tx.do("CLIENT ID")
+
+	list := clientList(admin)
+	if len(list) != 4 {
+		t.Errorf("%d clients, want 4", len(list))
+	}
+	for id, want := range map[string]map[string]string{
+		idA:  {"addr": a.LocalAddr().String(), "name": "web", "sub": "0", "multi": "-1", "watch": "0", "class": "normal", "user": "default", "cmd": "set", "db": "0"},
+		idB:  {"addr": b.LocalAddr().String(), "name": "", "sub": "1", "multi": "-1", "class": "pubsub", "cmd": "subscribe"},
+		idTx: {"multi": "1", "watch": "1", "class": "normal", "cmd": "client"},
+	} {
+		got := list[id]
+		if got == nil {
+			t.Errorf("client %s missing from CLIENT LIST", id)
+			continue
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("client %s: %s=%q, want %q", id, k, got[k], v)
+			}
+		}
+		for _, k := range []string{"age", "idle", "qbuf", "obl"} {
+			if _, ok := got[k]; !ok {
+				t.Errorf("client %s: no %s field", id, k)
+			}
+		}
+	}
+
+	// 名字为""时清除
+	a.expect(`CLIENT SETNAME ""`, "DONE")
+	a.expect("CLIENT GETNAME", "NIL")
+	if got := clientList(admin)[idA]["name"]; got != "" {
+		t.Errorf("name after clearing: %q", got)
+	}
+}
+
+func TestClientKill(t *testing.T) {
+	s := startServer(t, "-requirepass", "secret")
+	admin := login(t, s.addr, "default", "secret")
+	admin.expect("ACL SETUSER u on >pw allkeys +@all -@admin", "DONE")
+	a := login(t, s.addr, "default", "secret")
+	b := login(t, s.addr, "u", "pw")
+	c := login(t, s.addr, "u", "pw")
+	d := login(t, s.addr, "default", "secret")
+	idA := a.do("CLIENT ID")
+
+	admin.expect(fmt.Sprintf("CLIENT KILL ID %s USER u", idA), "0")
+	admin.expect("CLIENT KILL ID "+idA, "1")
+	expectClosed(a)
+	admin.expect("CLIENT KILL USER u", "2")
+	expectClosed(b)
+	expectClosed(c)
+	admin.expect("CLIENT KILL "+d.LocalAddr().String(), "DONE")
+	expectClosed(d)
+	admin.expect("CLIENT KILL 127.0.0.1:1", "no such client")
+	admin.expect("CLIENT KILL ADDR 127.0.0.1:1", "0")
+	admin.expect("CLIENT KILL NAME x", "wrong command")
+
+	waitFor(t, "killed clients to leave CLIENT LIST", func() bool { return len(clientList(admin)) == 1 })
+	admin.expect("PING", "PONG")
+}
+
+func TestClientPause(t *testing.T) {
+	s := startServer(t)
+	admin, c := dial(t, s.addr), dial(t, s.addr)
+	c.expect("SET cp_a:1", "DONE")
+
+	// 只暂停写命令
+	admin.expect("CLIENT PAUSE 300 WRITE", "DONE")
+	start := time.Now()
+	c.expect("GET cp_a", "1")
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Errorf("read paused for %v under CLIENT PAUSE WRITE", d)
+	}
+	c.expect("SET cp_a:2", "DONE")
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Errorf("write returned after %v, want it paused for 300ms", d)
+	}
+
+	// 暂停全部命令，CLIENT命令不受影响，UNPAUSE提前结束
+	admin.expect("CLIENT PAUSE 10000", "DONE")
+	start = time.Now()
+	c.send("GET cp_a")
+	time.Sleep(100 * time.Millisecond)
+	if len(clientList(admin)) != 2 {
+		t.Error("CLIENT LIST during pause")
+	}
+	admin.expect("CLIENT UNPAUSE", "DONE")
+	if got := c.recv(); got != "2" {
+		t.Errorf("GET after UNPAUSE: %q", got)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || d > 5*time.Second {
+		t.Errorf("paused read returned after %v", d)
+	}
+	admin.expect("CLIENT PAUSE -1", "timeout is not a non-negative integer")
+	admin.expect("CLIENT PAUSE 10 SOME", "wrong command")
+}
@@ -0,0 +1,167 @@
+package command
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"tinycached/server/acl"
+	"tinycached/utils"
+)
+
+var acls *acl.ACL
+
+// 设置AUTH与ACL命令使用的用户表；未设置时不做权限检查
+func UseACL(a *acl.ACL) {
+	acls = a
+}
+
+// 新连接的初始用户：default用户不需要密码时直接以default登录
+func initialUser() string {
+	if acls == nil || acls.DefaultNoAuth() {
+		return acl.DefaultUser
+	}
+	return ""
+}
+
+// 命令访问的key，不涉及key的命令返回空串
+func keyOf(cmd utils.CmdType, body string) string {
+	switch cmd {
+	case utils.GET, utils.SET, utils.DEL, utils.EXPR, utils.WATCH, utils.UNWATCH:
+		return strings.SplitN(body, ":", 2)[0]
+	default:
+		return ""
+	}
+}
+
+// 在执行命令前检查当前用户的权限
+func (clt *CacheClientInfo) checkPerm(cmd utils.CmdType, body string) error {
+	if acls == nil || clt.replaying || clt.master {
+		return nil
+	}
+	cat := acl.CategoryOf(cmd)
+	if cmd == utils.ACL && strings.EqualFold(strings.TrimSpace(body), "WHOAMI") {
+		cat = 0
+	}
+	// 只涉及当前连接的CLIENT子命令不需要权限
+	if cmd == utils.CLIENT {
+		switch strings.ToUpper(strings.SplitN(body, " ", 2)[0]) {
+		case "ID", "SETNAME", "GETNAME":
+			cat = 0
+		}
+	}
+	if cat == 0 {
+		return nil
+	}
+	if clt.user == "" {
+		return acl.ErrNoAuth
+	}
+	return acls.Check(clt.user, cat, keyOf(cmd, body))
+}
+
+/*
+ * AUTH 密码			以default用户登录
+ * AUTH 用户名 密码	以指定用户登录
+ */
+func (clt *CacheClientInfo) execAuthCmd(body string) ([]byte, error) {
+	if acls == nil {
+		return nil, errors.New("AUTH is not available")
+	}
+	elem := strings.SplitN(body, " ", 2)
+	name, pass := acl.DefaultUser, elem[0]
+	if len(elem) == 2 {
+		name, pass = elem[0], elem[1]
+	}
+	if err := acls.Authenticate(name, pass); err != nil {
+		return nil, err
+	}
+	clt.user = name
+	return []byte("DONE"), nil
+}
+
+/*
+ * ACL LIST				返回全部用户的规则
+ * ACL SETUSER 用户名 规则...	创建或修改用户
+ * ACL DELUSER 用户名...		删除用户，返回删除的用户数
+ * ACL WHOAMI			返回当前用户名
+ * ACL SAVE				将用户写入aclfile
+ */
+func (clt *CacheClientInfo) execACLCmd(body string) ([]byte, error) {
+	if acls == nil {
+		return nil, errors.New("ACL is not available")
+	}
+	elem := strings.Fields(body)
+	if len(elem) == 0 {
+		return nil, errors.New("wrong command")
+	}
+	switch strings.ToUpper(elem[0]) {
+	case "LIST":
+		return utils.MultiLine(acls.List()), nil
+
+	case "SETUSER":
+		if len(elem) < 2 {
+			return nil, errors.New("wrong command")
+		}
+		if err := acls.SetUser(elem[1], elem[2:]); err != nil {
+			return nil, err
+		}
+		return []byte("DONE"), nil
+
+	case "DELUSER":
+		if len(elem) < 2 {
+			return nil, errors.New("wrong command")
+		}
+		n, err := acls.DelUser(elem[1:])
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(n)), nil
+
+	case "WHOAMI":
+		if clt.user == "" {
+			return nil, acl.ErrNoAuth
+		}
+		return []byte(clt.user), nil
+
+	case "SAVE":
+		if serverConfig == nil || serverConfig.ACLFile == "" {
+			return nil, errors.New("aclfile is not configured")
+		}
+		if err := acls.Save(serverConfig.ACLFile); err != nil {
+			return nil, err
+		}
+		return []byte("DONE"), nil
+
+	default:
+		return nil, errors.New("wrong command")
+	}
+}
+
+/*
+ * ASUSER 用户名 命令 参数
+ * 以指定用户的身份执行一条命令，供代理转发客户端的命令；用户名为"-"表示未认证的客户端。
+ * 当前用户须拥有admin权限，命令的权限按指定用户检查
+ */
+func (clt *CacheClientInfo) execAsUserCmd(body string) ([]byte, error) {
+	elem := strings.SplitN(body, " ", 3)
+	if len(elem) < 2 {
+		return nil, errors.New("wrong command")
+	}
+	cmd := utils.ParseCmdType(elem[1])
+	switch cmd {
+	case utils.ERROR, utils.AUTH, utils.ASUSER:
+		return nil, errors.New("wrong command")
+	}
+	arg := ""
+	if len(elem) == 3 {
+		arg = elem[2]
+	}
+
+	user := clt.user
+	if elem[0] == acl.Unauthenticated {
+		clt.user = initialUser()
+	} else {
+		clt.user = elem[0]
+	}
+	defer func() { clt.user = user }()
+	return clt.ExecCmd(cmd, arg)
+}
@@ -0,0 +1,75 @@
+package command
+
+// 复制积压缓冲区：固定大小的环形缓冲区，保存复制流最近的若干字节，
+// 断线重连的副本请求的偏移量仍在其中时，只需补发缺失的部分
+type replBacklog struct {
+	buf   []byte // 为nil表示尚未分配，此时只记录偏移量
+	size  int
+	start int64 // 缓冲区中最早一个字节的偏移量
+	end   int64 // 复制流的偏移量，即缓冲区中最后一个字节之后的偏移量
+}
+
+// 分配缓冲区，已分配时不做任何事；分配之前的复制流不在缓冲区中
+func (b *replBacklog) activate() {
+	if b.buf == nil && b.size > 0 {
+		b.buf = make([]byte, b.size)
+		b.start = b.end
+	}
+}
+
+func (b *replBacklog) active() bool {
+	return b.buf != nil
+}
+
+// 修改大小，已分配的缓冲区按新大小重新分配，原有内容丢弃
+func (b *replBacklog) resize(size int) {
+	if size == b.size {
+		return
+	}
+	b.size = size
+	if b.buf != nil {
+		b.buf = nil
+		b.activate()
+	}
+}
+
+// 丢弃缓冲区中的内容，复制流从offset继续
+func (b *replBacklog) reset(offset int64) {
+	b.start, b.end = offset, offset
+}
+
+func (b *replBacklog) write(p []byte) {
+	b.end += int64(len(p))
+	if b.buf == nil {
+		b.start = b.end
+		return
+	}
+	if len(p) > b.size {
+		p = p[len(p)-b.size:]
+	}
+	// end之前的len(p)字节对应环形缓冲区中从pos开始的位置
+	pos := int((b.end - int64(len(p))) % int64(b.size))
+	n := copy(b.buf[pos:], p)
+	copy(b.buf, p[n:])
+	if b.end-b.start > int64(b.size) {
+		b.start = b.end - int64(b.size)
+	}
+}
+
+// 缓冲区中的字节数
+func (b *replBacklog) histlen() int64 {
+	return b.end - b.start
+}
+
+// 返回从offset到末尾的复制流；offset不在缓冲区范围内时返回false
+func (b *replBacklog) readFrom(offset int64) ([]byte, bool) {
+	if b.buf == nil || offset < b.start || offset > b.end {
+		return nil, false
+	}
+	n := int(b.end - offset)
+	ret := make([]byte, n)
+	pos := int(offset % int64(b.size))
+	m := copy(ret, b.buf[pos:])
+	copy(ret[m:], b.buf)
+	return ret, true
+}
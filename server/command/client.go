@@ -0,0 +1,405 @@
+package command
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tinycached/config"
+	"tinycached/server/acl"
+	"tinycached/utils"
+)
+
+// 网络层为客户端提供的操作
+type connHooks struct {
+	kill    func()            // 断开连接
+	buffers func() (int, int) // 读缓冲区中尚未处理的字节数与尚未写出的字节数
+}
+
+// 客户端状态的快照，每条命令执行完后由客户端自己的协程更新，供其他客户端的CLIENT LIST读取
+type clientStat struct {
+	lastActive time.Time
+	lastCmd    utils.CmdType
+	user       string
+	multi      int // 事务中排队的命令数，不在事务中为-1
+	watch      int
+	subs       int
+	class      config.ClientClass
+}
+
+// 已连接客户端的登记表，不包括重放AOF用的客户端
+type clientRegistry struct {
+	mutex  sync.RWMutex
+	nextID uint64
+	clts   map[uint64]*CacheClientInfo
+}
+
+var clients = &clientRegistry{nextID: 1, clts: make(map[uint64]*CacheClientInfo)}
+
+/*
+ * 将客户端登记到客户端列表，CLIENT命令只能看到登记过的客户端；
+ * addr为客户端地址，kill用于CLIENT KILL断开连接，buffers返回读写缓冲区中的字节数
+ */
+func (clt *CacheClientInfo) Register(addr string, kill func(), buffers func() (int, int)) {
+	clt.addr = addr
+	// 断开连接时同时结束阻塞中的WAIT
+	clt.hooks = connHooks{kill: func() { clt.wake(); kill() }, buffers: buffers}
+	clt.created = time.Now()
+	clt.updateStat(utils.ERROR)
+
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+
+	clt.id = clients.nextID
+	clients.nextID++
+	clients.clts[clt.id] = clt
+}
+
+func (clt *CacheClientInfo) unregister() {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+
+	delete(clients.clts, clt.id)
+}
+
+// 按id顺序返回全部客户端
+func (r *clientRegistry) list() []*CacheClientInfo {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	ret := make([]*CacheClientInfo, 0, len(r.clts))
+	for _, clt := range r.clts {
+		ret = append(ret, clt)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].id < ret[j].id })
+	return ret
+}
+
+// 执行命令后更新状态快照，cmd为ERROR表示尚未执行过命令
+func (clt *CacheClientInfo) updateStat(cmd utils.CmdType) {
+	multi := -1
+	if clt.isInMulti {
+		multi = clt.queue.list.Len()
+	}
+	class := config.ClassNormal
+	if clt.IsReplica() {
+		class = config.ClassReplica
+	} else if len(clt.subscriptions) > 0 || clt.monitoring {
+		class = config.ClassPubSub
+	}
+	clt.statMutex.Lock()
+	defer clt.statMutex.Unlock()
+
+	clt.stat = clientStat{
+		lastActive: time.Now(),
+		lastCmd:    cmd,
+		user:       clt.user,
+		multi:      multi,
+		watch:      len(clt.watched),
+		subs:       len(clt.subscriptions),
+		class:      class,
+	}
+}
+
+func (clt *CacheClientInfo) snapshot() (clientStat, string) {
+	clt.statMutex.Lock()
+	defer clt.statMutex.Unlock()
+
+	return clt.stat, clt.name
+}
+
+// CLIENT LIST中的一行
+func (clt *CacheClientInfo) describe(now time.Time) string {
+	stat, name := clt.snapshot()
+	qbuf, obl := 0, 0
+	if clt.hooks.buffers != nil {
+		qbuf, obl = clt.hooks.buffers()
+	}
+	user := stat.user
+	if user == "" {
+		user = acl.Unauthenticated
+	}
+	cmd := "NULL"
+	if stat.lastCmd != utils.ERROR {
+		cmd = strings.ToLower(stat.lastCmd.String())
+	}
+	return "id=" + strconv.FormatUint(clt.id, 10) +
+		" addr=" + clt.addr +
+		" name=" + name +
+		" age=" + strconv.FormatInt(int64(now.Sub(clt.created)/time.Second), 10) +
+		" idle=" + strconv.FormatInt(int64(now.Sub(stat.lastActive)/time.Second), 10) +
+		" db=0" +
+		" sub=" + strconv.Itoa(stat.subs) +
+		" multi=" + strconv.Itoa(stat.multi) +
+		" watch=" + strconv.Itoa(stat.watch) +
+		" qbuf=" + strconv.Itoa(qbuf) +
+		" obl=" + strconv.Itoa(obl) +
+		" class=" + stat.class.String() +
+		" user=" + user +
+		" cmd=" + cmd
+}
+
+// 各类客户端的输出缓冲区限制
+var outputLimits struct {
+	mutex  sync.RWMutex
+	limits config.OutputLimits
+}
+
+// 因超出输出缓冲区限制被断开的连接数
+var outputLimitKills uint64
+
+func SetOutputLimits(limits config.OutputLimits) {
+	outputLimits.mutex.Lock()
+	defer outputLimits.mutex.Unlock()
+
+	outputLimits.limits = limits
+}
+
+func OutputLimitKills() uint64 {
+	return atomic.LoadUint64(&outputLimitKills)
+}
+
+/*
+ * 检查尚未写出的字节数是否超出客户端所属类别的限制，超出时断开连接：
+ * 超过hard立即断开，超过soft且持续soft秒数后断开。
+ * 在写出回复与推送消息后调用，可在任意协程中调用
+ */
+func (clt *CacheClientInfo) CheckOutputLimit() {
+	if clt.hooks.buffers == nil {
+		return
+	}
+	stat, _ := clt.snapshot()
+	outputLimits.mutex.RLock()
+	limit := outputLimits.limits[stat.class]
+	outputLimits.mutex.RUnlock()
+	if limit.Hard == 0 && limit.Soft == 0 {
+		return
+	}
+	_, obl := clt.hooks.buffers()
+	n := uint64(obl) + uint64(atomic.LoadInt64(&clt.replPending))
+
+	clt.obufMutex.Lock()
+	exceeded := false
+	if limit.Hard > 0 && n >= limit.Hard {
+		exceeded = true
+	} else if limit.Soft > 0 && n >= limit.Soft {
+		now := time.Now()
+		if clt.softSince.IsZero() {
+			clt.softSince = now
+		}
+		exceeded = now.Sub(clt.softSince) >= time.Duration(limit.SoftSeconds)*time.Second
+	} else {
+		clt.softSince = time.Time{}
+	}
+	kill := exceeded && !clt.killed
+	if kill {
+		clt.killed = true
+	}
+	clt.obufMutex.Unlock()
+
+	if kill {
+		atomic.AddUint64(&outputLimitKills, 1)
+		log.Printf("client %s (%s) closed for overcoming of output buffer limits: %d bytes pending",
+			clt.addr, stat.class, n)
+		// 可能在发布消息时持有订阅表的锁，断开连接会取消订阅，须在其他协程中执行
+		go clt.hooks.kill()
+	}
+}
+
+// CLIENT PAUSE的状态
+type clientPause struct {
+	mutex      sync.Mutex
+	until      time.Time
+	writesOnly bool
+	resume     chan struct{} // CLIENT UNPAUSE时关闭，唤醒等待的客户端
+}
+
+var pause = &clientPause{resume: make(chan struct{})}
+
+/*
+ * 暂停期间执行命令前等待暂停结束，只暂停写命令时读命令不受影响；
+ * CLIENT命令不暂停，以便执行CLIENT UNPAUSE。
+ * netpoll模式下等待会阻塞整个事件循环，同一事件循环上的其他连接也要等到暂停结束
+ */
+func (p *clientPause) wait(cmd utils.CmdType) {
+	if cmd == utils.CLIENT {
+		return
+	}
+	for {
+		p.mutex.Lock()
+		remaining := time.Until(p.until)
+		applies := !p.writesOnly || acl.CategoryOf(cmd) == acl.CatWrite || cmd == utils.EXEC
+		resume := p.resume
+		p.mutex.Unlock()
+		if remaining <= 0 || !applies {
+			return
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-timer.C:
+		case <-resume:
+			timer.Stop()
+		}
+	}
+}
+
+func (p *clientPause) start(d time.Duration, writesOnly bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.until = time.Now().Add(d)
+	p.writesOnly = writesOnly
+}
+
+func (p *clientPause) stop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.until = time.Time{}
+	close(p.resume)
+	p.resume = make(chan struct{})
+}
+
+/*
+ * CLIENT LIST				返回全部客户端，每行一个
+ * CLIENT KILL 地址			断开指定地址的客户端
+ * CLIENT KILL ID id|ADDR 地址|USER 用户名...	断开满足全部条件的客户端，返回断开的客户端数
+ * CLIENT ID				返回当前客户端的id
+ * CLIENT SETNAME 名字		设置当前客户端的名字，名字不能含空格，为空时清除
+ * CLIENT GETNAME			返回当前客户端的名字，未设置时返回NIL
+ * CLIENT PAUSE 毫秒 [WRITE|ALL]	暂停处理客户端的命令，WRITE只暂停写命令，默认ALL
+ * CLIENT UNPAUSE			提前结束暂停
+ */
+func (clt *CacheClientInfo) execClientCmd(body string) ([]byte, error) {
+	elem := strings.Fields(body)
+	if len(elem) == 0 {
+		return nil, errors.New("wrong command")
+	}
+	switch strings.ToUpper(elem[0]) {
+	case "LIST":
+		if len(elem) != 1 {
+			return nil, errors.New("wrong command")
+		}
+		now := time.Now()
+		var lines []string
+		for _, c := range clients.list() {
+			lines = append(lines, c.describe(now))
+		}
+		return utils.MultiLine(lines), nil
+
+	case "KILL":
+		return clt.execClientKill(elem[1:])
+
+	case "ID":
+		if len(elem) != 1 {
+			return nil, errors.New("wrong command")
+		}
+		return []byte(strconv.FormatUint(clt.id, 10)), nil
+
+	case "SETNAME":
+		if len(elem) > 2 {
+			return nil, errors.New("client names cannot contain spaces")
+		}
+		name := ""
+		if len(elem) == 2 && elem[1] != `""` {
+			name = elem[1]
+		}
+		if !utils.SafeReplyLine(name) {
+			return nil, utils.ErrStarPrefix
+		}
+		clt.statMutex.Lock()
+		clt.name = name
+		clt.statMutex.Unlock()
+		return []byte("DONE"), nil
+
+	case "GETNAME":
+		if len(elem) != 1 {
+			return nil, errors.New("wrong command")
+		}
+		if _, name := clt.snapshot(); name != "" {
+			return []byte(name), nil
+		}
+		return nil, errors.New("NIL")
+
+	case "PAUSE":
+		if len(elem) != 2 && len(elem) != 3 {
+			return nil, errors.New("wrong command")
+		}
+		ms, err := strconv.ParseInt(elem[1], 10, 64)
+		if err != nil || ms < 0 {
+			return nil, errors.New("timeout is not a non-negative integer")
+		}
+		writesOnly := false
+		if len(elem) == 3 {
+			switch strings.ToUpper(elem[2]) {
+			case "WRITE":
+				writesOnly = true
+			case "ALL":
+			default:
+				return nil, errors.New("wrong command")
+			}
+		}
+		pause.start(time.Duration(ms)*time.Millisecond, writesOnly)
+		return []byte("DONE"), nil
+
+	case "UNPAUSE":
+		if len(elem) != 1 {
+			return nil, errors.New("wrong command")
+		}
+		pause.stop()
+		return []byte("DONE"), nil
+
+	default:
+		return nil, errors.New("wrong command")
+	}
+}
+
+func (clt *CacheClientInfo) execClientKill(args []string) ([]byte, error) {
+	var id, addr, user string
+	if len(args) == 1 {
+		// 旧格式：CLIENT KILL 地址，找不到时返回错误
+		addr = args[0]
+	} else if len(args) > 0 && len(args)%2 == 0 {
+		for i := 0; i < len(args); i += 2 {
+			switch strings.ToUpper(args[i]) {
+			case "ID":
+				id = args[i+1]
+			case "ADDR":
+				addr = args[i+1]
+			case "USER":
+				user = args[i+1]
+			default:
+				return nil, errors.New("wrong command")
+			}
+		}
+	} else {
+		return nil, errors.New("wrong command")
+	}
+
+	var killed []*CacheClientInfo
+	for _, c := range clients.list() {
+		stat, _ := c.snapshot()
+		if (id != "" && strconv.FormatUint(c.id, 10) != id) ||
+			(addr != "" && c.addr != addr) ||
+			(user != "" && stat.user != user) {
+			continue
+		}
+		killed = append(killed, c)
+	}
+	for _, c := range killed {
+		if c.hooks.kill != nil {
+			c.hooks.kill()
+		}
+	}
+	if len(args) == 1 {
+		if len(killed) == 0 {
+			return nil, errors.New("no such client")
+		}
+		return []byte("DONE"), nil
+	}
+	return []byte(strconv.Itoa(len(killed))), nil
+}
@@ -4,30 +4,156 @@ import (
 	"errors"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"tinycached/server/cache"
 	"tinycached/server/persistence"
 	"tinycached/utils"
 )
 
 type CacheClientInfo struct {
-	cache     *cache.Cache
-	isCAS     bool          // 客户端监视的key中，是否至少有一个已经被其他客户端修改
-	isInMulti bool          // 是否位于事务状态
-	queue     *CommandQueue // 事务命令队列
+	pushBytes     int64 // pushChan中尚未写出的字节数，原子操作，放在首位保证64位对齐
+	replPending   int64 // 积压在复制流中尚未交给网络层的字节数，原子操作
+	replica       int32 // 是否是副本连接，原子操作
+	cache         *cache.Cache
+	isCAS         bool                // 客户端监视的key中，是否至少有一个已经被其他客户端修改
+	isInMulti     bool                // 是否位于事务状态
+	queue         *CommandQueue       // 事务命令队列
+	subscriptions map[string]struct{} // 已订阅的频道与频道模式
+	pushChan      chan []byte         // 服务器主动推送给客户端的消息
+	pushFunc      func([]byte) bool   // 不为nil时推送的消息直接交给调用方写出，不经过pushChan
+	replaying     bool                // 是否在重放AOF，重放的命令不再写入AOF
+	master        bool                // 是否在执行主服务器通过复制流发来的命令
+	user          string              // 当前用户，为空表示尚未认证
+	watched       map[string]struct{} // 监视的key
+	id            uint64              // 客户端列表中的id，未登记时为0
+	addr          string              // 客户端地址
+	created       time.Time           // 登记的时间
+	hooks         connHooks           // 网络层提供的断开连接等操作
+	statMutex     sync.Mutex          // 保护name与stat
+	name          string              // CLIENT SETNAME设置的名字
+	stat          clientStat          // 供CLIENT LIST读取的状态快照
+	monitoring    bool                // 是否执行过MONITOR
+	obufMutex     sync.Mutex          // 保护softSince与killed
+	softSince     time.Time           // 输出缓冲区开始超过soft限制的时间
+	killed        bool                // 是否已因超出输出缓冲区限制被断开
+	listenPort    string              // 副本通过REPLCONF告知的监听端口
+	woff          int64               // 最近一次写入之后复制流的偏移量，WAIT等待副本确认到该偏移量
+	unblock       chan struct{}       // 连接断开时关闭，结束阻塞中的WAIT
+	unblockOnce   sync.Once
 }
 
-func NewCacheClient() (clt *CacheClientInfo) {
+func NewCacheClient(c *cache.Cache) (clt *CacheClientInfo) {
 	clt = &CacheClientInfo{
-		cache:     cache.New(512),
-		isCAS:     false,
-		isInMulti: false,
-		queue:     NewCmdQueue(),
+		cache:         c,
+		isCAS:         false,
+		isInMulti:     false,
+		queue:         NewCmdQueue(),
+		subscriptions: make(map[string]struct{}),
+		pushChan:      make(chan []byte, maxPendingPushes),
+		user:          initialUser(),
+		watched:       make(map[string]struct{}),
+		unblock:       make(chan struct{}),
 	}
 	return clt
 }
 
+// 推送的消息由push直接写出的客户端，用于不为每个连接单独启动推送协程的网络模型；
+// push须是非阻塞的，积压过多时返回false丢弃消息
+func NewPushClient(c *cache.Cache, push func([]byte) bool) (clt *CacheClientInfo) {
+	clt = &CacheClientInfo{
+		cache:         c,
+		queue:         NewCmdQueue(),
+		subscriptions: make(map[string]struct{}),
+		pushFunc:      push,
+		user:          initialUser(),
+		watched:       make(map[string]struct{}),
+		unblock:       make(chan struct{}),
+	}
+	return clt
+}
+
+// 用于启动时重放AOF的客户端
+func NewReplayClient(c *cache.Cache) (clt *CacheClientInfo) {
+	clt = NewCacheClient(c)
+	clt.replaying = true
+	return clt
+}
+
+func (clt *CacheClientInfo) appendAof(cmd utils.CmdType, body string) {
+	if !clt.replaying {
+		persistence.AofInstance().Append([]byte(cmd.String()), []byte(body))
+		clt.woff = replicas.currentOffset()
+	}
+}
+
+// 服务器主动推送给该客户端的消息；客户端关闭后通道被关闭
+func (clt *CacheClientInfo) Pushed() <-chan []byte {
+	return clt.pushChan
+}
+
+// 非阻塞推送，积压过多时丢弃消息；推送后检查输出缓冲区限制。
+// 丢弃时同样检查，积压一直超过soft限制的客户端不会因为不再入队而逃过断开
+func (clt *CacheClientInfo) push(msg []byte) bool {
+	ok := false
+	if clt.pushFunc != nil {
+		ok = clt.pushFunc(msg)
+	} else {
+		select {
+		case clt.pushChan <- msg:
+			atomic.AddInt64(&clt.pushBytes, int64(len(msg)))
+			ok = true
+		default:
+		}
+	}
+	clt.CheckOutputLimit()
+	return ok
+}
+
+// 从Pushed取出的消息已写出，n为字节数
+func (clt *CacheClientInfo) PushSent(n int) {
+	atomic.AddInt64(&clt.pushBytes, -int64(n))
+	if clt.IsReplica() {
+		replicas.resume(clt, false)
+	}
+}
+
+// pushChan中尚未写出的字节数
+func (clt *CacheClientInfo) PushPending() int {
+	return int(atomic.LoadInt64(&clt.pushBytes))
+}
+
+// 客户端断开时释放其订阅、MONITOR与复制，并从客户端列表中移除
+func (clt *CacheClientInfo) Close() {
+	pubsub.unsubscribe("", clt)
+	monitors.remove(clt)
+	replicas.remove(clt)
+	clt.unregister()
+	clt.wake()
+	if clt.pushChan != nil {
+		close(clt.pushChan)
+	}
+}
+
 func (clt *CacheClientInfo) ExecCmd(cmd utils.CmdType, body string) (ret []byte, err error) {
-	aof := persistence.AofInstance()
+	if err := clt.checkPerm(cmd, body); err != nil {
+		return nil, err
+	}
+	if err := clt.checkReadOnly(cmd); err != nil {
+		return nil, err
+	}
+	if !clt.replaying && !clt.master {
+		pause.wait(cmd)
+		defer clt.observe(cmd, body, time.Now())
+		// ASUSER执行的命令在内层调用时推送
+		if cmd != utils.ASUSER && cmd != utils.MONITOR {
+			feedMonitors(clt, cmd, body)
+		}
+	}
+	if ret, handled, err := clt.execConsensus(cmd, body); handled {
+		return ret, err
+	}
 	elem := strings.Split(string(body), ":")
 	switch cmd {
 	case utils.GET:
@@ -50,15 +176,20 @@ func (clt *CacheClientInfo) ExecCmd(cmd utils.CmdType, body string) (ret []byte,
 		if len(elem) < 2 {
 			return nil, errors.New("wrong command")
 		}
-
-		aof.Append([]byte(cmd.String()), []byte(body)) // 记录SET命令
+		if !utils.SafeReplyLine(elem[1]) {
+			return nil, utils.ErrStarPrefix
+		}
 
 		if clt.isInMulti {
 			clt.queue.PushCmd(cmd, body)
 			NotifyModifyed(string(elem[0]))
 			return []byte("QUEUED"), nil
 		} else {
-			clt.cache.Add(elem[0], []byte(elem[1]))
+			if err := clt.applyWrite(cmd, body, func() error {
+				return clt.cache.Add(elem[0], []byte(elem[1]))
+			}); err != nil {
+				return nil, err
+			}
 			NotifyModifyed(string(elem[0]))
 			return []byte("DONE"), nil
 		}
@@ -68,13 +199,15 @@ func (clt *CacheClientInfo) ExecCmd(cmd utils.CmdType, body string) (ret []byte,
 			return nil, errors.New("wrong command")
 		}
 
-		aof.Append([]byte(cmd.String()), []byte(body)) // 记录DEL命令
 		if clt.isInMulti {
 			clt.queue.PushCmd(cmd, body)
 			NotifyModifyed(string(elem[0]))
 			return []byte("QUEUED"), nil
 		} else {
-			clt.cache.Del(elem[0])
+			clt.applyWrite(cmd, body, func() error {
+				clt.cache.Del(elem[0])
+				return nil
+			})
 			NotifyModifyed(string(elem[0]))
 			return []byte("DONE"), nil
 		}
@@ -84,7 +217,6 @@ func (clt *CacheClientInfo) ExecCmd(cmd utils.CmdType, body string) (ret []byte,
 			return nil, errors.New("wrong command")
 		}
 
-		aof.Append([]byte(cmd.String()), []byte(body)) // 记录EXPR命令
 		if clt.isInMulti {
 			clt.queue.PushCmd(cmd, body)
 			NotifyModifyed(string(elem[0]))
@@ -94,36 +226,39 @@ func (clt *CacheClientInfo) ExecCmd(cmd utils.CmdType, body string) (ret []byte,
 			if err != nil {
 				return nil, err
 			}
-			clt.cache.SetExpireTimeMs(elem[0], t)
+			clt.applyWrite(cmd, body, func() error {
+				clt.cache.SetExpireTimeMs(elem[0], t)
+				return nil
+			})
 			NotifyModifyed(string(elem[0]))
 			return []byte("DONE"), nil
 		}
 
+	// 事务中的写命令入队时不记录AOF，EXEC执行时逐条记录，DISCARD或EXEC失败的命令不进入AOF与复制流；
+	// 事务控制命令本身也不记录
 	case utils.MULTI:
 		clt.isInMulti = true
-		aof.Append([]byte(cmd.String()), []byte(body))
 		return []byte("DONE"), nil
 
 	case utils.EXEC:
-		aof.Append([]byte(cmd.String()), []byte(body))
 		DelWatchKey(string(body), clt)
+		// 入队的命令按普通命令执行
+		clt.isInMulti = false
 		if !clt.isCAS {
+			clt.queue.discardAllCmds()
 			return nil, errors.New("NIL")
 		}
-		ret, err := clt.queue.ExecCmds(clt)
-		clt.isInMulti = false
-		return ret, err
+		return clt.queue.ExecCmds(clt)
 
 	case utils.DISCARD:
 		clt.isInMulti = false
-		aof.Append([]byte(cmd.String()), []byte(body))
+		clt.queue.discardAllCmds()
 		return []byte("DONE"), nil
 
 	case utils.WATCH:
 		if clt.isInMulti {
 			return nil, errors.New("NIL")
 		} else {
-			aof.Append([]byte(cmd.String()), []byte(body))
 			AddWatchKey(string(body), clt)
 			return []byte("DONE"), nil
 		}
@@ -132,11 +267,76 @@ func (clt *CacheClientInfo) ExecCmd(cmd utils.CmdType, body string) (ret []byte,
 		if clt.isInMulti {
 			return nil, errors.New("NIL")
 		} else {
-			aof.Append([]byte(cmd.String()), []byte(body))
 			DelWatchKey(string(body), clt)
 			return []byte("DONE"), nil
 		}
 
+	case utils.SUBSCRIBE:
+		if body == "" {
+			return nil, errors.New("wrong command")
+		}
+		pubsub.subscribe(pubsub.channels, body, clt)
+		return []byte("DONE"), nil
+
+	case utils.PSUBSCRIBE:
+		if body == "" {
+			return nil, errors.New("wrong command")
+		}
+		pubsub.subscribe(pubsub.patterns, body, clt)
+		return []byte("DONE"), nil
+
+	case utils.UNSUBSCRIBE:
+		pubsub.unsubscribe(body, clt)
+		return []byte("DONE"), nil
+
+	case utils.CONFIG:
+		return clt.execConfigCmd(body)
+
+	case utils.AUTH:
+		return clt.execAuthCmd(body)
+
+	case utils.ACL:
+		return clt.execACLCmd(body)
+
+	case utils.ASUSER:
+		return clt.execAsUserCmd(body)
+
+	case utils.INFO:
+		return execInfoCmd(body)
+
+	case utils.SLOWLOG:
+		return execSlowlogCmd(body)
+
+	case utils.MONITOR:
+		return clt.execMonitorCmd()
+
+	case utils.CLIENT:
+		return clt.execClientCmd(body)
+
+	case utils.SYNC:
+		return clt.execSyncCmd(body)
+
+	case utils.PSYNC:
+		return clt.execPsyncCmd(body)
+
+	case utils.REPLCONF:
+		return clt.execReplconfCmd(body)
+
+	case utils.REPLICAOF:
+		return execReplicaOfCmd(body)
+
+	case utils.WAIT:
+		return clt.execWaitCmd(body)
+
+	case utils.PING:
+		if body == "" {
+			return []byte("PONG"), nil
+		}
+		if !utils.SafeReplyLine(body) {
+			return nil, utils.ErrStarPrefix
+		}
+		return []byte(body), nil
+
 	default:
 		// 请求的格式出错
 		return nil, errors.New("wrong command")
@@ -0,0 +1,55 @@
+package command
+
+import (
+	"errors"
+	"strings"
+	"tinycached/config"
+	"tinycached/utils"
+)
+
+var serverConfig *config.Server
+
+// 设置CONFIG命令操作的服务器配置
+func UseConfig(cfg *config.Server) {
+	serverConfig = cfg
+}
+
+/*
+ * CONFIG GET 配置名模式	返回匹配的"配置名 值"列表
+ * CONFIG SET 配置名 值		运行时修改配置
+ * CONFIG REWRITE		将当前配置写回配置文件
+ */
+func (clt *CacheClientInfo) execConfigCmd(body string) ([]byte, error) {
+	if serverConfig == nil {
+		return nil, errors.New("config is not available")
+	}
+	elem := strings.SplitN(body, " ", 3)
+	switch strings.ToUpper(elem[0]) {
+	case "GET":
+		if len(elem) != 2 {
+			return nil, errors.New("wrong command")
+		}
+		return utils.MultiLine(serverConfig.Params().Match(elem[1])), nil
+
+	case "SET":
+		if len(elem) != 3 {
+			return nil, errors.New("wrong command")
+		}
+		if err := serverConfig.Params().SetLive(elem[1], elem[2]); err != nil {
+			return nil, err
+		}
+		return []byte("DONE"), nil
+
+	case "REWRITE":
+		if len(elem) != 1 {
+			return nil, errors.New("wrong command")
+		}
+		if err := serverConfig.Rewrite(); err != nil {
+			return nil, err
+		}
+		return []byte("DONE"), nil
+
+	default:
+		return nil, errors.New("wrong command")
+	}
+}
@@ -0,0 +1,57 @@
+package command
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"tinycached/utils"
+	"tinycached/utils/metrics"
+)
+
+// 每类命令的执行耗时，不含重放AOF与没有权限被拒绝的命令
+var cmdLatency [utils.ERROR + 1]*metrics.Histogram
+
+func init() {
+	for i := range cmdLatency {
+		cmdLatency[i] = metrics.NewHistogram(metrics.DefBuckets)
+	}
+}
+
+// 统计命令的执行耗时，超过慢日志阈值的同时记入慢日志，并更新客户端的状态快照
+func (clt *CacheClientInfo) observe(cmd utils.CmdType, body string, start time.Time) {
+	if cmd >= 0 && cmd <= utils.ERROR {
+		cmdLatency[cmd].Observe(time.Since(start))
+	}
+	slowlogs.record(clt, cmd, body, start)
+	clt.updateStat(cmd)
+}
+
+// 某类命令的执行次数，用于INFO
+func Calls(cmd utils.CmdType) uint64 {
+	return cmdLatency[cmd].Count()
+}
+
+// 某类命令的执行耗时，用于指标输出
+func Latency(cmd utils.CmdType) *metrics.Histogram {
+	return cmdLatency[cmd]
+}
+
+// 按段名返回INFO的内容，由服务器提供
+var infoFunc func(sections []string) []string
+
+// 设置INFO命令的内容来源
+func UseInfo(fn func(sections []string) []string) {
+	infoFunc = fn
+}
+
+/*
+ * INFO [段名...]
+ * 段名为server、clients、memory、persistence、stats、replication、raft、keyspace，不带参数或为all时返回全部
+ */
+func execInfoCmd(body string) ([]byte, error) {
+	if infoFunc == nil {
+		return nil, errors.New("INFO is not available")
+	}
+	sections := strings.Fields(strings.ToLower(body))
+	return utils.MultiLine(infoFunc(sections)), nil
+}
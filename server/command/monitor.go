@@ -0,0 +1,102 @@
+package command
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tinycached/utils"
+)
+
+// 执行MONITOR的客户端；推送经过客户端自己的有界缓冲区，积压过多时丢弃，不会拖慢执行命令的客户端
+type monitorSet struct {
+	count int32 // 客户端数，没有MONITOR时不必格式化命令，用原子操作访问
+	mutex sync.RWMutex
+	clts  map[*CacheClientInfo]struct{}
+}
+
+var monitors = &monitorSet{clts: make(map[*CacheClientInfo]struct{})}
+
+func (ms *monitorSet) add(clt *CacheClientInfo) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, ok := ms.clts[clt]; !ok {
+		ms.clts[clt] = struct{}{}
+		atomic.AddInt32(&ms.count, 1)
+	}
+}
+
+func (ms *monitorSet) remove(clt *CacheClientInfo) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, ok := ms.clts[clt]; ok {
+		delete(ms.clts, clt)
+		atomic.AddInt32(&ms.count, -1)
+	}
+}
+
+/*
+ * 将clt执行的命令推送给全部MONITOR客户端，每条一行：
+ * 开始时间(Unix秒，精确到微秒) [0 客户端地址] 命令 参数
+ * 0为数据库编号，与键空间事件的频道名一致
+ */
+func feedMonitors(clt *CacheClientInfo, cmd utils.CmdType, body string) {
+	if atomic.LoadInt32(&monitors.count) == 0 {
+		return
+	}
+	addr := clt.addr
+	if addr == "" {
+		addr = "-"
+	}
+	now := time.Now()
+	line := strconv.FormatInt(now.Unix(), 10) + "." + leftPad(strconv.Itoa(now.Nanosecond()/1000), 6) +
+		" [0 " + addr + "] " + cmd.String()
+	if args := redactArgs(cmd, body); args != "" {
+		line += " " + args
+	}
+	msg := []byte(line + "\n")
+
+	monitors.mutex.RLock()
+	defer monitors.mutex.RUnlock()
+
+	for m := range monitors.clts {
+		m.push(msg)
+	}
+}
+
+func leftPad(s string, n int) string {
+	if len(s) >= n {
+		return s
+	}
+	return strings.Repeat("0", n-len(s)) + s
+}
+
+// 隐去命令中的密码：AUTH的全部参数、ACL SETUSER的规则与CONFIG SET requirepass的值
+func redactArgs(cmd utils.CmdType, body string) string {
+	const redacted = "(redacted)"
+	switch cmd {
+	case utils.AUTH:
+		return redacted
+	case utils.ACL:
+		elem := strings.SplitN(body, " ", 3)
+		if len(elem) == 3 && strings.EqualFold(elem[0], "SETUSER") {
+			return elem[0] + " " + elem[1] + " " + redacted
+		}
+	case utils.CONFIG:
+		elem := strings.SplitN(body, " ", 3)
+		if len(elem) == 3 && strings.EqualFold(elem[0], "SET") && strings.EqualFold(elem[1], "requirepass") {
+			return elem[0] + " " + elem[1] + " " + redacted
+		}
+	}
+	return body
+}
+
+// MONITOR：之后服务器执行的每条命令都会推送给该客户端，直到连接断开
+func (clt *CacheClientInfo) execMonitorCmd() ([]byte, error) {
+	clt.monitoring = true
+	monitors.add(clt)
+	return []byte("DONE"), nil
+}
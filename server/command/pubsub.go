@@ -0,0 +1,90 @@
+package command
+
+import (
+	"path"
+	"sync"
+	"tinycached/server/cache"
+)
+
+// 每个订阅客户端最多积压的推送消息数；超出后丢弃，避免慢客户端拖住发布方
+const maxPendingPushes = 256
+
+type pubSub struct {
+	mutex    sync.RWMutex
+	channels map[string]map[*CacheClientInfo]struct{} // 频道名 -> 订阅者
+	patterns map[string]map[*CacheClientInfo]struct{} // 频道模式 -> 订阅者
+}
+
+var pubsub = &pubSub{
+	channels: make(map[string]map[*CacheClientInfo]struct{}),
+	patterns: make(map[string]map[*CacheClientInfo]struct{}),
+}
+
+func (ps *pubSub) subscribe(subs map[string]map[*CacheClientInfo]struct{}, name string, clt *CacheClientInfo) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if _, ok := subs[name]; !ok {
+		subs[name] = make(map[*CacheClientInfo]struct{})
+	}
+	subs[name][clt] = struct{}{}
+	clt.subscriptions[name] = struct{}{}
+}
+
+// 取消订阅；name为空时取消该客户端的全部订阅
+func (ps *pubSub) unsubscribe(name string, clt *CacheClientInfo) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	for sub := range clt.subscriptions {
+		if name != "" && name != sub {
+			continue
+		}
+		for _, subs := range []map[string]map[*CacheClientInfo]struct{}{ps.channels, ps.patterns} {
+			if clts, ok := subs[sub]; ok {
+				delete(clts, clt)
+				if len(clts) == 0 {
+					delete(subs, sub)
+				}
+			}
+		}
+		delete(clt.subscriptions, sub)
+	}
+}
+
+// 向频道发布消息，返回收到消息的客户端数
+func Publish(channel string, msg string) int {
+	pubsub.mutex.RLock()
+	defer pubsub.mutex.RUnlock()
+
+	n := 0
+	for clt := range pubsub.channels[channel] {
+		if clt.push([]byte("MESSAGE " + channel + " " + msg + "\n")) {
+			n++
+		}
+	}
+	for pattern, clts := range pubsub.patterns {
+		if ok, _ := path.Match(pattern, channel); !ok {
+			continue
+		}
+		for clt := range clts {
+			if clt.push([]byte("PMESSAGE " + pattern + " " + channel + " " + msg + "\n")) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// 将缓存的键空间事件发布到__keyspace@0__与__keyevent@0__频道
+func EnableKeyspaceEvents(c *cache.Cache) {
+	c.AddNotifyHook(func(event cache.Event, key string) {
+		flags := c.NotifyFlags()
+		if flags&cache.NotifyKeyspace != 0 {
+			Publish("__keyspace@0__:"+key, event.String())
+		}
+		if flags&cache.NotifyKeyevent != 0 {
+			Publish("__keyevent@0__:"+event.String(), key)
+		}
+	})
+}
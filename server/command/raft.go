@@ -0,0 +1,94 @@
+package command
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"tinycached/server/cache"
+	"tinycached/utils"
+)
+
+/*
+ * Raft模式：客户端的写命令不直接修改缓存，而是交给一致性模块提交，
+ * 多数节点写入日志后由各节点的状态机按相同顺序执行（ExecApplied），执行完成后才回复客户端；
+ * 读命令先确认自己仍是领导者并等待状态机执行到当前的提交位置，保证读到全部已回复的写入。
+ * 事务命令无法拆成日志中的单条命令，Raft模式下不支持
+ */
+type Consensus interface {
+	// 提交一条写命令，执行后返回执行结果；自己不是领导者时返回错误
+	Propose(cmd utils.CmdType, body string) error
+	// 读之前调用：返回nil后本地数据包含调用之前已提交的全部写入
+	ReadBarrier() error
+}
+
+var consensus Consensus
+
+var ErrRaftMulti = errors.New("transactions are not supported in raft mode")
+
+// 开启Raft模式，须在接受连接之前调用
+func UseConsensus(c Consensus) {
+	consensus = c
+}
+
+// 状态机执行已提交命令的客户端
+func NewApplyClient(c *cache.Cache) (clt *CacheClientInfo) {
+	return NewMasterClient(c)
+}
+
+// 执行一条已提交的命令；与ExecUpstream一样持有syncMutex，写入同时进入复制流
+func (clt *CacheClientInfo) ExecApplied(cmd utils.CmdType, body string) ([]byte, error) {
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+
+	return clt.ExecCmd(cmd, body)
+}
+
+// 将提交日志中的一条命令解析为命令类型与参数
+func ParseApplied(data []byte) (utils.CmdType, string) {
+	name, body, _ := strings.Cut(string(data), " ")
+	return utils.ParseCmdType(name), body
+}
+
+// 编码为提交日志中的一条命令，与AOF中的一行相同（不含\n）
+func EncodeApplied(cmd utils.CmdType, body string) string {
+	return cmd.String() + " " + body
+}
+
+// Raft模式下客户端命令的处理：写命令提交，读命令先确认读屏障；handled为false时按普通流程执行
+func (clt *CacheClientInfo) execConsensus(cmd utils.CmdType, body string) (ret []byte, handled bool, err error) {
+	if consensus == nil || clt.replaying || clt.master {
+		return nil, false, nil
+	}
+	elem := strings.Split(body, ":")
+	switch cmd {
+	case utils.GET:
+		if err := consensus.ReadBarrier(); err != nil {
+			return nil, true, err
+		}
+		return nil, false, nil
+
+	case utils.SET, utils.EXPR:
+		if len(elem) < 2 {
+			return nil, true, errors.New("wrong command")
+		}
+		if cmd == utils.EXPR {
+			if _, err := strconv.ParseInt(elem[1], 10, 64); err != nil {
+				return nil, true, err
+			}
+		}
+		if err := consensus.Propose(cmd, body); err != nil {
+			return nil, true, err
+		}
+		return []byte("DONE"), true, nil
+
+	case utils.DEL:
+		if err := consensus.Propose(cmd, body); err != nil {
+			return nil, true, err
+		}
+		return []byte("DONE"), true, nil
+
+	case utils.MULTI, utils.EXEC, utils.DISCARD, utils.WATCH, utils.UNWATCH:
+		return nil, true, ErrRaftMulti
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,562 @@
+package command
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tinycached/server/cache"
+	"tinycached/server/persistence"
+	"tinycached/utils"
+)
+
+/*
+ * 主从复制（主服务器一侧）：
+ * 副本发来SYNC或PSYNC后，主服务器回复全量快照或缺失的复制流，之后把写入AOF的每条命令原样推送给副本（复制流）。
+ * 写命令持有syncMutex修改缓存并记录AOF，SYNC持有该锁取得快照并登记副本，
+ * 因此快照恰好包含复制流起点之前的全部修改。
+ * 复制流由复制ID与偏移量标识：副本全量同步后沿用主服务器的复制ID与偏移量，
+ * 并把收到的复制流原样写入自己的积压缓冲区、转发给自己的副本，因此同一条复制链上的偏移量一致
+ */
+var syncMutex sync.Mutex
+
+// 复制积压缓冲区的默认大小
+const defaultBacklogSize = 1 << 20
+
+// 主服务器上一个副本连接的状态，由replicaSet的锁保护
+type replicaState struct {
+	ip        string
+	port      string    // 副本的监听端口，未通过REPLCONF告知时为连接的端口
+	start     int64     // 开始同步时复制流的偏移量
+	offset    int64     // 已交给网络层的复制流的偏移量
+	streaming bool      // SYNC或PSYNC的回复已写出，可以开始推送复制流
+	buf       []byte    // 尚未交给网络层的复制流
+	caughtUp  time.Time // 最近一次没有积压复制流的时间
+	ack       int64     // 副本通过REPLCONF ACK确认已执行的偏移量
+	ackTime   time.Time // 最近一次收到ACK的时间，为零表示副本从未发送ACK
+}
+
+type replicaSet struct {
+	mutex    sync.Mutex
+	id       string // 当前复制流的复制ID
+	id2      string // 成为主服务器之前所复制的复制流的ID，为空表示没有
+	offset2  int64  // id2的复制流在该偏移量结束，之后的部分属于id
+	upstream bool   // 自己是副本：复制流是主服务器发来的原始数据，不再由AOF产生
+	backlog  replBacklog
+	clts     map[*CacheClientInfo]*replicaState
+	acks     chan struct{} // 收到ACK时关闭并换新，唤醒等待中的WAIT
+}
+
+var replicas = &replicaSet{
+	id:      newReplID(),
+	offset2: -1,
+	backlog: replBacklog{size: defaultBacklogSize},
+	clts:    make(map[*CacheClientInfo]*replicaState),
+	acks:    make(chan struct{}),
+}
+
+// 全量同步与部分重同步的次数
+var syncFull, syncPartialOK, syncPartialErr uint64
+
+// 随机生成40个十六进制字符的复制ID
+func newReplID() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// 副本的状态，用于INFO replication
+type ReplicaInfo struct {
+	IP     string
+	Port   string
+	State  string        // sync：全量同步的快照尚未写出；online：正在接收复制流
+	Offset int64         // 副本确认的偏移量；副本不发送ACK时为已发送给副本的偏移量
+	Lag    time.Duration // 距离最近一次收到ACK的时间；副本不发送ACK时为距离最近一次追上复制流的时间
+}
+
+// 自己的复制流的状态，用于INFO replication与PSYNC
+type ReplInfo struct {
+	ID               string
+	ID2              string
+	Offset           int64 // 复制流的偏移量
+	Offset2          int64 // ID2的复制流结束的偏移量，没有ID2时为-1
+	BacklogActive    bool
+	BacklogSize      int
+	BacklogFirstByte int64 // 积压缓冲区中最早一个字节的偏移量
+	BacklogHistlen   int64 // 积压缓冲区中的字节数
+}
+
+type SyncStats struct {
+	Full       uint64 // 全量同步的次数
+	PartialOK  uint64 // 接受的部分重同步请求数
+	PartialErr uint64 // 被拒绝、转为全量同步的部分重同步请求数
+}
+
+// 开启复制：之后写入AOF的命令都进入复制流
+func EnableReplication() {
+	persistence.AofInstance().SetFeed(replicas.feed)
+}
+
+// 在持有AOF锁时调用；事务中的命令在EXEC执行时逐条记录，不转发事务控制命令，
+// 旧版本写入AOF的事务控制命令来自不同客户端、交错在一起，副本无法重放
+func (rs *replicaSet) feed(cmd, body []byte) {
+	switch utils.ParseCmdType(string(cmd)) {
+	case utils.MULTI, utils.EXEC, utils.DISCARD, utils.WATCH, utils.UNWATCH:
+		return
+	}
+	line := make([]byte, 0, len(cmd)+len(body)+2)
+	line = append(line, cmd...)
+	line = append(line, ' ')
+	line = append(line, body...)
+	line = append(line, '\n')
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	// 副本自己的写入（如过期删除）不进入复制流，以免与主服务器的偏移量不一致
+	if rs.upstream {
+		return
+	}
+	rs.propagate(line)
+}
+
+// 在持有锁时调用：写入积压缓冲区并推送给全部副本
+func (rs *replicaSet) propagate(data []byte) {
+	rs.backlog.write(data)
+	now := time.Now()
+	for clt, r := range rs.clts {
+		if len(r.buf) == 0 && clt.outputPending() == 0 {
+			r.caughtUp = now
+		}
+		r.buf = append(r.buf, data...)
+		r.flush(clt)
+	}
+}
+
+// 将积压的复制流交给网络层；推送通道已满时留在buf中，待之前的消息写出后再试
+func (r *replicaState) flush(clt *CacheClientInfo) {
+	if r.streaming && len(r.buf) > 0 && clt.push(r.buf) {
+		r.offset += int64(len(r.buf))
+		r.buf = nil
+	}
+	atomic.StoreInt64(&clt.replPending, int64(len(r.buf)))
+	if len(r.buf) > 0 {
+		clt.CheckOutputLimit()
+	}
+}
+
+// 全量同步时登记副本，返回复制ID与复制流的当前偏移量，即副本收到的复制流的起点
+func (rs *replicaSet) add(clt *CacheClientInfo) (string, int64) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	// 有副本之后才需要积压缓冲区
+	rs.backlog.activate()
+	rs.register(clt, rs.backlog.end, nil)
+	atomic.AddUint64(&syncFull, 1)
+	return rs.id, rs.backlog.end
+}
+
+/*
+ * 部分重同步：副本此前收到的复制流属于id且偏移量仍在积压缓冲区中时，
+ * 登记副本并把offset之后的复制流作为待推送的数据，返回当前的复制ID；否则返回false
+ */
+func (rs *replicaSet) tryContinue(clt *CacheClientInfo, id string, offset int64) (string, bool) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if id != rs.id && (id != rs.id2 || offset > rs.offset2) {
+		return "", false
+	}
+	missing, ok := rs.backlog.readFrom(offset)
+	if !ok {
+		return "", false
+	}
+	rs.register(clt, offset, missing)
+	return rs.id, true
+}
+
+// 在持有锁时调用
+func (rs *replicaSet) register(clt *CacheClientInfo, offset int64, missing []byte) {
+	ip, port, _ := net.SplitHostPort(clt.addr)
+	if clt.listenPort != "" {
+		port = clt.listenPort
+	}
+	rs.clts[clt] = &replicaState{
+		ip:       ip,
+		port:     port,
+		start:    offset,
+		offset:   offset,
+		buf:      missing,
+		caughtUp: time.Now(),
+	}
+	atomic.StoreInt64(&clt.replPending, int64(len(missing)))
+	atomic.StoreInt32(&clt.replica, 1)
+}
+
+func (rs *replicaSet) remove(clt *CacheClientInfo) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	delete(rs.clts, clt)
+}
+
+// 开始或继续推送积压的复制流
+func (rs *replicaSet) resume(clt *CacheClientInfo, start bool) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if r, ok := rs.clts[clt]; ok {
+		r.streaming = r.streaming || start
+		r.flush(clt)
+	}
+}
+
+// 全部副本的状态，按地址排序
+func Replicas() []ReplicaInfo {
+	replicas.mutex.Lock()
+	defer replicas.mutex.Unlock()
+
+	now := time.Now()
+	ret := make([]ReplicaInfo, 0, len(replicas.clts))
+	for clt, r := range replicas.clts {
+		info := ReplicaInfo{IP: r.ip, Port: r.port, State: "sync", Offset: r.start}
+		if r.streaming {
+			obl := clt.outputPending()
+			info.State = "online"
+			if info.Offset = r.offset - int64(obl); info.Offset < r.start {
+				info.Offset = r.start
+			}
+			if obl == 0 && len(r.buf) == 0 {
+				r.caughtUp = now
+			}
+		}
+		info.Lag = now.Sub(r.caughtUp)
+		if !r.ackTime.IsZero() {
+			info.Offset, info.Lag = r.ack, now.Sub(r.ackTime)
+		}
+		ret = append(ret, info)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].IP+":"+ret[i].Port < ret[j].IP+":"+ret[j].Port
+	})
+	return ret
+}
+
+func (rs *replicaSet) currentOffset() int64 {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	return rs.backlog.end
+}
+
+func Replication() ReplInfo {
+	replicas.mutex.Lock()
+	defer replicas.mutex.Unlock()
+
+	b := &replicas.backlog
+	return ReplInfo{
+		ID:               replicas.id,
+		ID2:              replicas.id2,
+		Offset:           b.end,
+		Offset2:          replicas.offset2,
+		BacklogActive:    b.active(),
+		BacklogSize:      b.size,
+		BacklogFirstByte: b.start,
+		BacklogHistlen:   b.histlen(),
+	}
+}
+
+func ReplSyncStats() SyncStats {
+	return SyncStats{
+		Full:       atomic.LoadUint64(&syncFull),
+		PartialOK:  atomic.LoadUint64(&syncPartialOK),
+		PartialErr: atomic.LoadUint64(&syncPartialErr),
+	}
+}
+
+// 设置积压缓冲区的大小，已有的内容丢弃
+func SetReplBacklogSize(size int) {
+	replicas.mutex.Lock()
+	defer replicas.mutex.Unlock()
+
+	replicas.backlog.resize(size)
+}
+
+// 成为副本：之后只转发主服务器发来的复制流
+func BecomeReplica() {
+	replicas.mutex.Lock()
+	defer replicas.mutex.Unlock()
+
+	replicas.upstream = true
+}
+
+/*
+ * 成为主服务器：生成新的复制ID，原ID作为ID2保留到当前偏移量为止，
+ * 之前与自己复制同一主服务器的副本可以用原ID部分重同步。
+ * 返回true时应断开自己的副本，使其部分重同步后得知新ID
+ */
+func BecomeMaster() bool {
+	replicas.mutex.Lock()
+	defer replicas.mutex.Unlock()
+
+	if !replicas.upstream {
+		return false
+	}
+	replicas.upstream = false
+	replicas.id2, replicas.offset2 = replicas.id, replicas.backlog.end
+	replicas.id = newReplID()
+	return true
+}
+
+// 副本全量同步之后调用：沿用主服务器的复制ID与偏移量，清空积压缓冲区
+func ResetReplication(id string, offset int64) {
+	replicas.mutex.Lock()
+	defer replicas.mutex.Unlock()
+
+	replicas.id, replicas.id2, replicas.offset2 = id, "", -1
+	replicas.backlog.reset(offset)
+	replicas.backlog.activate()
+}
+
+/*
+ * 副本部分重同步之后调用：主服务器的复制ID变化时（如主服务器由副本提升而来）沿用新ID，
+ * 原ID作为ID2保留，返回true；此时应断开自己的副本，使其用原ID部分重同步后得知新ID
+ */
+func ContinueReplication(id string) bool {
+	replicas.mutex.Lock()
+	defer replicas.mutex.Unlock()
+
+	if id == replicas.id {
+		return false
+	}
+	replicas.id2, replicas.offset2 = replicas.id, replicas.backlog.end
+	replicas.id = id
+	return true
+}
+
+// 执行主服务器发来的一条命令，并把原始数据写入自己的复制流；与SYNC互斥，保证快照与偏移量一致
+func (clt *CacheClientInfo) ExecUpstream(cmd utils.CmdType, args []string, raw []byte) {
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+
+	for _, body := range utils.Bodies(cmd, args) {
+		clt.ExecCmd(cmd, body)
+	}
+	replicas.mutex.Lock()
+	replicas.propagate(raw)
+	replicas.mutex.Unlock()
+}
+
+// 断开全部副本，副本重新连接后全量同步；在自己的数据被全量同步替换后调用
+func DisconnectReplicas() {
+	replicas.mutex.Lock()
+	var clts []*CacheClientInfo
+	for clt := range replicas.clts {
+		clts = append(clts, clt)
+	}
+	replicas.mutex.Unlock()
+
+	for _, clt := range clts {
+		if clt.hooks.kill != nil {
+			clt.hooks.kill()
+		}
+	}
+}
+
+// 是否是执行过SYNC或PSYNC的副本连接，可在任意协程中调用
+func (clt *CacheClientInfo) IsReplica() bool {
+	return atomic.LoadInt32(&clt.replica) == 1
+}
+
+// 网络层写出本次的回复后调用：全量同步的快照在SYNC与PSYNC的回复中，写出之后才开始推送复制流
+func (clt *CacheClientInfo) AfterReply() {
+	if clt.IsReplica() {
+		replicas.resume(clt, true)
+	}
+}
+
+// 尚未写出的字节数，不含积压在复制流中的部分
+func (clt *CacheClientInfo) outputPending() int {
+	if clt.hooks.buffers == nil {
+		return 0
+	}
+	_, obl := clt.hooks.buffers()
+	return obl
+}
+
+// 副本执行主服务器发来的命令的客户端：不检查权限、不受只读限制，命令照常写入AOF，复制流由ExecUpstream转发
+func NewMasterClient(c *cache.Cache) (clt *CacheClientInfo) {
+	clt = NewCacheClient(c)
+	clt.master = true
+	return clt
+}
+
+// 修改缓存并记录AOF：先修改缓存再记录，执行失败的命令不记录
+func (clt *CacheClientInfo) applyWrite(cmd utils.CmdType, body string, apply func() error) error {
+	// 主服务器发来的命令由ExecUpstream持有该锁
+	if !clt.master {
+		syncMutex.Lock()
+		defer syncMutex.Unlock()
+	}
+
+	if err := apply(); err != nil {
+		return err
+	}
+	clt.appendAof(cmd, body)
+	return nil
+}
+
+var readOnly int32
+
+var ErrReadOnly = errors.New("READONLY You can't write against a read only replica.")
+
+// 命令不需要回复，如副本发来的REPLCONF ACK，网络层不写出任何内容
+var ErrNoReply = errors.New("no reply")
+
+// 设置是否拒绝客户端的写命令，作为只读副本时开启；主服务器发来的命令不受影响
+func SetReadOnly(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&readOnly, v)
+}
+
+func (clt *CacheClientInfo) checkReadOnly(cmd utils.CmdType) error {
+	if clt.replaying || clt.master || atomic.LoadInt32(&readOnly) == 0 {
+		return nil
+	}
+	switch cmd {
+	case utils.SET, utils.DEL, utils.EXPR:
+		return ErrReadOnly
+	}
+	return nil
+}
+
+/*
+ * SYNC：全量同步，回复"FULLSYNC 偏移量 字节数"，之后紧跟该字节数的快照；
+ * 之后该连接持续收到复制流，即主服务器写入AOF的命令，偏移量为快照之后复制流的起点
+ */
+func (clt *CacheClientInfo) execSyncCmd(body string) ([]byte, error) {
+	if body != "" {
+		return nil, errors.New("wrong command")
+	}
+	_, offset, snapshot, err := clt.fullSync()
+	if err != nil {
+		return nil, err
+	}
+	header := "FULLSYNC " + strconv.FormatInt(offset, 10) + " " + strconv.Itoa(len(snapshot)) + "\n"
+	return append([]byte(header), snapshot...), nil
+}
+
+/*
+ * PSYNC 复制ID 偏移量：副本请求从偏移量处继续接收复制流，首次同步时复制ID为?、偏移量为-1。
+ * 复制ID相同（或为自己成为主服务器前的ID）且偏移量仍在积压缓冲区中时回复"CONTINUE 复制ID"，
+ * 之后推送缺失的复制流；否则回复"FULLSYNC 复制ID 偏移量 字节数"与快照，同SYNC
+ */
+func (clt *CacheClientInfo) execPsyncCmd(body string) ([]byte, error) {
+	elem := strings.Fields(body)
+	if len(elem) != 2 {
+		return nil, errors.New("wrong command")
+	}
+	offset, err := strconv.ParseInt(elem[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid offset")
+	}
+	if elem[0] != "?" {
+		if id, ok := replicas.tryContinue(clt, elem[0], offset); ok {
+			atomic.AddUint64(&syncPartialOK, 1)
+			return []byte("CONTINUE " + id), nil
+		}
+		atomic.AddUint64(&syncPartialErr, 1)
+	}
+	id, offset, snapshot, err := clt.fullSync()
+	if err != nil {
+		return nil, err
+	}
+	header := "FULLSYNC " + id + " " + strconv.FormatInt(offset, 10) + " " + strconv.Itoa(len(snapshot)) + "\n"
+	return append([]byte(header), snapshot...), nil
+}
+
+// 登记副本并生成快照，返回复制ID与快照对应的偏移量
+func (clt *CacheClientInfo) fullSync() (string, int64, []byte, error) {
+	syncMutex.Lock()
+	id, offset := replicas.add(clt)
+	entries := clt.cache.Entries()
+	syncMutex.Unlock()
+
+	var snapshot bytes.Buffer
+	if err := persistence.WriteSnapshot(&snapshot, entries); err != nil {
+		replicas.remove(clt)
+		return "", 0, nil, err
+	}
+	return id, offset, snapshot.Bytes(), nil
+}
+
+/*
+ * REPLCONF listening-port 端口	副本告知自己的监听端口，在SYNC或PSYNC之前发送
+ * REPLCONF ACK 偏移量		副本确认已执行到的偏移量，每秒发送一次，不回复
+ * REPLCONF GETACK *		主服务器在复制流中要求副本立即发送ACK，不回复
+ */
+func (clt *CacheClientInfo) execReplconfCmd(body string) ([]byte, error) {
+	elem := strings.Fields(body)
+	if len(elem) != 2 {
+		return nil, errors.New("wrong command")
+	}
+	switch strings.ToLower(elem[0]) {
+	case "ack":
+		offset, err := strconv.ParseInt(elem[1], 10, 64)
+		if err != nil {
+			return nil, ErrNoReply
+		}
+		replicas.ack(clt, offset)
+		return nil, ErrNoReply
+
+	case "getack":
+		// 由副本的复制连接发送ACK
+		return nil, ErrNoReply
+
+	case "listening-port":
+		if n, err := strconv.ParseUint(elem[1], 10, 16); err != nil || n == 0 {
+			return nil, errors.New("invalid port")
+		}
+		clt.listenPort = elem[1]
+		return []byte("DONE"), nil
+
+	default:
+		return nil, errors.New("wrong command")
+	}
+}
+
+/*
+ * REPLICAOF host port	成为指定主服务器的副本，丢弃已有数据并从主服务器全量同步
+ * REPLICAOF NO ONE		停止复制，成为主服务器，保留已有数据
+ * 与CONFIG SET replicaof等价
+ */
+func execReplicaOfCmd(body string) ([]byte, error) {
+	if serverConfig == nil {
+		return nil, errors.New("REPLICAOF is not available")
+	}
+	elem := strings.Fields(body)
+	if len(elem) != 2 {
+		return nil, errors.New("wrong command")
+	}
+	value := elem[0] + " " + elem[1]
+	if strings.EqualFold(elem[0], "NO") && strings.EqualFold(elem[1], "ONE") {
+		value = ""
+	}
+	if err := serverConfig.Params().SetLive("replicaof", value); err != nil {
+		return nil, err
+	}
+	return []byte("DONE"), nil
+}
@@ -0,0 +1,196 @@
+package command
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tinycached/utils"
+)
+
+// 慢日志中每条命令参数保留的最大字节数
+const slowlogMaxArgLen = 128
+
+// 一条慢日志
+type slowlogEntry struct {
+	id       uint64
+	time     time.Time
+	duration time.Duration
+	addr     string // 客户端地址
+	cmd      utils.CmdType
+	args     string // 截断后的参数
+}
+
+// 慢日志：执行时间超过阈值的命令，保存在定长的环形缓冲区中，写满后覆盖最旧的一条
+type slowlog struct {
+	threshold int64 // 记录的阈值（纳秒），0表示不记录；每条命令都要读取，用原子操作访问
+	mutex     sync.Mutex
+	entries   []slowlogEntry
+	next      int    // 下一条写入的位置
+	size      int    // 当前条数
+	nextID    uint64 // 下一条的编号，RESET后不归零
+}
+
+var slowlogs = &slowlog{}
+
+// 设置慢日志的阈值与最大条数，调小最大条数时丢弃较旧的记录
+func SetSlowlog(threshold time.Duration, maxLen int) {
+	atomic.StoreInt64(&slowlogs.threshold, int64(threshold))
+	slowlogs.resize(maxLen)
+}
+
+func (sl *slowlog) resize(maxLen int) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	if maxLen == len(sl.entries) {
+		return
+	}
+	kept := sl.newest(maxLen)
+	sl.entries = make([]slowlogEntry, maxLen)
+	// newest返回的顺序为从新到旧
+	for i := range kept {
+		sl.entries[i] = kept[len(kept)-1-i]
+	}
+	sl.size = len(kept)
+	sl.next = 0
+	if maxLen > 0 {
+		sl.next = sl.size % maxLen
+	}
+}
+
+// 执行时间超过阈值时记录一条慢日志
+func (sl *slowlog) record(clt *CacheClientInfo, cmd utils.CmdType, body string, start time.Time) {
+	threshold := atomic.LoadInt64(&sl.threshold)
+	if threshold <= 0 {
+		return
+	}
+	d := time.Since(start)
+	if int64(d) < threshold {
+		return
+	}
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	if len(sl.entries) == 0 {
+		return
+	}
+	sl.entries[sl.next] = slowlogEntry{
+		id:       sl.nextID,
+		time:     start,
+		duration: d,
+		addr:     clt.addr,
+		cmd:      cmd,
+		args:     truncateArgs(body),
+	}
+	sl.nextID++
+	sl.next = (sl.next + 1) % len(sl.entries)
+	if sl.size < len(sl.entries) {
+		sl.size++
+	}
+}
+
+// 最新的n条，从新到旧排列；调用方须持有锁
+func (sl *slowlog) newest(n int) []slowlogEntry {
+	if n > sl.size {
+		n = sl.size
+	}
+	ret := make([]slowlogEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		idx := (sl.next - i + len(sl.entries)) % len(sl.entries)
+		ret = append(ret, sl.entries[idx])
+	}
+	return ret
+}
+
+func (sl *slowlog) get(n int) []slowlogEntry {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	return sl.newest(n)
+}
+
+func (sl *slowlog) len() int {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	return sl.size
+}
+
+func (sl *slowlog) reset() {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	sl.size = 0
+	sl.next = 0
+}
+
+func truncateArgs(body string) string {
+	if len(body) <= slowlogMaxArgLen {
+		return body
+	}
+	return body[:slowlogMaxArgLen] + "... (" + strconv.Itoa(len(body)-slowlogMaxArgLen) + " more bytes)"
+}
+
+// 默认返回的条数
+const slowlogDefaultGet = 10
+
+/*
+ * SLOWLOG GET [n]	返回最新的n条慢日志，默认10条，n为-1时返回全部；
+ *			每行为"编号 开始时间(Unix秒) 耗时(微秒) 客户端地址 命令 参数"
+ * SLOWLOG LEN		返回慢日志的条数
+ * SLOWLOG RESET	清空慢日志
+ */
+func execSlowlogCmd(body string) ([]byte, error) {
+	elem := strings.Fields(body)
+	if len(elem) == 0 {
+		return nil, errors.New("wrong command")
+	}
+	switch strings.ToUpper(elem[0]) {
+	case "GET":
+		if len(elem) > 2 {
+			return nil, errors.New("wrong command")
+		}
+		n := slowlogDefaultGet
+		if len(elem) == 2 {
+			var err error
+			if n, err = strconv.Atoi(elem[1]); err != nil || n < -1 {
+				return nil, errors.New("count should be a non-negative integer or -1")
+			}
+			if n == -1 {
+				n = int(^uint(0) >> 1)
+			}
+		}
+		entries := slowlogs.get(n)
+		lines := make([]string, 0, len(entries))
+		for _, e := range entries {
+			addr := e.addr
+			if addr == "" {
+				addr = "-"
+			}
+			lines = append(lines, strconv.FormatUint(e.id, 10)+" "+
+				strconv.FormatInt(e.time.Unix(), 10)+" "+
+				strconv.FormatInt(e.duration.Microseconds(), 10)+" "+
+				addr+" "+e.cmd.String()+" "+e.args)
+		}
+		return utils.MultiLine(lines), nil
+
+	case "LEN":
+		if len(elem) != 1 {
+			return nil, errors.New("wrong command")
+		}
+		return []byte(strconv.Itoa(slowlogs.len())), nil
+
+	case "RESET":
+		if len(elem) != 1 {
+			return nil, errors.New("wrong command")
+		}
+		slowlogs.reset()
+		return []byte("DONE"), nil
+
+	default:
+		return nil, errors.New("wrong command")
+	}
+}
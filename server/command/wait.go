@@ -0,0 +1,115 @@
+package command
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 要求副本立即发送ACK的命令，写入复制流
+var getAckLine = []byte("REPLCONF GETACK *\n")
+
+// 记录副本确认的偏移量，并唤醒等待中的WAIT
+func (rs *replicaSet) ack(clt *CacheClientInfo, offset int64) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	r, ok := rs.clts[clt]
+	if !ok {
+		return
+	}
+	r.ack, r.ackTime = offset, time.Now()
+	close(rs.acks)
+	rs.acks = make(chan struct{})
+}
+
+// 在持有锁时调用：确认到offset的副本数
+func (rs *replicaSet) numAcked(offset int64) int {
+	n := 0
+	for _, r := range rs.clts {
+		if !r.ackTime.IsZero() && r.ack >= offset {
+			n++
+		}
+	}
+	return n
+}
+
+/*
+ * 等待至少n个副本确认到offset，超时或abort关闭时返回已确认的副本数；timeout为0表示一直等待。
+ * 确认的副本不足时先在复制流中写入GETACK，使副本立即发送ACK，不必等到下一次定时发送
+ */
+func (rs *replicaSet) wait(offset int64, n int, timeout time.Duration, abort <-chan struct{}) int {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	getAck := true
+	for {
+		rs.mutex.Lock()
+		acked := rs.numAcked(offset)
+		if acked < n && getAck {
+			rs.propagate(getAckLine)
+			getAck = false
+		}
+		acks := rs.acks
+		rs.mutex.Unlock()
+
+		if acked >= n {
+			return acked
+		}
+		select {
+		case <-acks:
+		case <-deadline:
+			return rs.countAcked(offset)
+		case <-abort:
+			return rs.countAcked(offset)
+		}
+	}
+}
+
+func (rs *replicaSet) countAcked(offset int64) int {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	return rs.numAcked(offset)
+}
+
+// 结束阻塞中的WAIT，连接断开时调用
+func (clt *CacheClientInfo) wake() {
+	clt.unblockOnce.Do(func() { close(clt.unblock) })
+}
+
+/*
+ * WAIT 副本数 超时毫秒：阻塞当前连接，直到至少指定数量的副本确认收到该连接最近一次写入，或超时；
+ * 超时为0表示一直等待。返回确认的副本数，超时时可能小于指定的数量。
+ * 连接没有写入过时等待此刻复制流中的全部写入，代理在新建的连接上转发WAIT时同样包括客户端之前的写入
+ */
+func (clt *CacheClientInfo) execWaitCmd(body string) ([]byte, error) {
+	elem := strings.Fields(body)
+	if len(elem) != 2 {
+		return nil, errors.New("wrong command")
+	}
+	n, err := strconv.Atoi(elem[0])
+	if err != nil || n < 0 {
+		return nil, errors.New("invalid number of replicas")
+	}
+	ms, err := strconv.ParseInt(elem[1], 10, 64)
+	if err != nil || ms < 0 {
+		return nil, errors.New("invalid timeout")
+	}
+	replicas.mutex.Lock()
+	upstream := replicas.upstream
+	replicas.mutex.Unlock()
+	if upstream {
+		return nil, errors.New("WAIT cannot be used with replica instances")
+	}
+	offset := clt.woff
+	if offset == 0 {
+		offset = replicas.currentOffset()
+	}
+	acked := replicas.wait(offset, n, time.Duration(ms)*time.Millisecond, clt.unblock)
+	return []byte(strconv.Itoa(acked)), nil
+}
@@ -8,6 +8,7 @@ import (
 var watchMap sync.Map
 
 func AddWatchKey(key string, clt *CacheClientInfo) {
+	clt.watched[key] = struct{}{}
 	if val, ok := watchMap.Load(&key); !ok {
 		cltList := list.New()
 		cltList.PushBack(clt)
@@ -28,6 +29,7 @@ func NotifyModifyed(key string) {
 }
 
 func DelWatchKey(key string, clt *CacheClientInfo) {
+	delete(clt.watched, key)
 	if val, ok := watchMap.Load(&key); ok {
 		list := val.(*list.List)
 		for i := list.Front(); i != nil; i = i.Next() {
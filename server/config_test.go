@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// CONFIG SET的值不合法或无法生效时返回错误，配置保持原值
+func TestConfigSet(t *testing.T) {
+	s := startServer(t, "-maxmemory", "64mb")
+	c := dial(t, s.addr)
+	c.expect("SET config_a:1", "DONE")
+
+	// 值本身合法但回调失败，恢复原值
+	c.expect("CONFIG SET maxmemory 0", "maxmemory: must be greater than 0")
+	c.expect("CONFIG GET maxmemory", "*1\nmaxmemory 64mb")
+	c.expect("CONFIG SET maxmemory lots", `maxmemory: invalid size "lots"`)
+	c.expect("CONFIG SET maxmemory-policy random", "maxmemory-policy: invalid value \"random\", must be one of allkeys-lru, volatile-lru, noeviction")
+	c.expect("CONFIG GET maxmemory-policy", "*1\nmaxmemory-policy allkeys-lru")
+	c.expect("CONFIG SET notify-keyspace-events Q", "notify-keyspace-events: invalid notify flag 'Q'")
+	c.expect("CONFIG GET notify-keyspace-events", "*1\nnotify-keyspace-events ")
+	c.expect("CONFIG SET listen :1", "listen: cannot be changed at runtime")
+	c.expect("CONFIG SET no-such-option 1", `unknown option "no-such-option"`)
+	c.expect("GET config_a", "1")
+
+	c.expect("CONFIG SET maxmemory 32mb", "DONE")
+	c.expect("CONFIG GET maxmemory", "*1\nmaxmemory 32mb")
+	c.expect("CONFIG SET SLOWLOG-MAX-LEN 5", "DONE")
+	c.expect("CONFIG GET slowlog-*", "*2\nslowlog-log-slower-than 10ms\nslowlog-max-len 5")
+	c.expect("CONFIG REWRITE", "no config file specified")
+}
+
+// CONFIG REWRITE保留注释与配置项的位置，经临时文件原子替换；重启后仍是修改后的值
+func TestConfigRewrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tinycached.conf")
+	orig := "# test config\nmaxmemory 64mb\n\n# slowlog\nslowlog-log-slower-than 10ms\n"
+	if err := os.WriteFile(path, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := startServerIn(t, dir, freeAddr(t), "-config", path)
+	c := dial(t, s.addr)
+	c.expect("CONFIG SET maxmemory 32mb", "DONE")
+	c.expect("CONFIG SET slowlog-max-len 5", "DONE")
+	c.expect("CONFIG SET requirepass", "wrong command")
+	c.expect("CONFIG REWRITE", "DONE")
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "# test config\nmaxmemory 32mb\n\n# slowlog\nslowlog-log-slower-than 10ms\n\n# Generated by CONFIG REWRITE\n"
+	if !strings.HasPrefix(string(got), prefix) || !strings.Contains(string(got), "\nslowlog-max-len 5\n") {
+		t.Errorf("rewritten file:\n%s", got)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	s.stop()
+	s = startServerIn(t, dir, s.addr, "-config", path)
+	c = dial(t, s.addr)
+	c.expect("CONFIG GET maxmemory", "*1\nmaxmemory 32mb")
+	c.expect("CONFIG GET slowlog-max-len", "*1\nslowlog-max-len 5")
+}
+
+// 发送SIGHUP，等待之后的日志中出现want，返回之后的日志
+func (s *testServer) reload(t *testing.T, want string) string {
+	t.Helper()
+	start := len(s.log.String())
+	s.cmd.Process.Signal(syscall.SIGHUP)
+	var logged string
+	waitFor(t, "reload: "+want, func() bool {
+		logged = s.log.String()[start:]
+		return strings.Contains(logged, want)
+	})
+	return logged
+}
+
+// 收到SIGHUP后重新读取配置文件：可在运行时修改的配置项立即生效，其余的只记录日志；
+// 命令行参数仍然覆盖配置文件，配置文件有错误时整体不生效
+func TestReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tinycached.conf")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("maxmemory 64mb\ndbfilename dump.tcs\n")
+	s := startServerIn(t, dir, freeAddr(t), "-config", path, "-maxclients", "100")
+	c := dial(t, s.addr)
+
+	write("maxmemory 32mb\nslowlog-max-len 5\ndbfilename other.tcs\nmaxclients 7\nappendonly yes\n")
+	// 变化按配置项的注册顺序记录，dbfilename在最后
+	logged := s.reload(t, "(restart required)")
+	if !strings.Contains(logged, "reload: 3 option(s) changed") {
+		t.Errorf("reload log:\n%s", logged)
+	}
+	for _, line := range []string{
+		`reload: maxmemory: "64mb" -> "32mb"` + "\n",
+		`reload: slowlog-max-len: "128" -> "5"` + "\n",
+		`reload: dbfilename: "dump.tcs" -> "other.tcs" (restart required)`,
+	} {
+		if !strings.Contains(logged, line) {
+			t.Errorf("reload log does not contain %q:\n%s", line, logged)
+		}
+	}
+	c.expect("CONFIG GET maxmemory", "*1\nmaxmemory 32mb")
+	c.expect("CONFIG GET slowlog-max-len", "*1\nslowlog-max-len 5")
+	c.expect("CONFIG GET dbfilename", "*1\ndbfilename dump.tcs")
+	// 命令行参数优先
+	c.expect("CONFIG GET maxclients", "*1\nmaxclients 100")
+	c.expect("CONFIG GET appendonly", "*1\nappendonly no")
+
+	// 配置文件有错误时不修改任何配置项
+	write("maxmemory 16mb\nslowlog-max-len many\n")
+	s.reload(t, `reload: `+path+`:2: slowlog-max-len: invalid integer "many"`)
+	c.expect("CONFIG GET maxmemory", "*1\nmaxmemory 32mb")
+	c.expect("CONFIG GET slowlog-max-len", "*1\nslowlog-max-len 5")
+
+	// 回调失败的配置项不生效，其余照常生效
+	write("maxmemory 32mb\nslowlog-max-len 6\nnotify-keyspace-events Q\ndbfilename other.tcs\n")
+	// dbfilename仍未生效，又记录一次
+	logged = s.reload(t, "(restart required)")
+	if !strings.Contains(logged, `notify-keyspace-events: "" -> "Q" (failed: notify-keyspace-events: invalid notify flag 'Q')`) {
+		t.Errorf("reload log:\n%s", logged)
+	}
+	c.expect("CONFIG GET notify-keyspace-events", "*1\nnotify-keyspace-events ")
+	c.expect("CONFIG GET slowlog-max-len", "*1\nslowlog-max-len 6")
+	c.expect("SET reload_a:1", "DONE")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+	"tinycached/server/cache"
+	"tinycached/server/command"
+	"tinycached/server/persistence"
+	"tinycached/server/raft"
+	"tinycached/utils"
+)
+
+/*
+ * Raft模式：raft-peers中的服务器组成一个Raft组，客户端的写命令写入复制日志，
+ * 多数节点写入后各节点按日志顺序在缓存上执行；日志与快照保存在raft-dir，重启后从中恢复数据。
+ * 只有领导者处理读写命令，其他节点回复"NOTLEADER 领导者ID"。
+ * EXPR的过期时间在各节点执行时开始计算，淘汰策略也由各节点独立执行，开启淘汰时各节点的数据可能不同。
+ * 节点之间的连接没有认证，只应在可信的网络中使用
+ */
+type raftConsensus struct {
+	node      *raft.Node
+	transport *raft.TCPTransport
+	storage   *raft.FileStorage
+	stop      chan struct{}
+}
+
+const (
+	raftTick           = 100 * time.Millisecond
+	raftElectionTicks  = 10 // 选举超时1~2秒
+	raftHeartbeatTicks = 1
+	raftDialTimeout    = time.Second
+	raftWaitTimeout    = 5 * time.Second // 等待提交或读屏障的最长时间
+)
+
+var errRaftTimeout = errors.New("raft: timed out, the command may still be applied")
+
+// 开启Raft模式，raft-id为空时不开启
+func (svr *CacheServer) startRaft() error {
+	if svr.cfg.RaftID == "" {
+		return nil
+	}
+	storage, err := raft.NewFileStorage(svr.cfg.RaftDir)
+	if err != nil {
+		return err
+	}
+	addrs := svr.cfg.RaftAddrs()
+	peers := make([]string, 0, len(addrs))
+	for id := range addrs {
+		peers = append(peers, id)
+	}
+	sort.Strings(peers)
+	transport := raft.NewTCPTransport(svr.cfg.RaftID, addrs, raftDialTimeout)
+	node, err := raft.NewNode(raft.Config{
+		ID:              svr.cfg.RaftID,
+		Peers:           peers,
+		ElectionTicks:   raftElectionTicks,
+		HeartbeatTicks:  raftHeartbeatTicks,
+		SnapshotEntries: uint64(svr.cfg.RaftSnapshotEntries),
+		Storage:         storage,
+		StateMachine:    &cacheFSM{cache: svr.cache, clt: command.NewApplyClient(svr.cache)},
+		Transport:       transport,
+	})
+	if err != nil {
+		storage.Close()
+		return err
+	}
+	if err := transport.Start(node.Step); err != nil {
+		storage.Close()
+		return err
+	}
+	rc := &raftConsensus{node: node, transport: transport, storage: storage, stop: make(chan struct{})}
+	go node.Run(raftTick, rc.stop)
+	svr.raft = rc
+	command.UseConsensus(rc)
+	log.Printf("raft: node %s started, peers %v", svr.cfg.RaftID, svr.cfg.RaftPeers)
+	return nil
+}
+
+// 停止Raft节点；关闭时在全部连接退出之后调用
+func (svr *CacheServer) stopRaft() {
+	if svr.raft == nil {
+		return
+	}
+	close(svr.raft.stop)
+	svr.raft.node.Stop()
+	svr.raft.transport.Close()
+	if err := svr.raft.storage.Close(); err != nil {
+		log.Printf("raft: close storage: %v", err)
+	}
+}
+
+func (rc *raftConsensus) Propose(cmd utils.CmdType, body string) error {
+	done, err := rc.node.Propose([]byte(command.EncodeApplied(cmd, body)))
+	if err != nil {
+		return err
+	}
+	select {
+	case res := <-done:
+		return res.Err
+	case <-time.After(raftWaitTimeout):
+		return errRaftTimeout
+	}
+}
+
+func (rc *raftConsensus) ReadBarrier() error {
+	done, err := rc.node.ReadIndex()
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(raftWaitTimeout):
+		return errRaftTimeout
+	}
+}
+
+// 以缓存为状态机：命令由master客户端执行，快照与dbfilename的格式相同
+type cacheFSM struct {
+	cache *cache.Cache
+	clt   *command.CacheClientInfo
+}
+
+func (fsm *cacheFSM) Apply(data []byte) ([]byte, error) {
+	cmd, body := command.ParseApplied(data)
+	return fsm.clt.ExecApplied(cmd, body)
+}
+
+func (fsm *cacheFSM) Snapshot() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := persistence.WriteSnapshot(&buf, fsm.cache.Entries()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 以领导者发来的快照替换全部数据；副本的数据随之失效，断开后重新全量同步
+func (fsm *cacheFSM) Restore(data []byte) error {
+	fsm.cache.Clear()
+	if err := persistence.ReadSnapshot(bytes.NewReader(data), fsm.cache.Load); err != nil {
+		return err
+	}
+	command.DisconnectReplicas()
+	return nil
+}
+
+func (svr *CacheServer) infoRaft() []string {
+	if svr.raft == nil {
+		return []string{"raft_enabled:0"}
+	}
+	status := svr.raft.node.Status()
+	return []string{
+		"raft_enabled:1",
+		"raft_id:" + status.ID,
+		"raft_state:" + status.State.String(),
+		"raft_term:" + fmt.Sprint(status.Term),
+		"raft_leader:" + status.Leader,
+		"raft_commit_index:" + fmt.Sprint(status.Commit),
+		"raft_applied_index:" + fmt.Sprint(status.Applied),
+		"raft_last_index:" + fmt.Sprint(status.LastIndex),
+		"raft_snapshot_index:" + fmt.Sprint(status.SnapIndex),
+	}
+}
@@ -1,18 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"flag"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"tinycached/config"
+	"tinycached/server/acl"
+	"tinycached/server/cache"
 	"tinycached/server/command"
+	"tinycached/server/netpoll"
 	"tinycached/server/persistence"
 	"tinycached/utils"
+	"tinycached/utils/tlsutil"
 )
 
 /*
@@ -29,6 +39,49 @@ import (
  * WATCH KEY名字\n		标记该缓存值需要被监视；若其他客户端在事务执行中修改了该缓存值，则事务执行失败，返回NIL\n
  * UNWATCH KEY名字\n	取消监视
  * ----------------------------------------------------------------------------------------------
+ * 订阅命令
+ * SUBSCRIBE 频道名\n		订阅频道，之后服务器会推送MESSAGE 频道名 消息\n
+ * PSUBSCRIBE 频道模式\n	按glob模式订阅频道，之后服务器会推送PMESSAGE 频道模式 频道名 消息\n
+ * UNSUBSCRIBE [频道名]\n	取消订阅，不带参数则取消全部订阅
+ * 键空间事件通过__keyspace@0__:KEY名字与__keyevent@0__:事件名两类频道发布
+ * ----------------------------------------------------------------------------------------------
+ * 管理命令
+ * CONFIG GET 配置名模式\n	返回匹配的配置项，多行回复
+ * CONFIG SET 配置名 值\n	运行时修改配置，执行完成后返回DONE\n
+ * CONFIG REWRITE\n		将当前配置写回配置文件，执行完成后返回DONE\n
+ * INFO [段名...]\n		返回服务器状态，段名为server、clients、memory、persistence、stats、replication、raft、keyspace，多行回复
+ * SLOWLOG GET [n]\n		返回最新的n条慢日志，默认10条，多行回复
+ * SLOWLOG LEN\n			返回慢日志的条数
+ * SLOWLOG RESET\n		清空慢日志，执行完成后返回DONE\n
+ * MONITOR\n			返回DONE\n，之后推送服务器执行的每条命令："时间 [0 客户端地址] 命令 参数\n"
+ * CLIENT LIST\n			返回全部客户端，每行一个，如id=1 addr=127.0.0.1:5000 name= age=3 idle=0 ...
+ * CLIENT KILL ID id|ADDR 地址|USER 用户名\n	断开满足条件的客户端，返回断开的客户端数
+ * CLIENT SETNAME 名字\n	设置当前连接的名字；CLIENT GETNAME\n返回名字；CLIENT ID\n返回id
+ * CLIENT PAUSE 毫秒 [WRITE|ALL]\n	暂停处理命令；CLIENT UNPAUSE\n提前结束
+ * PING [消息]\n			返回PONG\n，带消息时原样返回消息，不受权限限制
+ * ----------------------------------------------------------------------------------------------
+ * 复制命令
+ * REPLICAOF host port\n		成为指定主服务器的副本，同步后持续接收主服务器的写命令
+ * REPLICAOF NO ONE\n		停止复制，成为主服务器
+ * REPLCONF listening-port 端口\n	副本告知自己的监听端口
+ * REPLCONF ACK 偏移量\n		副本告知已执行到的偏移量，每秒一次，不回复
+ * WAIT 副本数 超时毫秒\n		阻塞到至少指定数量的副本确认该连接最近一次写入或超时，返回确认的副本数
+ * SYNC\n				副本请求全量同步，返回FULLSYNC 偏移量 字节数\n与快照，之后推送复制流
+ * PSYNC 复制ID 偏移量\n		副本请求部分重同步，返回CONTINUE 复制ID\n后推送缺失的复制流；
+ *					无法部分重同步时返回FULLSYNC 复制ID 偏移量 字节数\n与快照
+ * Raft模式（配置raft-id与raft-peers）下写命令经多数节点提交并执行后才回复DONE，
+ * 不是领导者的节点回复NOTLEADER 领导者ID\n；不支持事务命令与REPLICAOF
+ * ----------------------------------------------------------------------------------------------
+ * 认证命令
+ * AUTH [用户名] 密码\n		登录，不带用户名时以default用户登录；配置了requirepass时须先登录
+ * ACL LIST\n				返回全部用户的规则，多行回复
+ * ACL SETUSER 用户名 规则...\n	创建或修改用户，规则与redis一致，如on >密码 ~user* +@read
+ * ACL DELUSER 用户名...\n	删除用户，返回删除的用户数
+ * ACL WHOAMI\n			返回当前用户名
+ * ACL SAVE\n				将用户写入aclfile
+ * ASUSER 用户名 命令 参数\n	以指定用户的身份执行命令，供代理使用，须有admin权限
+ * 命令类别：read、write、admin、transaction、pubsub
+ * ----------------------------------------------------------------------------------------------
  */
 
 var (
@@ -41,32 +94,222 @@ func init() {
 }
 
 type CacheServer struct {
-	sigChan  chan os.Signal
-	ticker   *time.Ticker
-	listener net.Listener
-	wg       sync.WaitGroup
+	totalConns     uint64 // 累计接受的连接数，原子操作，放在首位保证64位对齐
+	rejectedConns  uint64 // 因超过maxclients被拒绝的连接数，原子操作
+	timeoutConns   uint64 // 因空闲超时或写超时被断开的连接数，原子操作
+	timeout        int64  // 以下三项是timeout、write-timeout与maxclients的当前值，CONFIG SET时更新，原子操作
+	writeTimeout   int64
+	maxClients     int64
+	startTime      time.Time
+	cfg            *config.Server
+	cache          *cache.Cache
+	users          *acl.ACL
+	sigChan        chan os.Signal
+	ticker         *time.Ticker
+	listener       net.Listener
+	poller         *netpoll.Server // 事件循环模式下代替listener
+	extraListeners []net.Listener  // TLS与Unix socket监听，总是每个连接一个协程处理
+	certs          *tlsutil.Certs
+	metrics        *http.Server // Prometheus指标的HTTP服务，未开启时为nil
+	wg             sync.WaitGroup
+	connMutex      sync.Mutex
+	conns          map[*clientConn]struct{} // 当前的客户端连接
+	linkMutex      sync.Mutex
+	link           *replicaLink   // 到主服务器的复制连接，自己是主服务器时为nil
+	raft           *raftConsensus // Raft模式下的一致性模块，未开启时为nil
 }
 
-func newServer(port uint16) (svr *CacheServer) {
+func newServer(cfg *config.Server) (svr *CacheServer, err error) {
+	policy, err := cache.ParsePolicy(cfg.MaxMemoryPolicy)
+	if err != nil {
+		return nil, err
+	}
+	fsync, err := persistence.ParseFsyncPolicy(cfg.AppendFsync)
+	if err != nil {
+		return nil, err
+	}
+	notifyFlags, err := cache.ParseNotifyFlags(cfg.NotifyKeyspaceEvents)
+	if err != nil {
+		return nil, err
+	}
+	// Raft模式下数据来自Raft的快照与日志，不使用AOF与快照文件
+	raftMode := cfg.RaftID != ""
+	persistence.Configure(cfg.AppendOnly && !raftMode, cfg.AppendFilename, fsync)
+
 	svr = &CacheServer{
-		sigChan: make(chan os.Signal, 1),
-		ticker:  time.NewTicker(time.Duration(1) * time.Second), // 1s刷一次磁盘
+		startTime: time.Now(),
+		cfg:       cfg,
+		cache:     cache.New(cfg.MaxMemory),
+		conns:     make(map[*clientConn]struct{}),
+		sigChan:   make(chan os.Signal, 1),
+		ticker:    time.NewTicker(time.Duration(1) * time.Second), // 1s刷一次磁盘
+	}
+	svr.cache.SetPolicy(policy)
+	svr.applyClientLimits()
+	if err = svr.loadUsers(); err != nil {
+		return nil, err
 	}
+	// 允许通过CONFIG SET在运行时修改的配置项
+	svr.watchConfig()
+	command.UseConfig(cfg)
+	command.UseACL(svr.users)
+	command.UseInfo(svr.info)
+	command.SetSlowlog(cfg.SlowlogSlowerThan, cfg.SlowlogMaxLen)
+	command.SetOutputLimits(cfg.OutputBufferLimits)
+	command.SetReplBacklogSize(int(cfg.ReplBacklogSize))
 	// 恢复历史数据
-	svr.recoverHistoryCache()
+	if !raftMode {
+		if err = svr.recoverHistoryCache(); err != nil {
+			return nil, err
+		}
+	}
+	// 开启键空间事件通知；放在恢复之后，避免重放AOF时产生大量事件
+	svr.cache.SetNotifyFlags(notifyFlags)
+	command.EnableKeyspaceEvents(svr.cache)
+	// 写入AOF的命令同时进入复制流
+	command.EnableReplication()
+	// 配置了raft-id时加入Raft组，之后的写命令经Raft提交
+	if err = svr.startRaft(); err != nil {
+		return nil, err
+	}
 	// 启动AOF定时刷新
 	svr.startAof()
+	// 定时删除已过期的key
+	svr.startExpire()
 	// 捕获信号
 	svr.capSignal()
 	// 开始监听
-	svr.startListen(port)
-	return svr
+	if err = svr.startListen(cfg.Listen); err != nil {
+		return nil, err
+	}
+	if err = svr.startTLSListen(cfg.TLSListen); err != nil {
+		svr.stopListen()
+		return nil, err
+	}
+	if err = svr.startUnixListen(cfg.UnixSocket); err != nil {
+		svr.stopListen()
+		return nil, err
+	}
+	if err = svr.startMetrics(cfg.MetricsListen); err != nil {
+		svr.stopListen()
+		return nil, err
+	}
+	// 配置了replicaof时开始复制
+	svr.applyReplicaOf()
+	return svr, nil
 }
 
-func (svr *CacheServer) recoverHistoryCache() {
+func (svr *CacheServer) watchConfig() {
+	ps := svr.cfg.Params()
+	ps.OnChange("maxmemory", func() error {
+		if svr.cfg.MaxMemory == 0 {
+			return errors.New("must be greater than 0")
+		}
+		svr.cache.SetMaxBytes(svr.cfg.MaxMemory)
+		return nil
+	})
+	ps.OnChange("maxmemory-policy", func() error {
+		policy, err := cache.ParsePolicy(svr.cfg.MaxMemoryPolicy)
+		if err == nil {
+			svr.cache.SetPolicy(policy)
+		}
+		return err
+	})
+	ps.OnChange("appendfsync", func() error {
+		fsync, err := persistence.ParseFsyncPolicy(svr.cfg.AppendFsync)
+		if err == nil {
+			persistence.AofInstance().SetFsync(fsync)
+		}
+		return err
+	})
+	ps.OnChange("notify-keyspace-events", func() error {
+		flags, err := cache.ParseNotifyFlags(svr.cfg.NotifyKeyspaceEvents)
+		if err == nil {
+			svr.cache.SetNotifyFlags(flags)
+		}
+		return err
+	})
+	ps.OnChange("maxclients", svr.applyClientLimits)
+	ps.OnChange("timeout", func() error {
+		svr.applyClientLimits()
+		if svr.poller != nil {
+			svr.poller.SetIdleTimeout(svr.clientTimeout())
+		}
+		return nil
+	})
+	ps.OnChange("write-timeout", svr.applyClientLimits)
+	ps.OnChange("client-output-buffer-limit", func() error {
+		command.SetOutputLimits(svr.cfg.OutputBufferLimits)
+		return nil
+	})
+	ps.OnChange("replicaof", svr.applyReplicaOf)
+	ps.OnChange("replica-read-only", func() error {
+		command.SetReadOnly(svr.cfg.MasterAddr() != "" && svr.cfg.ReplicaReadOnly)
+		return nil
+	})
+	ps.OnChange("repl-backlog-size", func() error {
+		command.SetReplBacklogSize(int(svr.cfg.ReplBacklogSize))
+		return nil
+	})
+	// 下次连接主服务器时生效
+	ps.OnChange("masteruser", func() error { return nil })
+	ps.OnChange("masterauth", func() error { return nil })
+	ps.OnChange("slowlog-log-slower-than", svr.applySlowlog)
+	ps.OnChange("slowlog-max-len", svr.applySlowlog)
+	ps.OnChange("requirepass", func() error {
+		svr.users.SetRequirePass(svr.cfg.RequirePass)
+		return nil
+	})
+}
+
+// 连接路径上读取的配置项另存一份，CONFIG SET修改cfg时连接协程不读cfg
+func (svr *CacheServer) applyClientLimits() error {
+	atomic.StoreInt64(&svr.timeout, int64(svr.cfg.Timeout))
+	atomic.StoreInt64(&svr.writeTimeout, int64(svr.cfg.WriteTimeout))
+	atomic.StoreInt64(&svr.maxClients, int64(svr.cfg.MaxClients))
+	return nil
+}
+
+func (svr *CacheServer) clientTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&svr.timeout))
+}
+
+func (svr *CacheServer) clientWriteTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&svr.writeTimeout))
+}
+
+func (svr *CacheServer) clientLimit() int {
+	return int(atomic.LoadInt64(&svr.maxClients))
+}
+
+func (svr *CacheServer) applySlowlog() error {
+	command.SetSlowlog(svr.cfg.SlowlogSlowerThan, svr.cfg.SlowlogMaxLen)
+	return nil
+}
+
+// 加载aclfile中的用户，文件不存在时只有default用户；requirepass覆盖default用户的密码
+func (svr *CacheServer) loadUsers() error {
+	svr.users = acl.New()
+	if svr.cfg.ACLFile != "" {
+		if err := svr.users.Load(svr.cfg.ACLFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if svr.cfg.RequirePass != "" {
+		svr.users.SetRequirePass(svr.cfg.RequirePass)
+	}
+	return nil
+}
+
+// 先加载快照，再重放快照之后的AOF
+func (svr *CacheServer) recoverHistoryCache() error {
+	if err := persistence.LoadSnapshot(svr.cfg.DbFilename, svr.cache.Load); err != nil {
+		return err
+	}
 	aof := persistence.AofInstance()
 	// 逐条执行命令，恢复缓存状态
-	clt := command.NewCacheClient()
+	clt := command.NewReplayClient(svr.cache)
+	defer clt.Close()
 	for {
 		// 每次接受一个字符，进入协议解析状态机，并调用相关命令的api
 		cmd, args, ok := utils.ParseFsm(func() (byte, bool) {
@@ -74,12 +317,12 @@ func (svr *CacheServer) recoverHistoryCache() {
 		})
 
 		if !ok {
-			break
+			return nil
 		}
 
-		for _, arg := range args {
-			if _, err := clt.ExecCmd(cmd, arg); err != nil {
-				return
+		for _, body := range utils.Bodies(cmd, args) {
+			if _, err := clt.ExecCmd(cmd, body); err != nil {
+				return nil
 			}
 		}
 	}
@@ -99,70 +342,331 @@ func (svr *CacheServer) startAof() {
 	}()
 }
 
+// 主动过期的间隔，与每次最多抽查的轮数
+const (
+	expireInterval = 100 * time.Millisecond
+	expireRounds   = 16
+)
+
+// 定时删除已过期的key并产生expired事件，不依赖读取时检查
+func (svr *CacheServer) startExpire() {
+	go func() {
+		ticker := time.NewTicker(expireInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				svr.cache.ExpireCycle(expireRounds)
+			}
+		}
+	}()
+}
+
+// SIGHUP重新加载配置，SIGINT与SIGTERM关闭服务器
 func (svr *CacheServer) capSignal() {
 	signal.Notify(svr.sigChan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		<-svr.sigChan
-		svr.listener.Close()
-		cancel()
+		for sig := range svr.sigChan {
+			if sig == syscall.SIGHUP {
+				svr.reloadConfig()
+				svr.reloadCerts()
+				continue
+			}
+			svr.stopListen()
+			cancel()
+			return
+		}
 	}()
 }
 
-func (svr *CacheServer) startListen(port uint16) {
-	var err error
-	svr.listener, err = net.Listen("tcp", ":"+strconv.FormatUint(uint64(port), 10))
+// 重新读取证书文件；证书可能已被原地替换，即使配置没有变化也要读取
+func (svr *CacheServer) reloadCerts() {
+	if svr.certs == nil {
+		return
+	}
+	if err := svr.certs.Reload(svr.cfg.TLSOptions()); err != nil {
+		log.Printf("reload: tls: %v", err)
+	} else {
+		log.Print("reload: tls certificates reloaded")
+	}
+}
+
+func (svr *CacheServer) reloadConfig() {
+	if svr.cfg.Path == "" {
+		log.Print("reload: no config file specified")
+		return
+	}
+	changes, err := svr.cfg.Reload()
 	if err != nil {
-		panic(err)
+		log.Printf("reload: %v", err)
+		return
+	}
+	log.Printf("reload: %d option(s) changed", len(changes))
+	for _, c := range changes {
+		log.Printf("reload: %v", c)
+	}
+}
+
+func (svr *CacheServer) startListen(addr string) (err error) {
+	if svr.cfg.IOMode == "netpoll" {
+		n := svr.cfg.IOThreads
+		if n == 0 {
+			n = runtime.NumCPU()
+		}
+		if svr.poller, err = netpoll.Listen(addr, n, &netpollHandler{svr}); err == nil {
+			svr.poller.SetIdleTimeout(svr.clientTimeout())
+		}
+		return err
+	}
+	svr.listener, err = net.Listen("tcp", addr)
+	return err
+}
+
+// 开启TLS监听，addr为空时不开启
+func (svr *CacheServer) startTLSListen(addr string) (err error) {
+	if addr == "" {
+		return nil
+	}
+	if svr.certs, err = tlsutil.New(svr.cfg.TLSOptions()); err != nil {
+		return err
+	}
+	listener, err := tlsutil.Listen(addr, svr.certs)
+	if err == nil {
+		svr.extraListeners = append(svr.extraListeners, listener)
+	}
+	return err
+}
+
+// 监听Unix socket，path为空时不监听；与TCP连接使用相同的处理流程
+func (svr *CacheServer) startUnixListen(path string) error {
+	if path == "" {
+		return nil
+	}
+	listener, err := utils.ListenUnix(path, svr.cfg.UnixSocketPerm)
+	if err == nil {
+		svr.extraListeners = append(svr.extraListeners, listener)
+	}
+	return err
+}
+
+// 停止接受新连接
+func (svr *CacheServer) stopListen() {
+	if svr.poller != nil {
+		svr.poller.Close()
+	} else {
+		svr.listener.Close()
+	}
+	for _, listener := range svr.extraListeners {
+		listener.Close()
+	}
+	if svr.metrics != nil {
+		svr.metrics.Close()
 	}
 }
 
 func (svr *CacheServer) run() {
+	var accepting sync.WaitGroup
+	for _, listener := range svr.extraListeners {
+		accepting.Add(1)
+		go func(listener net.Listener) {
+			defer accepting.Done()
+			svr.acceptLoop(listener)
+		}(listener)
+	}
+	if svr.poller != nil {
+		// 事件循环模式：Serve在关闭时处理完已收到的命令并关闭全部连接后返回
+		svr.poller.Serve()
+	} else {
+		svr.acceptLoop(svr.listener)
+	}
+	// 监听关闭后各接受连接的协程退出，之后不会再有wg.Add，shutdown中的wg.Wait才能等到全部连接
+	accepting.Wait()
+	svr.shutdown()
+}
+
+// 接受连接直到服务器关闭
+func (svr *CacheServer) acceptLoop(listener net.Listener) {
 	for {
-		select {
-		case <-ctx.Done():
-			svr.wg.Wait()
-			return
-		default:
-			conn, err := svr.listener.Accept()
-			if err != nil {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
 				continue
 			}
-			svr.wg.Add(1)
-			go svr.reqHandler(conn, command.NewCacheClient())
 		}
+		if svr.numClients() >= svr.clientLimit() {
+			go svr.reject(conn)
+			continue
+		}
+		svr.wg.Add(1)
+		go svr.reqHandler(svr.addConn(conn), command.NewCacheClient(svr.cache))
 	}
 }
 
-func (svr *CacheServer) reqHandler(conn net.Conn, clt *command.CacheClientInfo) {
-	char := make([]byte, 1)
-	for {
-		select {
-		case <-ctx.Done():
-			log.Print("reqHandler")
+// 超过maxclients时拒绝连接的回复
+var errMaxClients = []byte("max number of clients reached\n")
+
+// 回复错误后关闭连接；TLS连接写出前要先握手，不能阻塞接受连接的协程
+func (svr *CacheServer) reject(conn net.Conn) {
+	atomic.AddUint64(&svr.rejectedConns, 1)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write(errMaxClients)
+	conn.Close()
+}
+
+// 当前的客户端连接数
+func (svr *CacheServer) numClients() int {
+	svr.connMutex.Lock()
+	n := len(svr.conns)
+	svr.connMutex.Unlock()
+	if svr.poller != nil {
+		n += svr.poller.NumConns()
+	}
+	return n
+}
+
+// 向客户端写数据前调用：设置写超时，客户端长时间不读取回复时写失败，之后连接被关闭
+func (svr *CacheServer) armWrite(conn *clientConn) {
+	if timeout := svr.clientWriteTimeout(); timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+	} else {
+		conn.SetWriteDeadline(time.Time{})
+	}
+}
+
+// 写出缓冲区中的回复，写超时时计数
+func (svr *CacheServer) flush(conn *clientConn, writer *bufio.Writer) error {
+	svr.armWrite(conn)
+	err := writer.Flush()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		atomic.AddUint64(&svr.timeoutConns, 1)
+		log.Printf("client %s closed for write timeout", conn.RemoteAddr())
+	}
+	return err
+}
+
+// 每个连接的读写缓冲区大小
+const ioBufSize = 4096
+
+func (svr *CacheServer) reqHandler(conn *clientConn, clt *command.CacheClientInfo) {
+	reader := bufio.NewReaderSize(conn, ioBufSize)
+	writer := bufio.NewWriterSize(conn, ioBufSize)
+	// 命令回复与订阅推送可能并发写连接，需要加锁
+	var writeMutex sync.Mutex
+	defer svr.wg.Done()
+	defer svr.removeConn(conn)
+	defer conn.Close()
+	defer clt.Close()
+	go svr.pushHandler(conn, writer, &writeMutex, clt)
+	clt.Register(conn.RemoteAddr().String(), func() { conn.Close() }, func() (int, int) {
+		qbuf, obl := conn.buffers()
+		return qbuf, obl + clt.PushPending()
+	})
+
+	s := &session{clt: clt}
+	// 客户端空闲超时或服务器关闭时退出；副本只接收复制流，不受空闲超时限制
+	for conn.waitCommand(svr.idleTimeout(clt)) {
+		// 每次接受一个字符，进入协议解析状态机，并调用相关命令的api
+		var readErr error
+		cmd, args, ok := utils.ParseFsm(func() (byte, bool) {
+			b, err := reader.ReadByte()
+			readErr = err
+			return b, (err == nil)
+		})
+
+		if !ok {
+			if errors.Is(readErr, os.ErrDeadlineExceeded) && !conn.isClosing() {
+				atomic.AddUint64(&svr.timeoutConns, 1)
+			}
+			writeMutex.Lock()
+			svr.flush(conn, writer)
+			writeMutex.Unlock()
 			return
-		default:
-			// 每次接受一个字符，进入协议解析状态机，并调用相关命令的api
-			cmd, args, ok := utils.ParseFsm(func() (byte, bool) {
-				_, err := conn.Read(char)
-				return char[0], (err == nil)
-			})
-
-			if !ok {
+		}
+
+		// WAIT可能长时间阻塞，执行时不持有写锁，以免阻塞推送
+		var blocked []byte
+		if cmd == utils.WAIT {
+			blocked = s.execBuffered(cmd, args)
+		}
+		writeMutex.Lock()
+		svr.armWrite(conn)
+		if cmd == utils.WAIT {
+			writer.Write(blocked)
+		} else {
+			s.exec(cmd, args, writer)
+		}
+		// 之后的推送在持有锁时写入writer，排在回复之后
+		clt.AfterReply()
+		writeMutex.Unlock()
+
+		// 客户端一次发来多条命令时，全部执行完再将回复一起发出
+		if reader.Buffered() == 0 {
+			writeMutex.Lock()
+			err := svr.flush(conn, writer)
+			writeMutex.Unlock()
+			if err != nil {
 				return
 			}
+		}
+		writeMutex.Lock()
+		conn.setBuffers(reader.Buffered(), writer.Buffered())
+		writeMutex.Unlock()
+	}
+}
 
-			for _, arg := range args {
-				if ret, err := clt.ExecCmd(cmd, arg); err != nil {
-					utils.WriteAll(conn, []byte(err.Error()))
-				} else {
-					utils.WriteAll(conn, ret)
-				}
-			}
+func (svr *CacheServer) idleTimeout(clt *command.CacheClientInfo) time.Duration {
+	if clt.IsReplica() {
+		return 0
+	}
+	return svr.clientTimeout()
+}
+
+// 将订阅消息推送给客户端，客户端关闭后退出
+func (svr *CacheServer) pushHandler(conn *clientConn, writer *bufio.Writer, writeMutex *sync.Mutex, clt *command.CacheClientInfo) {
+	for msg := range clt.Pushed() {
+		writeMutex.Lock()
+		svr.armWrite(conn)
+		writer.Write(msg)
+		clt.PushSent(len(msg))
+		// 积压的消息一起发出
+		var err error
+		if len(clt.Pushed()) == 0 {
+			err = svr.flush(conn, writer)
+		}
+		writeMutex.Unlock()
+		if err != nil {
+			// 关闭连接，唤醒阻塞在读上的处理协程
+			conn.Close()
+			return
 		}
 	}
 }
 
 func main() {
-	svr := newServer(7000)
+	cfg, err := config.LoadServer(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	svr, err := newServer(cfg)
+	if err != nil {
+		log.Fatalf("start server: %v", err)
+	}
+	log.Printf("tinycached listening on %s", cfg.Listen)
+	if cfg.TLSListen != "" {
+		log.Printf("tinycached listening on %s (tls)", cfg.TLSListen)
+	}
+	if cfg.UnixSocket != "" {
+		log.Printf("tinycached listening on %s (unix)", cfg.UnixSocket)
+	}
+	if cfg.MetricsListen != "" {
+		log.Printf("tinycached metrics on http://%s/metrics", cfg.MetricsListen)
+	}
 	svr.run()
 }
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"tinycached/utils"
+)
+
+// 服务器的包级状态（ctx、command包中的配置等）只有一份，每个服务器在单独的进程中运行：
+// 设置了该环境变量时，测试程序自身以命令行参数作为服务器启动
+const serverEnv = "TINYCACHED_TEST_SERVER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(serverEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// 测试程序同步写的日志缓冲区
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+type testServer struct {
+	t    testing.TB
+	addr string
+	dir  string
+	cmd  *exec.Cmd
+	log  *syncBuffer
+	done chan struct{}
+}
+
+// 本机上一个空闲的端口
+func freeAddr(t testing.TB) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// 在临时目录中启动服务器，监听一个空闲端口；测试结束时关闭
+func startServer(t testing.TB, args ...string) *testServer {
+	t.Helper()
+	return startServerIn(t, t.TempDir(), freeAddr(t), args...)
+}
+
+func startServerIn(t testing.TB, dir string, addr string, args ...string) *testServer {
+	t.Helper()
+	s := &testServer{t: t, addr: addr, dir: dir, log: &syncBuffer{}, done: make(chan struct{})}
+	s.cmd = exec.Command(os.Args[0], append([]string{"-listen", addr, "-appendonly", "no"}, args...)...)
+	s.cmd.Dir = dir
+	s.cmd.Env = append(os.Environ(), serverEnv+"=1")
+	s.cmd.Stdout, s.cmd.Stderr = s.log, s.log
+	if err := s.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		s.cmd.Wait()
+		close(s.done)
+	}()
+	t.Cleanup(s.stop)
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return s
+		}
+		select {
+		case <-s.done:
+			t.Fatalf("server exited: %s", s.log)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not start: %v\n%s", err, s.log)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// 以SIGTERM关闭服务器并等待退出
+func (s *testServer) stop() {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	s.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-s.done:
+	case <-time.After(10 * time.Second):
+		s.cmd.Process.Kill()
+		<-s.done
+		s.t.Errorf("server did not exit on SIGTERM\n%s", s.log)
+	}
+	if s.t.Failed() {
+		s.t.Logf("server %s log:\n%s", s.addr, s.log)
+	}
+}
+
+// 进程崩溃：不经正常关闭流程直接退出
+func (s *testServer) kill() {
+	s.cmd.Process.Kill()
+	<-s.done
+}
+
+type testConn struct {
+	t testing.TB
+	net.Conn
+	reader *bufio.Reader
+}
+
+func dial(t testing.TB, addr string) *testConn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *testConn) send(lines ...string) {
+	c.t.Helper()
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line + "\n")
+	}
+	c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// 读取一条回复，多行回复以\n连接，不含结尾的\n
+func (c *testConn) recv() string {
+	c.t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := utils.ReadReply(c.reader.ReadByte)
+	if err != nil {
+		c.t.Fatalf("read reply: %v (got %q)", err, reply)
+	}
+	return strings.TrimSuffix(string(reply), "\n")
+}
+
+func (c *testConn) do(line string) string {
+	c.t.Helper()
+	c.send(line)
+	return c.recv()
+}
+
+// 发送命令并检查回复
+func (c *testConn) expect(line string, want string) {
+	c.t.Helper()
+	if got := c.do(line); got != want {
+		c.t.Errorf("%s: got %q, want %q", line, got, want)
+	}
+}
+
+// 两种网络模型下同一组命令的回复相同
+func TestIOModes(t *testing.T) {
+	modes := []string{"goroutine", "netpoll"}
+	cases := []struct {
+		name string
+		run  func(t *testing.T, addr string)
+	}{
+		{"GetSet", testGetSet},
+		{"Multi", testMulti},
+		{"Subscribe", testSubscribe},
+		{"Pipeline", testPipeline},
+		{"LongArg", testLongArg},
+		{"StarValue", testStarValue},
+		{"HalfClose", testHalfClose},
+	}
+	for _, mode := range modes {
+		t.Run(mode, func(t *testing.T) {
+			if mode == "netpoll" && runtime.GOOS != "linux" {
+				t.Skip("netpoll is only supported on linux")
+			}
+			s := startServer(t, "-io-mode", mode, "-notify-keyspace-events", "KEA")
+			if info := dial(t, s.addr).do("INFO server"); !strings.Contains(info, "io_mode:"+mode) {
+				t.Fatalf("server not running in %s mode:\n%s", mode, info)
+			}
+			for _, tc := range cases {
+				t.Run(tc.name, func(t *testing.T) { tc.run(t, s.addr) })
+			}
+		})
+	}
+}
+
+func testGetSet(t *testing.T, addr string) {
+	c := dial(t, addr)
+	c.expect("SET getset_a:1", "DONE")
+	c.expect("GET getset_a", "1")
+	c.expect("SET getset_a:2", "DONE")
+	c.expect("GET getset_a", "2")
+	c.expect("DEL getset_a", "DONE")
+	c.expect("GET getset_a", "key is not exits")
+	c.expect("PING", "PONG")
+
+	// 其他连接立即可见
+	c.expect("SET getset_b:x", "DONE")
+	dial(t, addr).expect("GET getset_b", "x")
+
+	c.expect("EXPR getset_b:50", "DONE")
+	time.Sleep(200 * time.Millisecond)
+	c.expect("GET getset_b", "key is not exits")
+}
+
+func testMulti(t *testing.T, addr string) {
+	c := dial(t, addr)
+	other := dial(t, addr)
+	c.expect("MULTI", "DONE")
+	c.expect("SET multi_a:1", "QUEUED")
+	c.expect("GET multi_a", "QUEUED")
+	// 入队的命令在EXEC之前不执行
+	other.expect("GET multi_a", "key is not exits")
+	c.expect("DISCARD", "DONE")
+	other.expect("GET multi_a", "key is not exits")
+
+	// DISCARD与EXEC结束事务，之后的命令立即执行
+	c.expect("SET multi_b:1", "DONE")
+	c.expect("MULTI", "DONE")
+	c.expect("SET multi_c:1", "QUEUED")
+	c.send("EXEC")
+	c.recv()
+	c.expect("SET multi_d:1", "DONE")
+	other.expect("GET multi_d", "1")
+}
+
+func testSubscribe(t *testing.T, addr string) {
+	sub := dial(t, addr)
+	sub.expect("SUBSCRIBE __keyevent@0__:set", "DONE")
+	psub := dial(t, addr)
+	psub.expect("PSUBSCRIBE __keyspace@0__:sub_*", "DONE")
+
+	c := dial(t, addr)
+	c.expect("SET sub_a:1", "DONE")
+	c.expect("DEL sub_a", "DONE")
+	if got, want := sub.recv(), "MESSAGE __keyevent@0__:set sub_a"; got != want {
+		t.Errorf("subscriber got %q, want %q", got, want)
+	}
+	for _, event := range []string{"set", "del"} {
+		if got, want := psub.recv(), "PMESSAGE __keyspace@0__:sub_* __keyspace@0__:sub_a "+event; got != want {
+			t.Errorf("pattern subscriber got %q, want %q", got, want)
+		}
+	}
+
+	// 取消订阅后不再收到推送
+	sub.expect("UNSUBSCRIBE", "DONE")
+	c.expect("SET sub_b:1", "DONE")
+	sub.expect("PING", "PONG")
+}
+
+// 一次写出多条命令，回复按顺序返回
+func testPipeline(t *testing.T, addr string) {
+	const n = 1000
+	c := dial(t, addr)
+	var lines []string
+	for i := 0; i < n; i++ {
+		lines = append(lines, fmt.Sprintf("SET pipe_%d:v%d", i, i), fmt.Sprintf("GET pipe_%d", i))
+	}
+	// 另一个协程写，避免两端的缓冲区都写满时互相等待
+	go c.send(lines...)
+	for i := 0; i < n; i++ {
+		if got := c.recv(); got != "DONE" {
+			t.Fatalf("SET pipe_%d: got %q", i, got)
+		}
+		if got, want := c.recv(), fmt.Sprintf("v%d", i); got != want {
+			t.Fatalf("GET pipe_%d: got %q, want %q", i, got, want)
+		}
+	}
+
+	// 一条命令分多次写出
+	c.Write([]byte("SET pipe_split:"))
+	time.Sleep(20 * time.Millisecond)
+	c.Write([]byte("abc\nGET pipe_"))
+	time.Sleep(20 * time.Millisecond)
+	c.Write([]byte("split\n"))
+	if got := c.recv(); got != "DONE" {
+		t.Errorf("split SET: got %q", got)
+	}
+	if got := c.recv(); got != "abc" {
+		t.Errorf("split GET: got %q, want abc", got)
+	}
+}
+
+// 客户端发完命令后关闭写方向：已收到的命令全部回复后服务器才关闭连接。
+// WAIT在没有副本时等到超时才回复，之后的命令在它回复后才执行
+func testHalfClose(t *testing.T, addr string) {
+	const n = 500
+	c := dial(t, addr)
+	var lines, want []string
+	for i := 0; i < n; i++ {
+		lines = append(lines, fmt.Sprintf("SET half_%d:v%d", i, i))
+		want = append(want, "DONE")
+	}
+	lines = append(lines, "WAIT 1 200", "GET half_0", fmt.Sprintf("GET half_%d", n-1))
+	want = append(want, "0", "v0", fmt.Sprintf("v%d", n-1))
+	c.send(lines...)
+	if err := c.Conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	for i, w := range want {
+		if got := c.recv(); got != w {
+			t.Fatalf("reply %d: got %q, want %q", i, got, w)
+		}
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.reader.ReadByte(); err != io.EOF {
+		t.Errorf("after the last reply: got %v, want EOF", err)
+	}
+}
+
+// 参数长度的上限附近：上限以内的值原样返回，超过上限的命令被拒绝，连接仍可继续使用
+func testLongArg(t *testing.T, addr string) {
+	c := dial(t, addr)
+	value := strings.Repeat("x", 200)
+	c.expect("SET long:"+value, "DONE")
+	c.expect("GET long", value)
+	c.expect("SET long:"+strings.Repeat("y", 300), "wrong command")
+	c.expect("GET long", value)
+}
+
+// 以*开头的参数会被误读为多行回复的首行：被拒绝，之后流水线中的回复不错位
+func testStarValue(t *testing.T, addr string) {
+	c := dial(t, addr)
+	c.send("SET star_a:*2", "GET star_a", "PING *1", "CLIENT SETNAME *3", "SET star_b:x*", "GET star_b", "PING")
+	for _, want := range []string{
+		"values cannot start with *",
+		"key is not exits",
+		"values cannot start with *",
+		"values cannot start with *",
+		"DONE",
+		"x*",
+		"PONG",
+	} {
+		if got := c.recv(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	// 事务中同样在入队时拒绝
+	c.expect("MULTI", "DONE")
+	c.expect("SET star_c:*1", "values cannot start with *")
+	c.expect("DISCARD", "DONE")
+}
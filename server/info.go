@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+	"tinycached/server/command"
+	"tinycached/server/persistence"
+	"tinycached/utils"
+)
+
+// INFO的各段，按输出顺序排列
+var infoSections = []struct {
+	name  string
+	title string
+	fn    func(svr *CacheServer) []string
+}{
+	{"server", "Server", (*CacheServer).infoServer},
+	{"clients", "Clients", (*CacheServer).infoClients},
+	{"memory", "Memory", (*CacheServer).infoMemory},
+	{"persistence", "Persistence", (*CacheServer).infoPersistence},
+	{"stats", "Stats", (*CacheServer).infoStats},
+	{"replication", "Replication", (*CacheServer).infoReplication},
+	{"raft", "Raft", (*CacheServer).infoRaft},
+	{"keyspace", "Keyspace", (*CacheServer).infoKeyspace},
+}
+
+// 按段名生成INFO的内容，未指定段名或为all、default时返回全部段
+func (svr *CacheServer) info(sections []string) []string {
+	wanted := make(map[string]bool)
+	for _, name := range sections {
+		wanted[name] = true
+	}
+	all := len(sections) == 0 || wanted["all"] || wanted["default"]
+
+	var lines []string
+	for _, section := range infoSections {
+		if all || wanted[section.name] {
+			lines = append(lines, "# "+section.title)
+			lines = append(lines, section.fn(svr)...)
+		}
+	}
+	return lines
+}
+
+func (svr *CacheServer) infoServer() []string {
+	uptime := time.Since(svr.startTime)
+	return []string{
+		"process_id:" + fmt.Sprint(os.Getpid()),
+		"go_version:" + runtime.Version(),
+		"io_mode:" + svr.cfg.IOMode,
+		"listen:" + svr.cfg.Listen,
+		"uptime_in_seconds:" + fmt.Sprint(int64(uptime.Seconds())),
+		"uptime_in_days:" + fmt.Sprint(int64(uptime.Hours()/24)),
+		"config_file:" + svr.cfg.Path,
+	}
+}
+
+func (svr *CacheServer) infoClients() []string {
+	return []string{
+		"connected_clients:" + fmt.Sprint(svr.numClients()),
+		"maxclients:" + fmt.Sprint(svr.clientLimit()),
+	}
+}
+
+func (svr *CacheServer) infoMemory() []string {
+	stats := svr.cache.Stats()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return []string{
+		"used_memory:" + fmt.Sprint(stats.UsedBytes),
+		"used_memory_human:" + humanBytes(stats.UsedBytes),
+		"maxmemory:" + fmt.Sprint(stats.MaxBytes),
+		"maxmemory_human:" + humanBytes(stats.MaxBytes),
+		"maxmemory_policy:" + stats.Policy.String(),
+		"heap_alloc:" + fmt.Sprint(mem.HeapAlloc),
+		"heap_sys:" + fmt.Sprint(mem.HeapSys),
+	}
+}
+
+func (svr *CacheServer) infoPersistence() []string {
+	aof := persistence.AofInstance().Stats()
+	lines := []string{
+		"aof_enabled:" + boolInfo(aof.Enabled),
+		"aof_fsync:" + aof.Fsync.String(),
+		"aof_current_size:" + fmt.Sprint(aof.Size),
+		"aof_buffer_length:" + fmt.Sprint(aof.Buffered),
+	}
+	var lastFlush int64
+	if !aof.LastFlush.IsZero() {
+		lastFlush = aof.LastFlush.Unix()
+	}
+	lines = append(lines, "aof_last_flush_time:"+fmt.Sprint(lastFlush))
+	if aof.LastErr != nil {
+		lines = append(lines, "aof_last_write_status:err", "aof_last_error:"+aof.LastErr.Error())
+	} else {
+		lines = append(lines, "aof_last_write_status:ok")
+	}
+	return lines
+}
+
+func (svr *CacheServer) infoStats() []string {
+	stats := svr.cache.Stats()
+	syncStats := command.ReplSyncStats()
+	var total uint64
+	var cmdstats []string
+	for cmd := utils.CmdType(0); cmd < utils.ERROR; cmd++ {
+		if n := command.Calls(cmd); n > 0 {
+			total += n
+			cmdstats = append(cmdstats, "cmdstat_"+strings.ToLower(cmd.String())+":calls="+fmt.Sprint(n))
+		}
+	}
+	lines := []string{
+		"total_connections_received:" + fmt.Sprint(atomic.LoadUint64(&svr.totalConns)),
+		"rejected_connections:" + fmt.Sprint(atomic.LoadUint64(&svr.rejectedConns)),
+		"client_timeout_disconnections:" + fmt.Sprint(svr.timeoutDisconnections()),
+		"client_output_buffer_limit_disconnections:" + fmt.Sprint(command.OutputLimitKills()),
+		"sync_full:" + fmt.Sprint(syncStats.Full),
+		"sync_partial_ok:" + fmt.Sprint(syncStats.PartialOK),
+		"sync_partial_err:" + fmt.Sprint(syncStats.PartialErr),
+		"total_commands_processed:" + fmt.Sprint(total),
+		"keyspace_hits:" + fmt.Sprint(stats.Hits),
+		"keyspace_misses:" + fmt.Sprint(stats.Misses),
+		"evicted_keys:" + fmt.Sprint(stats.Evicted),
+		"expired_keys:" + fmt.Sprint(stats.Expired),
+	}
+	return append(lines, cmdstats...)
+}
+
+// 因空闲超时或写超时被断开的连接数
+func (svr *CacheServer) timeoutDisconnections() uint64 {
+	n := atomic.LoadUint64(&svr.timeoutConns)
+	if svr.poller != nil {
+		n += svr.poller.IdleClosed()
+	}
+	return n
+}
+
+// 自己的角色与复制状态，以及连接到自己的副本，每个副本一行
+func (svr *CacheServer) infoReplication() []string {
+	var lines []string
+	repl := command.Replication()
+	if link := svr.replicaLink(); link != nil {
+		host, port, _ := net.SplitHostPort(link.master)
+		state, lastIO := link.status()
+		lastIOAgo := int64(-1)
+		if !lastIO.IsZero() {
+			lastIOAgo = int64(time.Since(lastIO).Seconds())
+		}
+		linkStatus := "down"
+		if state == "connected" {
+			linkStatus = "up"
+		}
+		// replica-read-only可在运行时修改，加锁读取
+		readOnly, _ := svr.cfg.Params().Get("replica-read-only")
+		lines = append(lines,
+			"role:slave",
+			"master_host:"+host,
+			"master_port:"+port,
+			"master_link_status:"+linkStatus,
+			"master_last_io_seconds_ago:"+fmt.Sprint(lastIOAgo),
+			"master_sync_in_progress:"+boolInfo(state == "sync"),
+			"slave_repl_offset:"+fmt.Sprint(repl.Offset),
+			"slave_read_only:"+boolInfo(readOnly == "yes"),
+		)
+	} else {
+		lines = append(lines, "role:master")
+	}
+	replicas := command.Replicas()
+	lines = append(lines, "connected_slaves:"+fmt.Sprint(len(replicas)))
+	for i, r := range replicas {
+		lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%s,state=%s,offset=%d,lag=%d",
+			i, r.IP, r.Port, r.State, r.Offset, int64(r.Lag.Seconds())))
+	}
+	return append(lines,
+		"master_replid:"+repl.ID,
+		"master_replid2:"+replID2(repl.ID2),
+		"master_repl_offset:"+fmt.Sprint(repl.Offset),
+		"second_repl_offset:"+fmt.Sprint(repl.Offset2),
+		"repl_backlog_active:"+boolInfo(repl.BacklogActive),
+		"repl_backlog_size:"+fmt.Sprint(repl.BacklogSize),
+		"repl_backlog_first_byte_offset:"+fmt.Sprint(repl.BacklogFirstByte),
+		"repl_backlog_histlen:"+fmt.Sprint(repl.BacklogHistlen),
+	)
+}
+
+// 没有ID2时显示为40个0
+func replID2(id string) string {
+	if id == "" {
+		return strings.Repeat("0", 40)
+	}
+	return id
+}
+
+func (svr *CacheServer) infoKeyspace() []string {
+	stats := svr.cache.Stats()
+	if stats.Keys == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("db0:keys=%d,expires=%d", stats.Keys, stats.Volatile)}
+}
+
+func boolInfo(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// 以K、M、G为单位的字节数，如1.50M
+func humanBytes(n uint64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2fK", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// INFO的回复：各段标题按出现顺序，以及各字段的值
+func infoReply(c *testConn, sections string) (titles []string, fields map[string]string) {
+	c.t.Helper()
+	reply := c.do(strings.TrimSpace("INFO " + sections))
+	lines := strings.Split(reply, "\n")
+	if want := fmt.Sprintf("*%d", len(lines)-1); lines[0] != want {
+		c.t.Fatalf("INFO %s: got %q, want %s lines", sections, reply, want)
+	}
+	fields = make(map[string]string)
+	for _, line := range lines[1:] {
+		if title, ok := strings.CutPrefix(line, "# "); ok {
+			titles = append(titles, title)
+		} else if name, value, ok := strings.Cut(line, ":"); ok {
+			fields[name] = value
+		} else {
+			c.t.Fatalf("INFO %s: bad line %q", sections, line)
+		}
+	}
+	return titles, fields
+}
+
+// 不带参数或为all、default时按固定顺序返回全部段，指定段名时只返回这些段
+func TestInfoSections(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.addr)
+
+	all := []string{"Server", "Clients", "Memory", "Persistence", "Stats", "Replication", "Raft", "Keyspace"}
+	for _, sections := range []string{"", "all", "default", "ALL"} {
+		if titles, _ := infoReply(c, sections); !reflect.DeepEqual(titles, all) {
+			t.Errorf("INFO %s: sections %v, want %v", sections, titles, all)
+		}
+	}
+
+	titles, fields := infoReply(c, "clients")
+	if !reflect.DeepEqual(titles, []string{"Clients"}) {
+		t.Errorf("INFO clients: sections %v", titles)
+	}
+	if _, ok := fields["used_memory"]; ok {
+		t.Errorf("INFO clients: got memory fields %v", fields)
+	}
+	// 按固定顺序输出，与参数的顺序无关；未知的段名忽略
+	titles, _ = infoReply(c, "keyspace server nosuch")
+	if !reflect.DeepEqual(titles, []string{"Server", "Keyspace"}) {
+		t.Errorf("INFO keyspace server nosuch: sections %v", titles)
+	}
+	c.expect("INFO nosuch", "*0")
+}
+
+// 各段的字段反映服务器的配置与运行状态
+func TestInfoFields(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tinycached.conf")
+	if err := os.WriteFile(path, []byte("maxmemory 64mb\nmaxclients 50\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := startServerIn(t, dir, freeAddr(t), "-config", path)
+	c := dial(t, s.addr)
+
+	_, fields := infoReply(c, "server")
+	for name, want := range map[string]string{
+		"process_id":  fmt.Sprint(s.cmd.Process.Pid),
+		"listen":      s.addr,
+		"config_file": path,
+	} {
+		if fields[name] != want {
+			t.Errorf("%s: got %q, want %q", name, fields[name], want)
+		}
+	}
+
+	waitFor(t, "probe connection to close", func() bool { return infoField(c, "clients", "connected_clients") == "1" })
+	c2 := dial(t, s.addr)
+	c2.expect("PING", "PONG")
+	_, fields = infoReply(c, "clients memory")
+	for name, want := range map[string]string{
+		"connected_clients": "2",
+		"maxclients":        "50",
+		"maxmemory":         fmt.Sprint(64 << 20),
+		"maxmemory_human":   "64.00M",
+		"maxmemory_policy":  "allkeys-lru",
+	} {
+		if fields[name] != want {
+			t.Errorf("%s: got %q, want %q", name, fields[name], want)
+		}
+	}
+
+	// 没有key时keyspace段为空
+	_, fields = infoReply(c, "keyspace")
+	if len(fields) != 0 {
+		t.Errorf("empty keyspace: %v", fields)
+	}
+	c.expect("SET info_a:1", "DONE")
+	c.expect("SET info_b:2", "DONE")
+	c.expect("EXPR info_b:60000", "DONE")
+	c.expect("GET info_a", "1")
+	c.expect("GET info_a", "1")
+	c.expect("GET info_c", "key is not exits")
+	_, fields = infoReply(c, "stats keyspace")
+	for name, want := range map[string]string{
+		"keyspace_hits":   "2",
+		"keyspace_misses": "1",
+		"cmdstat_set":     "calls=2",
+		"cmdstat_get":     "calls=3",
+		"cmdstat_expr":    "calls=1",
+		"db0":             "keys=2,expires=1",
+	} {
+		if fields[name] != want {
+			t.Errorf("%s: got %q, want %q", name, fields[name], want)
+		}
+	}
+	if _, ok := fields["cmdstat_del"]; ok {
+		t.Errorf("cmdstat_del listed without calls")
+	}
+}
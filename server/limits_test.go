@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 接收缓冲区很小的连接，不读取时服务器很快写不出去
+func dialSmallBuffer(t *testing.T, addr string) *testConn {
+	t.Helper()
+	d := net.Dialer{Timeout: time.Second, Control: func(network, address string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 4096)
+		})
+	}}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+/*
+ * 在后台不断写入长key，产生大量键空间事件，直到返回的函数被调用。
+ * 写入的连接读取全部回复，不受慢订阅者影响
+ */
+func publishEvents(t *testing.T, addr string) (stop func()) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		reader := bufio.NewReader(conn)
+		for {
+			if _, err := reader.ReadSlice('\n'); err != nil {
+				return
+			}
+		}
+	}()
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		var batch strings.Builder
+		key := strings.Repeat("k", 200)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			batch.Reset()
+			for j := 0; j < 100; j++ {
+				fmt.Fprintf(&batch, "SET %s%d:1\n", key, j)
+			}
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte(batch.String())); err != nil {
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+		conn.Close()
+	}
+}
+
+// 超过maxclients的连接收到错误后被关闭；有连接断开后可以再连接
+func TestMaxClients(t *testing.T) {
+	s := startServer(t, "-maxclients", "2")
+	// 等待startServer探测用的连接关闭
+	a := dial(t, s.addr)
+	waitFor(t, "the probe connection to close", func() bool { return infoField(a, "clients", "connected_clients") == "1" })
+	b := dial(t, s.addr)
+	b.expect("PING", "PONG")
+
+	c := dial(t, s.addr)
+	c.expect("PING", "max number of clients reached")
+	expectClosed(c)
+	if got := infoField(a, "stats", "rejected_connections"); got != "1" {
+		t.Errorf("rejected_connections:%s, want 1", got)
+	}
+
+	b.Close()
+	waitFor(t, "a free slot", func() bool { return infoField(a, "clients", "connected_clients") == "1" })
+	dial(t, s.addr).expect("PING", "PONG")
+
+	// 运行时调大后立即生效
+	a.expect("CONFIG SET maxclients 3", "DONE")
+	dial(t, s.addr).expect("PING", "PONG")
+}
+
+// 客户端不读取回复时，写出在write-timeout后失败，连接被关闭
+func TestWriteTimeout(t *testing.T) {
+	s := startServer(t, "-write-timeout", "200ms")
+	admin := dial(t, s.addr)
+	admin.expect("SET wt_a:"+strings.Repeat("v", 250), "DONE")
+
+	c := dialSmallBuffer(t, s.addr)
+	go func() {
+		batch := []byte(strings.Repeat("GET wt_a\n", 1000))
+		for {
+			c.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if _, err := c.Write(batch); err != nil {
+				return
+			}
+		}
+	}()
+	waitFor(t, "the stalled client to be disconnected", func() bool {
+		return infoField(admin, "stats", "client_timeout_disconnections") == "1"
+	})
+	if !strings.Contains(s.log.String(), "closed for write timeout") {
+		t.Errorf("no write timeout in the log:\n%s", s.log)
+	}
+	waitFor(t, "the stalled client to leave CLIENT LIST", func() bool { return len(clientList(admin)) == 1 })
+	admin.expect("GET wt_a", strings.Repeat("v", 250))
+}
+
+// 不读取推送的订阅者超过pubsub类的hard限制时被断开，发布方与其他订阅者不受影响
+func TestPubSubOutputLimit(t *testing.T) {
+	s := startServer(t, "-notify-keyspace-events", "KEA", "-client-output-buffer-limit", "pubsub 16kb 0 0")
+	admin := dial(t, s.addr)
+	slow := dialSmallBuffer(t, s.addr)
+	slow.expect("PSUBSCRIBE __key*", "DONE")
+	fast := dial(t, s.addr)
+	fast.expect("SUBSCRIBE __keyevent@0__:del", "DONE")
+
+	stop := publishEvents(t, s.addr)
+	waitFor(t, "the slow subscriber to be disconnected", func() bool {
+		return infoField(admin, "stats", "client_output_buffer_limit_disconnections") == "1"
+	})
+	stop()
+	expectClosed(slow)
+	if !strings.Contains(s.log.String(), "closed for overcoming of output buffer limits") {
+		t.Errorf("no output buffer limit in the log:\n%s", s.log)
+	}
+
+	// 其余订阅者照常收到推送
+	admin.expect("SET ol_a:1", "DONE")
+	admin.expect("DEL ol_a", "DONE")
+	if got := fast.recv(); got != "MESSAGE __keyevent@0__:del ol_a" {
+		t.Errorf("other subscriber got %q", got)
+	}
+	for _, line := range strings.Split(admin.do("CLIENT LIST"), "\n")[1:] {
+		if strings.Contains(line, "addr="+slow.LocalAddr().String()) {
+			t.Errorf("disconnected subscriber still listed: %s", line)
+		}
+	}
+}
+
+// 超过soft限制持续soft秒数后才断开
+func TestPubSubSoftLimit(t *testing.T) {
+	s := startServer(t, "-notify-keyspace-events", "KEA", "-client-output-buffer-limit", "pubsub 0 16kb 1")
+	admin := dial(t, s.addr)
+	slow := dialSmallBuffer(t, s.addr)
+	slow.expect("PSUBSCRIBE __key*", "DONE")
+
+	start := time.Now()
+	stop := publishEvents(t, s.addr)
+	defer stop()
+	waitFor(t, "the slow subscriber to be disconnected", func() bool {
+		return infoField(admin, "stats", "client_output_buffer_limit_disconnections") == "1"
+	})
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("disconnected after %v, want at least the 1s soft limit", d)
+	}
+	expectClosed(slow)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+	"tinycached/server/command"
+	"tinycached/server/persistence"
+	"tinycached/utils"
+	"tinycached/utils/metrics"
+)
+
+// 开启Prometheus指标的HTTP监听，addr为空时不开启
+func (svr *CacheServer) startMetrics(addr string) (err error) {
+	if addr == "" {
+		return nil
+	}
+	svr.metrics, err = metrics.Serve(addr, svr.collectMetrics)
+	return err
+}
+
+func (svr *CacheServer) collectMetrics(w *metrics.Writer) {
+	w.Gauge("tinycached_uptime_seconds", "Seconds since the server started.", time.Since(svr.startTime).Seconds())
+
+	// 连接
+	w.Gauge("tinycached_connected_clients", "Number of client connections.", float64(svr.numClients()))
+	w.Gauge("tinycached_max_clients", "Maximum number of client connections.", float64(svr.clientLimit()))
+	w.Counter("tinycached_connections_received_total", "Total number of accepted connections.",
+		atomic.LoadUint64(&svr.totalConns))
+	w.Counter("tinycached_rejected_connections_total", "Connections rejected because of maxclients.",
+		atomic.LoadUint64(&svr.rejectedConns))
+	w.Counter("tinycached_client_disconnections_total", "Connections closed by the server.",
+		svr.timeoutDisconnections(), metrics.L("reason", "timeout"))
+	w.Counter("tinycached_client_disconnections_total", "Connections closed by the server.",
+		command.OutputLimitKills(), metrics.L("reason", "output_buffer_limit"))
+
+	// 命令
+	for cmd := utils.CmdType(0); cmd < utils.ERROR; cmd++ {
+		w.Counter("tinycached_commands_total", "Total number of commands processed.",
+			command.Calls(cmd), metrics.L("cmd", strings.ToLower(cmd.String())))
+	}
+	for cmd := utils.CmdType(0); cmd < utils.ERROR; cmd++ {
+		w.Histogram("tinycached_command_duration_seconds", "Command execution time.",
+			command.Latency(cmd), metrics.L("cmd", strings.ToLower(cmd.String())))
+	}
+
+	// 缓存
+	stats := svr.cache.Stats()
+	w.Counter("tinycached_keyspace_hits_total", "Number of successful key lookups.", stats.Hits)
+	w.Counter("tinycached_keyspace_misses_total", "Number of failed key lookups.", stats.Misses)
+	var ratio float64
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		ratio = float64(stats.Hits) / float64(lookups)
+	}
+	w.Gauge("tinycached_keyspace_hit_ratio", "Ratio of successful key lookups since start.", ratio)
+	w.Gauge("tinycached_keys", "Number of keys.", float64(stats.Keys))
+	w.Gauge("tinycached_expiring_keys", "Number of keys with an expire set.", float64(stats.Volatile))
+	w.Gauge("tinycached_memory_used_bytes", "Bytes used by cache entries.", float64(stats.UsedBytes))
+	w.Gauge("tinycached_memory_max_bytes", "Configured maxmemory.", float64(stats.MaxBytes))
+	w.Counter("tinycached_evicted_keys_total", "Keys evicted because of maxmemory.", stats.Evicted)
+	w.Counter("tinycached_expired_keys_total", "Keys removed because their TTL elapsed.", stats.Expired)
+
+	// AOF
+	aof := persistence.AofInstance()
+	aofStats := aof.Stats()
+	var enabled float64
+	if aofStats.Enabled {
+		enabled = 1
+	}
+	w.Gauge("tinycached_aof_enabled", "Whether AOF persistence is enabled.", enabled)
+	w.Gauge("tinycached_aof_size_bytes", "Current AOF file size.", float64(aofStats.Size))
+	w.Gauge("tinycached_aof_buffer_bytes", "Bytes buffered but not yet written to the AOF file.", float64(aofStats.Buffered))
+	var lastFlush float64
+	if !aofStats.LastFlush.IsZero() {
+		lastFlush = float64(aofStats.LastFlush.UnixNano()) / 1e9
+	}
+	w.Gauge("tinycached_aof_last_flush_timestamp_seconds", "Time of the last successful AOF write.", lastFlush)
+	w.Counter("tinycached_aof_errors_total", "Failed AOF writes and fsyncs.", aofStats.Errors)
+	w.Histogram("tinycached_aof_flush_duration_seconds", "Time spent writing and syncing the AOF.", aof.FlushLatency())
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var monitorLine = regexp.MustCompile(`^(\d+)\.\d{6} \[0 ([^\]]+)\] (.*)$`)
+
+// 读取一条MONITOR推送，返回客户端地址与命令
+func (c *testConn) monitored() (addr string, cmd string) {
+	c.t.Helper()
+	line := c.recv()
+	m := monitorLine.FindStringSubmatch(line)
+	if m == nil {
+		c.t.Fatalf("bad MONITOR line %q", line)
+	}
+	return m[2], m[3]
+}
+
+// 依次收到want中的命令，每条都来自from
+func (c *testConn) expectMonitored(from *testConn, want ...string) {
+	c.t.Helper()
+	for _, w := range want {
+		addr, cmd := c.monitored()
+		if addr != from.LocalAddr().String() || cmd != w {
+			c.t.Errorf("monitor got %q from %s, want %q from %s", cmd, addr, w, from.LocalAddr())
+		}
+	}
+}
+
+// MONITOR收到其他客户端执行的命令，带客户端地址；密码被隐去
+func TestMonitor(t *testing.T) {
+	s := startServer(t, "-requirepass", "secret")
+	mon := login(t, s.addr, "default", "secret")
+	start := time.Now().Unix()
+	mon.expect("MONITOR", "DONE")
+	other := login(t, s.addr, "default", "secret")
+	other.expect("MONITOR", "DONE")
+	// MONITOR本身不推送
+	mon.expectMonitored(other, "AUTH (redacted)")
+
+	c := dial(t, s.addr)
+	c.expect("AUTH default secret", "DONE")
+	c.expect("SET mon_a:1", "DONE")
+	c.expect("GET mon_a", "1")
+	c.expect("GET mon_missing", "key is not exits")
+	c.expect("DEL mon_a", "DONE")
+	c.expect("PING", "PONG")
+	want := []string{"AUTH (redacted)", "SET mon_a:1", "GET mon_a", "GET mon_missing", "DEL mon_a", "PING"}
+	mon.expectMonitored(c, want...)
+	other.expectMonitored(c, want...)
+
+	// 多个客户端的命令按执行顺序推送；权限检查未通过的命令不推送
+	d := dial(t, s.addr)
+	d.expect("GET mon_b", "NOAUTH Authentication required.")
+	c.expect("ACL SETUSER u on >pw allkeys +@all", "DONE")
+	c.expect("CONFIG SET requirepass newpass", "DONE")
+	d.expect("AUTH newpass", "DONE")
+	mon.expectMonitored(c, "ACL SETUSER u (redacted)", "CONFIG SET requirepass (redacted)")
+	mon.expectMonitored(d, "AUTH (redacted)")
+
+	// ASUSER推送内层执行的命令
+	c.expect("ASUSER u SET mon_c:1", "DONE")
+	mon.expectMonitored(c, "SET mon_c:1")
+
+	// 时间戳为执行时间
+	c.expect("PING", "PONG")
+	line := mon.recv()
+	m := monitorLine.FindStringSubmatch(line)
+	if m == nil {
+		t.Fatalf("bad MONITOR line %q", line)
+	}
+	if sec, _ := strconv.ParseInt(m[1], 10, 64); sec < start || sec > time.Now().Unix() {
+		t.Errorf("timestamp in %q not between %d and now", line, start)
+	}
+
+	// 断开后不再推送，其余监视端不受影响
+	other.Close()
+	c.expect("SET mon_d:1", "DONE")
+	mon.expectMonitored(c, "SET mon_d:1")
+}
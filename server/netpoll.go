@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"tinycached/server/command"
+	"tinycached/server/netpoll"
+	"tinycached/utils"
+)
+
+// 事件循环模式下，单个连接积压的推送数据上限，超出后丢弃推送消息
+const maxPushBuffered = 1 << 20
+
+// 回复缓冲池：一次收到的数据中的全部命令执行完后，回复一起写出
+var replyBufPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+type netpollHandler struct {
+	svr *CacheServer
+}
+
+func (h *netpollHandler) OnOpen(c *netpoll.Conn) {
+	atomic.AddUint64(&h.svr.totalConns, 1)
+	var clt *command.CacheClientInfo
+	clt = command.NewPushClient(h.svr.cache, func(msg []byte) bool {
+		// 复制流不能丢弃，积压由client-output-buffer-limit中replica类的限制约束
+		if c.Buffered() > maxPushBuffered && !clt.IsReplica() {
+			return false
+		}
+		return c.Write(msg) == nil
+	})
+	c.Context = &session{clt: clt, parser: utils.NewParser()}
+	// 新连接尚未计入NumConns
+	if h.svr.numClients() >= h.svr.clientLimit() {
+		atomic.AddUint64(&h.svr.rejectedConns, 1)
+		c.Write(errMaxClients)
+		c.Close()
+		return
+	}
+	addr := ""
+	if remote := c.RemoteAddr(); remote != nil {
+		addr = remote.String()
+	}
+	// 收到的数据在OnData中全部解析完，读缓冲区中没有积压
+	clt.Register(addr, func() { c.Close() }, func() (int, int) { return 0, c.Buffered() })
+}
+
+func (h *netpollHandler) OnData(c *netpoll.Conn, data []byte) {
+	s := c.Context.(*session)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.blocked {
+		s.pending = append(s.pending, data...)
+		return
+	}
+	h.process(c, s, data)
+}
+
+/*
+ * 在持有s.mutex时调用：执行data中的命令并写出回复。
+ * 遇到WAIT时先写出之前的回复，WAIT在单独的协程中执行，不阻塞事件循环；
+ * 之后的数据与WAIT期间收到的数据在WAIT回复后继续处理，回复的顺序与命令一致
+ */
+func (h *netpollHandler) process(c *netpoll.Conn, s *session, data []byte) {
+	out := replyBufPool.Get().(*bytes.Buffer)
+	defer replyBufPool.Put(out)
+
+	out.Reset()
+	for i, b := range data {
+		cmd, args, done := s.parser.Feed(b)
+		if !done {
+			continue
+		}
+		if cmd == utils.WAIT {
+			s.blocked = true
+			s.pending = append([]byte(nil), data[i+1:]...)
+			// 客户端发完命令后半关闭时，等WAIT及之后的命令回复后再关闭连接
+			c.Hold()
+			go h.wait(c, s, args)
+			break
+		}
+		s.exec(cmd, args, out)
+	}
+	if out.Len() > 0 {
+		if err := c.Write(out.Bytes()); err != nil {
+			c.Close()
+			return
+		}
+		s.clt.CheckOutputLimit()
+	}
+	// 回复写入发送缓冲区后才开始推送复制流；副本只接收复制流，不受空闲超时限制
+	if s.clt.IsReplica() {
+		c.DisableIdleTimeout()
+		s.clt.AfterReply()
+	}
+}
+
+func (h *netpollHandler) wait(c *netpoll.Conn, s *session, args []string) {
+	defer c.Release()
+	ret := s.execBuffered(utils.WAIT, args)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := c.Write(ret); err != nil {
+		c.Close()
+		return
+	}
+	s.blocked = false
+	pending := s.pending
+	s.pending = nil
+	h.process(c, s, pending)
+}
+
+func (h *netpollHandler) OnClose(c *netpoll.Conn) {
+	c.Context.(*session).clt.Close()
+}
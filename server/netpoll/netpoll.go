@@ -0,0 +1,45 @@
+// 基于epoll的事件循环网络模型：少量事件循环处理全部连接，读缓冲区由事件循环共用，
+// 写缓冲区只在一次写不完时才从缓冲池中取出，适合大量空闲连接的场景
+package netpoll
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrClosed      = errors.New("netpoll: connection closed")
+	ErrUnsupported = errors.New("netpoll: only supported on linux")
+)
+
+// 连接事件回调
+type Handler interface {
+	// 接受连接后、开始读取数据前调用；在其中关闭连接表示拒绝该连接
+	OnOpen(c *Conn)
+	// 在连接所属的事件循环协程中调用，data只在本次调用中有效
+	OnData(c *Conn, data []byte)
+	// 在关闭连接的协程中调用，每个连接只调用一次
+	OnClose(c *Conn)
+}
+
+// 写缓冲池
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 4096)
+		return &buf
+	},
+}
+
+// 超过此大小的缓冲区不放回缓冲池，避免缓冲池占用过多内存
+const maxPooledBufSize = 64 << 10
+
+func getBuf() []byte {
+	return (*bufPool.Get().(*[]byte))[:0]
+}
+
+func putBuf(buf []byte) {
+	if cap(buf) > maxPooledBufSize {
+		return
+	}
+	bufPool.Put(&buf)
+}
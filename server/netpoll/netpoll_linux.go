@@ -0,0 +1,536 @@
+//go:build linux
+
+package netpoll
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type Conn struct {
+	fd         int
+	loop       *eventLoop
+	remote     net.Addr
+	mutex      sync.Mutex
+	out        []byte // 尚未写出的数据
+	closed     bool
+	eof        bool        // 对端关闭了写方向，不再读取，尚未写出的数据写完后关闭
+	holds      int         // Hold的次数，不为0时半关闭的连接写完数据后仍不关闭
+	lastActive int64       // 最近一次收到数据的时间，unix纳秒
+	noIdle     int32       // 不因空闲超时关闭，原子操作
+	Context    interface{} // 由Handler保存的会话
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// 非阻塞写：写不完的部分缓存起来，待连接可写时由事件循环继续写出；可在任意协程中调用
+func (c *Conn) Write(b []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+	if len(c.out) > 0 {
+		c.out = append(c.out, b...)
+		return nil
+	}
+	n, err := writeFd(c.fd, b)
+	if err != nil {
+		return err
+	}
+	if n == len(b) {
+		return nil
+	}
+	c.out = append(getBuf(), b[n:]...)
+	return c.loop.modify(c.fd, c.events())
+}
+
+// 连接关注的事件：半关闭后不再读取，有待写出的数据时关注可写；调用方持有mutex
+func (c *Conn) events() uint32 {
+	var events uint32
+	if !c.eof {
+		events = syscall.EPOLLIN | syscall.EPOLLRDHUP
+	}
+	if len(c.out) > 0 {
+		events |= syscall.EPOLLOUT
+	}
+	return events
+}
+
+// 半关闭的连接是否已写完全部数据，可以关闭；调用方持有mutex
+func (c *Conn) drained() bool {
+	return c.eof && len(c.out) == 0 && c.holds == 0
+}
+
+// 之后还有数据要写出，如在其他协程中执行的命令的回复：对端半关闭后等到Release再关闭
+func (c *Conn) Hold() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.holds++
+}
+
+func (c *Conn) Release() {
+	c.mutex.Lock()
+	c.holds--
+	closing := !c.closed && c.drained()
+	c.mutex.Unlock()
+
+	if closing {
+		c.Close()
+	}
+}
+
+// 对端关闭了写方向：停止读取，写完尚未写出的数据后关闭。已经半关闭时返回false
+func (c *Conn) shutdownRead() bool {
+	c.mutex.Lock()
+	if c.closed || c.eof {
+		c.mutex.Unlock()
+		return false
+	}
+	c.eof = true
+	closing := c.drained()
+	if !closing {
+		c.loop.modify(c.fd, c.events())
+	}
+	c.mutex.Unlock()
+
+	if closing {
+		c.Close()
+	}
+	return true
+}
+
+func (c *Conn) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.closed
+}
+
+// 之后不再因空闲超时关闭该连接，用于只接收数据的连接
+func (c *Conn) DisableIdleTimeout() {
+	atomic.StoreInt32(&c.noIdle, 1)
+}
+
+// 尚未写出的字节数
+func (c *Conn) Buffered() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.out)
+}
+
+// 连接可写时继续写出缓存的数据；半关闭的连接写完后关闭
+func (c *Conn) flush() error {
+	c.mutex.Lock()
+	if c.closed || len(c.out) == 0 {
+		c.mutex.Unlock()
+		return nil
+	}
+	n, err := writeFd(c.fd, c.out)
+	if err != nil {
+		c.mutex.Unlock()
+		return err
+	}
+	c.out = c.out[:copy(c.out, c.out[n:])]
+	if len(c.out) > 0 {
+		c.mutex.Unlock()
+		return nil
+	}
+	putBuf(c.out)
+	c.out = nil
+	if c.drained() {
+		c.mutex.Unlock()
+		c.Close()
+		return nil
+	}
+	err = c.loop.modify(c.fd, c.events())
+	c.mutex.Unlock()
+	return err
+}
+
+// 关闭连接，可在任意协程中调用
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return ErrClosed
+	}
+	c.closed = true
+	if c.out != nil {
+		putBuf(c.out)
+		c.out = nil
+	}
+	c.mutex.Unlock()
+
+	c.loop.remove(c)
+	c.loop.srv.handler.OnClose(c)
+	return nil
+}
+
+// 非阻塞写，返回已写出的字节数；内核缓冲区满时返回已写部分且不报错
+func writeFd(fd int, b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := syscall.Write(fd, b[written:])
+		if err == syscall.EINTR {
+			continue
+		} else if err == syscall.EAGAIN {
+			break
+		} else if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+type Server struct {
+	listenFd    int
+	loops       []*eventLoop
+	handler     Handler
+	next        uint32 // 轮询分配新连接
+	closing     int32
+	idleTimeout int64  // 空闲超时，纳秒，0表示不超时
+	idleClosed  uint64 // 因空闲超时关闭的连接数
+	wg          sync.WaitGroup
+}
+
+// 监听addr，nloops为事件循环数
+func Listen(addr string, nloops int, handler Handler) (*Server, error) {
+	fd, err := listenTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &Server{listenFd: fd, handler: handler}
+	for i := 0; i < nloops; i++ {
+		loop, err := newEventLoop(srv)
+		if err != nil {
+			srv.closeLoops()
+			syscall.Close(fd)
+			return nil, err
+		}
+		srv.loops = append(srv.loops, loop)
+	}
+	// 监听socket由第一个事件循环处理
+	if err := srv.loops[0].add(fd, syscall.EPOLLIN); err != nil {
+		srv.closeLoops()
+		syscall.Close(fd)
+		return nil, err
+	}
+	return srv, nil
+}
+
+func listenTCP(addr string) (int, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return -1, err
+	}
+	var sa syscall.Sockaddr
+	family := syscall.AF_INET
+	if ip4 := tcpAddr.IP.To4(); tcpAddr.IP == nil || ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: tcpAddr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		family = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: tcpAddr.Port}
+		copy(sa6.Addr[:], tcpAddr.IP.To16())
+		sa = sa6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err == nil {
+		if err = syscall.Bind(fd, sa); err == nil {
+			err = syscall.Listen(fd, syscall.SOMAXCONN)
+		}
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return -1, &net.OpError{Op: "listen", Net: "tcp", Addr: tcpAddr, Err: err}
+	}
+	return fd, nil
+}
+
+func (srv *Server) SetIdleTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&srv.idleTimeout, int64(timeout))
+}
+
+// 因空闲超时关闭的连接数
+func (srv *Server) IdleClosed() uint64 {
+	return atomic.LoadUint64(&srv.idleClosed)
+}
+
+// 运行全部事件循环，直至Close后全部连接关闭
+func (srv *Server) Serve() {
+	for _, loop := range srv.loops {
+		srv.wg.Add(1)
+		go loop.run()
+	}
+	srv.wg.Wait()
+	srv.closeLoops()
+}
+
+// 停止接受新连接，各事件循环处理完当前批次的数据后关闭全部连接并退出
+func (srv *Server) Close() {
+	if !atomic.CompareAndSwapInt32(&srv.closing, 0, 1) {
+		return
+	}
+	syscall.Close(srv.listenFd)
+	for _, loop := range srv.loops {
+		loop.wake()
+	}
+}
+
+func (srv *Server) closeLoops() {
+	for _, loop := range srv.loops {
+		syscall.Close(loop.epfd)
+		syscall.Close(loop.wakeR)
+		syscall.Close(loop.wakeW)
+	}
+}
+
+// 当前连接数
+func (srv *Server) NumConns() int {
+	n := 0
+	for _, loop := range srv.loops {
+		loop.mutex.Lock()
+		n += len(loop.conns)
+		loop.mutex.Unlock()
+	}
+	return n
+}
+
+type eventLoop struct {
+	srv          *Server
+	epfd         int
+	wakeR, wakeW int // 用于唤醒阻塞在epoll_wait上的事件循环
+	mutex        sync.Mutex
+	conns        map[int]*Conn
+	buf          []byte // 本事件循环全部连接共用的读缓冲区
+}
+
+func newEventLoop(srv *Server) (*eventLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	loop := &eventLoop{
+		srv:   srv,
+		epfd:  epfd,
+		wakeR: p[0],
+		wakeW: p[1],
+		conns: make(map[int]*Conn),
+		buf:   make([]byte, 64<<10),
+	}
+	if err := loop.add(loop.wakeR, syscall.EPOLLIN); err != nil {
+		syscall.Close(epfd)
+		syscall.Close(p[0])
+		syscall.Close(p[1])
+		return nil, err
+	}
+	return loop, nil
+}
+
+func (loop *eventLoop) add(fd int, events uint32) error {
+	return syscall.EpollCtl(loop.epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: events, Fd: int32(fd)})
+}
+
+func (loop *eventLoop) modify(fd int, events uint32) error {
+	return syscall.EpollCtl(loop.epfd, syscall.EPOLL_CTL_MOD, fd, &syscall.EpollEvent{Events: events, Fd: int32(fd)})
+}
+
+func (loop *eventLoop) wake() {
+	syscall.Write(loop.wakeW, []byte{0})
+}
+
+func (loop *eventLoop) register(c *Conn) error {
+	loop.mutex.Lock()
+	loop.conns[c.fd] = c
+	loop.mutex.Unlock()
+
+	if err := loop.add(c.fd, syscall.EPOLLIN|syscall.EPOLLRDHUP); err != nil {
+		loop.mutex.Lock()
+		delete(loop.conns, c.fd)
+		loop.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (loop *eventLoop) remove(c *Conn) {
+	loop.mutex.Lock()
+	if loop.conns[c.fd] == c {
+		delete(loop.conns, c.fd)
+	}
+	loop.mutex.Unlock()
+
+	syscall.EpollCtl(loop.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+	syscall.Close(c.fd)
+}
+
+func (loop *eventLoop) conn(fd int) *Conn {
+	loop.mutex.Lock()
+	defer loop.mutex.Unlock()
+
+	return loop.conns[fd]
+}
+
+func (loop *eventLoop) run() {
+	defer loop.srv.wg.Done()
+
+	events := make([]syscall.EpollEvent, 128)
+	lastCheck := time.Now()
+	for atomic.LoadInt32(&loop.srv.closing) == 0 {
+		n, err := syscall.EpollWait(loop.epfd, events, 1000)
+		if err != nil && err != syscall.EINTR {
+			break
+		}
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			switch {
+			case fd == loop.wakeR:
+				loop.drainWake()
+			case fd == loop.srv.listenFd:
+				loop.accept()
+			default:
+				if c := loop.conn(fd); c != nil {
+					loop.handle(c, events[i].Events)
+				}
+			}
+		}
+		// 每秒检查一次空闲超时
+		if now := time.Now(); now.Sub(lastCheck) >= time.Second {
+			loop.closeIdle(now)
+			lastCheck = now
+		}
+	}
+	loop.closeAll()
+}
+
+func (loop *eventLoop) drainWake() {
+	buf := make([]byte, 64)
+	for {
+		if n, err := syscall.Read(loop.wakeR, buf); n <= 0 || err != nil {
+			return
+		}
+	}
+}
+
+func (loop *eventLoop) accept() {
+	for {
+		fd, sa, err := syscall.Accept4(loop.srv.listenFd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+		if err == syscall.EINTR || err == syscall.ECONNABORTED {
+			continue
+		} else if err != nil {
+			// EAGAIN：已没有待接受的连接
+			return
+		}
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
+
+		srv := loop.srv
+		target := srv.loops[atomic.AddUint32(&srv.next, 1)%uint32(len(srv.loops))]
+		c := &Conn{fd: fd, loop: target, remote: toAddr(sa), lastActive: time.Now().UnixNano()}
+		srv.handler.OnOpen(c)
+		if c.isClosed() {
+			continue
+		}
+		if err := target.register(c); err != nil {
+			c.Close()
+		}
+	}
+}
+
+func toAddr(sa syscall.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		zone := ""
+		if sa.ZoneId != 0 {
+			zone = strconv.Itoa(int(sa.ZoneId))
+		}
+		return &net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port, Zone: zone}
+	default:
+		return nil
+	}
+}
+
+func (loop *eventLoop) handle(c *Conn, events uint32) {
+	if events&syscall.EPOLLOUT != 0 {
+		if err := c.flush(); err != nil {
+			c.Close()
+			return
+		}
+	}
+	if events&(syscall.EPOLLIN|syscall.EPOLLRDHUP|syscall.EPOLLHUP|syscall.EPOLLERR) == 0 {
+		return
+	}
+	n, err := syscall.Read(c.fd, loop.buf)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return
+	}
+	if err != nil {
+		c.Close()
+		return
+	}
+	if n == 0 {
+		// 对端关闭了写方向（如流水线发完命令后shutdown）：回复仍要写出，与协程模式一致。
+		// 半关闭后只会因可写、出错或对端完全关闭而收到事件，后两种直接关闭
+		if !c.shutdownRead() {
+			c.Close()
+		}
+		return
+	}
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	loop.srv.handler.OnData(c, loop.buf[:n])
+}
+
+func (loop *eventLoop) snapshotConns() []*Conn {
+	loop.mutex.Lock()
+	defer loop.mutex.Unlock()
+
+	conns := make([]*Conn, 0, len(loop.conns))
+	for _, c := range loop.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (loop *eventLoop) closeIdle(now time.Time) {
+	timeout := atomic.LoadInt64(&loop.srv.idleTimeout)
+	if timeout <= 0 {
+		return
+	}
+	for _, c := range loop.snapshotConns() {
+		if atomic.LoadInt32(&c.noIdle) == 1 {
+			continue
+		}
+		if now.UnixNano()-atomic.LoadInt64(&c.lastActive) > timeout && c.Close() == nil {
+			atomic.AddUint64(&loop.srv.idleClosed, 1)
+		}
+	}
+}
+
+func (loop *eventLoop) closeAll() {
+	for _, c := range loop.snapshotConns() {
+		// 尽量写出尚未发出的回复
+		c.flush()
+		c.Close()
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+
+package netpoll
+
+import (
+	"net"
+	"time"
+)
+
+type Conn struct {
+	Context interface{}
+}
+
+func (c *Conn) RemoteAddr() net.Addr { return nil }
+func (c *Conn) Write(b []byte) error { return ErrUnsupported }
+func (c *Conn) Buffered() int        { return 0 }
+func (c *Conn) Close() error         { return ErrUnsupported }
+func (c *Conn) DisableIdleTimeout()  {}
+func (c *Conn) Hold()                {}
+func (c *Conn) Release()             {}
+
+type Server struct{}
+
+func Listen(addr string, nloops int, handler Handler) (*Server, error) {
+	return nil, ErrUnsupported
+}
+
+func (srv *Server) SetIdleTimeout(timeout time.Duration) {}
+func (srv *Server) Serve()                               {}
+func (srv *Server) Close()                               {}
+func (srv *Server) NumConns() int                        { return 0 }
+func (srv *Server) IdleClosed() uint64                   { return 0 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// 读取一条推送，返回"频道 消息"
+func (c *testConn) event() string {
+	c.t.Helper()
+	msg := c.recv()
+	if rest, ok := strings.CutPrefix(msg, "PMESSAGE __key* "); ok {
+		return rest
+	}
+	c.t.Fatalf("unexpected push %q", msg)
+	return ""
+}
+
+// 依次收到want中的推送
+func (c *testConn) expectEvents(want ...string) {
+	c.t.Helper()
+	for _, w := range want {
+		if got := c.event(); got != w {
+			c.t.Errorf("got event %q, want %q", got, w)
+		}
+	}
+}
+
+// 写入、删除、修改过期时间、过期与淘汰都发布到两类频道
+func TestKeyspaceEvents(t *testing.T) {
+	s := startServer(t, "-notify-keyspace-events", "KEA")
+	sub := dial(t, s.addr)
+	sub.expect("PSUBSCRIBE __key*", "DONE")
+	c := dial(t, s.addr)
+
+	c.expect("SET n_a:1", "DONE")
+	c.expect("DEL n_a", "DONE")
+	sub.expectEvents(
+		"__keyspace@0__:n_a set", "__keyevent@0__:set n_a",
+		"__keyspace@0__:n_a del", "__keyevent@0__:del n_a",
+	)
+	// 删除不存在的key不产生事件
+	c.expect("DEL n_a", "DONE")
+
+	// 没有被读取的key同样由定期抽查删除
+	c.expect("SET n_b:1", "DONE")
+	c.expect("EXPR n_b:50", "DONE")
+	sub.expectEvents(
+		"__keyspace@0__:n_b set", "__keyevent@0__:set n_b",
+		"__keyspace@0__:n_b expire", "__keyevent@0__:expire n_b",
+		"__keyspace@0__:n_b expired", "__keyevent@0__:expired n_b",
+	)
+	c.expect("GET n_b", "key is not exits")
+
+	// 调小maxmemory时按LRU顺序淘汰
+	c.expect("SET n_c:1", "DONE")
+	c.expect("SET n_d:1", "DONE")
+	c.expect("GET n_c", "1")
+	sub.expectEvents(
+		"__keyspace@0__:n_c set", "__keyevent@0__:set n_c",
+		"__keyspace@0__:n_d set", "__keyevent@0__:set n_d",
+	)
+	c.expect("CONFIG SET maxmemory 1", "DONE")
+	sub.expectEvents(
+		"__keyspace@0__:n_d evicted", "__keyevent@0__:evicted n_d",
+		"__keyspace@0__:n_c evicted", "__keyevent@0__:evicted n_c",
+	)
+	c.expect("CONFIG SET maxmemory 64mb", "DONE")
+	c.expect("SET n_e:1", "DONE")
+	sub.expectEvents("__keyspace@0__:n_e set", "__keyevent@0__:set n_e")
+}
+
+// 只发布开启的类别；关闭的事件不推送，之后第一条推送是下一条开启的事件
+func TestKeyspaceEventFlags(t *testing.T) {
+	s := startServer(t, "-notify-keyspace-events", "Ex")
+	sub := dial(t, s.addr)
+	sub.expect("PSUBSCRIBE __key*", "DONE")
+	c := dial(t, s.addr)
+
+	// 只有E与x：只发布到__keyevent@0__，只有expired事件
+	c.expect("SET f_a:1", "DONE")
+	c.expect("EXPR f_a:10", "DONE")
+	c.expect("SET f_b:1", "DONE")
+	c.expect("DEL f_b", "DONE")
+	sub.expectEvents("__keyevent@0__:expired f_a")
+
+	// K与g：只发布到__keyspace@0__，只有del与expire事件
+	c.expect("CONFIG SET notify-keyspace-events Kg", "DONE")
+	c.expect("SET f_c:1", "DONE")
+	c.expect("EXPR f_c:60000", "DONE")
+	c.expect("DEL f_c", "DONE")
+	sub.expectEvents("__keyspace@0__:f_c expire", "__keyspace@0__:f_c del")
+
+	// 只有$与e，没有K与E：都不发布
+	c.expect("CONFIG SET notify-keyspace-events $e", "DONE")
+	c.expect("SET f_d:1", "DONE")
+	c.expect("CONFIG SET maxmemory 1", "DONE")
+	c.expect("CONFIG SET maxmemory 64mb", "DONE")
+
+	// E与e：淘汰事件
+	c.expect("CONFIG SET notify-keyspace-events Ee", "DONE")
+	c.expect("SET f_e:1", "DONE")
+	c.expect("CONFIG SET maxmemory 1", "DONE")
+	c.expect("CONFIG SET maxmemory 64mb", "DONE")
+	sub.expectEvents("__keyevent@0__:evicted f_e")
+
+	// 没有事件类别时不发布
+	c.expect("CONFIG SET notify-keyspace-events KE", "DONE")
+	c.expect("SET f_f:1", "DONE")
+	c.expect("DEL f_f", "DONE")
+	c.expect("CONFIG SET notify-keyspace-events E$", "DONE")
+	c.expect("SET f_g:1", "DONE")
+	sub.expectEvents("__keyevent@0__:set f_g")
+}
@@ -2,78 +2,254 @@ package persistence
 
 import (
 	"bufio"
+	"errors"
 	"log"
 	"os"
 	"sync"
+	"time"
+	"tinycached/utils/metrics"
 )
 
+// AOF刷盘策略
+type FsyncPolicy int
+
+const (
+	FsyncAlways   FsyncPolicy = iota // 每条命令都写入并刷盘
+	FsyncEverysec                    // 每秒写入并刷盘一次
+	FsyncNo                          // 每秒写入一次，由操作系统决定何时刷盘
+)
+
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch s {
+	case "always":
+		return FsyncAlways, nil
+	case "everysec":
+		return FsyncEverysec, nil
+	case "no":
+		return FsyncNo, nil
+	default:
+		return FsyncEverysec, errors.New("invalid fsync policy " + s)
+	}
+}
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncAlways:
+		return "always"
+	case FsyncNo:
+		return "no"
+	default:
+		return "everysec"
+	}
+}
+
 type Aof struct {
-	buf    []byte
-	file   *os.File
-	reader *bufio.Reader
+	mutex     sync.Mutex
+	enabled   bool
+	closed    bool
+	fsync     FsyncPolicy
+	buf       []byte
+	file      *os.File
+	reader    *bufio.Reader
+	size      int64                  // 文件字节数
+	lastFlush time.Time              // 最近一次写入文件的时间
+	lastErr   error                  // 最近一次写入或刷盘的错误，成功后清空
+	errors    uint64                 // 写入或刷盘失败的累计次数
+	latency   *metrics.Histogram     // 每次写入文件（含刷盘）的耗时
+	feed      func(cmd, body []byte) // 每条记录的命令都交给feed，用于复制；未开启AOF时也调用
+}
+
+// AOF的运行状态，用于INFO
+type AofStats struct {
+	Enabled   bool
+	Fsync     FsyncPolicy
+	Size      int64
+	Buffered  int
+	LastFlush time.Time
+	LastErr   error
+	Errors    uint64
 }
 
+var aofEnabled = true
 var aofFilePath = "cache.aof"
+var aofFsync = FsyncEverysec
 var mutex = sync.Mutex{}
 var aofInstance *Aof
 
-func checkFileIsExist(filename string) bool {
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		return false
-	}
-	return true
+// 设置AOF参数，须在第一次调用AofInstance之前调用
+func Configure(enabled bool, path string, fsync FsyncPolicy) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	aofEnabled, aofFilePath, aofFsync = enabled, path, fsync
 }
 
 func AofInstance() *Aof {
+	mutex.Lock()
+	defer mutex.Unlock()
+
 	if aofInstance == nil {
-		mutex.Lock()
-		if aofInstance == nil {
-			aofInstance = newAof()
-		}
-		mutex.Unlock()
+		aofInstance = newAof()
 	}
 	return aofInstance
 }
 
 func newAof() (aof *Aof) {
-	var err error
-	var file *os.File
-	if checkFileIsExist(aofFilePath) {
-		file, err = os.OpenFile(aofFilePath, os.O_APPEND, 0666)
-	} else {
-		file, err = os.Create(aofFilePath)
+	aof = &Aof{
+		enabled: aofEnabled,
+		fsync:   aofFsync,
+		buf:     make([]byte, 0, 16),
+		latency: metrics.NewHistogram(metrics.DefBuckets),
+	}
+	if !aofEnabled {
+		return aof
 	}
+	file, err := os.OpenFile(aofFilePath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
 	if err != nil {
 		panic(err.Error())
 	}
-	aof = &Aof{
-		file:   file,
-		buf:    make([]byte, 16),
-		reader: bufio.NewReader(file),
+	aof.file = file
+	aof.reader = bufio.NewReader(file)
+	if fi, err := file.Stat(); err == nil {
+		aof.size = fi.Size()
 	}
 	return aof
 }
 
+func (aof *Aof) Stats() AofStats {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	return AofStats{
+		Enabled:   aof.enabled,
+		Fsync:     aof.fsync,
+		Size:      aof.size,
+		Buffered:  len(aof.buf),
+		LastFlush: aof.lastFlush,
+		LastErr:   aof.lastErr,
+		Errors:    aof.errors,
+	}
+}
+
+// 写入文件（含刷盘）的耗时
+func (aof *Aof) FlushLatency() *metrics.Histogram {
+	return aof.latency
+}
+
+// 设置命令的接收方，feed在持有AOF锁时调用，收到命令的顺序与写入AOF的顺序一致
+func (aof *Aof) SetFeed(feed func(cmd, body []byte)) {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	aof.feed = feed
+}
+
+func (aof *Aof) SetFsync(fsync FsyncPolicy) {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	aof.fsync = fsync
+}
+
+// 定时调用，将缓冲区写入文件，并按刷盘策略决定是否刷盘
 func (aof *Aof) Flush() {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	if !aof.enabled || aof.closed || len(aof.buf) == 0 {
+		return
+	}
+	start := time.Now()
+	aof.flush()
+	if aof.fsync == FsyncEverysec {
+		aof.sync()
+	}
+	aof.latency.Observe(time.Since(start))
+}
+
+// 清空AOF文件，在写入包含全部数据的快照后调用
+func (aof *Aof) Truncate() error {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	if !aof.enabled || aof.closed {
+		return nil
+	}
+	aof.buf = aof.buf[:0]
+	if err := aof.file.Truncate(0); err != nil {
+		return err
+	}
+	aof.size = 0
+	return aof.file.Sync()
+}
+
+// 关闭前将缓冲区写入文件并刷盘，之后的Append不再记录
+func (aof *Aof) Close() error {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	if !aof.enabled || aof.closed {
+		return nil
+	}
+	aof.closed = true
+	aof.flush()
+	if err := aof.file.Sync(); err != nil {
+		aof.file.Close()
+		return err
+	}
+	return aof.file.Close()
+}
+
+func (aof *Aof) flush() {
 	if len(aof.buf) == 0 {
 		return
 	}
 	n, err := aof.file.Write(aof.buf)
+	aof.size += int64(n)
+	aof.lastErr = err
 	if err != nil {
+		aof.errors++
 		log.Print("AOF write falied")
-		return
+	} else {
+		aof.lastFlush = time.Now()
 	}
 	aof.buf = aof.buf[n:]
 }
 
+func (aof *Aof) sync() {
+	if err := aof.file.Sync(); err != nil {
+		aof.lastErr = err
+		aof.errors++
+		log.Print("AOF fsync falied")
+	}
+}
+
 func (aof *Aof) Append(cmd []byte, body []byte) {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+
+	if aof.feed != nil {
+		aof.feed(cmd, body)
+	}
+	if !aof.enabled || aof.closed {
+		return
+	}
 	aof.buf = append(aof.buf, cmd...)
 	aof.buf = append(aof.buf, []byte(" ")...)
 	aof.buf = append(aof.buf, body...)
 	aof.buf = append(aof.buf, []byte("\n")...)
+	if aof.fsync == FsyncAlways {
+		start := time.Now()
+		aof.flush()
+		aof.sync()
+		aof.latency.Observe(time.Since(start))
+	}
 }
 
 func (aof *Aof) GetOneChar() (byte, bool) {
+	if !aof.enabled {
+		return '-', false
+	}
 	line, err := aof.reader.ReadByte()
 	if err != nil {
 		return '-', false
@@ -0,0 +1,172 @@
+package persistence
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+/*
+ * 快照文件格式：
+ * 魔数"TCSNAP01"
+ * 若干缓存项：0x00 uvarint(key长度) key uvarint(value长度) value varint(过期时刻，unix毫秒，0表示不过期)
+ * 结束标记0xFF，之后为前面全部内容的crc32（小端4字节）
+ */
+
+var snapshotMagic = []byte("TCSNAP01")
+
+const (
+	snapshotEntry = 0x00
+	snapshotEOF   = 0xFF
+)
+
+// 单个key或value的长度上限，防止损坏的快照导致分配过多内存
+const maxSnapshotItemSize = 1 << 30
+
+var ErrBadSnapshot = errors.New("bad snapshot")
+
+// 快照中的一个缓存项
+type Entry struct {
+	Key        string
+	Value      []byte
+	ExpireAtMs int64 // 过期时刻，0表示不过期
+}
+
+type crcWriter struct {
+	w   *bufio.Writer
+	crc uint32
+}
+
+func (cw *crcWriter) Write(p []byte) (int, error) {
+	cw.crc = crc32.Update(cw.crc, crc32.IEEETable, p)
+	return cw.w.Write(p)
+}
+
+func WriteSnapshot(w io.Writer, entries []Entry) error {
+	cw := &crcWriter{w: bufio.NewWriter(w)}
+	buf := make([]byte, binary.MaxVarintLen64)
+	cw.Write(snapshotMagic)
+	for _, e := range entries {
+		cw.Write([]byte{snapshotEntry})
+		cw.Write(buf[:binary.PutUvarint(buf, uint64(len(e.Key)))])
+		cw.Write([]byte(e.Key))
+		cw.Write(buf[:binary.PutUvarint(buf, uint64(len(e.Value)))])
+		cw.Write(e.Value)
+		cw.Write(buf[:binary.PutVarint(buf, e.ExpireAtMs)])
+	}
+	cw.Write([]byte{snapshotEOF})
+	binary.LittleEndian.PutUint32(buf, cw.crc)
+	cw.w.Write(buf[:4])
+	return cw.w.Flush()
+}
+
+type crcReader struct {
+	r   *bufio.Reader
+	crc uint32
+}
+
+func (cr *crcReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.crc = crc32.Update(cr.crc, crc32.IEEETable, p[:n])
+	return n, err
+}
+
+func (cr *crcReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.crc = crc32.Update(cr.crc, crc32.IEEETable, []byte{b})
+	}
+	return b, err
+}
+
+// 逐项读取快照，每读到一项调用一次fn
+func ReadSnapshot(r io.Reader, fn func(Entry) error) error {
+	cr := &crcReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(cr, magic); err != nil || string(magic) != string(snapshotMagic) {
+		return ErrBadSnapshot
+	}
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(cr)
+		if err != nil || n > maxSnapshotItemSize {
+			return nil, ErrBadSnapshot
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(cr, b); err != nil {
+			return nil, ErrBadSnapshot
+		}
+		return b, nil
+	}
+	for {
+		flag, err := cr.ReadByte()
+		if err != nil || (flag != snapshotEntry && flag != snapshotEOF) {
+			return ErrBadSnapshot
+		}
+		if flag == snapshotEOF {
+			break
+		}
+		key, err := readBytes()
+		if err != nil {
+			return err
+		}
+		value, err := readBytes()
+		if err != nil {
+			return err
+		}
+		expireAt, err := binary.ReadVarint(cr)
+		if err != nil {
+			return ErrBadSnapshot
+		}
+		if err := fn(Entry{string(key), value, expireAt}); err != nil {
+			return err
+		}
+	}
+	crc := cr.crc
+	sum := make([]byte, 4)
+	if _, err := io.ReadFull(cr.r, sum); err != nil || binary.LittleEndian.Uint32(sum) != crc {
+		return ErrBadSnapshot
+	}
+	return nil
+}
+
+// 将快照写入文件
+func SaveSnapshot(path string, entries []Entry) error {
+	return WriteFileAtomic(path, func(w io.Writer) error {
+		return WriteSnapshot(w, entries)
+	})
+}
+
+// 写文件：先由write写临时文件并刷盘，再重命名，避免留下不完整的文件
+func WriteFileAtomic(path string, write func(w io.Writer) error) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err = write(file); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// 从文件读取快照；文件不存在时不做任何事
+func LoadSnapshot(path string, fn func(Entry) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	return ReadSnapshot(file, fn)
+}
@@ -0,0 +1,101 @@
+package raft
+
+// 日志中的一条命令
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Data  []byte // 为nil表示领导者当选时追加的空命令，不交给状态机
+}
+
+// 快照：状态机在Index处的全部状态，Index及之前的日志已被压缩
+type Snapshot struct {
+	Index uint64
+	Term  uint64
+	Data  []byte
+}
+
+// 内存中的日志：快照之后的全部条目，entries[i].Index == snapIndex+1+i
+type raftLog struct {
+	snapIndex uint64
+	snapTerm  uint64
+	entries   []Entry
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.snapIndex + uint64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.snapTerm
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// index处条目的任期；index已被压缩或超出日志时返回false
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	if index == l.snapIndex {
+		return l.snapTerm, true
+	}
+	if index < l.snapIndex || index > l.lastIndex() {
+		return 0, false
+	}
+	return l.entries[index-l.snapIndex-1].Term, true
+}
+
+func (l *raftLog) entry(index uint64) Entry {
+	return l.entries[index-l.snapIndex-1]
+}
+
+// 从index开始的条目，最多max条；index须大于snapIndex
+func (l *raftLog) from(index uint64, max int) []Entry {
+	if index > l.lastIndex() {
+		return nil
+	}
+	ents := l.entries[index-l.snapIndex-1:]
+	if len(ents) > max {
+		ents = ents[:max]
+	}
+	return append([]Entry(nil), ents...)
+}
+
+// 追加条目，与已有条目冲突时先截断冲突处之后的部分；返回实际写入的条目（已有且相同的不再返回）
+func (l *raftLog) append(ents []Entry) []Entry {
+	for i, e := range ents {
+		if e.Index <= l.snapIndex {
+			continue
+		}
+		if t, ok := l.term(e.Index); ok {
+			if t == e.Term {
+				continue
+			}
+			l.entries = l.entries[:e.Index-l.snapIndex-1]
+		}
+		l.entries = append(l.entries, ents[i:]...)
+		return ents[i:]
+	}
+	return nil
+}
+
+// 压缩到index：丢弃index及之前的条目
+func (l *raftLog) compact(index uint64, term uint64) {
+	if index <= l.snapIndex {
+		return
+	}
+	if index >= l.lastIndex() {
+		l.entries = nil
+	} else {
+		l.entries = append([]Entry(nil), l.entries[index-l.snapIndex:]...)
+	}
+	l.snapIndex, l.snapTerm = index, term
+}
+
+// 以快照替换日志：快照之后与之相符的条目保留，否则丢弃全部条目
+func (l *raftLog) restore(index uint64, term uint64) {
+	if t, ok := l.term(index); ok && t == term && index >= l.snapIndex {
+		l.compact(index, term)
+		return
+	}
+	l.entries = nil
+	l.snapIndex, l.snapTerm = index, term
+}
@@ -0,0 +1,164 @@
+package raft
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+/*
+ * 进程内的确定性网络，用于测试：消息进入一个FIFO队列，由Deliver逐条交给目标节点，
+ * 计时由Tick统一推进，丢包使用固定种子的随机数，因此同一个种子下每次执行的结果相同。
+ * 可以隔离节点、切断两个节点之间的连接、设置丢包率；节点"崩溃"时Remove，
+ * 用同一个MemStorage新建节点后再Register即为重启
+ */
+type MemNetwork struct {
+	mutex    sync.Mutex
+	rand     *rand.Rand
+	nodes    map[string]*Node
+	queue    []Message
+	isolated map[string]bool
+	cut      map[[2]string]bool
+	dropRate float64
+}
+
+func NewMemNetwork(seed int64) *MemNetwork {
+	return &MemNetwork{
+		rand:     rand.New(rand.NewSource(seed)),
+		nodes:    make(map[string]*Node),
+		isolated: make(map[string]bool),
+		cut:      make(map[[2]string]bool),
+	}
+}
+
+type memTransport struct {
+	network *MemNetwork
+}
+
+func (t memTransport) Send(m Message) {
+	t.network.mutex.Lock()
+	defer t.network.mutex.Unlock()
+
+	t.network.queue = append(t.network.queue, m)
+}
+
+// 节点使用的Transport
+func (nw *MemNetwork) Transport() Transport {
+	return memTransport{nw}
+}
+
+func (nw *MemNetwork) Register(n *Node) {
+	nw.mutex.Lock()
+	defer nw.mutex.Unlock()
+
+	nw.nodes[n.cfg.ID] = n
+}
+
+// 节点崩溃：停止节点，发给它的消息全部丢弃
+func (nw *MemNetwork) Remove(id string) {
+	nw.mutex.Lock()
+	n := nw.nodes[id]
+	delete(nw.nodes, id)
+	nw.mutex.Unlock()
+
+	if n != nil {
+		n.Stop()
+	}
+}
+
+func (nw *MemNetwork) Node(id string) *Node {
+	nw.mutex.Lock()
+	defer nw.mutex.Unlock()
+
+	return nw.nodes[id]
+}
+
+func pair(a, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// 隔离节点，与其他节点之间的消息全部丢弃
+func (nw *MemNetwork) Isolate(id string) {
+	nw.mutex.Lock()
+	defer nw.mutex.Unlock()
+
+	nw.isolated[id] = true
+}
+
+// 切断两个节点之间的连接
+func (nw *MemNetwork) Cut(a, b string) {
+	nw.mutex.Lock()
+	defer nw.mutex.Unlock()
+
+	nw.cut[pair(a, b)] = true
+}
+
+// 恢复全部隔离与切断的连接
+func (nw *MemNetwork) Heal() {
+	nw.mutex.Lock()
+	defer nw.mutex.Unlock()
+
+	nw.isolated = make(map[string]bool)
+	nw.cut = make(map[[2]string]bool)
+}
+
+// 每条消息以概率p丢弃
+func (nw *MemNetwork) SetDropRate(p float64) {
+	nw.mutex.Lock()
+	defer nw.mutex.Unlock()
+
+	nw.dropRate = p
+}
+
+// 取出队首的消息，返回目标节点；消息被丢弃时目标为nil
+func (nw *MemNetwork) pop() (Message, *Node, bool) {
+	nw.mutex.Lock()
+	defer nw.mutex.Unlock()
+
+	if len(nw.queue) == 0 {
+		return Message{}, nil, false
+	}
+	m := nw.queue[0]
+	nw.queue = nw.queue[1:]
+	n := nw.nodes[m.To]
+	if nw.nodes[m.From] == nil || nw.isolated[m.From] || nw.isolated[m.To] || nw.cut[pair(m.From, m.To)] {
+		n = nil
+	} else if nw.dropRate > 0 && nw.rand.Float64() < nw.dropRate {
+		n = nil
+	}
+	return m, n, true
+}
+
+// 投递队列中的消息，直到队列为空（包括投递过程中产生的消息），返回投递的消息数
+func (nw *MemNetwork) Deliver() int {
+	count := 0
+	for {
+		m, n, ok := nw.pop()
+		if !ok {
+			return count
+		}
+		if n != nil {
+			n.Step(m)
+			count++
+		}
+	}
+}
+
+// 按ID的顺序让每个节点前进一个tick，然后投递产生的消息
+func (nw *MemNetwork) Tick() {
+	nw.mutex.Lock()
+	nodes := make([]*Node, 0, len(nw.nodes))
+	for _, n := range nw.nodes {
+		nodes = append(nodes, n)
+	}
+	nw.mutex.Unlock()
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].cfg.ID < nodes[j].cfg.ID })
+	for _, n := range nodes {
+		n.Tick()
+	}
+	nw.Deliver()
+}
@@ -0,0 +1,592 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ * Raft一致性算法：一组节点复制同一份命令日志，多数节点写入的条目即为已提交，按顺序交给状态机执行。
+ * 节点由Tick驱动计时（选举超时与心跳都以tick计），由Step处理其他节点的消息，消息经Transport发出；
+ * 因此只要按相同的顺序调用Tick与Step，执行过程就是确定的，进程内测试见MemNetwork。
+ * 实现包括领导者选举、日志复制、基于快照的日志压缩（InstallSnapshot）、
+ * 领导者确认自己仍被多数节点承认后才返回的线性一致读（ReadIndex），以及领导者失去多数节点时主动下台
+ */
+
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	default:
+		return "follower"
+	}
+}
+
+// 状态机：按日志顺序执行已提交的命令；快照包含执行到某条命令为止的全部状态
+type StateMachine interface {
+	Apply(cmd []byte) ([]byte, error)
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+type Config struct {
+	ID              string
+	Peers           []string // 全部节点的ID，包括自己
+	ElectionTicks   int      // 超过该tick数没有收到领导者的消息即发起选举，实际为[ElectionTicks, 2*ElectionTicks)中的随机值
+	HeartbeatTicks  int      // 领导者发送心跳的间隔
+	SnapshotEntries uint64   // 快照之后已执行的条目达到该数量时写新的快照，0表示不压缩
+	Storage         Storage
+	StateMachine    StateMachine
+	Transport       Transport
+	Rand            *rand.Rand // 选举超时的随机源，为nil时以当前时间为种子；测试中传入固定种子
+}
+
+// 每条追加消息最多携带的条目数
+const maxAppendEntries = 64
+
+var (
+	ErrStopped = errors.New("raft: stopped")
+	// 提交之前领导者变更，条目被新领导者的日志覆盖；命令可能没有执行
+	ErrLost  = errors.New("raft: entry lost after leader change")
+	ErrEmpty = errors.New("raft: empty command")
+)
+
+// 自己不是领导者
+type NotLeaderError struct {
+	Leader string // 当前已知的领导者，未知时为空
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "NOTLEADER no leader elected"
+	}
+	return "NOTLEADER " + e.Leader
+}
+
+// 命令执行的结果
+type Result struct {
+	Value []byte
+	Err   error
+}
+
+type proposal struct {
+	term uint64
+	done chan Result
+}
+
+type Node struct {
+	mutex            sync.Mutex
+	cfg              Config
+	rand             *rand.Rand
+	state            State
+	term             uint64
+	vote             string
+	leader           string
+	log              raftLog
+	commit           uint64
+	applied          uint64
+	electionElapsed  int
+	heartbeatElapsed int
+	timeout          int                  // 本轮的随机选举超时
+	votes            map[string]bool      // 候选人收到的投票结果
+	next             map[string]uint64    // 领导者下一次发给各节点的条目
+	match            map[string]uint64    // 各节点已确认与领导者一致的最后一条
+	active           map[string]bool      // 本轮选举超时内回复过领导者的节点
+	pending          map[uint64]*proposal // 领导者等待执行结果的命令，key=Index
+	readState                             // 线性一致读
+	stopped          bool
+}
+
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.ElectionTicks <= cfg.HeartbeatTicks || cfg.HeartbeatTicks <= 0 {
+		return nil, errors.New("raft: election ticks must be greater than heartbeat ticks")
+	}
+	found := false
+	for _, id := range cfg.Peers {
+		found = found || id == cfg.ID
+	}
+	if !found {
+		return nil, fmt.Errorf("raft: %s is not in peers", cfg.ID)
+	}
+	n := &Node{
+		cfg:     cfg,
+		rand:    cfg.Rand,
+		pending: make(map[uint64]*proposal),
+	}
+	if n.rand == nil {
+		n.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	term, vote, snap, ents, err := cfg.Storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	if snap.Index > 0 {
+		if err := cfg.StateMachine.Restore(snap.Data); err != nil {
+			return nil, err
+		}
+	}
+	n.term, n.vote = term, vote
+	n.log = raftLog{snapIndex: snap.Index, snapTerm: snap.Term, entries: ents}
+	n.commit, n.applied = snap.Index, snap.Index
+	n.becomeFollower(term, "")
+	return n, nil
+}
+
+func (n *Node) quorum() int {
+	return len(n.cfg.Peers)/2 + 1
+}
+
+// 写入任期与投票，失败时无法保证安全，直接退出
+func (n *Node) saveState() {
+	if err := n.cfg.Storage.SaveState(n.term, n.vote); err != nil {
+		panic(fmt.Sprintf("raft: save state: %v", err))
+	}
+}
+
+func (n *Node) saveEntries(ents []Entry) {
+	if err := n.cfg.Storage.Append(ents); err != nil {
+		panic(fmt.Sprintf("raft: append log: %v", err))
+	}
+}
+
+func (n *Node) send(m Message) {
+	m.From, m.Term = n.cfg.ID, n.term
+	n.cfg.Transport.Send(m)
+}
+
+func (n *Node) resetTimeout() {
+	n.electionElapsed, n.heartbeatElapsed = 0, 0
+	n.timeout = n.cfg.ElectionTicks + n.rand.Intn(n.cfg.ElectionTicks)
+}
+
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term != n.term {
+		n.term, n.vote = term, ""
+		n.saveState()
+	}
+	if n.state == Leader {
+		n.failReads(&NotLeaderError{leader})
+	}
+	n.state, n.leader = Follower, leader
+	n.resetTimeout()
+}
+
+func (n *Node) campaign() {
+	n.state, n.leader = Candidate, ""
+	n.term++
+	n.vote = n.cfg.ID
+	n.saveState()
+	n.resetTimeout()
+	n.votes = map[string]bool{n.cfg.ID: true}
+	if n.quorum() == 1 {
+		n.becomeLeader()
+		return
+	}
+	for _, id := range n.cfg.Peers {
+		if id != n.cfg.ID {
+			n.send(Message{Type: MsgVote, To: id, Index: n.log.lastIndex(), LogTerm: n.log.lastTerm()})
+		}
+	}
+}
+
+// 当选后追加一条空命令，提交后之前任期的条目也随之提交
+func (n *Node) becomeLeader() {
+	n.state, n.leader = Leader, n.cfg.ID
+	n.resetTimeout()
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	n.active = make(map[string]bool)
+	n.acked = make(map[string]uint64)
+	for _, id := range n.cfg.Peers {
+		n.next[id] = n.log.lastIndex() + 1
+		n.match[id] = 0
+	}
+	n.appendEntry(nil)
+	n.broadcastAppend()
+}
+
+// 领导者追加一条命令，返回其Index
+func (n *Node) appendEntry(data []byte) uint64 {
+	e := Entry{Index: n.log.lastIndex() + 1, Term: n.term, Data: data}
+	// 之前任期在该位置等待的命令已被覆盖
+	if p, ok := n.pending[e.Index]; ok && p.term != n.term {
+		p.done <- Result{Err: ErrLost}
+		delete(n.pending, e.Index)
+	}
+	n.log.append([]Entry{e})
+	n.saveEntries([]Entry{e})
+	n.match[n.cfg.ID] = e.Index
+	n.next[n.cfg.ID] = e.Index + 1
+	n.maybeCommit()
+	return e.Index
+}
+
+func (n *Node) broadcastAppend() {
+	for _, id := range n.cfg.Peers {
+		if id != n.cfg.ID {
+			n.sendAppend(id)
+		}
+	}
+}
+
+// 向节点发送它缺少的条目，没有缺少的条目时即为心跳；需要的条目已被压缩时发送快照
+func (n *Node) sendAppend(to string) {
+	prev := n.next[to] - 1
+	prevTerm, ok := n.log.term(prev)
+	if !ok {
+		snap, err := n.cfg.Storage.Snapshot()
+		if err != nil {
+			return
+		}
+		n.send(Message{Type: MsgSnap, To: to, Index: snap.Index, LogTerm: snap.Term, Snapshot: snap.Data})
+		// 之后从快照的下一条继续；快照丢失时跟随者会拒绝追加，再次发送快照
+		n.next[to] = snap.Index + 1
+		return
+	}
+	n.send(Message{
+		Type:    MsgApp,
+		To:      to,
+		Index:   prev,
+		LogTerm: prevTerm,
+		Entries: n.log.from(prev+1, maxAppendEntries),
+		Commit:  n.commit,
+		Context: n.readSeq,
+	})
+}
+
+// 推进一个tick：跟随者与候选人计时选举超时，领导者按间隔发送心跳，并检查是否仍有多数节点回复
+func (n *Node) Tick() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.stopped {
+		return
+	}
+	n.electionElapsed++
+	if n.state != Leader {
+		if n.electionElapsed >= n.timeout {
+			n.campaign()
+		}
+		return
+	}
+	n.heartbeatElapsed++
+	if n.heartbeatElapsed >= n.cfg.HeartbeatTicks {
+		n.heartbeatElapsed = 0
+		n.broadcastAppend()
+	}
+	if n.electionElapsed >= n.cfg.ElectionTicks {
+		n.electionElapsed = 0
+		if len(n.active)+1 < n.quorum() {
+			n.becomeFollower(n.term, "")
+			return
+		}
+		n.active = make(map[string]bool)
+	}
+}
+
+// 处理其他节点发来的消息
+func (n *Node) Step(m Message) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.stopped {
+		return
+	}
+	switch {
+	case m.Term > n.term:
+		// 刚收到过领导者的消息时忽略拉票，避免被网络隔离后回来的节点打断
+		if m.Type == MsgVote && n.leader != "" && n.electionElapsed < n.cfg.ElectionTicks {
+			return
+		}
+		leader := ""
+		if m.Type == MsgApp || m.Type == MsgSnap {
+			leader = m.From
+		}
+		n.becomeFollower(m.Term, leader)
+	case m.Term < n.term:
+		// 让过期的领导者得知新的任期
+		if m.Type == MsgApp || m.Type == MsgSnap {
+			n.send(Message{Type: MsgAppResp, To: m.From, Reject: true})
+		} else if m.Type == MsgVote {
+			n.send(Message{Type: MsgVoteResp, To: m.From, Reject: true})
+		}
+		return
+	}
+
+	switch m.Type {
+	case MsgVote:
+		lastTerm := n.log.lastTerm()
+		upToDate := m.LogTerm > lastTerm || (m.LogTerm == lastTerm && m.Index >= n.log.lastIndex())
+		grant := (n.vote == "" || n.vote == m.From) && upToDate
+		if grant {
+			n.vote = m.From
+			n.saveState()
+			n.electionElapsed = 0
+		}
+		n.send(Message{Type: MsgVoteResp, To: m.From, Reject: !grant})
+
+	case MsgVoteResp:
+		if n.state != Candidate {
+			return
+		}
+		n.votes[m.From] = !m.Reject
+		granted, rejected := 0, 0
+		for _, ok := range n.votes {
+			if ok {
+				granted++
+			} else {
+				rejected++
+			}
+		}
+		if granted >= n.quorum() {
+			n.becomeLeader()
+		} else if rejected >= n.quorum() {
+			n.becomeFollower(n.term, "")
+		}
+
+	case MsgApp:
+		n.becomeFollower(n.term, m.From)
+		n.handleAppend(m)
+
+	case MsgSnap:
+		n.becomeFollower(n.term, m.From)
+		n.handleSnapshot(m)
+
+	case MsgAppResp:
+		if n.state != Leader {
+			return
+		}
+		n.active[m.From] = true
+		if m.Context > n.acked[m.From] {
+			n.acked[m.From] = m.Context
+		}
+		if m.Reject {
+			// m.Index为跟随者的最后一条，从那里重试
+			if next := m.Index + 1; next < n.next[m.From] {
+				n.next[m.From] = next
+			} else if n.next[m.From] > 1 {
+				n.next[m.From]--
+			}
+			n.sendAppend(m.From)
+		} else if m.Index > n.match[m.From] {
+			n.match[m.From] = m.Index
+			n.next[m.From] = m.Index + 1
+			n.maybeCommit()
+			if n.next[m.From] <= n.log.lastIndex() {
+				n.sendAppend(m.From)
+			}
+		} else if m.Index+1 > n.next[m.From] {
+			n.next[m.From] = m.Index + 1
+		}
+		n.checkReads()
+	}
+}
+
+func (n *Node) handleAppend(m Message) {
+	reply := Message{Type: MsgAppResp, To: m.From, Context: m.Context}
+	if m.Index < n.commit {
+		// 已提交的部分必定一致，告知领导者从提交处继续
+		reply.Index = n.commit
+		n.send(reply)
+		return
+	}
+	if t, ok := n.log.term(m.Index); !ok || t != m.LogTerm {
+		reply.Reject = true
+		reply.Index = n.log.lastIndex()
+		if reply.Index >= m.Index && m.Index > 0 {
+			reply.Index = m.Index - 1
+		}
+		n.send(reply)
+		return
+	}
+	if written := n.log.append(m.Entries); len(written) > 0 {
+		n.saveEntries(written)
+	}
+	last := m.Index + uint64(len(m.Entries))
+	if commit := minIndex(m.Commit, last); commit > n.commit {
+		n.commit = commit
+		n.apply()
+	}
+	reply.Index = last
+	n.send(reply)
+}
+
+func (n *Node) handleSnapshot(m Message) {
+	reply := Message{Type: MsgAppResp, To: m.From, Index: n.commit}
+	if m.Index <= n.commit {
+		n.send(reply)
+		return
+	}
+	if err := n.cfg.StateMachine.Restore(m.Snapshot); err != nil {
+		panic(fmt.Sprintf("raft: restore snapshot: %v", err))
+	}
+	n.log.restore(m.Index, m.LogTerm)
+	snap := Snapshot{Index: m.Index, Term: m.LogTerm, Data: m.Snapshot}
+	if err := n.cfg.Storage.SaveSnapshot(snap, n.log.entries); err != nil {
+		panic(fmt.Sprintf("raft: save snapshot: %v", err))
+	}
+	n.commit, n.applied = m.Index, m.Index
+	reply.Index = m.Index
+	n.send(reply)
+}
+
+func minIndex(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// 多数节点都有的最后一条属于当前任期时提交到该条
+func (n *Node) maybeCommit() {
+	matched := make([]uint64, 0, len(n.cfg.Peers))
+	for _, id := range n.cfg.Peers {
+		matched = append(matched, n.match[id])
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i] > matched[j] })
+	index := matched[n.quorum()-1]
+	if index <= n.commit {
+		return
+	}
+	if t, _ := n.log.term(index); t != n.term {
+		return
+	}
+	n.commit = index
+	n.apply()
+}
+
+// 按顺序执行已提交的条目，并把结果交给等待的命令
+func (n *Node) apply() {
+	for n.applied < n.commit {
+		e := n.log.entry(n.applied + 1)
+		var res Result
+		if e.Data != nil {
+			res.Value, res.Err = n.cfg.StateMachine.Apply(e.Data)
+		}
+		n.applied = e.Index
+		if p, ok := n.pending[e.Index]; ok {
+			delete(n.pending, e.Index)
+			if p.term != e.Term {
+				res = Result{Err: ErrLost}
+			}
+			p.done <- res
+		}
+	}
+	n.maybeCompact()
+	n.checkReads()
+}
+
+// 快照之后已执行的条目足够多时写快照并压缩日志
+func (n *Node) maybeCompact() {
+	if n.cfg.SnapshotEntries == 0 || n.applied-n.log.snapIndex < n.cfg.SnapshotEntries {
+		return
+	}
+	data, err := n.cfg.StateMachine.Snapshot()
+	if err != nil {
+		return
+	}
+	term, _ := n.log.term(n.applied)
+	n.log.compact(n.applied, term)
+	snap := Snapshot{Index: n.applied, Term: term, Data: data}
+	if err := n.cfg.Storage.SaveSnapshot(snap, n.log.entries); err != nil {
+		panic(fmt.Sprintf("raft: save snapshot: %v", err))
+	}
+}
+
+/*
+ * 提交一条命令：领导者追加到日志并复制给其他节点，命令提交并执行后从返回的通道收到结果；
+ * 自己不是领导者时返回*NotLeaderError
+ */
+func (n *Node) Propose(cmd []byte) (<-chan Result, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.stopped {
+		return nil, ErrStopped
+	}
+	if n.state != Leader {
+		return nil, &NotLeaderError{n.leader}
+	}
+	// 空命令在日志中表示领导者的空条目，编码后也无法与nil区分
+	if len(cmd) == 0 {
+		return nil, ErrEmpty
+	}
+	done := make(chan Result, 1)
+	index := n.log.lastIndex() + 1
+	if p, ok := n.pending[index]; ok {
+		p.done <- Result{Err: ErrLost}
+	}
+	n.pending[index] = &proposal{term: n.term, done: done}
+	n.appendEntry(cmd)
+	n.broadcastAppend()
+	return done, nil
+}
+
+// 节点的当前状态，用于INFO
+type Status struct {
+	ID        string
+	State     State
+	Term      uint64
+	Leader    string
+	Commit    uint64
+	Applied   uint64
+	LastIndex uint64
+	SnapIndex uint64
+}
+
+func (n *Node) Status() Status {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return Status{
+		ID:        n.cfg.ID,
+		State:     n.state,
+		Term:      n.term,
+		Leader:    n.leader,
+		Commit:    n.commit,
+		Applied:   n.applied,
+		LastIndex: n.log.lastIndex(),
+		SnapIndex: n.log.snapIndex,
+	}
+}
+
+// 每隔interval调用一次Tick，直到stop关闭
+func (n *Node) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			n.Tick()
+		}
+	}
+}
+
+// 停止节点，等待中的命令与读请求返回ErrStopped
+func (n *Node) Stop() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.stopped = true
+	for index, p := range n.pending {
+		p.done <- Result{Err: ErrStopped}
+		delete(n.pending, index)
+	}
+	n.failReads(ErrStopped)
+}
@@ -0,0 +1,558 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+const (
+	testElectionTicks  = 10
+	testHeartbeatTicks = 2
+	maxTestTicks       = 500
+)
+
+// 状态机按顺序记录执行的命令，快照为以换行分隔的全部命令
+type listMachine struct {
+	cmds []string
+}
+
+func (m *listMachine) Apply(cmd []byte) ([]byte, error) {
+	m.cmds = append(m.cmds, string(cmd))
+	return []byte(fmt.Sprint(len(m.cmds))), nil
+}
+
+func (m *listMachine) Snapshot() ([]byte, error) {
+	return []byte(strings.Join(m.cmds, "\n")), nil
+}
+
+func (m *listMachine) Restore(data []byte) error {
+	m.cmds = nil
+	if len(data) > 0 {
+		m.cmds = strings.Split(string(data), "\n")
+	}
+	return nil
+}
+
+func (m *listMachine) String() string {
+	return strings.Join(m.cmds, ",")
+}
+
+type testCluster struct {
+	t        *testing.T
+	nw       *MemNetwork
+	ids      []string
+	storages map[string]Storage
+	machines map[string]*listMachine
+	snapshot uint64
+	seed     int64
+}
+
+func newTestCluster(t *testing.T, size int, snapshotEntries uint64) *testCluster {
+	c := &testCluster{
+		t:        t,
+		nw:       NewMemNetwork(1),
+		storages: make(map[string]Storage),
+		machines: make(map[string]*listMachine),
+		snapshot: snapshotEntries,
+	}
+	for i := 0; i < size; i++ {
+		c.ids = append(c.ids, fmt.Sprintf("n%d", i+1))
+	}
+	for _, id := range c.ids {
+		c.storages[id] = NewMemStorage()
+		c.start(id)
+	}
+	return c
+}
+
+// 以该节点的存储新建节点并加入网络；节点已在网络中时即为重启
+func (c *testCluster) start(id string) *Node {
+	c.t.Helper()
+	c.nw.Remove(id)
+	c.seed++
+	m := &listMachine{}
+	n, err := NewNode(Config{
+		ID:              id,
+		Peers:           c.ids,
+		ElectionTicks:   testElectionTicks,
+		HeartbeatTicks:  testHeartbeatTicks,
+		SnapshotEntries: c.snapshot,
+		Storage:         c.storages[id],
+		StateMachine:    m,
+		Transport:       c.nw.Transport(),
+		Rand:            rand.New(rand.NewSource(c.seed)),
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.machines[id] = m
+	c.nw.Register(n)
+	return n
+}
+
+func (c *testCluster) node(id string) *Node {
+	return c.nw.Node(id)
+}
+
+// 网络中的领导者，不止一个时取任期最大的
+func (c *testCluster) leader(except ...string) string {
+	leader, term := "", uint64(0)
+	for _, id := range c.ids {
+		if contains(except, id) {
+			continue
+		}
+		if n := c.node(id); n != nil {
+			if s := n.Status(); s.State == Leader && s.Term >= term {
+				leader, term = id, s.Term
+			}
+		}
+	}
+	return leader
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 推进直到除except之外的节点中选出领导者，且这些节点都承认它
+func (c *testCluster) waitLeader(except ...string) string {
+	c.t.Helper()
+	for i := 0; i < maxTestTicks; i++ {
+		c.nw.Tick()
+		leader := c.leader(except...)
+		if leader == "" {
+			continue
+		}
+		agreed := true
+		for _, id := range c.ids {
+			if n := c.node(id); n != nil && !contains(except, id) && n.Status().Leader != leader {
+				agreed = false
+			}
+		}
+		if agreed {
+			return leader
+		}
+	}
+	c.t.Fatal("no leader elected")
+	return ""
+}
+
+func (c *testCluster) propose(id string, cmd string) Result {
+	c.t.Helper()
+	done, err := c.node(id).Propose([]byte(cmd))
+	if err != nil {
+		c.t.Fatalf("propose %q on %s: %v", cmd, id, err)
+	}
+	return c.wait(done)
+}
+
+func (c *testCluster) wait(done <-chan Result) Result {
+	c.t.Helper()
+	c.nw.Deliver()
+	for i := 0; i < maxTestTicks; i++ {
+		select {
+		case res := <-done:
+			return res
+		default:
+			c.nw.Tick()
+		}
+	}
+	c.t.Fatal("command not applied")
+	return Result{}
+}
+
+// 推进直到所列节点都执行到与want相同的命令
+func (c *testCluster) waitApplied(want string, ids ...string) {
+	c.t.Helper()
+	for i := 0; i < maxTestTicks; i++ {
+		same := true
+		for _, id := range ids {
+			same = same && c.machines[id].String() == want
+		}
+		if same {
+			return
+		}
+		c.nw.Tick()
+	}
+	for _, id := range ids {
+		if got := c.machines[id].String(); got != want {
+			c.t.Errorf("%s applied %q, want %q", id, got, want)
+		}
+	}
+	c.t.FailNow()
+}
+
+func TestNewNodeConfig(t *testing.T) {
+	cfg := Config{ID: "n1", Peers: []string{"n1"}, ElectionTicks: 2, HeartbeatTicks: 2, Storage: NewMemStorage()}
+	if _, err := NewNode(cfg); err == nil {
+		t.Error("NewNode with election ticks not greater than heartbeat ticks should fail")
+	}
+	cfg.ElectionTicks, cfg.Peers = 10, []string{"n2", "n3"}
+	if _, err := NewNode(cfg); err == nil {
+		t.Error("NewNode with ID not in peers should fail")
+	}
+}
+
+func TestElection(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.waitLeader()
+	term := c.node(leader).Status().Term
+	for _, id := range c.ids {
+		s := c.node(id).Status()
+		if id != leader && s.State != Follower {
+			t.Errorf("%s is %s, want follower", id, s.State)
+		}
+		if s.Term != term {
+			t.Errorf("%s at term %d, leader at %d", id, s.Term, term)
+		}
+	}
+
+	// 心跳正常时不发生新的选举
+	for i := 0; i < 5*testElectionTicks; i++ {
+		c.nw.Tick()
+	}
+	if s := c.node(leader).Status(); s.State != Leader || s.Term != term {
+		t.Errorf("leader changed without failures: %s is %s at term %d", leader, s.State, s.Term)
+	}
+
+	// 不是领导者的节点拒绝命令并告知领导者
+	for _, id := range c.ids {
+		if id == leader {
+			continue
+		}
+		var nle *NotLeaderError
+		if _, err := c.node(id).Propose([]byte("x")); !errors.As(err, &nle) || nle.Leader != leader {
+			t.Errorf("propose on follower %s: %v, want NOTLEADER %s", id, err, leader)
+		}
+	}
+	if _, err := c.node(leader).Propose(nil); err != ErrEmpty {
+		t.Errorf("propose empty command: %v, want %v", err, ErrEmpty)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.waitLeader()
+	var want []string
+	for i := 1; i <= 10; i++ {
+		cmd := fmt.Sprintf("set:%d", i)
+		res := c.propose(leader, cmd)
+		if res.Err != nil || string(res.Value) != fmt.Sprint(i) {
+			t.Fatalf("propose %s: %q %v", cmd, res.Value, res.Err)
+		}
+		want = append(want, cmd)
+	}
+	c.waitApplied(strings.Join(want, ","), c.ids...)
+
+	// 一个跟随者隔离时多数节点仍可提交，恢复后补齐
+	follower := c.ids[0]
+	if follower == leader {
+		follower = c.ids[1]
+	}
+	c.nw.Isolate(follower)
+	for i := 11; i <= 15; i++ {
+		cmd := fmt.Sprintf("set:%d", i)
+		if res := c.propose(leader, cmd); res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		want = append(want, cmd)
+	}
+	c.nw.Heal()
+	c.waitApplied(strings.Join(want, ","), c.ids...)
+}
+
+// 领导者被隔离后追加的条目无法提交；新领导者提交了其他条目后，旧领导者回来时截断冲突的条目
+func TestFailoverTruncatesConflicts(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	old := c.waitLeader()
+	if res := c.propose(old, "a"); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	c.waitApplied("a", c.ids...)
+
+	c.nw.Isolate(old)
+	var lost []<-chan Result
+	for _, cmd := range []string{"lost1", "lost2", "lost3"} {
+		done, err := c.node(old).Propose([]byte(cmd))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lost = append(lost, done)
+	}
+	c.nw.Deliver()
+	oldLast := c.node(old).Status().LastIndex
+
+	leader := c.waitLeader(old)
+	for _, cmd := range []string{"b", "c"} {
+		if res := c.propose(leader, cmd); res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+	// 被隔离的领导者得不到多数节点的回复，主动下台；未提交的条目仍在日志中
+	for i := 0; i < 2*testElectionTicks; i++ {
+		c.nw.Tick()
+	}
+	if s := c.node(old).Status(); s.State == Leader {
+		t.Errorf("isolated leader %s did not step down", old)
+	} else if s.LastIndex != oldLast || s.Commit >= oldLast {
+		t.Errorf("isolated leader log changed while isolated: %+v, last index was %d", s, oldLast)
+	}
+
+	c.nw.Heal()
+	c.waitApplied("a,b,c", c.ids...)
+	for i, done := range lost {
+		select {
+		case res := <-done:
+			if res.Err != ErrLost {
+				t.Errorf("overwritten command %d: %v, want %v", i+1, res.Err, ErrLost)
+			}
+		default:
+			t.Errorf("overwritten command %d did not return", i+1)
+		}
+	}
+	// 之后的写入在全部节点上执行，日志一致
+	leader = c.waitLeader()
+	if res := c.propose(leader, "d"); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	c.waitApplied("a,b,c,d", c.ids...)
+	last := c.node(leader).Status().LastIndex
+	for _, id := range c.ids {
+		if s := c.node(id).Status(); s.LastIndex != last {
+			t.Errorf("%s last index %d, leader %d", id, s.LastIndex, last)
+		}
+	}
+}
+
+// 落后的节点需要的条目已被压缩时，领导者发送快照
+func TestSnapshotInstall(t *testing.T) {
+	c := newTestCluster(t, 3, 5)
+	leader := c.waitLeader()
+	lagging := c.ids[0]
+	if lagging == leader {
+		lagging = c.ids[1]
+	}
+	c.nw.Isolate(lagging)
+
+	var want []string
+	for i := 1; i <= 20; i++ {
+		cmd := fmt.Sprintf("set:%d", i)
+		if res := c.propose(leader, cmd); res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		want = append(want, cmd)
+	}
+	if s := c.node(leader).Status(); s.SnapIndex == 0 {
+		t.Fatalf("leader did not compact its log: %+v", s)
+	}
+	if s := c.node(lagging).Status(); s.Applied != 0 && s.SnapIndex != 0 {
+		t.Fatalf("isolated node received entries: %+v", s)
+	}
+
+	c.nw.Heal()
+	c.waitApplied(strings.Join(want, ","), c.ids...)
+	if s := c.node(lagging).Status(); s.SnapIndex == 0 {
+		t.Errorf("lagging node caught up without a snapshot: %+v", s)
+	}
+
+	// 安装快照后继续从日志复制
+	if res := c.propose(leader, "after"); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	c.waitApplied(strings.Join(append(want, "after"), ","), c.ids...)
+
+	// 重启后从快照与之后的条目恢复
+	c.start(lagging)
+	if got := c.machines[lagging].String(); !strings.HasPrefix(strings.Join(want, ","), got) || got == "" {
+		t.Errorf("restarted node restored %q from its snapshot", got)
+	}
+	c.waitApplied(strings.Join(append(want, "after"), ","), c.ids...)
+}
+
+// 全部节点停止后以FileStorage重启，已提交的命令不丢失，任期不倒退
+func TestRestartFromFileStorage(t *testing.T) {
+	c := newTestCluster(t, 3, 5)
+	for _, id := range c.ids {
+		storage, err := NewFileStorage(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.storages[id] = storage
+		c.start(id)
+	}
+	leader := c.waitLeader()
+	var want []string
+	for i := 1; i <= 8; i++ {
+		cmd := fmt.Sprintf("set:%d", i)
+		if res := c.propose(leader, cmd); res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		want = append(want, cmd)
+	}
+	c.waitApplied(strings.Join(want, ","), c.ids...)
+	term := c.node(leader).Status().Term
+
+	for _, id := range c.ids {
+		c.nw.Remove(id)
+		if err := c.storages[id].(*FileStorage).Close(); err != nil {
+			t.Fatal(err)
+		}
+		dir := c.storages[id].(*FileStorage).dir
+		storage, err := NewFileStorage(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.storages[id] = storage
+	}
+	for _, id := range c.ids {
+		n := c.start(id)
+		s := n.Status()
+		if s.Term < term {
+			t.Errorf("%s restarted at term %d, was %d", id, s.Term, term)
+		}
+		if s.SnapIndex == 0 || s.LastIndex <= s.SnapIndex {
+			t.Errorf("%s restarted without both a snapshot and log entries: %+v", id, s)
+		}
+	}
+
+	// 快照之后的条目在新领导者提交本任期的条目后执行
+	leader = c.waitLeader()
+	c.waitApplied(strings.Join(want, ","), c.ids...)
+	if res := c.propose(leader, "after"); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	c.waitApplied(strings.Join(append(want, "after"), ","), c.ids...)
+	for _, id := range c.ids {
+		c.storages[id].(*FileStorage).Close()
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.waitLeader()
+	if res := c.propose(leader, "a"); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	done, err := c.node(leader).ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.nw.Deliver()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("read on leader: %v", err)
+		}
+	default:
+		t.Fatal("read on leader not confirmed after one round of heartbeats")
+	}
+
+	for _, id := range c.ids {
+		if id == leader {
+			continue
+		}
+		var nle *NotLeaderError
+		if _, err := c.node(id).ReadIndex(); !errors.As(err, &nle) || nle.Leader != leader {
+			t.Errorf("read on follower %s: %v, want NOTLEADER %s", id, err, leader)
+		}
+	}
+}
+
+// 被隔离的领导者在其他节点选出新领导者并写入后，仍以为自己是领导者，但不能返回读结果
+func TestReadIndexDeposedLeader(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	old := c.waitLeader()
+	if res := c.propose(old, "a"); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	c.waitApplied("a", c.ids...)
+
+	c.nw.Isolate(old)
+	// 其他节点尚未发现领导者失联之前，旧领导者仍处于Leader状态
+	done, err := c.node(old).ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range c.ids {
+		if id != old {
+			// 让其他节点立即发起选举，新领导者在旧领导者下台之前当选
+			c.node(id).mutex.Lock()
+			c.node(id).electionElapsed = c.node(id).timeout - 1
+			c.node(id).mutex.Unlock()
+		}
+	}
+	leader := c.waitLeader(old)
+	if res := c.propose(leader, "b"); res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	if c.node(old).Status().State != Leader {
+		t.Fatal("old leader stepped down before the new leader committed; test needs a longer election timeout")
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("deposed leader served a read: %v", err)
+	default:
+	}
+
+	// 得不到多数节点回复，下台并使读请求失败
+	for i := 0; i < 2*testElectionTicks; i++ {
+		c.nw.Tick()
+	}
+	select {
+	case err := <-done:
+		var nle *NotLeaderError
+		if !errors.As(err, &nle) {
+			t.Errorf("read on deposed leader: %v, want NOTLEADER", err)
+		}
+	default:
+		t.Fatal("read on deposed leader did not fail after it stepped down")
+	}
+	if _, err := c.node(old).ReadIndex(); err == nil {
+		t.Error("read accepted by a node that stepped down")
+	}
+
+	// 恢复后读到新领导者的写入
+	c.nw.Heal()
+	c.waitApplied("a,b", c.ids...)
+	done, err = c.node(leader).ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.nw.Deliver()
+	if err := <-done; err != nil {
+		t.Errorf("read on new leader: %v", err)
+	}
+}
+
+func TestStop(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.waitLeader()
+	c.nw.Isolate(leader)
+	done, err := c.node(leader).Propose([]byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := c.node(leader).ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := c.node(leader)
+	c.nw.Remove(leader)
+	if res := <-done; res.Err != ErrStopped {
+		t.Errorf("pending command after stop: %v, want %v", res.Err, ErrStopped)
+	}
+	if err := <-read; err != ErrStopped {
+		t.Errorf("pending read after stop: %v, want %v", err, ErrStopped)
+	}
+	if _, err := n.Propose([]byte("y")); err != ErrStopped {
+		t.Errorf("propose after stop: %v, want %v", err, ErrStopped)
+	}
+}
@@ -0,0 +1,77 @@
+package raft
+
+// 一个线性一致读请求
+type readReq struct {
+	seq       uint64
+	index     uint64 // 确认领导地位时的提交位置，执行到该位置后即可读
+	confirmed bool
+	done      chan error
+}
+
+/*
+ * ReadIndex：领导者收到读请求后发出一轮心跳，心跳携带请求的序号，
+ * 多数节点回复了序号不小于它的心跳，说明发出心跳时自己仍是领导者；
+ * 此时的提交位置包含了读请求到达之前提交的全部写入，状态机执行到该位置后读本地数据即为线性一致。
+ * 领导者刚当选、本任期的空命令尚未提交时，提交位置可能落后，须等到它提交
+ */
+type readState struct {
+	readSeq uint64            // 最近一个读请求的序号，随心跳发出
+	acked   map[string]uint64 // 各节点回复的最大序号
+	reads   []*readReq
+}
+
+// 请求一次线性一致读：可以读本地数据时从返回的通道收到nil；自己不是领导者时返回*NotLeaderError
+func (n *Node) ReadIndex() (<-chan error, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.stopped {
+		return nil, ErrStopped
+	}
+	if n.state != Leader {
+		return nil, &NotLeaderError{n.leader}
+	}
+	n.readSeq++
+	r := &readReq{seq: n.readSeq, done: make(chan error, 1)}
+	n.reads = append(n.reads, r)
+	n.broadcastAppend()
+	n.checkReads()
+	return r.done, nil
+}
+
+// 确认多数节点已回复的读请求，并完成状态机已执行到位的请求
+func (n *Node) checkReads() {
+	if n.state != Leader || len(n.reads) == 0 {
+		return
+	}
+	t, _ := n.log.term(n.commit)
+	committed := t == n.term
+	kept := n.reads[:0]
+	for _, r := range n.reads {
+		if !r.confirmed && committed {
+			acks := 1
+			for id, seq := range n.acked {
+				if id != n.cfg.ID && seq >= r.seq {
+					acks++
+				}
+			}
+			if acks >= n.quorum() {
+				r.confirmed, r.index = true, n.commit
+			}
+		}
+		if r.confirmed && n.applied >= r.index {
+			r.done <- nil
+			continue
+		}
+		kept = append(kept, r)
+	}
+	n.reads = kept
+}
+
+// 不再是领导者或停止时，结束全部读请求
+func (n *Node) failReads(err error) {
+	for _, r := range n.reads {
+		r.done <- err
+	}
+	n.reads = nil
+}
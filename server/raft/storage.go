@@ -0,0 +1,351 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"tinycached/server/persistence"
+)
+
+/*
+ * 持久化存储：任期与投票、日志条目与最近的快照。
+ * 节点先写存储再回复其他节点，因此每个方法返回时数据须已落盘
+ */
+type Storage interface {
+	// 启动时读取全部内容
+	Load() (term uint64, vote string, snap Snapshot, ents []Entry, err error)
+	SaveState(term uint64, vote string) error
+	// 追加条目；ents[0].Index不大于已有的最后一条时，先截断该位置及之后的条目
+	Append(ents []Entry) error
+	// 写入快照，并将日志替换为ents（快照之后仍保留的条目）
+	SaveSnapshot(snap Snapshot, ents []Entry) error
+	// 最近一次写入的快照，发送给落后太多的节点
+	Snapshot() (Snapshot, error)
+}
+
+var ErrCorrupt = errors.New("raft: corrupt storage")
+
+// 内存中的存储，用于进程内测试；节点重启时传入同一个MemStorage即可恢复
+type MemStorage struct {
+	mutex sync.Mutex
+	term  uint64
+	vote  string
+	snap  Snapshot
+	ents  []Entry
+}
+
+func NewMemStorage() *MemStorage {
+	return &MemStorage{}
+}
+
+func (s *MemStorage) Load() (uint64, string, Snapshot, []Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.term, s.vote, s.snap, append([]Entry(nil), s.ents...), nil
+}
+
+func (s *MemStorage) SaveState(term uint64, vote string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.term, s.vote = term, vote
+	return nil
+}
+
+func (s *MemStorage) Append(ents []Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(ents) == 0 {
+		return nil
+	}
+	first := s.snap.Index + 1
+	if n := int(ents[0].Index - first); n < len(s.ents) {
+		s.ents = s.ents[:n]
+	}
+	s.ents = append(s.ents, ents...)
+	return nil
+}
+
+func (s *MemStorage) SaveSnapshot(snap Snapshot, ents []Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.snap, s.ents = snap, append([]Entry(nil), ents...)
+	return nil
+}
+
+func (s *MemStorage) Snapshot() (Snapshot, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.snap, nil
+}
+
+/*
+ * 目录中的存储：
+ * state		任期与投票
+ * snapshot	快照的Index、Term与状态机数据
+ * log		快照之后的条目，逐条追加，每条为uvarint(Index) uvarint(Term) uvarint(长度) 数据 crc32；
+ *			数据为空表示空命令。读到不完整的最后一条（写入时进程退出）时将其截掉
+ * 三个文件都通过persistence.WriteFileAtomic整体替换，log平时只追加并刷盘
+ */
+type FileStorage struct {
+	mutex   sync.Mutex
+	dir     string
+	log     *os.File
+	first   uint64  // log中第一条的Index
+	offsets []int64 // log中各条目的起始位置，offsets[i]对应Index为first+i的条目
+	size    int64
+}
+
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStorage{dir: dir}, nil
+}
+
+func (s *FileStorage) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+func (s *FileStorage) Load() (term uint64, vote string, snap Snapshot, ents []Entry, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if term, vote, err = s.loadState(); err != nil {
+		return
+	}
+	if snap, err = s.loadSnapshot(); err != nil {
+		return
+	}
+	if s.log, err = os.OpenFile(s.path("log"), os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return
+	}
+	ents, err = s.readLog(snap.Index + 1)
+	return
+}
+
+func (s *FileStorage) loadState() (uint64, string, error) {
+	data, err := os.ReadFile(s.path("state"))
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	} else if err != nil {
+		return 0, "", err
+	}
+	term, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, "", ErrCorrupt
+	}
+	return term, string(data[n:]), nil
+}
+
+func (s *FileStorage) SaveState(term uint64, vote string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return persistence.WriteFileAtomic(s.path("state"), func(w io.Writer) error {
+		buf := binary.AppendUvarint(nil, term)
+		_, err := w.Write(append(buf, vote...))
+		return err
+	})
+}
+
+func (s *FileStorage) loadSnapshot() (Snapshot, error) {
+	data, err := os.ReadFile(s.path("snapshot"))
+	if os.IsNotExist(err) {
+		return Snapshot{}, nil
+	} else if err != nil {
+		return Snapshot{}, err
+	}
+	index, n := binary.Uvarint(data)
+	if n <= 0 {
+		return Snapshot{}, ErrCorrupt
+	}
+	term, m := binary.Uvarint(data[n:])
+	if m <= 0 {
+		return Snapshot{}, ErrCorrupt
+	}
+	return Snapshot{Index: index, Term: term, Data: data[n+m:]}, nil
+}
+
+func (s *FileStorage) Snapshot() (Snapshot, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.loadSnapshot()
+}
+
+// 读取log中从first开始的条目，记录各条目的位置；截掉不完整的最后一条
+func (s *FileStorage) readLog(first uint64) ([]Entry, error) {
+	s.first, s.offsets, s.size = first, nil, 0
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(s.log)
+	var ents []Entry
+	for {
+		e, n, err := readRecord(reader)
+		if err != nil {
+			break
+		}
+		pos := s.size
+		s.size += n
+		// 写快照后替换log之前进程退出时，log开头还有快照之前的条目，跳过，下次写快照时删除
+		if e.Index < first {
+			continue
+		}
+		if e.Index != first+uint64(len(ents)) {
+			return nil, ErrCorrupt
+		}
+		s.offsets = append(s.offsets, pos)
+		ents = append(ents, e)
+	}
+	if err := s.log.Truncate(s.size); err != nil {
+		return nil, err
+	}
+	_, err := s.log.Seek(s.size, io.SeekStart)
+	return ents, err
+}
+
+func readRecord(reader *bufio.Reader) (Entry, int64, error) {
+	var e Entry
+	cr := &countingReader{r: reader}
+	var err error
+	if e.Index, err = binary.ReadUvarint(cr); err != nil {
+		return e, 0, err
+	}
+	if e.Term, err = binary.ReadUvarint(cr); err != nil {
+		return e, 0, err
+	}
+	size, err := binary.ReadUvarint(cr)
+	if err != nil || size > 1<<30 {
+		return e, 0, ErrCorrupt
+	}
+	if size > 0 {
+		e.Data = make([]byte, size)
+		if _, err := io.ReadFull(cr, e.Data); err != nil {
+			return e, 0, err
+		}
+	}
+	crc := cr.crc
+	sum := make([]byte, 4)
+	if _, err := io.ReadFull(cr.r, sum); err != nil || binary.LittleEndian.Uint32(sum) != crc {
+		return e, 0, ErrCorrupt
+	}
+	return e, cr.n + 4, nil
+}
+
+// 统计读取的字节数并计算crc32
+type countingReader struct {
+	r   *bufio.Reader
+	n   int64
+	crc uint32
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	cr.crc = crc32.Update(cr.crc, crc32.IEEETable, p[:n])
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+		cr.crc = crc32.Update(cr.crc, crc32.IEEETable, []byte{b})
+	}
+	return b, err
+}
+
+func encodeRecord(buf []byte, e Entry) []byte {
+	start := len(buf)
+	buf = binary.AppendUvarint(buf, e.Index)
+	buf = binary.AppendUvarint(buf, e.Term)
+	buf = binary.AppendUvarint(buf, uint64(len(e.Data)))
+	buf = append(buf, e.Data...)
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[start:]))
+}
+
+func (s *FileStorage) Append(ents []Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(ents) == 0 {
+		return nil
+	}
+	if n := int(ents[0].Index - s.first); n < len(s.offsets) {
+		if err := s.log.Truncate(s.offsets[n]); err != nil {
+			return err
+		}
+		s.size, s.offsets = s.offsets[n], s.offsets[:n]
+		if _, err := s.log.Seek(s.size, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	var buf []byte
+	for _, e := range ents {
+		s.offsets = append(s.offsets, s.size+int64(len(buf)))
+		buf = encodeRecord(buf, e)
+	}
+	n, err := s.log.Write(buf)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// 先写快照，再整体替换log；两步之间进程退出时，重启后log中快照之前的条目被跳过
+func (s *FileStorage) SaveSnapshot(snap Snapshot, ents []Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := persistence.WriteFileAtomic(s.path("snapshot"), func(w io.Writer) error {
+		buf := binary.AppendUvarint(nil, snap.Index)
+		buf = binary.AppendUvarint(buf, snap.Term)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		_, err := w.Write(snap.Data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = persistence.WriteFileAtomic(s.path("log"), func(w io.Writer) error {
+		var buf []byte
+		for _, e := range ents {
+			buf = encodeRecord(buf, e)
+		}
+		_, err := w.Write(buf)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.log.Close()
+	if s.log, err = os.OpenFile(s.path("log"), os.O_RDWR, 0644); err != nil {
+		return err
+	}
+	_, err = s.readLog(snap.Index + 1)
+	return err
+}
+
+func (s *FileStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.log == nil {
+		return nil
+	}
+	return s.log.Close()
+}
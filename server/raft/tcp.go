@@ -0,0 +1,185 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/gob"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// 每个节点待发送消息的上限，队列满时丢弃新消息，由心跳与重试补回
+const tcpQueueSize = 1024
+
+/*
+ * 基于TCP的Transport：消息以gob编码。
+ * 每个对端一个发送协程与一条长连接，连接断开后在下一条消息时重连；接收方对每条连接逐条调用step。
+ * 连接没有认证，只应在可信的网络中使用
+ */
+type TCPTransport struct {
+	id       string
+	addrs    map[string]string // 节点ID -> 地址
+	timeout  time.Duration
+	queues   map[string]chan Message
+	listener net.Listener
+	mutex    sync.Mutex
+	conns    map[net.Conn]bool
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewTCPTransport(id string, addrs map[string]string, timeout time.Duration) *TCPTransport {
+	t := &TCPTransport{
+		id:      id,
+		addrs:   addrs,
+		timeout: timeout,
+		queues:  make(map[string]chan Message),
+		conns:   make(map[net.Conn]bool),
+		stop:    make(chan struct{}),
+	}
+	for peer := range addrs {
+		if peer != id {
+			t.queues[peer] = make(chan Message, tcpQueueSize)
+		}
+	}
+	return t
+}
+
+func (t *TCPTransport) Send(m Message) {
+	queue, ok := t.queues[m.To]
+	if !ok {
+		return
+	}
+	select {
+	case queue <- m:
+	default:
+	}
+}
+
+// 监听自己的地址并开始收发消息，收到的消息交给step
+func (t *TCPTransport) Start(step func(Message)) error {
+	listener, err := net.Listen("tcp", t.addrs[t.id])
+	if err != nil {
+		return err
+	}
+	t.listener = listener
+	t.wg.Add(1)
+	go t.acceptLoop(step)
+	for peer, queue := range t.queues {
+		t.wg.Add(1)
+		go t.sendLoop(peer, queue)
+	}
+	return nil
+}
+
+func (t *TCPTransport) acceptLoop(step func(Message)) {
+	defer t.wg.Done()
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.stop:
+				return
+			default:
+			}
+			log.Printf("raft accept: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if !t.track(conn, true) {
+			conn.Close()
+			return
+		}
+		t.wg.Add(1)
+		go t.receive(conn, step)
+	}
+}
+
+// 记录或移除连接，Close时统一关闭；已经Close时返回false
+func (t *TCPTransport) track(conn net.Conn, add bool) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	select {
+	case <-t.stop:
+		return !add
+	default:
+	}
+	if add {
+		t.conns[conn] = true
+	} else {
+		delete(t.conns, conn)
+	}
+	return true
+}
+
+func (t *TCPTransport) receive(conn net.Conn, step func(Message)) {
+	defer t.wg.Done()
+	defer t.track(conn, false)
+	defer conn.Close()
+
+	decoder := gob.NewDecoder(bufio.NewReader(conn))
+	for {
+		var m Message
+		if err := decoder.Decode(&m); err != nil {
+			return
+		}
+		if m.To == t.id {
+			step(m)
+		}
+	}
+}
+
+func (t *TCPTransport) sendLoop(peer string, queue chan Message) {
+	defer t.wg.Done()
+	var conn net.Conn
+	var writer *bufio.Writer
+	var encoder *gob.Encoder
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		var m Message
+		select {
+		case <-t.stop:
+			return
+		case m = <-queue:
+		}
+		if conn == nil {
+			c, err := net.DialTimeout("tcp", t.addrs[peer], t.timeout)
+			if err != nil {
+				continue
+			}
+			conn, writer = c, bufio.NewWriter(c)
+			encoder = gob.NewEncoder(writer)
+		}
+		conn.SetWriteDeadline(time.Now().Add(t.timeout))
+		err := encoder.Encode(&m)
+		// 队列中没有更多消息时再写出，连续的消息合并发送
+		if err == nil && len(queue) == 0 {
+			err = writer.Flush()
+		}
+		if err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+// 停止收发并关闭全部连接
+func (t *TCPTransport) Close() {
+	t.mutex.Lock()
+	close(t.stop)
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mutex.Unlock()
+
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	t.wg.Wait()
+}
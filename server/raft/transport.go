@@ -0,0 +1,48 @@
+package raft
+
+type MsgType uint8
+
+const (
+	MsgVote     MsgType = iota // 候选人拉票，Index与LogTerm为候选人的最后一条
+	MsgVoteResp                // 投票结果，Reject为true表示不同意
+	MsgApp                     // 领导者追加条目，Index与LogTerm为Entries之前的一条；Entries为空即为心跳
+	MsgAppResp                 // 追加结果，Index为已一致的最后一条，拒绝时为跟随者的最后一条
+	MsgSnap                    // 领导者发送快照，Index与LogTerm为快照的位置
+)
+
+func (t MsgType) String() string {
+	switch t {
+	case MsgVote:
+		return "vote"
+	case MsgVoteResp:
+		return "vote-resp"
+	case MsgApp:
+		return "app"
+	case MsgAppResp:
+		return "app-resp"
+	case MsgSnap:
+		return "snap"
+	default:
+		return "unknown"
+	}
+}
+
+// 节点之间的消息
+type Message struct {
+	Type     MsgType
+	From     string
+	To       string
+	Term     uint64
+	Index    uint64
+	LogTerm  uint64
+	Entries  []Entry
+	Commit   uint64
+	Reject   bool
+	Context  uint64 // 领导者最近一个读请求的序号，跟随者原样带回，见ReadIndex
+	Snapshot []byte
+}
+
+// 向其他节点发送消息；Send不能阻塞，在持有节点的锁时调用，消息可以丢失或重复
+type Transport interface {
+	Send(m Message)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tinycached/server/acl"
+	"tinycached/server/command"
+	"tinycached/server/persistence"
+	"tinycached/utils"
+)
+
+// 连接主服务器的超时
+const masterDialTimeout = 3 * time.Second
+
+// 副本向主服务器发送ACK的间隔
+const replAckInterval = time.Second
+
+var errLinkClosed = errors.New("replication stopped")
+
+// 副本到主服务器的复制连接，由replicaof配置项控制
+type replicaLink struct {
+	lastIO int64 // 最近一次收到主服务器数据的时间，unix纳秒，原子操作，放在首位保证64位对齐
+	master string
+	mutex  sync.Mutex
+	state  string   // connect：正在连接；sync：正在同步；connected：正在接收复制流
+	conn   net.Conn // 当前的连接，未连接时为nil
+	closed bool
+	stop   chan struct{}
+	// 定时发送的ACK与对GETACK的回复可能并发写连接
+	writeMutex sync.Mutex
+}
+
+func newReplicaLink(master string) *replicaLink {
+	return &replicaLink{master: master, state: "connect", stop: make(chan struct{})}
+}
+
+// 记录新建立的连接，复制已停止时返回false
+func (link *replicaLink) attach(conn net.Conn) bool {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+
+	if link.closed {
+		return false
+	}
+	link.conn = conn
+	return true
+}
+
+func (link *replicaLink) setState(state string) {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+
+	link.state = state
+}
+
+func (link *replicaLink) status() (state string, lastIO time.Time) {
+	link.mutex.Lock()
+	state = link.state
+	link.mutex.Unlock()
+
+	if ns := atomic.LoadInt64(&link.lastIO); ns > 0 {
+		lastIO = time.Unix(0, ns)
+	}
+	return state, lastIO
+}
+
+// 停止复制并断开连接
+func (link *replicaLink) close() {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+
+	if link.closed {
+		return
+	}
+	link.closed = true
+	close(link.stop)
+	if link.conn != nil {
+		link.conn.Close()
+	}
+}
+
+// 按replicaof配置开始或停止复制；已经在复制同一主服务器时不做任何事
+func (svr *CacheServer) applyReplicaOf() error {
+	master := svr.cfg.MasterAddr()
+	if master != "" && svr.cfg.RaftID != "" {
+		return errors.New("cannot be used in raft mode")
+	}
+	command.SetReadOnly(master != "" && svr.cfg.ReplicaReadOnly)
+
+	svr.linkMutex.Lock()
+	defer svr.linkMutex.Unlock()
+
+	if svr.link != nil {
+		if svr.link.master == master {
+			return nil
+		}
+		svr.link.close()
+		svr.link = nil
+	}
+	if master == "" {
+		if command.BecomeMaster() {
+			command.DisconnectReplicas()
+			log.Print("replication: stopped, now a master")
+		}
+		return nil
+	}
+	command.BecomeReplica()
+	svr.link = newReplicaLink(master)
+	go svr.replicate(svr.link)
+	return nil
+}
+
+// 当前的复制连接，自己是主服务器时返回nil
+func (svr *CacheServer) replicaLink() *replicaLink {
+	svr.linkMutex.Lock()
+	defer svr.linkMutex.Unlock()
+
+	return svr.link
+}
+
+// 停止复制，关闭服务器时调用
+func (svr *CacheServer) stopReplication() {
+	if link := svr.replicaLink(); link != nil {
+		link.close()
+	}
+}
+
+// 与主服务器同步，连接断开后每秒重试一次，直到复制停止
+func (svr *CacheServer) replicate(link *replicaLink) {
+	log.Printf("replication: connecting to master %s", link.master)
+	for {
+		err := svr.syncWithMaster(link)
+		select {
+		case <-link.stop:
+			return
+		default:
+		}
+		log.Printf("replication: master %s: %v", link.master, err)
+		link.setState("connect")
+		select {
+		case <-link.stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+/*
+ * 复制流程：
+ * 1. 连接主服务器，配置了masterauth时先登录
+ * 2. 用REPLCONF告知自己的监听端口，再用PSYNC发送自己的复制ID与偏移量
+ * 3. 主服务器回复CONTINUE时直接接收缺失的复制流；回复FULLSYNC时清空数据并加载快照，
+ *    沿用主服务器的复制ID与偏移量，同时断开自己的副本，使其重新同步
+ * 4. 逐条执行复制流中的命令，并原样转发给自己的副本，直到连接断开；
+ *    期间每秒用REPLCONF ACK告知已执行的偏移量，复制流中出现REPLCONF GETACK时立即告知
+ */
+func (svr *CacheServer) syncWithMaster(link *replicaLink) error {
+	conn, err := net.DialTimeout("tcp", link.master, masterDialTimeout)
+	if err != nil {
+		return err
+	}
+	if !link.attach(conn) {
+		conn.Close()
+		return errLinkClosed
+	}
+	defer conn.Close()
+	reader := bufio.NewReaderSize(conn, ioBufSize)
+
+	// masteruser与masterauth可在运行时修改，加锁读取
+	ps := svr.cfg.Params()
+	if pass, _ := ps.Get("masterauth"); pass != "" {
+		user, _ := ps.Get("masteruser")
+		if user == "" {
+			user = acl.DefaultUser
+		}
+		if err := masterRequest(conn, reader, "AUTH "+user+" "+pass); err != nil {
+			return fmt.Errorf("auth: %v", err)
+		}
+	}
+	if _, port, err := net.SplitHostPort(svr.cfg.Listen); err == nil {
+		if err := masterRequest(conn, reader, "REPLCONF listening-port "+port); err != nil {
+			return fmt.Errorf("replconf: %v", err)
+		}
+	}
+
+	link.setState("sync")
+	// 没有积压缓冲区（从未同步过，也没有副本）时无法部分重同步，直接请求全量同步
+	repl := command.Replication()
+	psync := fmt.Sprintf("%s %s %d\n", utils.PSYNC, repl.ID, repl.Offset)
+	if !repl.BacklogActive {
+		psync = utils.PSYNC.String() + " ? -1\n"
+	}
+	if err := utils.WriteAll(conn, []byte(psync)); err != nil {
+		return err
+	}
+	header, err := readPsyncHeader(reader)
+	if err != nil {
+		return err
+	}
+	if header.full {
+		if err := svr.loadFromMaster(reader, header); err != nil {
+			return err
+		}
+		log.Printf("replication: full sync with master %s done, %d bytes", link.master, header.size)
+	} else {
+		if command.ContinueReplication(header.id) {
+			command.DisconnectReplicas()
+		}
+		log.Printf("replication: partial resync with master %s from offset %d", link.master, repl.Offset)
+	}
+	atomic.StoreInt64(&link.lastIO, time.Now().UnixNano())
+	link.setState("connected")
+
+	done := make(chan struct{})
+	defer close(done)
+	go link.ackLoop(conn, done)
+
+	clt := command.NewMasterClient(svr.cache)
+	defer clt.Close()
+	var raw []byte
+	for {
+		var readErr error
+		raw = raw[:0]
+		cmd, args, ok := utils.ParseFsm(func() (byte, bool) {
+			b, err := reader.ReadByte()
+			if err != nil {
+				readErr = err
+				return b, false
+			}
+			raw = append(raw, b)
+			return b, true
+		})
+		if !ok {
+			if readErr == nil {
+				readErr = io.ErrUnexpectedEOF
+			}
+			return readErr
+		}
+		clt.ExecUpstream(cmd, args, raw)
+		atomic.StoreInt64(&link.lastIO, time.Now().UnixNano())
+		if cmd == utils.REPLCONF && len(args) > 0 && strings.EqualFold(args[0], "GETACK") {
+			if err := link.sendAck(conn); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// 向主服务器告知已执行的复制流偏移量
+func (link *replicaLink) sendAck(conn net.Conn) error {
+	link.writeMutex.Lock()
+	defer link.writeMutex.Unlock()
+
+	line := fmt.Sprintf("%s ACK %d\n", utils.REPLCONF, command.Replication().Offset)
+	return utils.WriteAll(conn, []byte(line))
+}
+
+// 同步完成后立即发送一次ACK，之后每秒一次，直到done关闭
+func (link *replicaLink) ackLoop(conn net.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(replAckInterval)
+	defer ticker.Stop()
+	for {
+		if link.sendAck(conn) != nil {
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 全量同步：清空数据并加载快照，沿用主服务器的复制ID与偏移量
+func (svr *CacheServer) loadFromMaster(reader *bufio.Reader, header psyncHeader) error {
+	svr.cache.Clear()
+	if err := persistence.ReadSnapshot(io.LimitReader(reader, header.size), svr.cache.Load); err != nil {
+		return fmt.Errorf("load snapshot: %v", err)
+	}
+	// 快照之后是回复结尾的\n
+	if _, err := reader.ReadByte(); err != nil {
+		return err
+	}
+	command.ResetReplication(header.id, header.offset)
+	command.DisconnectReplicas()
+	svr.saveSynced()
+	return nil
+}
+
+// 向主服务器发送一条命令，回复不是DONE时返回错误
+func masterRequest(conn net.Conn, reader *bufio.Reader, line string) error {
+	if err := utils.WriteAll(conn, []byte(line+"\n")); err != nil {
+		return err
+	}
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if reply = strings.TrimSuffix(reply, "\n"); reply != "DONE" {
+		return errors.New(reply)
+	}
+	return nil
+}
+
+// PSYNC回复的首行："FULLSYNC 复制ID 偏移量 字节数"或"CONTINUE 复制ID"
+type psyncHeader struct {
+	full   bool
+	id     string
+	offset int64
+	size   int64
+}
+
+func readPsyncHeader(reader *bufio.Reader) (header psyncHeader, err error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return header, err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	elem := strings.Fields(line)
+	switch {
+	case len(elem) == 2 && elem[0] == "CONTINUE":
+		header.id = elem[1]
+		return header, nil
+
+	case len(elem) == 4 && elem[0] == "FULLSYNC":
+		header.full, header.id = true, elem[1]
+		if header.offset, err = strconv.ParseInt(elem[2], 10, 64); err != nil {
+			return header, fmt.Errorf("bad sync header %q", line)
+		}
+		if header.size, err = strconv.ParseInt(elem[3], 10, 64); err != nil || header.size < 0 {
+			return header, fmt.Errorf("bad sync header %q", line)
+		}
+		return header, nil
+	}
+	return header, errors.New(line)
+}
+
+// 开启AOF时，全量同步后写快照并清空AOF，重启后从快照恢复同步得到的数据
+func (svr *CacheServer) saveSynced() {
+	aof := persistence.AofInstance()
+	if !aof.Stats().Enabled {
+		return
+	}
+	if err := persistence.SaveSnapshot(svr.cfg.DbFilename, svr.cache.Entries()); err != nil {
+		log.Printf("replication: save snapshot: %v", err)
+	} else if err := aof.Truncate(); err != nil {
+		log.Printf("replication: truncate AOF: %v", err)
+	}
+}
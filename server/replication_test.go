@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// INFO中某一项的值
+func infoField(c *testConn, section string, field string) string {
+	c.t.Helper()
+	for _, line := range strings.Split(c.do("INFO "+section), "\n") {
+		if v, ok := strings.CutPrefix(line, field+":"); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// 每隔一段时间检查一次，直到cond成立或超时
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// 启动主服务器与一个副本，等待全量同步完成
+func startReplication(t *testing.T, masterArgs ...string) (master *testServer, replica *testServer) {
+	t.Helper()
+	master = startServer(t, masterArgs...)
+	_, port, _ := net.SplitHostPort(master.addr)
+	replica = startServer(t, "-replicaof", "127.0.0.1 "+port)
+	m := dial(t, master.addr)
+	waitFor(t, "replica to connect", func() bool {
+		return infoField(m, "replication", "connected_slaves") == "1"
+	})
+	return master, replica
+}
+
+// 副本执行到与主服务器相同的偏移量
+func waitInSync(t *testing.T, m *testConn, r *testConn) {
+	t.Helper()
+	waitFor(t, "replica to catch up", func() bool {
+		return infoField(r, "replication", "master_link_status") == "up" &&
+			infoField(r, "replication", "slave_repl_offset") == infoField(m, "replication", "master_repl_offset")
+	})
+}
+
+// 断开主服务器上的复制连接，副本随后重连
+func killReplicaLink(t *testing.T, m *testConn) {
+	t.Helper()
+	for _, line := range strings.Split(m.do("CLIENT LIST"), "\n") {
+		if !strings.Contains(line, " class=replica ") {
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			if addr, ok := strings.CutPrefix(field, "addr="); ok {
+				m.expect("CLIENT KILL ADDR "+addr, "1")
+				return
+			}
+		}
+	}
+	t.Fatal("no replica connection on master")
+}
+
+func syncStats(m *testConn) string {
+	return fmt.Sprintf("full=%s partial_ok=%s partial_err=%s",
+		infoField(m, "stats", "sync_full"), infoField(m, "stats", "sync_partial_ok"), infoField(m, "stats", "sync_partial_err"))
+}
+
+// 断线期间的写入仍在积压缓冲区中时，副本重连后只接收缺失的部分
+func TestPartialResync(t *testing.T) {
+	master, replica := startReplication(t)
+	m, r := dial(t, master.addr), dial(t, replica.addr)
+	m.expect("SET before:1", "DONE")
+	waitInSync(t, m, r)
+	r.expect("GET before", "1")
+	if got, want := syncStats(m), "full=1 partial_ok=0 partial_err=0"; got != want {
+		t.Fatalf("initial sync: %s, want %s", got, want)
+	}
+	replID := infoField(m, "replication", "master_replid")
+
+	killReplicaLink(t, m)
+	for i := 0; i < 20; i++ {
+		m.expect(fmt.Sprintf("SET during%d:%d", i, i), "DONE")
+	}
+	m.expect("DEL before", "DONE")
+	waitInSync(t, m, r)
+
+	if got, want := syncStats(m), "full=1 partial_ok=1 partial_err=0"; got != want {
+		t.Errorf("after reconnect: %s, want %s", got, want)
+	}
+	if id := infoField(r, "replication", "master_replid"); id != replID {
+		t.Errorf("replica replication ID %s, master %s", id, replID)
+	}
+	for i := 0; i < 20; i++ {
+		r.expect(fmt.Sprintf("GET during%d", i), fmt.Sprint(i))
+	}
+	r.expect("GET before", "key is not exits")
+
+	// 之后的写入继续复制
+	m.expect("SET after:1", "DONE")
+	waitInSync(t, m, r)
+	r.expect("GET after", "1")
+}
+
+// 断线期间的写入超出积压缓冲区时，副本重连后全量同步
+func TestFullResyncAfterBacklogOverflow(t *testing.T) {
+	const backlog = 1024
+	master, replica := startReplication(t, "-repl-backlog-size", fmt.Sprint(backlog))
+	m, r := dial(t, master.addr), dial(t, replica.addr)
+	m.expect("SET before:1", "DONE")
+	m.expect("SET gone:1", "DONE")
+	waitInSync(t, m, r)
+
+	// 副本断线后每秒重试一次，在它重连之前写入远多于积压缓冲区的数据
+	killReplicaLink(t, m)
+	value := strings.Repeat("v", 100)
+	var lines []string
+	for i := 0; i < 4*backlog/len(value); i++ {
+		lines = append(lines, fmt.Sprintf("SET overflow%d:%s%d", i, value, i))
+	}
+	lines = append(lines, "DEL gone")
+	m.send(lines...)
+	for range lines {
+		if got := m.recv(); got != "DONE" {
+			t.Fatalf("write on master: %q", got)
+		}
+	}
+	if first := infoField(m, "replication", "repl_backlog_first_byte_offset"); first == "0" {
+		t.Fatal("backlog did not overflow")
+	}
+	waitInSync(t, m, r)
+
+	if got, want := syncStats(m), "full=2 partial_ok=0 partial_err=1"; got != want {
+		t.Errorf("after reconnect: %s, want %s", got, want)
+	}
+	r.expect("GET before", "1")
+	r.expect("GET gone", "key is not exits")
+	for i := range lines[:len(lines)-1] {
+		r.expect(fmt.Sprintf("GET overflow%d", i), fmt.Sprintf("%s%d", value, i))
+	}
+	if got := infoField(r, "keyspace", "db0"); got != infoField(m, "keyspace", "db0") {
+		t.Errorf("replica keyspace %q, master %q", got, infoField(m, "keyspace", "db0"))
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"tinycached/server/command"
+	"tinycached/utils"
+)
+
+// 客户端会话：命令执行与回复，与网络模型无关
+type session struct {
+	clt    *command.CacheClientInfo
+	parser *utils.Parser // 事件循环模式下增量解析收到的数据
+	// 事件循环模式下，WAIT在单独的协程中阻塞，期间收到的数据留在pending中，WAIT返回后再处理
+	mutex   sync.Mutex
+	blocked bool
+	pending []byte
+}
+
+// 执行一条命令，并将回复写入w
+func (s *session) exec(cmd utils.CmdType, args []string, w utils.ReplyWriter) {
+	for _, body := range utils.Bodies(cmd, args) {
+		ret, err := s.clt.ExecCmd(cmd, body)
+		if err == command.ErrNoReply {
+			continue
+		}
+		if err != nil {
+			ret = []byte(err.Error())
+		}
+		utils.WriteReply(w, ret)
+	}
+}
+
+// 执行一条命令，返回全部回复
+func (s *session) execBuffered(cmd utils.CmdType, args []string) []byte {
+	var out bytes.Buffer
+	s.exec(cmd, args, &out)
+	return out.Bytes()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tinycached/server/persistence"
+)
+
+// 服务器持有的客户端连接，关闭服务器时用于唤醒阻塞在读上的处理协程
+type clientConn struct {
+	qbuf int64 // 最近一条命令处理完时读缓冲区中尚未处理的字节数，原子操作，放在首位保证64位对齐
+	obl  int64 // 最近一条命令处理完时尚未写出的字节数，原子操作
+	net.Conn
+	mutex   sync.Mutex
+	closing bool
+}
+
+// 记录读写缓冲区中的字节数，供CLIENT LIST读取
+func (c *clientConn) setBuffers(query int, output int) {
+	atomic.StoreInt64(&c.qbuf, int64(query))
+	atomic.StoreInt64(&c.obl, int64(output))
+}
+
+func (c *clientConn) buffers() (int, int) {
+	return int(atomic.LoadInt64(&c.qbuf)), int(atomic.LoadInt64(&c.obl))
+}
+
+// 读取下一条命令前调用，设置空闲超时；服务器正在关闭时返回false
+func (c *clientConn) waitCommand(timeout time.Duration) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closing {
+		return false
+	}
+	if timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		c.SetReadDeadline(time.Time{})
+	}
+	return true
+}
+
+// 服务器是否正在关闭
+func (c *clientConn) isClosing() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.closing
+}
+
+// 停止读取新命令：正在执行的命令不受影响，阻塞在读上的处理协程立即返回
+func (c *clientConn) stopReading() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closing = true
+	c.SetReadDeadline(time.Now())
+}
+
+func (svr *CacheServer) addConn(conn net.Conn) *clientConn {
+	c := &clientConn{Conn: conn}
+	atomic.AddUint64(&svr.totalConns, 1)
+	svr.connMutex.Lock()
+	defer svr.connMutex.Unlock()
+
+	svr.conns[c] = struct{}{}
+	if ctx.Err() != nil {
+		// 关闭过程中才接受的连接不再处理命令
+		c.closing = true
+	}
+	return c
+}
+
+func (svr *CacheServer) removeConn(c *clientConn) {
+	svr.connMutex.Lock()
+	defer svr.connMutex.Unlock()
+
+	delete(svr.conns, c)
+}
+
+// 强制关闭连接后等待处理协程退出的最长时间：协程可能仍在执行最后一条命令，须在写快照与关闭AOF之前结束
+const forceCloseWait = 5 * time.Second
+
+/*
+ * 关闭流程：
+ * 1. 监听已关闭，接受连接的协程已全部退出，不再有新连接
+ * 2. 唤醒空闲连接并使其退出，正在执行命令的连接回复后退出
+ * 3. 等待全部连接退出，超过shutdown-timeout则强制关闭，再等待处理协程退出，最多forceCloseWait
+ * 4. 停止复制，不再执行主服务器发来的命令；停止Raft节点
+ * 5. 按配置写快照，之后AOF中的内容已全部包含在快照中，清空AOF；Raft模式下数据保存在raft-dir，不写快照
+ * 6. AOF缓冲区写入文件并刷盘
+ */
+func (svr *CacheServer) shutdown() {
+	log.Print("shutting down")
+	svr.connMutex.Lock()
+	for c := range svr.conns {
+		c.stopReading()
+	}
+	svr.connMutex.Unlock()
+
+	if !svr.waitHandlers(svr.cfg.ShutdownTimeout) {
+		svr.connMutex.Lock()
+		log.Printf("shutdown timeout, closing %d connection(s)", len(svr.conns))
+		for c := range svr.conns {
+			c.Close()
+		}
+		svr.connMutex.Unlock()
+		// 连接关闭后仍在执行的命令可能还要写缓存与AOF，等它们结束后再写快照
+		if !svr.waitHandlers(forceCloseWait) {
+			log.Printf("%d connection handler(s) still running, writes after the snapshot may be lost", svr.numHandlers())
+		}
+	}
+
+	svr.stopReplication()
+	svr.stopRaft()
+	aof := persistence.AofInstance()
+	if svr.cfg.ShutdownSnapshot && svr.raft == nil {
+		if err := persistence.SaveSnapshot(svr.cfg.DbFilename, svr.cache.Entries()); err != nil {
+			log.Printf("save snapshot: %v", err)
+		} else if err := aof.Truncate(); err != nil {
+			log.Printf("truncate AOF: %v", err)
+		} else {
+			log.Printf("snapshot saved to %s", svr.cfg.DbFilename)
+		}
+	}
+	if err := aof.Close(); err != nil {
+		log.Printf("close AOF: %v", err)
+	}
+	log.Print("server stopped")
+}
+
+// 等待全部连接的处理协程退出，超时返回false
+func (svr *CacheServer) waitHandlers(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		svr.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// 仍未退出的处理协程数，即仍登记着的连接数
+func (svr *CacheServer) numHandlers() int {
+	svr.connMutex.Lock()
+	defer svr.connMutex.Unlock()
+	return len(svr.conns)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 一条慢日志的各字段
+type slowlogLine struct {
+	id       int
+	time     time.Time
+	duration time.Duration
+	addr     string
+	command  string
+}
+
+// SLOWLOG GET的回复，从新到旧
+func slowlogGet(c *testConn, args string) []slowlogLine {
+	c.t.Helper()
+	reply := c.do(strings.TrimSpace("SLOWLOG GET " + args))
+	lines := strings.Split(reply, "\n")
+	if !strings.HasPrefix(lines[0], "*") {
+		c.t.Fatalf("SLOWLOG GET %s: %q", args, reply)
+	}
+	var ret []slowlogLine
+	for _, line := range lines[1:] {
+		f := strings.SplitN(line, " ", 5)
+		if len(f) != 5 {
+			c.t.Fatalf("bad slowlog line %q", line)
+		}
+		id, err1 := strconv.Atoi(f[0])
+		sec, err2 := strconv.ParseInt(f[1], 10, 64)
+		us, err3 := strconv.ParseInt(f[2], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			c.t.Fatalf("bad slowlog line %q", line)
+		}
+		ret = append(ret, slowlogLine{id, time.Unix(sec, 0), time.Duration(us) * time.Microsecond, f[3], f[4]})
+	}
+	return ret
+}
+
+// 超过阈值的命令记入慢日志，超出最大条数时丢弃最旧的，RESET清空但编号继续递增
+func TestSlowlog(t *testing.T) {
+	s := startServer(t, "-slowlog-log-slower-than", "100ms", "-slowlog-max-len", "3")
+	c := dial(t, s.addr)
+	addr := c.LocalAddr().String()
+
+	c.expect("SET sl_a:1", "DONE")
+	c.expect("GET sl_a", "1")
+	c.expect("SLOWLOG LEN", "0")
+	c.expect("SLOWLOG GET", "*0")
+
+	start := time.Now()
+	c.expect("WAIT 1 150", "0")
+	c.expect("SLOWLOG LEN", "1")
+	entries := slowlogGet(c, "")
+	if len(entries) != 1 {
+		t.Fatalf("%d entries, want 1", len(entries))
+	}
+	e := entries[0]
+	if e.id != 0 || e.addr != addr || e.command != "WAIT 1 150" {
+		t.Errorf("entry %+v, want id 0 from %s for WAIT 1 150", e, addr)
+	}
+	if e.duration < 150*time.Millisecond || e.duration > 5*time.Second {
+		t.Errorf("duration %v, want at least 150ms", e.duration)
+	}
+	if e.time.Before(start.Truncate(time.Second)) || e.time.After(time.Now()) {
+		t.Errorf("start time %v, want about %v", e.time, start)
+	}
+
+	// 阈值调低后每条命令都记录；只保留最新的3条，从新到旧
+	c.expect("CONFIG SET slowlog-log-slower-than 1ns", "DONE")
+	for i := 0; i < 4; i++ {
+		c.expect(fmt.Sprintf("SET sl_%d:%d", i, i), "DONE")
+	}
+	c.expect("SLOWLOG LEN", "3")
+	entries = slowlogGet(c, "-1")
+	// SLOWLOG LEN本身也记入慢日志
+	want := []string{"SLOWLOG LEN", "SET sl_3:3", "SET sl_2:2"}
+	if len(entries) != len(want) {
+		t.Fatalf("%d entries, want %d", len(entries), len(want))
+	}
+	for i, e := range entries {
+		if e.command != want[i] || e.id != entries[0].id-i {
+			t.Errorf("entry %d: %d %q, want %q with consecutive ids", i, e.id, e.command, want[i])
+		}
+	}
+	// 编号0为WAIT，1为生效后记录的CONFIG SET本身
+	if entries[0].id != 6 {
+		t.Errorf("newest id %d, want 6", entries[0].id)
+	}
+	if got := slowlogGet(c, "2"); len(got) != 2 || got[0].command != "SLOWLOG GET -1" {
+		t.Errorf("SLOWLOG GET 2: %+v", got)
+	}
+	c.expect("SLOWLOG GET -2", "count should be a non-negative integer or -1")
+	c.expect("SLOWLOG GET x", "count should be a non-negative integer or -1")
+	c.expect("SLOWLOG GET 0", "*0")
+
+	// 过长的参数被截断
+	long := strings.Repeat("x", 200)
+	c.expect("SET sl_long:"+long, "DONE")
+	if got := slowlogGet(c, "1"); got[0].command != "SET sl_long:"+long[:128-len("sl_long:")]+"... (80 more bytes)" {
+		t.Errorf("long command logged as %q", got[0].command)
+	}
+
+	// 调小最大条数时保留最新的
+	c.expect("CONFIG SET slowlog-max-len 1", "DONE")
+	if got := slowlogGet(c, "-1"); len(got) != 1 || got[0].command != "CONFIG SET slowlog-max-len 1" {
+		t.Errorf("after shrinking: %+v", got)
+	}
+
+	// 阈值为0时不记录；RESET之后编号继续递增
+	c.expect("CONFIG SET slowlog-log-slower-than 0", "DONE")
+	c.expect("SLOWLOG RESET", "DONE")
+	c.expect("SLOWLOG LEN", "0")
+	c.expect("WAIT 1 150", "0")
+	c.expect("SLOWLOG LEN", "0")
+	c.expect("CONFIG SET slowlog-log-slower-than 100ms", "DONE")
+	c.expect("WAIT 1 150", "0")
+	if got := slowlogGet(c, ""); len(got) != 1 || got[0].command != "WAIT 1 150" || got[0].id <= entries[0].id {
+		t.Errorf("after RESET: %+v", got)
+	}
+	c.expect("SLOWLOG COUNT", "wrong command")
+}
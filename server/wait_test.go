@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// WAIT写入GETACK使副本立即确认，不必等待每秒一次的ACK；副本不足时超时返回已确认的数量
+func TestWait(t *testing.T) {
+	master := startServer(t)
+	_, port, _ := net.SplitHostPort(master.addr)
+	r1 := startServer(t, "-replicaof", "127.0.0.1 "+port)
+	r2 := startServer(t, "-replicaof", "127.0.0.1 "+port)
+	m := dial(t, master.addr)
+	waitFor(t, "replicas to connect", func() bool {
+		return infoField(m, "replication", "connected_slaves") == "2"
+	})
+	waitInSync(t, m, dial(t, r1.addr))
+	waitInSync(t, m, dial(t, r2.addr))
+
+	c := dial(t, master.addr)
+	// 返回已确认的副本数，可能多于要求的数量
+	c.expect("WAIT 0 0", "2")
+	for i := 0; i < 5; i++ {
+		c.expect("SET wait_a:1", "DONE")
+		start := time.Now()
+		c.expect("WAIT 2 5000", "2")
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Errorf("WAIT took %v; replicas should ack on GETACK instead of the periodic ACK", d)
+		}
+	}
+	c.expect("SET wait_b:1", "DONE")
+	if got := c.do("WAIT 1 5000"); got != "1" && got != "2" {
+		t.Errorf("WAIT 1: got %q", got)
+	}
+
+	// 一个副本停止响应：超时返回部分数量
+	r2.cmd.Process.Signal(syscall.SIGSTOP)
+	defer r2.cmd.Process.Signal(syscall.SIGCONT)
+	c.expect("SET wait_c:1", "DONE")
+	start := time.Now()
+	c.expect("WAIT 2 300", "1")
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("WAIT returned after %v, before its 300ms timeout", d)
+	}
+
+	// 副本恢复后确认，WAIT在超时前返回
+	c.expect("SET wait_d:1", "DONE")
+	start = time.Now()
+	c.send("WAIT 2 10000")
+	time.Sleep(200 * time.Millisecond)
+	r2.cmd.Process.Signal(syscall.SIGCONT)
+	if got := c.recv(); got != "2" {
+		t.Errorf("WAIT after the replica resumed: got %q, want 2", got)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond || d > 5*time.Second {
+		t.Errorf("WAIT returned after %v", d)
+	}
+
+	// 没有写入过的连接等待此刻复制流中的全部写入
+	dial(t, master.addr).expect("WAIT 2 5000", "2")
+	dial(t, r1.addr).expect("WAIT 1 100", "WAIT cannot be used with replica instances")
+	c.expect("WAIT -1 100", "invalid number of replicas")
+	c.expect("WAIT 1 x", "invalid timeout")
+}
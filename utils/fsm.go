@@ -2,7 +2,7 @@ package utils
 
 import "strings"
 
-var maxCmdSize = 8
+var maxCmdSize = 16
 var maxArgSize = 256
 
 type fsmState interface {
@@ -17,14 +17,15 @@ func (s *cmdState) doAction(ctx *fsmContext) {
 	if s.cmd == nil {
 		s.cmd = make([]byte, 0)
 	}
-	if len(s.cmd) > maxCmdSize {
+	if ctx.curByte == '\n' {
+		ctx.cmd = string(s.cmd)
+		ctx.args = []string{""} // 无参数命令也需要执行一次
+		ctx.setState(&endState{})
+	} else if len(s.cmd) >= maxCmdSize {
 		ctx.setState(&errState{})
 	} else if ctx.curByte == ' ' {
 		ctx.cmd = string(s.cmd)
 		ctx.setState(&argState{})
-	} else if ctx.curByte == '\n' {
-		ctx.cmd = string(s.cmd)
-		ctx.setState(&endState{})
 	} else {
 		s.cmd = append(s.cmd, ctx.curByte)
 	}
@@ -39,28 +40,33 @@ func (s *argState) doAction(ctx *fsmContext) {
 		s.arg = make([]byte, 0)
 	}
 
-	if len(s.arg) > maxArgSize {
-		ctx.setState(&errState{})
-	} else if ctx.curByte == '\n' {
+	if ctx.curByte == '\n' {
 		ctx.args = strings.Split(string(s.arg), " ")
 		ctx.setState(&endState{})
+	} else if len(s.arg) >= maxArgSize {
+		ctx.setState(&errState{})
 	} else {
 		s.arg = append(s.arg, ctx.curByte)
 	}
 }
 
+// 一条命令解析完成
 type endState struct {
 }
 
 func (s *endState) doAction(ctx *fsmContext) {
-	ctx.setState(&cmdState{})
 }
 
+// 命令格式错误，丢弃到行尾
 type errState struct {
 }
 
 func (s *errState) doAction(ctx *fsmContext) {
-	ctx.setState(&cmdState{})
+	if ctx.curByte == '\n' {
+		ctx.cmd = ""
+		ctx.args = []string{""}
+		ctx.setState(&endState{})
+	}
 }
 
 type fsmContext struct {
@@ -78,7 +84,12 @@ func newContext() (ctx *fsmContext) {
 }
 
 func (ctx *fsmContext) getCmd() CmdType {
-	switch strings.ToUpper(ctx.cmd) {
+	return ParseCmdType(ctx.cmd)
+}
+
+// 由命令名得到命令类型，不区分大小写
+func ParseCmdType(name string) CmdType {
+	switch strings.ToUpper(name) {
 	case "GET":
 		return GET
 	case "SET":
@@ -97,6 +108,44 @@ func (ctx *fsmContext) getCmd() CmdType {
 		return WATCH
 	case "UNWATCH":
 		return UNWATCH
+	case "SUBSCRIBE":
+		return SUBSCRIBE
+	case "PSUBSCRIBE":
+		return PSUBSCRIBE
+	case "UNSUBSCRIBE":
+		return UNSUBSCRIBE
+	case "CONFIG":
+		return CONFIG
+	case "AUTH":
+		return AUTH
+	case "ACL":
+		return ACL
+	case "ASUSER":
+		return ASUSER
+	case "INFO":
+		return INFO
+	case "SLOWLOG":
+		return SLOWLOG
+	case "MONITOR":
+		return MONITOR
+	case "CLIENT":
+		return CLIENT
+	case "SYNC":
+		return SYNC
+	case "PSYNC":
+		return PSYNC
+	case "REPLCONF":
+		return REPLCONF
+	case "REPLICAOF":
+		return REPLICAOF
+	case "WAIT":
+		return WAIT
+	case "SENTINEL":
+		return SENTINEL
+	case "PROXY":
+		return PROXY
+	case "PING":
+		return PING
 	default:
 		return ERROR
 	}
@@ -110,26 +159,41 @@ func (ctx *fsmContext) setState(state fsmState) {
 	ctx.curState = state
 }
 
+// 增量协议解析器：逐字节输入，每解析出一条完整命令返回一次；格式错误的命令解析为ERROR
+type Parser struct {
+	ctx *fsmContext
+}
+
+func NewParser() *Parser {
+	return &Parser{ctx: newContext()}
+}
+
+// 输入一个字节，解析出完整命令时done为true
+func (p *Parser) Feed(b byte) (cmd CmdType, args []string, done bool) {
+	if b == '\r' {
+		// 兼容telnet等以\r\n结尾的客户端
+		return ERROR, nil, false
+	}
+	p.ctx.curByte = b
+	p.ctx.getState().doAction(p.ctx)
+	if _, isEndState := p.ctx.getState().(*endState); !isEndState {
+		return ERROR, nil, false
+	}
+	cmd, args = p.ctx.getCmd(), p.ctx.args
+	p.ctx = newContext()
+	return cmd, args, true
+}
+
+// 每次从recv接收一个字符直至解析出一条完整命令；recv失败时返回false
 func ParseFsm(recv func() (byte, bool)) (CmdType, []string, bool) {
-	ctx := newContext()
-	var ok bool
+	p := NewParser()
 	for {
-		ctx.curByte, ok = recv()
+		b, ok := recv()
 		if !ok {
 			return ERROR, nil, false
 		}
-
-		state := ctx.getState()
-		_, isEndState := state.(*endState)
-		_, isErrState := state.(*errState)
-		state.doAction(ctx)
-
-		if isEndState || isErrState {
-			if isErrState {
-				return ERROR, nil, false
-			}
-			break
+		if cmd, args, done := p.Feed(b); done {
+			return cmd, args, true
 		}
 	}
-	return ctx.getCmd(), ctx.args, true
 }
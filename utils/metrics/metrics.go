@@ -0,0 +1,144 @@
+// 手写的Prometheus文本格式指标输出，不依赖客户端库：
+// 计数器与仪表由调用方在抓取时读出当前值写入，直方图由本包累计
+package metrics
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 延迟直方图的默认桶上界（秒），缓存命令通常在微秒级
+var DefBuckets = []float64{
+	0.00001, 0.00005, 0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1,
+}
+
+// 并发安全的延迟直方图
+type Histogram struct {
+	bounds []float64
+	counts []uint64 // 每个桶（不累计）的样本数，最后一个为+Inf
+	sumNs  uint64
+	count  uint64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	i := sort.SearchFloat64s(h.bounds, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sumNs, uint64(d))
+	atomic.AddUint64(&h.count, 1)
+}
+
+// 样本总数
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// 标签，按给出的顺序输出
+type Label struct {
+	Name  string
+	Value string
+}
+
+func L(name string, value string) Label {
+	return Label{name, value}
+}
+
+// 指标输出，同名指标的HELP与TYPE只输出一次
+type Writer struct {
+	w    *bufio.Writer
+	last string
+}
+
+func NewWriter(w *bufio.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) header(name string, typ string, help string) {
+	if w.last == name {
+		return
+	}
+	w.last = name
+	w.w.WriteString("# HELP " + name + " " + help + "\n")
+	w.w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func (w *Writer) sample(name string, labels []Label, value string) {
+	w.w.WriteString(name)
+	if len(labels) > 0 {
+		w.w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.w.WriteByte(',')
+			}
+			w.w.WriteString(l.Name + "=\"" + escape(l.Value) + "\"")
+		}
+		w.w.WriteByte('}')
+	}
+	w.w.WriteString(" " + value + "\n")
+}
+
+func (w *Writer) Counter(name string, help string, value uint64, labels ...Label) {
+	w.header(name, "counter", help)
+	w.sample(name, labels, strconv.FormatUint(value, 10))
+}
+
+func (w *Writer) Gauge(name string, help string, value float64, labels ...Label) {
+	w.header(name, "gauge", help)
+	w.sample(name, labels, formatFloat(value))
+}
+
+func (w *Writer) Histogram(name string, help string, h *Histogram, labels ...Label) {
+	w.header(name, "histogram", help)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		w.sample(name+"_bucket", append(labels[:len(labels):len(labels)], L("le", formatFloat(bound))),
+			strconv.FormatUint(cumulative, 10))
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.bounds)])
+	w.sample(name+"_bucket", append(labels[:len(labels):len(labels)], L("le", "+Inf")),
+		strconv.FormatUint(cumulative, 10))
+	w.sample(name+"_sum", labels, formatFloat(float64(atomic.LoadUint64(&h.sumNs))/1e9))
+	w.sample(name+"_count", labels, strconv.FormatUint(cumulative, 10))
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+// 在addr上开启HTTP服务，GET /metrics时调用collect写出全部指标
+func Serve(addr string, collect func(w *Writer)) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(rw)
+		collect(NewWriter(bw))
+		bw.Flush()
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(listener)
+	return srv, nil
+}
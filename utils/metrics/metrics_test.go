@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func write(fn func(w *Writer)) string {
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	fn(NewWriter(bw))
+	bw.Flush()
+	return buf.String()
+}
+
+// 同名指标的多组标签共用一组HELP与TYPE
+func TestWriterHeader(t *testing.T) {
+	got := write(func(w *Writer) {
+		w.Counter("cmd_total", "Commands processed.", 3, L("cmd", "get"))
+		w.Counter("cmd_total", "Commands processed.", 5, L("cmd", "set"))
+		w.Gauge("clients", "Connected clients.", 2)
+		w.Gauge("ratio", "Hit ratio.", 0.25, L("db", "0"), L("role", "master"))
+	})
+	want := `# HELP cmd_total Commands processed.
+# TYPE cmd_total counter
+cmd_total{cmd="get"} 3
+cmd_total{cmd="set"} 5
+# HELP clients Connected clients.
+# TYPE clients gauge
+clients 2
+# HELP ratio Hit ratio.
+# TYPE ratio gauge
+ratio{db="0",role="master"} 0.25
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// 桶的计数是累计的，最后是+Inf桶、_sum与_count；le标签追加在调用方的标签之后
+func TestWriterHistogram(t *testing.T) {
+	h := NewHistogram([]float64{0.001, 0.01, 0.1})
+	for _, d := range []time.Duration{500 * time.Microsecond, 5 * time.Millisecond, 5 * time.Millisecond, 2 * time.Second} {
+		h.Observe(d)
+	}
+	if h.Count() != 4 {
+		t.Errorf("Count: got %d, want 4", h.Count())
+	}
+	labels := []Label{L("cmd", "get")}
+	got := write(func(w *Writer) {
+		w.Histogram("latency_seconds", "Command latency.", h, labels...)
+		w.Histogram("latency_seconds", "Command latency.", NewHistogram([]float64{0.001}), L("cmd", "set"))
+	})
+	want := `# HELP latency_seconds Command latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{cmd="get",le="0.001"} 1
+latency_seconds_bucket{cmd="get",le="0.01"} 3
+latency_seconds_bucket{cmd="get",le="0.1"} 3
+latency_seconds_bucket{cmd="get",le="+Inf"} 4
+latency_seconds_sum{cmd="get"} 2.0105
+latency_seconds_count{cmd="get"} 4
+latency_seconds_bucket{cmd="set",le="0.001"} 0
+latency_seconds_bucket{cmd="set",le="+Inf"} 0
+latency_seconds_sum{cmd="set"} 0
+latency_seconds_count{cmd="set"} 0
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	// 追加le标签不能改写调用方的切片
+	if len(labels) != 1 || labels[0] != L("cmd", "get") {
+		t.Errorf("labels modified: %v", labels)
+	}
+}
+
+// 标签值中的反斜杠、双引号与换行需要转义
+func TestWriterEscape(t *testing.T) {
+	got := write(func(w *Writer) {
+		w.Gauge("info", "Escaped labels.", 1, L("path", `C:\data`), L("name", `say "hi"`), L("text", "a\nb"))
+	})
+	want := `# HELP info Escaped labels.
+# TYPE info gauge
+info{path="C:\\data",name="say \"hi\"",text="a\nb"} 1
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
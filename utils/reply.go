@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+ * 回复格式：
+ * 单行回复以\n结尾，如DONE\n
+ * 多行回复首行为*行数，之后每行一项，如*2\nmaxmemory 64mb\nmaxmemory-policy allkeys-lru\n
+ * 协议没有转义，单行回复不能以*开头，否则会被当作多行回复的首行，吞掉之后的回复：
+ * 回复内容来自客户端参数的命令（SET的值、PING的参数、CLIENT SETNAME的名字）拒绝以*开头的参数
+ */
+
+var (
+	ErrStarPrefix     = errors.New("values cannot start with *")
+	ErrMalformedReply = errors.New("malformed reply")
+)
+
+// 参数原样作为单行回复返回时能否与多行回复区分
+func SafeReplyLine(s string) bool {
+	return !strings.HasPrefix(s, "*")
+}
+
+// 回复的写入目标，如bufio.Writer、bytes.Buffer
+type ReplyWriter interface {
+	io.Writer
+	io.ByteWriter
+}
+
+// 写入一条回复
+func WriteReply(w ReplyWriter, ret []byte) error {
+	w.Write(ret)
+	return w.WriteByte('\n')
+}
+
+// 每次从recv接收一个字符直至读出一条完整回复，返回的回复包含结尾的\n；
+// 以*开头而行数不是非负整数的回复返回ErrMalformedReply，此后连接上的回复已无法对应
+func ReadReply(recv func() (byte, error)) ([]byte, error) {
+	line, err := readLine(recv, nil)
+	if err != nil {
+		return line, err
+	}
+	if line[0] != '*' {
+		return line, nil
+	}
+	n, err := strconv.Atoi(string(line[1 : len(line)-1]))
+	if err != nil || n < 0 {
+		return line, ErrMalformedReply
+	}
+	for i := 0; i < n; i++ {
+		if line, err = readLine(recv, line); err != nil {
+			return line, err
+		}
+	}
+	return line, nil
+}
+
+func readLine(recv func() (byte, error), buf []byte) ([]byte, error) {
+	for {
+		b, err := recv()
+		if err != nil {
+			return buf, err
+		}
+		buf = append(buf, b)
+		if b == '\n' {
+			return buf, nil
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// 服务器与代理共用的TLS配置：证书、私钥与CA从文件加载，收到SIGHUP时重新读取，
+// 新的握手使用新证书，已建立的连接不受影响
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type Options struct {
+	CertFile    string // 证书，监听时作为服务端证书，连接服务器时作为客户端证书
+	KeyFile     string // 私钥
+	CAFile      string // 用于校验对端证书的CA，为空时使用系统CA
+	AuthClients string // 是否校验客户端证书：no、optional、yes
+}
+
+func ParseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch s {
+	case "", "no":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "yes":
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("invalid tls-auth-clients %q", s)
+	}
+}
+
+// 可重新加载的证书
+type Certs struct {
+	mutex      sync.RWMutex
+	cert       *tls.Certificate // 未配置证书时为nil
+	ca         *x509.CertPool   // 未配置CA时为nil
+	clientAuth tls.ClientAuthType
+}
+
+func New(opts Options) (*Certs, error) {
+	c := &Certs{}
+	if err := c.Reload(opts); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 重新读取证书文件；读取失败时保留原来的证书
+func (c *Certs) Reload(opts Options) error {
+	clientAuth, err := ParseClientAuth(opts.AuthClients)
+	if err != nil {
+		return err
+	}
+	var cert *tls.Certificate
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		pair, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &pair
+	}
+	var ca *x509.CertPool
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return err
+		}
+		ca = x509.NewCertPool()
+		if !ca.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates found", opts.CAFile)
+		}
+	}
+	if clientAuth != tls.NoClientCert && ca == nil {
+		return errors.New("verifying client certificates requires a CA file")
+	}
+
+	c.mutex.Lock()
+	c.cert, c.ca, c.clientAuth = cert, ca, clientAuth
+	c.mutex.Unlock()
+	return nil
+}
+
+// 监听用的TLS配置，每次握手时取当前的证书
+func (c *Certs) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mutex.RLock()
+			defer c.mutex.RUnlock()
+
+			if c.cert == nil {
+				return nil, errors.New("tls: no server certificate")
+			}
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.cert},
+				ClientCAs:    c.ca,
+				ClientAuth:   c.clientAuth,
+			}, nil
+		},
+	}
+}
+
+// 连接addr用的TLS配置：按addr中的主机名校验服务器证书，服务器要求时出示当前证书
+func (c *Certs) ClientConfig(addr string) *tls.Config {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	c.mutex.RLock()
+	ca := c.ca
+	c.mutex.RUnlock()
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: host,
+		RootCAs:    ca,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			c.mutex.RLock()
+			defer c.mutex.RUnlock()
+
+			if c.cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return c.cert, nil
+		},
+	}
+}
+
+// 监听TLS连接
+func Listen(addr string, c *Certs) (net.Listener, error) {
+	return tls.Listen("tcp", addr, c.ServerConfig())
+}
+
+// 建立TLS连接并完成握手
+func Dial(network string, addr string, timeout time.Duration, c *Certs) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, network, addr, c.ClientConfig(addr))
+}
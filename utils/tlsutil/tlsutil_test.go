@@ -0,0 +1,354 @@
+package tlsutil
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 测试时生成的CA，签发服务端与客户端证书
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+var serial int64
+
+func newTestCA(t *testing.T, dir string, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{t: t, dir: dir, cert: cert, key: key, file: filepath.Join(dir, name+".pem")}
+	writePEM(t, ca.file, "CERTIFICATE", der)
+	return ca
+}
+
+func writePEM(t *testing.T, path string, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 签发证书，写入dir中的name.pem与name-key.pem；server为true时是127.0.0.1的服务端证书，否则是客户端证书
+func (ca *testCA) issue(name string, server bool) (certFile string, keyFile string) {
+	t := ca.t
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(ca.dir, name+".pem"), filepath.Join(ca.dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func newCerts(t *testing.T, opts Options) *Certs {
+	t.Helper()
+	c, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// 握手成功后回显每一行的TLS服务器；握手结果从返回的通道收到
+func echoServer(t *testing.T, certs *Certs) (string, <-chan error) {
+	t.Helper()
+	l, err := Listen("127.0.0.1:0", certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	handshakes := make(chan error, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				err := conn.(*tls.Conn).Handshake()
+				handshakes <- err
+				if err != nil {
+					return
+				}
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadBytes('\n')
+					if err != nil {
+						return
+					}
+					conn.Write(line)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), handshakes
+}
+
+// 发送一行并读回；握手在第一次读写时完成
+func roundTrip(conn net.Conn, line string) (string, error) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(line + "\n")); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	return reply, err
+}
+
+func peerName(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	state := conn.(*tls.Conn).ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		t.Fatal("no peer certificate")
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+func TestParseClientAuth(t *testing.T) {
+	for s, want := range map[string]tls.ClientAuthType{
+		"":         tls.NoClientCert,
+		"no":       tls.NoClientCert,
+		"optional": tls.VerifyClientCertIfGiven,
+		"yes":      tls.RequireAndVerifyClientCert,
+	} {
+		if got, err := ParseClientAuth(s); err != nil || got != want {
+			t.Errorf("ParseClientAuth(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseClientAuth("always"); err == nil {
+		t.Error("ParseClientAuth(\"always\") should fail")
+	}
+}
+
+func TestOptionsErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	cert, key := ca.issue("server", true)
+	if _, err := New(Options{CertFile: cert, KeyFile: key, AuthClients: "yes"}); err == nil {
+		t.Error("verifying client certificates without a CA should fail")
+	}
+	if _, err := New(Options{CertFile: cert, KeyFile: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Error("missing key file should fail")
+	}
+	if _, err := New(Options{CAFile: key}); err == nil {
+		t.Error("CA file without certificates should fail")
+	}
+}
+
+// 双向TLS：客户端校验服务端证书，服务端校验客户端证书
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	serverCert, serverKey := ca.issue("server", true)
+	clientCert, clientKey := ca.issue("client", false)
+	server := newCerts(t, Options{CertFile: serverCert, KeyFile: serverKey, CAFile: ca.file, AuthClients: "yes"})
+	addr, handshakes := echoServer(t, server)
+
+	client := newCerts(t, Options{CertFile: clientCert, KeyFile: clientKey, CAFile: ca.file})
+	conn, err := Dial("tcp", addr, time.Second, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := <-handshakes; err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+	if reply, err := roundTrip(conn, "PING"); err != nil || reply != "PING\n" {
+		t.Fatalf("round trip: %q %v", reply, err)
+	}
+	if name := peerName(t, conn); name != "server" {
+		t.Errorf("server certificate %q, want server", name)
+	}
+}
+
+// 要求客户端证书时，不出示证书或证书不是由CA签发的客户端被拒绝；optional时可以不出示
+func TestRejectClient(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	other := newTestCA(t, dir, "other")
+	serverCert, serverKey := ca.issue("server", true)
+	strangerCert, strangerKey := other.issue("stranger", false)
+
+	cases := []struct {
+		name   string
+		auth   string
+		client Options
+		ok     bool
+	}{
+		{"NoCert", "yes", Options{CAFile: ca.file}, false},
+		{"UntrustedCert", "yes", Options{CertFile: strangerCert, KeyFile: strangerKey, CAFile: ca.file}, false},
+		{"OptionalNoCert", "optional", Options{CAFile: ca.file}, true},
+		{"OptionalUntrustedCert", "optional", Options{CertFile: strangerCert, KeyFile: strangerKey, CAFile: ca.file}, false},
+		{"NotRequired", "no", Options{CAFile: ca.file}, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newCerts(t, Options{CertFile: serverCert, KeyFile: serverKey, CAFile: ca.file, AuthClients: tc.auth})
+			addr, handshakes := echoServer(t, server)
+			// TLS 1.3中服务端拒绝客户端证书时，客户端的握手已经完成，在之后的读上得到错误
+			conn, err := Dial("tcp", addr, time.Second, newCerts(t, tc.client))
+			if err == nil {
+				defer conn.Close()
+				_, err = roundTrip(conn, "PING")
+			}
+			serverErr := <-handshakes
+			if tc.ok && (err != nil || serverErr != nil) {
+				t.Errorf("client rejected: client %v, server %v", err, serverErr)
+			}
+			if !tc.ok && (err == nil || serverErr == nil) {
+				t.Errorf("client accepted: client %v, server %v", err, serverErr)
+			}
+		})
+	}
+}
+
+// 客户端不接受不是由CA签发的服务端证书
+func TestRejectServer(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	other := newTestCA(t, dir, "other")
+	serverCert, serverKey := other.issue("server", true)
+	addr, _ := echoServer(t, newCerts(t, Options{CertFile: serverCert, KeyFile: serverKey}))
+
+	conn, err := Dial("tcp", addr, time.Second, newCerts(t, Options{CAFile: ca.file}))
+	if err == nil {
+		conn.Close()
+		t.Fatal("client accepted a server certificate from an unknown CA")
+	}
+}
+
+// 重新加载后新的握手使用新证书，已建立的连接不受影响；加载失败时保留原来的证书
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	oldCert, oldKey := ca.issue("server-old", true)
+	newCert, newKey := ca.issue("server-new", true)
+	clientCert, clientKey := ca.issue("client", false)
+
+	opts := Options{CertFile: oldCert, KeyFile: oldKey, CAFile: ca.file, AuthClients: "yes"}
+	server := newCerts(t, opts)
+	addr, _ := echoServer(t, server)
+	client := newCerts(t, Options{CertFile: clientCert, KeyFile: clientKey, CAFile: ca.file})
+
+	before, err := Dial("tcp", addr, time.Second, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Close()
+	if name := peerName(t, before); name != "server-old" {
+		t.Fatalf("server certificate %q, want server-old", name)
+	}
+
+	opts.CertFile, opts.KeyFile = newCert, newKey
+	if err := server.Reload(opts); err != nil {
+		t.Fatal(err)
+	}
+	after, err := Dial("tcp", addr, time.Second, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer after.Close()
+	if name := peerName(t, after); name != "server-new" {
+		t.Errorf("server certificate after reload %q, want server-new", name)
+	}
+	if reply, err := roundTrip(before, "PING"); err != nil || reply != "PING\n" {
+		t.Errorf("connection established before reload: %q %v", reply, err)
+	}
+
+	// 证书文件被原地替换后重新加载
+	data, err := os.ReadFile(oldCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyData, err := os.ReadFile(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(newCert, data, 0600)
+	os.WriteFile(newKey, keyData, 0600)
+	if err := server.Reload(opts); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := Dial("tcp", addr, time.Second, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if name := peerName(t, conn); name != "server-old" {
+		t.Errorf("server certificate after replacing the file %q, want server-old", name)
+	}
+
+	// 加载失败时保留原来的证书
+	opts.KeyFile = filepath.Join(dir, "missing.pem")
+	if err := server.Reload(opts); err == nil {
+		t.Fatal("reload with a missing key should fail")
+	}
+	conn, err = Dial("tcp", addr, time.Second, client)
+	if err != nil {
+		t.Fatalf("handshake after a failed reload: %v", err)
+	}
+	conn.Close()
+	if name := peerName(t, conn); name != "server-old" {
+		t.Errorf("server certificate after a failed reload %q, want server-old", name)
+	}
+}
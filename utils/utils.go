@@ -2,6 +2,9 @@ package utils
 
 import (
 	"net"
+	"os"
+	"strconv"
+	"strings"
 )
 
 type CmdType int16
@@ -16,6 +19,25 @@ const (
 	DISCARD
 	WATCH
 	UNWATCH
+	SUBSCRIBE
+	PSUBSCRIBE
+	UNSUBSCRIBE
+	CONFIG
+	AUTH
+	ACL
+	ASUSER
+	INFO
+	SLOWLOG
+	MONITOR
+	CLIENT
+	SYNC
+	PSYNC
+	REPLCONF
+	REPLICAOF
+	WAIT
+	SENTINEL
+	PROXY
+	PING
 	ERROR
 )
 
@@ -39,11 +61,105 @@ func (cmd CmdType) String() string {
 		return "WATCH"
 	case UNWATCH:
 		return "UNWATCH"
+	case SUBSCRIBE:
+		return "SUBSCRIBE"
+	case PSUBSCRIBE:
+		return "PSUBSCRIBE"
+	case UNSUBSCRIBE:
+		return "UNSUBSCRIBE"
+	case CONFIG:
+		return "CONFIG"
+	case AUTH:
+		return "AUTH"
+	case ACL:
+		return "ACL"
+	case ASUSER:
+		return "ASUSER"
+	case INFO:
+		return "INFO"
+	case SLOWLOG:
+		return "SLOWLOG"
+	case MONITOR:
+		return "MONITOR"
+	case CLIENT:
+		return "CLIENT"
+	case SYNC:
+		return "SYNC"
+	case PSYNC:
+		return "PSYNC"
+	case REPLCONF:
+		return "REPLCONF"
+	case REPLICAOF:
+		return "REPLICAOF"
+	case WAIT:
+		return "WAIT"
+	case SENTINEL:
+		return "SENTINEL"
+	case PROXY:
+		return "PROXY"
+	case PING:
+		return "PING"
 	default:
 		return ""
 	}
 }
 
+// 数据命令的每个参数都是一次独立的操作（如SET a:1 b:2），
+// 管理与认证命令的全部参数共同组成一次调用（如CONFIG SET maxmemory 64mb）
+func (cmd CmdType) JoinArgs() bool {
+	switch cmd {
+	case CONFIG, AUTH, ACL, ASUSER, INFO, SLOWLOG, CLIENT, SYNC, PSYNC, REPLCONF, REPLICAOF, WAIT, SENTINEL, PROXY, PING:
+		return true
+	default:
+		return false
+	}
+}
+
+// 返回需要依次执行的命令体
+func Bodies(cmd CmdType, args []string) []string {
+	if cmd.JoinArgs() {
+		return []string{strings.Join(args, " ")}
+	}
+	return args
+}
+
+// 多行回复：首行为*行数，之后每行一项
+func MultiLine(lines []string) []byte {
+	if len(lines) == 0 {
+		return []byte("*0")
+	}
+	return []byte("*" + strconv.Itoa(len(lines)) + "\n" + strings.Join(lines, "\n"))
+}
+
+// 解析服务器地址：以unix:或/开头的是Unix socket路径，其余为TCP的host:port
+func SplitNetAddr(addr string) (network string, address string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	if strings.HasPrefix(addr, "/") {
+		return "unix", addr
+	}
+	return "tcp", addr
+}
+
+// 监听Unix socket：先删除上次未清理的socket文件，perm不为0时修改文件权限
+func ListenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
 func CopyBytes(src []byte) (dest []byte) {
 	dest = make([]byte, len(src))
 	copy(dest, src)